@@ -10,6 +10,7 @@ import (
 
 	"dogestry/cli"
 	"dogestry/config"
+	"dogestry/remote"
 	"dogestry/utils"
 )
 
@@ -33,6 +34,8 @@ var (
 	flLockFile       string
 	flUseMetaService bool
 	flUseAzureBlobs  bool
+	flOutput         string
+	flCacheDir       string
 )
 
 func init() {
@@ -46,8 +49,22 @@ func init() {
 	flag.BoolVar(&flVersion, "v", versionDefault, versionUsage+" (short)")
 	flag.Var(&flPullHosts, "pullhosts", "a comma-separated list of docker hosts where the image will be pulled")
 	flag.StringVar(&flLockFile, "lockfile", "", "lockfile to use while executing command, prevents parallel executions")
-	flag.BoolVar(&flUseMetaService, "use-metaservice", false, "use tha AWS metadata service to get credentials")
+	flag.BoolVar(&flUseMetaService, "use-metaservice", false, "only use the AWS instance metadata service to get credentials")
 	flag.BoolVar(&flUseAzureBlobs, "az", false, "use Azure Blobs as a remote instead of AWS")
+	flag.StringVar(&flOutput, "output", "text", "output format: 'text', or 'json' for a newline-delimited event stream on stdout")
+	flag.StringVar(&flCacheDir, "cache-dir", "", "keep work dirs and transfer journals here, so an interrupted push or pull resumes when rerun")
+
+	// transfer and retry settings, which the config file can set too, see
+	// config.Settings
+	flag.Int("upload-workers", remote.DefaultUploadWorkers, "number of files pushed at once")
+	flag.Int("download-workers", 1, "number of layers pulled at once")
+	flag.Int("part-concurrency", remote.DefaultPartConcurrency, "number of parts (S3) or blocks (Azure) of a single file transferred at once")
+	flag.String("limit-rate", "", "limit all transfers and docker loads together to this many bytes per second, eg. 10MB")
+	flag.String("compression", remote.DefaultCompression, "codec layers are pushed with: 'gzip', 'zstd' (needs the zstd command) or 'none'")
+	flag.Int("retries", remote.DefaultRetryPolicy.Attempts, "attempts for each remote request, block or part before giving up on transient errors")
+	flag.Duration("retry-delay", remote.DefaultRetryPolicy.BaseDelay, "delay before the first retry, doubled on each following attempt")
+	flag.Duration("retry-max-delay", remote.DefaultRetryPolicy.MaxDelay, "maximum delay between retries")
+	flag.Float64("retry-jitter", remote.DefaultRetryPolicy.Jitter, "fraction (0-1) of each retry delay that is randomised")
 }
 
 func main() {
@@ -84,20 +101,79 @@ func main() {
 		}
 	}
 
+	// The defaults of the flags are under the config file, and the flags
+	// given are over it, see config.UseRemote.
+	cfg.Defaults, cfg.Flags = make(config.Settings), make(config.Settings)
+	flag.VisitAll(func(f *flag.Flag) {
+		if config.IsSetting(f.Name) {
+			cfg.Defaults[f.Name] = f.DefValue
+		}
+	})
+	flag.Visit(func(f *flag.Flag) {
+		if config.IsSetting(f.Name) {
+			cfg.Flags[f.Name] = f.Value.String()
+		}
+	})
+	if err := cfg.ApplySettings(cfg.Defaults); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.ApplySettings(cfg.Flags); err != nil {
+		log.Fatalf("-%v", err)
+	}
+	if compression, ok := cfg.Flags["compression"]; ok {
+		if _, err := remote.LookupCodec(compression); err != nil {
+			log.Fatalf("-compression: %v", err)
+		}
+	}
+
+	configFile := flConfigFile
+	if configFile == "" {
+		if _, err := os.Stat(config.DefaultFile); err == nil {
+			configFile = config.DefaultFile
+		}
+	}
+	if configFile != "" {
+		if err := cfg.LoadFile(configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	cfg.CacheDir = flCacheDir
+
 	dogestryCli, err := cli.NewDogestryCli(cfg, flPullHosts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if err := dogestryCli.SetOutputFormat(flOutput); err != nil {
+		log.Fatal(err)
+	}
+
+	// SIGINT/SIGTERM cancel ctx, which aborts pending uploads, downloads and
+	// docker loads. The work dir and lock file are still cleaned up.
+	ctx, stop := utils.SignalContext()
+	defer stop()
+
 	if flLockFile != "" {
-		utils.LockByFile(dogestryCli, args, flLockFile)
+		err = utils.LockByFile(ctx, dogestryCli, args, flLockFile)
 	} else {
-		err = dogestryCli.RunCmd(args...)
+		err = dogestryCli.RunCmd(ctx, args...)
 
 		dogestryCli.Cleanup()
+	}
 
-		if err != nil {
-			log.Fatal(err)
-		}
+	if ctx.Err() != nil {
+		log.Println("Cancelled, exiting")
+		stop()
+		os.Exit(utils.ExitCancelled)
+	}
+
+	if _, ok := err.(*remote.TagConflictError); ok {
+		log.Println(err)
+		os.Exit(utils.ExitConflict)
+	}
+
+	if err != nil {
+		log.Fatal(err)
 	}
 }
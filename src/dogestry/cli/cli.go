@@ -1,6 +1,9 @@
 package cli
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -14,11 +17,13 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cheggaaa/pb"
 	"dogestry/config"
 	"dogestry/remote"
+	"dogestry/utils"
 	docker "github.com/fsouza/go-dockerclient"
 	homedir "github.com/mitchellh/go-homedir"
 )
@@ -65,11 +70,15 @@ func NewDogestryCli(cfg config.Config, hosts []string) (*DogestryCli, error) {
 
 	dogestryCli := &DogestryCli{
 		Config:     cfg,
+		out:        os.Stdout,
 		err:        os.Stderr,
 		DockerHost: cfg.Docker.Connection,
 		PullHosts:  hosts,
 	}
 
+	// shared by every transfer in the process
+	utils.SetRateLimit(cfg.Transfer.BytesPerSecond)
+
 	dogestryCli.Client, err = newDockerClient(dogestryCli.DockerHost)
 	if err != nil {
 		log.Fatal(err)
@@ -97,7 +106,9 @@ func NewDogestryCli(cfg config.Config, hosts []string) (*DogestryCli, error) {
 
 type DogestryCli struct {
 	Client      *docker.Client
+	out         io.Writer
 	err         io.Writer
+	events      *eventStream
 	TempDir     string
 	TempDirRoot string
 	DockerHost  string
@@ -106,35 +117,79 @@ type DogestryCli struct {
 	PullClients []*docker.Client
 }
 
-func (cli *DogestryCli) getMethod(name string) (func(...string) error, bool) {
+func (cli *DogestryCli) getMethod(name string) (func(context.Context, ...string) error, bool) {
 	methodName := "Cmd" + strings.ToUpper(name[:1]) + strings.ToLower(name[1:])
 	method := reflect.ValueOf(cli).MethodByName(methodName)
 	if !method.IsValid() {
 		return nil, false
 	}
-	return method.Interface().(func(...string) error), true
+	return method.Interface().(func(context.Context, ...string) error), true
 }
 
-func (cli *DogestryCli) GetRemote(path string) (remote.Remote, error) {
+func (cli *DogestryCli) GetRemote(ctx context.Context, path string) (remote.Remote, error) {
+	// remotes can be named in the config file, which also has their settings
+	path = cli.Config.UseRemote(path)
+	utils.SetRateLimit(cli.Config.Transfer.BytesPerSecond)
+
+	if strings.HasPrefix(path, "manifest:") {
+		return remote.NewManifestRemote(ctx, cli.Config, strings.TrimPrefix(path, "manifest:"))
+	}
+
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		r, err := remote.NewHTTPRemote(cli.Config, path)
+		if err != nil {
+			return nil, err
+		}
+		return r, r.Validate(ctx)
+	}
+
+	if strings.HasPrefix(path, "gs://") {
+		if err := cli.Config.SetGCSURL(path); err != nil {
+			return nil, err
+		}
+		r, err := remote.NewGCSRemote(cli.Config)
+		if err != nil {
+			return nil, err
+		}
+		return r, r.Validate(ctx)
+	}
+
+	if strings.HasPrefix(path, "ssh://") {
+		if err := cli.Config.SetSSHURL(path); err != nil {
+			return nil, err
+		}
+		r, err := remote.NewSFTPRemote(cli.Config)
+		if err != nil {
+			return nil, err
+		}
+		return r, r.Validate(ctx)
+	}
+
 	if cli.Config.Azure.Active {
 		cli.Config.SetBlobSpec(path)
-		return remote.NewAzureRemote(cli.Config)
+		r, err := remote.NewAzureRemote(cli.Config)
+		if err != nil {
+			return nil, err
+		}
+		return r, r.Validate(ctx)
 	} else {
 		cli.Config.SetS3URL(path)
-		return remote.NewRemote(cli.Config)
+		return remote.NewRemote(ctx, cli.Config)
 	}
 }
 
-func (cli *DogestryCli) RunCmd(args ...string) error {
+// RunCmd runs the command named by args[0]. Cancelling ctx aborts the
+// command's pending remote and docker operations.
+func (cli *DogestryCli) RunCmd(ctx context.Context, args ...string) error {
 	if len(args) > 0 {
 		method, exists := cli.getMethod(args[0])
 		if !exists {
-			fmt.Println("Error: Command not found:", args[0])
-			return cli.CmdHelp(args[1:]...)
+			fmt.Fprintln(cli.err, "Error: Command not found:", args[0])
+			return cli.CmdHelp(ctx, args[1:]...)
 		}
-		return method(args[1:]...)
+		return method(ctx, args[1:]...)
 	}
-	return cli.CmdHelp(args...)
+	return cli.CmdHelp(ctx, args...)
 }
 
 func (cli *DogestryCli) Subcmd(name, signature, description string) *flag.FlagSet {
@@ -173,7 +228,7 @@ func (cli *DogestryCli) WorkDirGivenBaseDir(basedir, suffix string) (string, err
 
 	path := filepath.Join(basedir, suffix)
 
-	fmt.Printf("WorkDir: %v\n", path)
+	fmt.Fprintf(cli.out, "WorkDir: %v\n", path)
 
 	if err := os.MkdirAll(path, os.ModeDir|0700); err != nil {
 		return "", err
@@ -190,6 +245,52 @@ func (cli *DogestryCli) WorkDir(suffix string) (string, error) {
 	return cli.WorkDirGivenBaseDir(basedir, suffix)
 }
 
+// workDirFor returns the work dir for a push or pull of image to or from
+// remotePath. With a cache dir it lives there, at a path that's the same for
+// every run of the command, so an interrupted transfer can be resumed.
+func (cli *DogestryCli) workDirFor(remotePath, image string) (string, error) {
+	if cli.Config.CacheDir == "" {
+		return cli.WorkDir(image)
+	}
+
+	remoteSum := sha1.Sum([]byte(remotePath))
+	basedir := filepath.Join(cli.Config.CacheDir, hex.EncodeToString(remoteSum[:])[:12])
+
+	return cli.WorkDirGivenBaseDir(basedir, image)
+}
+
+// openJournal starts recording transfer progress for r next to imageRoot,
+// picking up the progress of an earlier run. Only done with a cache dir, a
+// temporary work dir doesn't outlive the command.
+func (cli *DogestryCli) openJournal(r remote.Remote, imageRoot string) (*remote.Journal, error) {
+	if cli.Config.CacheDir == "" {
+		return nil, nil
+	}
+
+	journal, err := remote.OpenJournal(imageRoot+".journal", r.Desc())
+	if err != nil {
+		return nil, err
+	}
+
+	r.SetJournal(journal)
+	return journal, nil
+}
+
+// finishWorkDir removes a cached work dir and its journal once the command
+// succeeded. Temporary work dirs are removed by Cleanup.
+func (cli *DogestryCli) finishWorkDir(imageRoot string, journal *remote.Journal) {
+	if cli.Config.CacheDir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(imageRoot); err != nil {
+		log.Println(err)
+	}
+	if err := journal.Remove(); err != nil {
+		log.Println(err)
+	}
+}
+
 // clean up the tempDir
 func (cli *DogestryCli) Cleanup() {
 	if cli.TempDir != "" {
@@ -199,11 +300,11 @@ func (cli *DogestryCli) Cleanup() {
 	}
 }
 
-func (cli *DogestryCli) getLayerIdsToDownload(fromId remote.ID, imageRoot string, r remote.Remote, client *docker.Client) ([]remote.ID, error) {
+func (cli *DogestryCli) getLayerIdsToDownload(ctx context.Context, fromId remote.ID, imageRoot string, r remote.Remote, client *docker.Client, host string) ([]remote.ID, error) {
 	toDownload := make([]remote.ID, 0)
 
-	err := r.WalkImages(fromId, func(id remote.ID, image docker.Image, err error) error {
-		fmt.Printf("Examining id '%s' on remote docker host...\n", id.Short())
+	err := r.WalkImages(ctx, fromId, func(id remote.ID, image docker.Image, err error) error {
+		fmt.Fprintf(cli.out, "Examining id '%s' on remote docker host...\n", id.Short())
 		if err != nil {
 			return err
 		}
@@ -211,12 +312,14 @@ func (cli *DogestryCli) getLayerIdsToDownload(fromId remote.ID, imageRoot string
 		_, err = client.InspectImage(string(id))
 
 		if err == docker.ErrNoSuchImage {
+			cli.emit(Event{Type: EventLayerCheck, ID: id.String(), Host: host, Status: StatusMissing})
 			toDownload = append(toDownload, id)
 			return nil
 		} else if err != nil {
 			return err
 		} else {
-			fmt.Printf("Docker host already has id '%s', stop scanning.\n", id.Short())
+			cli.emit(Event{Type: EventLayerCheck, ID: id.String(), Host: host, Status: StatusPresent})
+			fmt.Fprintf(cli.out, "Docker host already has id '%s', stop scanning.\n", id.Short())
 			return remote.BreakWalk
 		}
 
@@ -226,8 +329,8 @@ func (cli *DogestryCli) getLayerIdsToDownload(fromId remote.ID, imageRoot string
 	return toDownload, err
 }
 
-func (cli *DogestryCli) pullImage(fromId remote.ID, imageRoot string, r remote.Remote) error {
-	toDownload, err := cli.getLayerIdsToDownload(fromId, imageRoot, r, cli.Client)
+func (cli *DogestryCli) pullImage(ctx context.Context, fromId remote.ID, imageRoot string, r remote.Remote) error {
+	toDownload, err := cli.getLayerIdsToDownload(ctx, fromId, imageRoot, r, cli.Client, cli.DockerHost)
 	if err != nil {
 		return err
 	}
@@ -235,9 +338,9 @@ func (cli *DogestryCli) pullImage(fromId remote.ID, imageRoot string, r remote.R
 	for _, id := range toDownload {
 		downloadPath := filepath.Join(imageRoot, string(id))
 
-		fmt.Printf("Pulling image id '%s' to: %v\n", id.Short(), downloadPath)
+		fmt.Fprintf(cli.out, "Pulling image id '%s' to: %v\n", id.Short(), downloadPath)
 
-		err := r.PullImageId(id, downloadPath)
+		err := r.PullImageId(ctx, id, downloadPath)
 		if err != nil {
 			return err
 		}
@@ -246,10 +349,10 @@ func (cli *DogestryCli) pullImage(fromId remote.ID, imageRoot string, r remote.R
 	return nil
 }
 
-func (cli *DogestryCli) createRepositoriesJsonFile(image, imageRoot string, r remote.Remote) error {
+func (cli *DogestryCli) createRepositoriesJsonFile(ctx context.Context, image, imageRoot string, r remote.Remote) error {
 	repoName, repoTag := remote.NormaliseImageName(image)
 
-	id, err := r.ParseTag(repoName, repoTag)
+	id, err := r.ParseTag(ctx, repoName, repoTag)
 	if err != nil {
 		return err
 	} else if id == "" {
@@ -301,12 +404,14 @@ func (cli *DogestryCli) outputStatus(errMap map[string]error) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(result[:]))
+	fmt.Fprintln(cli.out, string(result[:]))
 	return nil
 }
 
-// sendTar streams exported tarball into remote docker hosts
-func (cli *DogestryCli) sendTar(imageRoot string) error {
+// sendTar streams exported tarball into remote docker hosts.
+// Returns the load error for each host that failed.
+// Cancelling ctx kills the tar processes, which aborts the load streams.
+func (cli *DogestryCli) sendTar(ctx context.Context, imageRoot string) (map[string]error, error) {
 	type hostErrTuple struct {
 		host string
 		err  error
@@ -317,16 +422,21 @@ func (cli *DogestryCli) sendTar(imageRoot string) error {
 		bar   *pb.ProgressBar
 	}
 
-	progressBar := &placeboProgressBar{1000, pb.StartNew(1000)}
-	progressBar.bar.ShowCounters = false
-
-	// Starts the placebo progress bar
-	go func(progressBar *placeboProgressBar) {
-		for {
-			progressBar.bar.Increment()
-			time.Sleep(time.Second)
-		}
-	}(progressBar)
+	// Starts the placebo progress bar, stdout is reserved for events in
+	// json mode
+	if !cli.jsonOutput() {
+		progressBar := &placeboProgressBar{1000, pb.New(1000)}
+		progressBar.bar.ShowCounters = false
+		progressBar.bar.Output = cli.out
+		progressBar.bar.Start()
+
+		go func(progressBar *placeboProgressBar) {
+			for {
+				progressBar.bar.Increment()
+				time.Sleep(time.Second)
+			}
+		}(progressBar)
+	}
 
 	tupleCh := make(chan hostErrTuple)
 
@@ -334,7 +444,9 @@ func (cli *DogestryCli) sendTar(imageRoot string) error {
 		host := cli.PullHosts[i]
 
 		go func(client *docker.Client, host string) {
-			cmd := exec.Command("tar", "cvf", "-", "-C", imageRoot, ".")
+			cli.emit(Event{Type: EventLoadStart, Host: host})
+
+			cmd := exec.CommandContext(ctx, "tar", "cvf", "-", "-C", imageRoot, ".")
 			cmd.Env = os.Environ()
 			cmd.Dir = imageRoot
 			defer cmd.Wait()
@@ -350,7 +462,8 @@ func (cli *DogestryCli) sendTar(imageRoot string) error {
 				return
 			}
 
-			err = client.LoadImage(docker.LoadImageOptions{InputStream: stdout})
+			err = client.LoadImage(docker.LoadImageOptions{InputStream: utils.NewLimitedReader(ctx, stdout)})
+			cli.emit(Event{Type: EventLoadDone, Host: host, Status: statusOf(err), Error: errString(err)})
 			if err != nil {
 				tupleCh <- hostErrTuple{host, err}
 				return
@@ -369,23 +482,27 @@ func (cli *DogestryCli) sendTar(imageRoot string) error {
 	}
 	close(tupleCh)
 
-	err := cli.outputStatus(uploadImageErrMap)
+	var err error
+	if !cli.jsonOutput() {
+		// the load results are part of the summary event in json mode
+		err = cli.outputStatus(uploadImageErrMap)
+	}
 	if len(uploadImageErrMap) > 0 {
 		err = errors.New("Error in sendTar")
 	}
-	return err
+	return uploadImageErrMap, err
 }
 
 type DownloadMap map[remote.ID][]string
 
-func (cli *DogestryCli) makeDownloadMap(r remote.Remote, id remote.ID, imageRoot string) (DownloadMap, error) {
+func (cli *DogestryCli) makeDownloadMap(ctx context.Context, r remote.Remote, id remote.ID, imageRoot string) (DownloadMap, error) {
 	var downloadMap = make(map[remote.ID][]string)
 	var err error
 
 	for i, pullHost := range cli.PullClients {
-		fmt.Printf("Connecting to remote docker host: %v\n", cli.PullHosts[i])
+		fmt.Fprintf(cli.out, "Connecting to remote docker host: %v\n", cli.PullHosts[i])
 
-		layers, err := cli.getLayerIdsToDownload(id, imageRoot, r, pullHost)
+		layers, err := cli.getLayerIdsToDownload(ctx, id, imageRoot, r, pullHost, cli.PullHosts[i])
 		if err != nil {
 			return nil, err
 		}
@@ -397,22 +514,60 @@ func (cli *DogestryCli) makeDownloadMap(r remote.Remote, id remote.ID, imageRoot
 	return downloadMap, err
 }
 
-func (cli *DogestryCli) downloadImages(r remote.Remote, downloadMap DownloadMap, imageRoot string) error {
+// downloadImages pulls the layers in downloadMap, Transfer.DownloadWorkers
+// (default 1) at a time.
+func (cli *DogestryCli) downloadImages(ctx context.Context, r remote.Remote, downloadMap DownloadMap, imageRoot string) error {
 	pullImagesErrMap := make(map[string]error)
 
+	workers := cli.Config.Transfer.DownloadWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	idc := make(chan remote.ID, len(downloadMap))
 	for id, _ := range downloadMap {
-		downloadPath := filepath.Join(imageRoot, string(id))
+		idc <- id
+	}
+	close(idc)
 
-		fmt.Printf("Pulling image id '%s' to: %v\n", id.Short(), downloadPath)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
 
-		err := r.PullImageId(id, downloadPath)
-		if err != nil {
-			pullImagesErrMap[downloadPath] = err
-		}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for id := range idc {
+				if ctx.Err() != nil {
+					return
+				}
+
+				downloadPath := filepath.Join(imageRoot, string(id))
+
+				fmt.Fprintf(cli.out, "Pulling image id '%s' to: %v\n", id.Short(), downloadPath)
+				cli.emit(Event{Type: EventDownloadStart, ID: id.String()})
+
+				err := r.PullImageId(ctx, id, downloadPath)
+				if err != nil {
+					mu.Lock()
+					pullImagesErrMap[downloadPath] = err
+					mu.Unlock()
+				}
+
+				cli.emit(Event{Type: EventDownloadDone, ID: id.String(), Status: statusOf(err), Error: errString(err)})
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
 	if len(pullImagesErrMap) > 0 {
-		fmt.Printf("Errors pulling images: %v\n", pullImagesErrMap)
+		fmt.Fprintf(cli.out, "Errors pulling images: %v\n", pullImagesErrMap)
 		return fmt.Errorf("Error downloading files from S3")
 	}
 
@@ -1,10 +1,21 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"dogestry/config"
+	"dogestry/remote"
 )
 
 var hosts = make([]string, 0)
@@ -43,3 +54,216 @@ func TestCreateAndReturnTempDirAndCleanup(t *testing.T) {
 		t.Fatalf("Cleanup() should remove tmp directory. tmpDir: %v", tmpDir)
 	}
 }
+
+func TestSetOutputFormat(t *testing.T) {
+	cfg, _ := config.NewConfig(false)
+	dogestryCli, _ := NewDogestryCli(cfg, hosts)
+
+	if err := dogestryCli.SetOutputFormat("yaml"); err == nil {
+		t.Fatal("SetOutputFormat should reject unknown formats.")
+	}
+
+	if err := dogestryCli.SetOutputFormat(OutputJSON); err != nil {
+		t.Fatalf("SetOutputFormat(json) should work. Error: %v", err)
+	}
+	if dogestryCli.out != os.Stderr {
+		t.Error("Human readable output should go to stderr in json mode.")
+	}
+
+	if err := dogestryCli.SetOutputFormat(OutputText); err != nil {
+		t.Fatalf("SetOutputFormat(text) should work. Error: %v", err)
+	}
+	if dogestryCli.jsonOutput() {
+		t.Error("Events should not be emitted in text mode.")
+	}
+}
+
+func TestEmitSummary(t *testing.T) {
+	cfg, _ := config.NewConfig(false)
+	dogestryCli, _ := NewDogestryCli(cfg, []string{"tcp://host-1:2375", "tcp://host-2:2375"})
+
+	var buf bytes.Buffer
+	dogestryCli.events = newEventStream(&buf)
+
+	hostErrs := map[string]error{"tcp://host-2:2375": errors.New("boom")}
+	dogestryCli.emitSummary("pull", "ubuntu:14.04", remote.ID("sha256:abc"), hostErrs, errors.New("Error in sendTar"))
+
+	var event Event
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("Events should be valid JSON. Error: %v", err)
+	}
+
+	if event.Type != EventSummary || event.Status != StatusFailed || event.ID != "abc" {
+		t.Errorf("Unexpected summary event: %+v", event)
+	}
+	if len(event.Hosts) != 2 || event.Hosts[0].Status != StatusOk || event.Hosts[1].Error != "boom" {
+		t.Errorf("Summary should report the status of every host: %+v", event.Hosts)
+	}
+	if bytes.Count(buf.Bytes(), []byte("\n")) != 1 {
+		t.Error("Each event should be a single line.")
+	}
+}
+
+func TestPullJSONOutput(t *testing.T) {
+	id := strings.Repeat("ab", 32)
+	objects := map[string]string{
+		"images/" + id + "/json":      `{"id":"` + id + `"}`,
+		"images/" + id + "/layer.tar": "layer contents",
+		"images/" + id + "/VERSION":   "1.0",
+		"repositories/app/latest":     id,
+	}
+	index := make(map[string]map[string]int)
+	for key, content := range objects {
+		index[key] = map[string]int{"size": len(content)}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"objects": index})
+	objects[remote.IndexKey] = string(data)
+
+	// a mirror of a remote, and a docker host without the image
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := objects[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, content)
+	}))
+	defer mirror.Close()
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/images/load") {
+			ioutil.ReadAll(r.Body)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer docker.Close()
+
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(orig *os.File) { os.Stdout = orig }(os.Stdout)
+	os.Stdout = w
+
+	cfg, _ := config.NewConfig(false)
+	dogestryCli, _ := NewDogestryCli(cfg, []string{docker.URL})
+	defer dogestryCli.Cleanup()
+	if err := dogestryCli.SetOutputFormat(OutputJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan []string)
+	go func() {
+		var read []string
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			read = append(read, scanner.Text())
+		}
+		lines <- read
+	}()
+
+	err = dogestryCli.CmdPull(context.Background(), mirror.URL+"/", "app")
+	w.Close()
+	if err != nil {
+		t.Fatalf("Pulling should work. Error: %v", err)
+	}
+
+	var types []string
+	for _, line := range <-lines {
+		var event Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Every line of stdout should be an event, got %q", line)
+		}
+		types = append(types, event.Type)
+	}
+	if len(types) == 0 || types[len(types)-1] != EventSummary {
+		t.Errorf("The pull should end with a summary event, got %v", types)
+	}
+}
+
+func TestWorkDirForCacheDir(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "dogestry-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	cfg, _ := config.NewConfig(false)
+	cfg.CacheDir = cacheDir
+	dogestryCli, _ := NewDogestryCli(cfg, hosts)
+
+	first, err := dogestryCli.workDirFor("s3://bucket/", "ubuntu:14.04")
+	if err != nil {
+		t.Fatalf("workDirFor should work. Error: %v", err)
+	}
+
+	dogestryCli.Cleanup()
+	if _, err := os.Stat(first); err != nil {
+		t.Fatal("Cleanup() must keep work dirs in the cache dir.")
+	}
+
+	second, _ := dogestryCli.workDirFor("s3://bucket/", "ubuntu:14.04")
+	other, _ := dogestryCli.workDirFor("s3://other-bucket/", "ubuntu:14.04")
+	if first != second || first == other {
+		t.Errorf("Work dirs should be stable per remote and image. Got: %v, %v, %v", first, second, other)
+	}
+
+	dogestryCli.finishWorkDir(first, nil)
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Error("finishWorkDir should remove the work dir.")
+	}
+}
+
+func TestRollbackTarget(t *testing.T) {
+	history := []remote.TagHistoryEntry{
+		{New: "aaa"},
+		{Old: "aaa", New: "bbb"},
+		{Old: "bbb", New: "ccc"},
+	}
+
+	targets := map[int]remote.ID{-1: "bbb", 0: "ccc", 1: "bbb", 2: "aaa"}
+	for to, expected := range targets {
+		id, err := rollbackTarget("app", "prod", history, to)
+		if err != nil {
+			t.Errorf("rollbackTarget(%d) should work. Error: %v", to, err)
+		} else if id != expected {
+			t.Errorf("rollbackTarget(%d) = %s, expected %s", to, id, expected)
+		}
+	}
+
+	if _, err := rollbackTarget("app", "prod", history, 3); err == nil {
+		t.Error("rollbackTarget past the oldest entry should fail.")
+	}
+
+	if _, err := rollbackTarget("app", "prod", history[:1], -1); err == nil {
+		t.Error("rollbackTarget of a tag created by its only push should fail.")
+	}
+
+	if _, err := rollbackTarget("app", "prod", nil, -1); err == nil {
+		t.Error("rollbackTarget without history should fail.")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	l := make(labels)
+
+	for _, s := range []string{"git=1a2b3c4", "build=https://ci/42?a=b", "empty="} {
+		if err := l.Set(s); err != nil {
+			t.Errorf("Set(%q) should work. Error: %v", s, err)
+		}
+	}
+
+	if l["build"] != "https://ci/42?a=b" || l["empty"] != "" {
+		t.Errorf("Labels should split on the first '='. Got: %v", l)
+	}
+
+	if s := l.String(); s != "build=https://ci/42?a=b,empty=,git=1a2b3c4" {
+		t.Errorf("String() = %q", s)
+	}
+
+	for _, s := range []string{"git", "=value"} {
+		if err := l.Set(s); err == nil {
+			t.Errorf("Set(%q) should fail.", s)
+		}
+	}
+}
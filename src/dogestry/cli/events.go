@@ -0,0 +1,176 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"dogestry/remote"
+	"dogestry/utils"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// Event types emitted with -output=json. See "Machine-readable output" in the
+// README for the schema.
+const (
+	EventResolve          = "resolve"
+	EventLayerCheck       = "layer-check"
+	EventUploadProgress   = "upload-progress"
+	EventDownloadStart    = "download-start"
+	EventDownloadProgress = "download-progress"
+	EventDownloadDone     = "download-done"
+	EventLoadStart        = "load-start"
+	EventLoadDone         = "load-done"
+	EventSummary          = "summary"
+)
+
+const (
+	StatusOk       = "ok"
+	StatusFailed   = "failed"
+	StatusConflict = "conflict"
+	StatusPresent  = "present"
+	StatusMissing  = "missing"
+)
+
+// Event is a single line of the -output=json stream. Fields that don't apply
+// to an event type are omitted.
+type Event struct {
+	Type    string       `json:"type"`
+	Time    time.Time    `json:"time"`
+	Command string       `json:"command,omitempty"`
+	Image   string       `json:"image,omitempty"`
+	ID      string       `json:"id,omitempty"`
+	Host    string       `json:"host,omitempty"`
+	File    string       `json:"file,omitempty"`
+	Status  string       `json:"status,omitempty"`
+	Bytes   int64        `json:"bytes,omitempty"`
+	Total   int64        `json:"total,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Hosts   []HostStatus `json:"hosts,omitempty"`
+}
+
+// HostStatus is the load result for a single docker host in a summary event.
+type HostStatus struct {
+	Host   string `json:"host"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// eventStream writes events as newline-delimited JSON. Events are emitted from
+// several goroutines (eg. one per pull host), so writes are serialised.
+type eventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newEventStream(w io.Writer) *eventStream {
+	return &eventStream{enc: json.NewEncoder(w)}
+}
+
+func (s *eventStream) emit(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	s.enc.Encode(&e)
+}
+
+// SetOutputFormat switches between human readable output and the JSON event
+// stream. In json mode stdout is reserved for events and all human readable
+// text is sent to stderr.
+func (cli *DogestryCli) SetOutputFormat(format string) error {
+	switch format {
+	case "", OutputText:
+		cli.out = os.Stdout
+		cli.events = nil
+		utils.SetProgressOutput(os.Stdout)
+	case OutputJSON:
+		cli.out = os.Stderr
+		cli.events = newEventStream(os.Stdout)
+		utils.SetProgressOutput(os.Stderr)
+	default:
+		return fmt.Errorf("Unknown output format '%s', must be one of: %s, %s", format, OutputText, OutputJSON)
+	}
+
+	return nil
+}
+
+func (cli *DogestryCli) jsonOutput() bool {
+	return cli.events != nil
+}
+
+func (cli *DogestryCli) emit(e Event) {
+	if cli.events != nil {
+		cli.events.emit(e)
+	}
+}
+
+// emitProgress reports ProgressReader updates as events of the given type
+// for the duration of a command.
+func (cli *DogestryCli) emitProgress(eventType string) {
+	if cli.events == nil {
+		return
+	}
+
+	utils.SetProgressFunc(func(fileName string, current, total int64) {
+		cli.emit(Event{Type: eventType, File: fileName, Bytes: current, Total: total})
+	})
+}
+
+func (cli *DogestryCli) emitSummary(command, image string, id remote.ID, hostErrs map[string]error, err error) {
+	if cli.events == nil {
+		return
+	}
+
+	summary := Event{
+		Type:    EventSummary,
+		Command: command,
+		Image:   image,
+		ID:      id.String(),
+		Status:  StatusOk,
+	}
+
+	if _, ok := err.(*remote.TagConflictError); ok {
+		summary.Status = StatusConflict
+		summary.Error = err.Error()
+	} else if err != nil {
+		summary.Status = StatusFailed
+		summary.Error = err.Error()
+	}
+
+	if hostErrs != nil {
+		for _, host := range cli.PullHosts {
+			status := HostStatus{Host: host, Status: StatusOk}
+			if hostErr, ok := hostErrs[host]; ok {
+				status.Status = StatusFailed
+				status.Error = hostErr.Error()
+			}
+			summary.Hosts = append(summary.Hosts, status)
+		}
+	}
+
+	cli.emit(summary)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func statusOf(err error) string {
+	if err != nil {
+		return StatusFailed
+	}
+	return StatusOk
+}
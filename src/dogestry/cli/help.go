@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -8,10 +9,16 @@ const HelpMessage string = `Usage: dogestry [OPTIONS] COMMAND [arg...]
 
   Commands:
      help        Print help message. Use help COMMAND for more specific help
+     inspect     Show the push metadata of a tag on remote
      list        List images on remote
+     log         Show how a tag on remote has moved
+     migrate     Rewrite remote to a newer layout version
+     presign     Write a manifest of time-limited URLs to pull an image from remote
      pull        Pull IMAGE from remote and load it into docker
      push        Push IMAGE from docker to remote
+     reindex     Rebuild the catalog of remote
      remote      Show info about remote
+     rollback    Point a tag on remote back at an earlier image
      version     Print version
 
   Options:
@@ -19,21 +26,49 @@ const HelpMessage string = `Usage: dogestry [OPTIONS] COMMAND [arg...]
      -pullhosts  A comma-separated list of docker hosts where the image will be pulled
      -lockfile   Path to optional lock file to use, prevents parallel execution
      -az      Use Azure blob storage instead of AWS
+     -output     Output format: text (default) or json, a newline-delimited event stream
+     -cache-dir  Keep work dirs here so an interrupted push or pull resumes when rerun
+     -upload-workers, -download-workers, -part-concurrency
+                 Files pushed, layers pulled and parts of a file sent at once (defaults 25, 1, 10)
+     -limit-rate Limit all transfers and docker loads together to this many bytes/sec, eg. 10MB
+     -compression
+                 Codec layers are pushed with: gzip (default), zstd or none. zstd runs
+                 the zstd command, which pushing and pulling hosts need installed
+     -retries    Attempts per remote request, block or part on transient errors (default 5)
+     -retry-delay, -retry-max-delay, -retry-jitter
+                 Exponential backoff between retries (defaults 500ms, 30s, 0.2)
 
   Typical S3 Usage:
      dogestry push s3://<bucket name>/<path name>/?region=us-east-1 <image name>
      dogestry pull s3://<bucket name>/<path name>/?region=us-west-1 <image name>
      dogestry -pullhosts tcp://host-1:2375,tcp://host-2:2375 pull s3://<bucket name>/<path name>/ <image name>
+     dogestry presign s3://<bucket name>/<path name>/ <image name> -ttl 1h -o manifest.json
+     dogestry pull manifest:manifest.json <image name>
+     dogestry pull https://<mirror host>/<path>/ <image name>
+
+  Typical GCS Usage:
+     dogestry push gs://<bucket name>/<path name>/ <image name>
+     dogestry pull gs://<bucket name>/<path name>/ <image name>
+
+  Typical SFTP Usage:
+     dogestry push ssh://<user>@<host>/<path name>/ <image name>
+     dogestry pull ssh://<user>@<host>/~/<path in home>/?key=/path/to/id_ed25519 <image name>
 `
 
 const AzureHelpMessage string = `Usage: dogestry [OPTIONS] COMMAND [arg...]
 
   Commands:
      help        Print help message. Use help COMMAND for more specific help
+     inspect     Show the push metadata of a tag on remote
      list        List images on remote
+     log         Show how a tag on remote has moved
+     migrate     Rewrite remote to a newer layout version
+     presign     Write a manifest of time-limited URLs to pull an image from remote
      pull        Pull IMAGE from remote and load it into docker
      push        Push IMAGE from docker to remote
+     reindex     Rebuild the catalog of remote
      remote      Show info about remote
+     rollback    Point a tag on remote back at an earlier image
      version     Print version
 
   Options:
@@ -41,24 +76,38 @@ const AzureHelpMessage string = `Usage: dogestry [OPTIONS] COMMAND [arg...]
      -pullhosts  A comma-separated list of docker hosts where the image will be pulled
      -lockfile   Path to optional lock file to use, prevents parallel execution
      -az      Use Azure blob storage instead of AWS
+     -output     Output format: text (default) or json, a newline-delimited event stream
+     -cache-dir  Keep work dirs here so an interrupted push or pull resumes when rerun
+     -upload-workers, -download-workers, -part-concurrency
+                 Files pushed, layers pulled and parts of a file sent at once (defaults 25, 1, 10)
+     -limit-rate Limit all transfers and docker loads together to this many bytes/sec, eg. 10MB
+     -compression
+                 Codec layers are pushed with: gzip (default), zstd or none. zstd runs
+                 the zstd command, which pushing and pulling hosts need installed
+     -retries    Attempts per remote request, block or part on transient errors (default 5)
+     -retry-delay, -retry-max-delay, -retry-jitter
+                 Exponential backoff between retries (defaults 500ms, 30s, 0.2)
 
   Typical Azure Usage:
      dogestry push <blob-container>/[path] <image name>
      dogestry pull <blob-container>/[path] <image name>
+     dogestry presign <blob-container>/[path] <image name> -ttl 1h -o manifest.json
+     dogestry pull manifest:manifest.json <image name>
+     dogestry pull https://<mirror host>/<path>/ <image name>
 `
 
-func (cli *DogestryCli) CmdHelp(args ...string) error {
+func (cli *DogestryCli) CmdHelp(ctx context.Context, args ...string) error {
 	if len(args) > 0 {
 		method, exists := cli.getMethod(args[0])
 		if !exists {
 			fmt.Fprintf(cli.err, "Error: Command not found: %s\n", args[0])
 		} else {
-			method("--help")
+			method(ctx, "--help")
 			return nil
 		}
 	}
 
-	if cli.Config.Azure.AccountName != "" || cli.Config.Azure.AccountKey != "" {
+	if cli.Config.Azure.Active {
 		fmt.Println(AzureHelpMessage)
 	} else {
 		fmt.Println(HelpMessage)
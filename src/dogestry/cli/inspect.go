@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"dogestry/remote"
+)
+
+const InspectHelpMessage string = `  Show the metadata of the push that pointed TAG on REMOTE at its image.
+
+  Prints a JSON document with the image ID, push time, docker host, dogestry
+  version, image size and layer count, the user who pushed and the labels
+  given to push -label. Tags pushed by older versions only have an ID.
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+    IMAGE[:TAG]  Name of IMAGE. TAG is optional, and defaults to 'latest'.
+
+  Examples:
+    dogestry inspect s3://DockerBucket/Path/?region=us-east-1 myapp:prod`
+
+func (cli *DogestryCli) CmdInspect(ctx context.Context, args ...string) error {
+	inspectFlags := cli.Subcmd("inspect", "REMOTE IMAGE[:TAG]", InspectHelpMessage)
+	if err := inspectFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(inspectFlags.Args()) < 2 {
+		fmt.Fprintln(cli.err, "Error: IMAGE and REMOTE not specified")
+		inspectFlags.Usage()
+		os.Exit(2)
+	}
+
+	r, err := cli.GetRemote(ctx, inspectFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	repo, tag := remote.NormaliseImageName(inspectFlags.Arg(1))
+	meta, err := r.TagMetadata(ctx, repo, tag)
+	if err == remote.ErrNoMetadata {
+		fmt.Fprintf(cli.err, "%s:%s was pushed without metadata\n", repo, tag)
+	} else if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stdout, string(out))
+	return nil
+}
@@ -1,9 +1,15 @@
 package cli
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"text/tabwriter"
+	"time"
+
+	"dogestry/remote"
+	"dogestry/utils"
 )
 
 const ListHelpMessage string = `  List images on REMOTE.
@@ -11,12 +17,18 @@ const ListHelpMessage string = `  List images on REMOTE.
   Arguments:
     REMOTE       Name of REMOTE.
 
+  Options:
+    -l           Also show the image ID, push time, size and labels of every
+                 tag, from the metadata stored by push.
+
   Examples:
     dogestry list s3://DockerBucket/Path/?region=us-east-1
+    dogestry list -l s3://DockerBucket/Path/?region=us-east-1
     dogestry list /path/to/images`
 
-func (cli *DogestryCli) CmdList(args ...string) error {
-	listFlags := cli.Subcmd("list", "REMOTE", ListHelpMessage)
+func (cli *DogestryCli) CmdList(ctx context.Context, args ...string) error {
+	listFlags := cli.Subcmd("list", "[OPTIONS] REMOTE", ListHelpMessage)
+	long := listFlags.Bool("l", false, "show the push metadata of every tag")
 	if err := listFlags.Parse(args); err != nil {
 		return nil
 	}
@@ -30,16 +42,20 @@ func (cli *DogestryCli) CmdList(args ...string) error {
 	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
 	defer w.Flush()
 
-	r, err := cli.GetRemote(listFlags.Arg(0))
+	r, err := cli.GetRemote(ctx, listFlags.Arg(0))
 	if err != nil {
 		return err
 	}
 
-	images, err := r.List()
+	images, err := r.List(ctx)
 	if err != nil {
 		return err
 	}
 
+	if *long {
+		return cli.listLong(ctx, w, r, images)
+	}
+
 	fmt.Fprintf(w, "REPOSITORY\tTAG\n")
 
 	for _, i := range images {
@@ -49,3 +65,23 @@ func (cli *DogestryCli) CmdList(args ...string) error {
 
 	return nil
 }
+
+func (cli *DogestryCli) listLong(ctx context.Context, w io.Writer, r remote.Remote, images []remote.Image) error {
+	fmt.Fprintf(w, "REPOSITORY\tTAG\tIMAGE ID\tPUSHED\tSIZE\tLABELS\n")
+
+	for _, i := range images {
+		meta, err := r.TagMetadata(ctx, i.Repository, i.Tag)
+		if err == remote.ErrNoMetadata {
+			// pushed by an older version, only the ID is known
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t\n", i.Repository, i.Tag, meta.ID.Short())
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", i.Repository, i.Tag, meta.ID.Short(),
+			meta.PushedAt.Local().Format(time.RFC3339), utils.HumanSize(meta.Size), labels(meta.Labels))
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"dogestry/remote"
+)
+
+const LogHelpMessage string = `  Show how TAG on REMOTE has moved, most recent first.
+
+  Every push or rollback that moves a tag is recorded with the image it
+  pointed at before and after, who ran dogestry and on which host. Entry N
+  can be restored with 'dogestry rollback -to N'.
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+    IMAGE[:TAG]  Name of IMAGE. TAG is optional, and defaults to 'latest'.
+
+  Examples:
+    dogestry log s3://DockerBucket/Path/?region=us-east-1 myapp:prod`
+
+func (cli *DogestryCli) CmdLog(ctx context.Context, args ...string) error {
+	logFlags := cli.Subcmd("log", "REMOTE IMAGE[:TAG]", LogHelpMessage)
+	if err := logFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(logFlags.Args()) < 2 {
+		fmt.Fprintln(cli.err, "Error: IMAGE and REMOTE not specified")
+		logFlags.Usage()
+		os.Exit(2)
+	}
+
+	r, err := cli.GetRemote(ctx, logFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	repo, tag := remote.NormaliseImageName(logFlags.Arg(1))
+	history, err := r.TagHistory(ctx, repo, tag)
+	if err != nil {
+		return err
+	}
+
+	if len(history) == 0 {
+		fmt.Fprintf(cli.err, "No history recorded for %s:%s\n", repo, tag)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "N\tTIME\tFROM\tTO\tUSER\tHOST\n")
+
+	for n := 0; n < len(history); n++ {
+		entry := history[len(history)-1-n]
+
+		from := string(entry.Old.Short())
+		if from == "" {
+			from = "-"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", n, entry.Time.Local().Format(time.RFC3339), from, entry.New.Short(), entry.User, entry.Host)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"dogestry/remote"
+)
+
+const MigrateHelpMessage string = `  Rewrite REMOTE in place to a newer layout version.
+
+  The layout version of a remote is declared in dogestry.json at its root,
+  and versions of dogestry that don't know it refuse to use the remote. A
+  remote without dogestry.json has version 1; migrating it to version 1
+  only writes the descriptor. Version 2 stores layers as content-addressed
+  blobs, shared by identical layers. Version 3 stores new layers
+  compressed, with the codec chosen by -compression; layers already on the
+  remote stay as they are. An interrupted migration is resumed by running
+  the same command again.
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+
+  Options:
+    -to N        Layout version to migrate to, defaults to the newest one
+                 this dogestry supports.
+
+  Examples:
+    dogestry migrate s3://DockerBucket/Path/?region=us-east-1 -to 3`
+
+func (cli *DogestryCli) CmdMigrate(ctx context.Context, args ...string) error {
+	migrateFlags := cli.Subcmd("migrate", "REMOTE [OPTIONS]", MigrateHelpMessage)
+	to := migrateFlags.Int("to", remote.LayoutVersion, "layout version to migrate to")
+	if err := migrateFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(migrateFlags.Args()) < 1 {
+		fmt.Fprintln(cli.err, "Error: REMOTE not specified")
+		migrateFlags.Usage()
+		os.Exit(2)
+	}
+
+	// options are allowed after REMOTE too
+	remoteName := migrateFlags.Arg(0)
+	if err := migrateFlags.Parse(migrateFlags.Args()[1:]); err != nil {
+		return nil
+	}
+
+	r, err := cli.GetRemote(ctx, remoteName)
+	if err != nil {
+		return err
+	}
+
+	if err := r.Migrate(ctx, *to); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "Remote has layout version %d\n", *to)
+	return nil
+}
@@ -0,0 +1,91 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"dogestry/remote"
+)
+
+const PresignHelpMessage string = `  Write a manifest of time-limited URLs to pull IMAGE from REMOTE.
+
+  The manifest lists a presigned GET URL for the tag and every file and
+  layer of IMAGE and its parents. Anyone holding it can pull IMAGE with
+  'dogestry pull manifest:FILE IMAGE' until the URLs expire, without
+  credentials for REMOTE, and can't read anything else from it. Keep the
+  manifest as secret as the image. Encrypted remotes still need their key
+  to pull. URLs signed with temporary AWS credentials stop working when
+  the credentials expire, whatever the -ttl.
+
+  Arguments:
+    REMOTE       Name of REMOTE, on S3 or Azure.
+    IMAGE[:TAG]  Name of IMAGE. TAG is optional, and defaults to 'latest'.
+
+  Options:
+    -ttl DURATION
+                 How long the URLs are valid for, eg. 30m or 12h. Defaults
+                 to 1h.
+    -o FILE      Write the manifest to FILE instead of stdout.
+
+  Examples:
+    dogestry presign s3://DockerBucket/Path/?region=us-east-1 myapp:prod -ttl 1h -o myapp.json
+    dogestry pull manifest:myapp.json myapp:prod
+    dogestry pull manifest:https://example.com/myapp.json myapp:prod`
+
+func (cli *DogestryCli) CmdPresign(ctx context.Context, args ...string) error {
+	presignFlags := cli.Subcmd("presign", "REMOTE IMAGE[:TAG] [OPTIONS]", PresignHelpMessage)
+	ttl := presignFlags.Duration("ttl", time.Hour, "how long the URLs are valid for")
+	output := presignFlags.String("o", "", "file to write the manifest to")
+	if err := presignFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(presignFlags.Args()) < 2 {
+		fmt.Fprintln(cli.err, "Error: IMAGE and REMOTE not specified")
+		presignFlags.Usage()
+		os.Exit(2)
+	}
+
+	// options are allowed after IMAGE too
+	remoteName, image := presignFlags.Arg(0), presignFlags.Arg(1)
+	if err := presignFlags.Parse(presignFlags.Args()[2:]); err != nil {
+		return nil
+	}
+
+	if *ttl <= 0 {
+		return fmt.Errorf("invalid -ttl %s", *ttl)
+	}
+
+	r, err := cli.GetRemote(ctx, remoteName)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := remote.Presign(ctx, r, image, *ttl)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *output == "" {
+		_, err = cli.out.Write(data)
+		return err
+	}
+
+	// the URLs give access to the image
+	if err := ioutil.WriteFile(*output, data, 0600); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.err, "Presigned %d objects of %s until %s in %s\n", len(manifest.Objects), manifest.Image, manifest.Expires.Local().Format(time.RFC3339), *output)
+	return nil
+}
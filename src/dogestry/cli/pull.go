@@ -1,21 +1,34 @@
 package cli
 
 import (
+	"context"
 	"errors"
 	"fmt"
+
+	"dogestry/remote"
 )
 
 const PullHelpMessage string = `  Pull IMAGE from REMOTE and load it into docker.
 
+  Besides S3 and Azure remotes, REMOTE can be an http:// or https:// URL
+  serving a copy of a remote, eg. a CDN or a web server in front of a
+  mirrored bucket. It's read with plain GETs and needs the index written by
+  'dogestry reindex' on the remote it mirrors. REMOTE can also be
+  manifest:FILE or manifest:URL, a manifest written by 'dogestry presign'.
+
   Arguments:
     REMOTE       Name of REMOTE.
     IMAGE[:TAG]  Name of IMAGE. TAG is optional, and defaults to 'latest'.
 
   Examples:
     dogestry -pullhosts tcp://host-1:2375 pull s3://DockerBucket/Path/ ubuntu:14.04
+    dogestry pull gs://DockerBucket/Path/ ubuntu:14.04
+    dogestry pull ssh://docker@storage.example.com/srv/docker/ ubuntu:14.04
+    dogestry pull https://mirror.example.com/docker/ ubuntu:14.04
+    dogestry pull manifest:ubuntu.json ubuntu:14.04
     dogestry pull /path/to/images ubuntu`
 
-func (cli *DogestryCli) CmdPull(args ...string) error {
+func (cli *DogestryCli) CmdPull(ctx context.Context, args ...string) (err error) {
 	pullFlags := cli.Subcmd("pull", "REMOTE IMAGE[:TAG]", PullHelpMessage)
 
 	// Don't return error here, this part is only relevant for CLI
@@ -27,49 +40,65 @@ func (cli *DogestryCli) CmdPull(args ...string) error {
 		return errors.New("Error: REMOTE and IMAGE not specified")
 	}
 
-	r, err := cli.GetRemote(pullFlags.Arg(0))
+	image := pullFlags.Arg(1)
+
+	var id remote.ID
+	var loadErrs map[string]error
+	defer func() {
+		cli.emitSummary("pull", image, id, loadErrs, err)
+	}()
+
+	r, err := cli.GetRemote(ctx, pullFlags.Arg(0))
 	if err != nil {
 		return err
 	}
 
-	image := pullFlags.Arg(1)
-	imageRoot, err := cli.WorkDir(image)
+	imageRoot, err := cli.workDirFor(pullFlags.Arg(0), image)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Using docker endpoints for pull: %v\n", cli.PullHosts)
-	fmt.Printf("Remote Connection: %v\n", r.Desc())
+	journal, err := cli.openJournal(r, imageRoot)
+	if err != nil {
+		return err
+	}
 
-	fmt.Printf("Image tag: %v\n", image)
+	fmt.Fprintf(cli.out, "Using docker endpoints for pull: %v\n", cli.PullHosts)
+	fmt.Fprintf(cli.out, "Remote Connection: %v\n", r.Desc())
 
-	id, err := r.ResolveImageNameToId(image)
+	fmt.Fprintf(cli.out, "Image tag: %v\n", image)
+
+	id, err = r.ResolveImageNameToId(ctx, image)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Image '%s' resolved to ID '%s'\n", image, id.Short())
+	fmt.Fprintf(cli.out, "Image '%s' resolved to ID '%s'\n", image, id.Short())
+	cli.emit(Event{Type: EventResolve, Image: image, ID: id.String()})
 
-	fmt.Println("Determining which images need to be downloaded from remote...")
-	downloadMap, err := cli.makeDownloadMap(r, id, imageRoot)
+	fmt.Fprintln(cli.out, "Determining which images need to be downloaded from remote...")
+	downloadMap, err := cli.makeDownloadMap(ctx, r, id, imageRoot)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Downloading images from remote...")
-	if err := cli.downloadImages(r, downloadMap, imageRoot); err != nil {
+	fmt.Fprintln(cli.out, "Downloading images from remote...")
+	cli.emitProgress(EventDownloadProgress)
+	if err := cli.downloadImages(ctx, r, downloadMap, imageRoot); err != nil {
 		return err
 	}
 
-	fmt.Println("Generating repositories JSON file...")
-	if err := cli.createRepositoriesJsonFile(image, imageRoot, r); err != nil {
+	fmt.Fprintln(cli.out, "Generating repositories JSON file...")
+	if err := cli.createRepositoriesJsonFile(ctx, image, imageRoot, r); err != nil {
 		return err
 	}
 
-	fmt.Printf("Importing image(%s) TAR file to docker hosts: %v\n", id.Short(), cli.PullHosts)
-	if err := cli.sendTar(imageRoot); err != nil {
+	fmt.Fprintf(cli.out, "Importing image(%s) TAR file to docker hosts: %v\n", id.Short(), cli.PullHosts)
+	loadErrs, err = cli.sendTar(ctx, imageRoot)
+	if err != nil {
 		return err
 	}
 
+	cli.finishWorkDir(imageRoot, journal)
 	return nil
 }
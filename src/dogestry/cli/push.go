@@ -2,13 +2,17 @@ package cli
 
 import (
 	"archive/tar"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"dogestry/remote"
 	"dogestry/utils"
@@ -21,12 +25,30 @@ const PushHelpMessage string = `  Push IMAGE from docker to REMOTE.
     REMOTE       Name of REMOTE.
     IMAGE[:TAG]  Name of IMAGE. TAG is optional, and defaults to 'latest'.
 
+   Options:
+    -expect-id ID  Only move TAG if it points at image ID on REMOTE, or if
+                   ID is 'none', only create it if it doesn't exist yet.
+                   Otherwise the push fails with exit code 3.
+    -override-immutable
+                   Move TAG even if the remote's policy marks it immutable.
+    -label KEY=VALUE
+                   Store KEY=VALUE in the push's metadata, see 'inspect'.
+                   Can be repeated.
+
   Examples:
     dogestry push s3://DockerBucket/Path/?region=us-east-1 ubuntu:14.04
+    dogestry push -expect-id 5d4e24b3d968 s3://DockerBucket/Path/ myapp:latest
+    dogestry push -label git=1a2b3c4 -label build=https://ci/42 s3://DockerBucket/Path/ myapp
+    dogestry push gs://DockerBucket/Path/ ubuntu:14.04
+    dogestry push ssh://docker@storage.example.com/srv/docker/ ubuntu:14.04
     dogestry push /path/to/images ubuntu`
 
-func (cli *DogestryCli) CmdPush(args ...string) error {
-	pushFlags := cli.Subcmd("push", "REMOTE IMAGE[:TAG]", PushHelpMessage)
+func (cli *DogestryCli) CmdPush(ctx context.Context, args ...string) (err error) {
+	pushFlags := cli.Subcmd("push", "[OPTIONS] REMOTE IMAGE[:TAG]", PushHelpMessage)
+	expectID := pushFlags.String("expect-id", "", "only move the tag if it points at this image ID ('none': the tag must not exist)")
+	overrideImmutable := pushFlags.Bool("override-immutable", false, "move the tag even if the remote policy marks it immutable")
+	pushLabels := make(labels)
+	pushFlags.Var(pushLabels, "label", "KEY=VALUE stored in the push metadata, can be repeated")
 	if err := pushFlags.Parse(args); err != nil {
 		return nil
 	}
@@ -37,33 +59,103 @@ func (cli *DogestryCli) CmdPush(args ...string) error {
 		os.Exit(2)
 	}
 
-	r, err := cli.GetRemote(pushFlags.Arg(0))
+	image := pushFlags.Arg(1)
+
+	var id remote.ID
+	defer func() {
+		cli.emitSummary("push", image, id, nil, err)
+	}()
+
+	r, err := cli.GetRemote(ctx, pushFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+	r.SetExpectedID(remote.ID(*expectID))
+	r.SetOverrideImmutable(*overrideImmutable)
+
+	imageRoot, err := cli.workDirFor(pushFlags.Arg(0), image)
 	if err != nil {
 		return err
 	}
 
-	image := pushFlags.Arg(1)
-	imageRoot, err := cli.WorkDir(image)
+	journal, err := cli.openJournal(r, imageRoot)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Using docker endpoint for push: %v\n", cli.DockerHost)
-	fmt.Printf("Remote: %v\n", r.Desc())
+	fmt.Fprintf(cli.out, "Using docker endpoint for push: %v\n", cli.DockerHost)
+	fmt.Fprintf(cli.out, "Remote: %v\n", r.Desc())
 
-	if err = cli.exportToFiles(image, r, imageRoot); err != nil {
+	if id, err = cli.exportToFiles(ctx, image, r, imageRoot); err != nil {
 		return err
 	}
 
-	if err := r.Push(image, imageRoot); err != nil {
-		fmt.Printf(`{"Status":"error", "Message": "%v"}`+"\n", err.Error())
+	cli.emitProgress(EventUploadProgress)
+	if err := r.Push(ctx, image, imageRoot); err != nil {
 		return err
 	}
 
-	fmt.Println(`{"Status":"ok"}`)
+	// the tag has moved, so a missing record isn't worth failing the push
+	if err := cli.putTagMetadata(ctx, r, image, id, pushLabels); err != nil {
+		log.Printf("Warning: unable to store metadata of %s: %v", image, err)
+	}
+
+	cli.finishWorkDir(imageRoot, journal)
+
+	fmt.Fprintf(cli.out, "Pushed %s\n", image)
+	return nil
+}
+
+// labels collects repeated -label KEY=VALUE flags.
+type labels map[string]string
+
+func (l labels) String() string {
+	var pairs []string
+	for key, value := range l {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l labels) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("invalid label '%s', expected KEY=VALUE", s)
+	}
+	l[parts[0]] = parts[1]
 	return nil
 }
 
+// putTagMetadata records the push of image, which now points at id.
+func (cli *DogestryCli) putTagMetadata(ctx context.Context, r remote.Remote, image string, id remote.ID, pushLabels labels) error {
+	history, err := cli.Client.ImageHistory(image)
+	if err != nil {
+		return err
+	}
+
+	repo, tag := remote.NormaliseImageName(image)
+	meta := remote.TagMetadata{
+		Repo:            repo,
+		Tag:             tag,
+		ID:              id,
+		PushedAt:        time.Now().UTC(),
+		DockerHost:      cli.DockerHost,
+		DogestryVersion: Version,
+		Layers:          len(history),
+	}
+
+	for _, layer := range history {
+		meta.Size += layer.Size
+	}
+
+	if len(pushLabels) > 0 {
+		meta.Labels = pushLabels
+	}
+
+	return r.PutTagMetadata(ctx, meta)
+}
+
 // There's no Set data structure in Go, so use a map to simulate one.
 type set map[remote.ID]struct{}
 
@@ -72,13 +164,24 @@ var empty struct{}
 
 // Stream the tarball from docker and translate it into the portable repo format
 // Note that its easier to handle as a stream on the way out.
-func (cli *DogestryCli) exportImageToFiles(image, root string, saveIds set) error {
-	fmt.Printf("Exporting image: %v to: %v\n", image, root)
+func (cli *DogestryCli) exportImageToFiles(ctx context.Context, image, root string, saveIds set) error {
+	fmt.Fprintf(cli.out, "Exporting image: %v to: %v\n", image, root)
 
 	reader, writer := io.Pipe()
 	defer writer.Close()
 	defer reader.Close()
 
+	// Closing the reader fails docker's next write, aborting the export
+	exported := make(chan struct{})
+	defer close(exported)
+	go func() {
+		select {
+		case <-ctx.Done():
+			reader.CloseWithError(ctx.Err())
+		case <-exported:
+		}
+	}()
+
 	tarball := tar.NewReader(reader)
 
 	errch := make(chan error)
@@ -133,7 +236,7 @@ func (cli *DogestryCli) exportImageToFiles(image, root string, saveIds set) erro
 func (cli *DogestryCli) createFileFromTar(root string, header *tar.Header, tarball io.Reader) error {
 	// only handle files (directories are implicit)
 	if header.Typeflag == tar.TypeReg {
-		fmt.Printf("  tar: extracting file: %s\n", header.Name)
+		fmt.Fprintf(cli.out, "  tar: extracting file: %s\n", header.Name)
 
 		// special case - repositories file
 		if filepath.Base(header.Name) == "repositories" {
@@ -157,7 +260,7 @@ func (cli *DogestryCli) createFileFromTar(root string, header *tar.Header, tarba
 			if wrote, err := io.Copy(destFile, tarball); err != nil {
 				return err
 			} else {
-				fmt.Printf("  tar: file created. Size: %s\n", utils.HumanSize(wrote))
+				fmt.Fprintf(cli.out, "  tar: file created. Size: %s\n", utils.HumanSize(wrote))
 			}
 
 			destFile.Close()
@@ -195,7 +298,7 @@ func createRepositoriesJsonFile(root string, tarball io.Reader) error {
 }
 
 func (cli *DogestryCli) exportMetaDataToFiles(repoName string, repoTag string, id remote.ID, root string) error {
-	fmt.Printf("Exporting metadata for: %v to: %v\n", repoName, root)
+	fmt.Fprintf(cli.out, "Exporting metadata for: %v to: %v\n", repoName, root)
 	dest := filepath.Join(root, "repositories", repoName, repoTag)
 
 	if err := os.MkdirAll(filepath.Dir(dest), os.ModeDir|0700); err != nil {
@@ -208,17 +311,20 @@ func (cli *DogestryCli) exportMetaDataToFiles(repoName string, repoTag string, i
 	return nil
 }
 
-func (cli *DogestryCli) exportToFiles(image string, r remote.Remote, imageRoot string) error {
+// exportToFiles exports the layers missing from the remote to imageRoot and
+// returns the ID of the image.
+func (cli *DogestryCli) exportToFiles(ctx context.Context, image string, r remote.Remote, imageRoot string) (remote.ID, error) {
 	imageHistory, err := cli.Client.ImageHistory(image)
 	if err != nil {
-		fmt.Printf("Error getting image history: %v\n", err)
-		return err
+		fmt.Fprintf(cli.out, "Error getting image history: %v\n", err)
+		return "", err
 	}
 
-	fmt.Println("Checking layers on remote")
+	fmt.Fprintln(cli.out, "Checking layers on remote")
 
 	imageID := remote.ID(imageHistory[0].ID)
 	repoName, repoTag := remote.NormaliseImageName(image)
+	cli.emit(Event{Type: EventResolve, Image: image, ID: imageID.String()})
 
 	// Check the remote to see what layers are missing. Only missing Ids will
 	// need to be saved to disk when exporting the docker image.
@@ -227,24 +333,26 @@ func (cli *DogestryCli) exportToFiles(image string, r remote.Remote, imageRoot s
 
 	for _, i := range imageHistory {
 		id := remote.ID(i.ID)
-		_, err = r.ImageMetadata(id)
+		_, err = r.ImageMetadata(ctx, id)
 		if err == nil {
-			fmt.Printf("  exists   : %v\n", id)
+			fmt.Fprintf(cli.out, "  exists   : %v\n", id)
+			cli.emit(Event{Type: EventLayerCheck, ID: id.String(), Status: StatusPresent})
 		} else {
-			fmt.Printf("  not found: %v\n", id)
+			fmt.Fprintf(cli.out, "  not found: %v\n", id)
+			cli.emit(Event{Type: EventLayerCheck, ID: id.String(), Status: StatusMissing})
 			missingIds[id] = empty
 		}
 	}
 
 	if len(missingIds) > 0 {
-		if err := cli.exportImageToFiles(image, imageRoot, missingIds); err != nil {
-			return err
+		if err := cli.exportImageToFiles(ctx, image, imageRoot, missingIds); err != nil {
+			return imageID, err
 		}
 	}
 
 	if err := cli.exportMetaDataToFiles(repoName, repoTag, imageID, imageRoot); err != nil {
-		return err
+		return imageID, err
 	}
 
-	return nil
+	return imageID, nil
 }
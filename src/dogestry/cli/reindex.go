@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"dogestry/remote"
+)
+
+const ReindexHelpMessage string = `  Rebuild the catalog of REMOTE from the tags and images on it.
+
+  The catalog is a single object at the root of the remote indexing its
+  tags and images, so that list and resolving short IDs don't have to list
+  every key. Pushes update it once it exists, so run reindex once to create
+  it, and again after a version without catalog support pushed to REMOTE.
+  Reindex also writes the index of the objects on REMOTE, which lets copies
+  of it served over HTTP(S) be pulled from, see 'dogestry help pull'.
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+
+  Examples:
+    dogestry reindex s3://DockerBucket/Path/?region=us-east-1`
+
+func (cli *DogestryCli) CmdReindex(ctx context.Context, args ...string) error {
+	reindexFlags := cli.Subcmd("reindex", "REMOTE", ReindexHelpMessage)
+	if err := reindexFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(reindexFlags.Args()) < 1 {
+		fmt.Fprintln(cli.err, "Error: REMOTE not specified")
+		reindexFlags.Usage()
+		os.Exit(2)
+	}
+
+	r, err := cli.GetRemote(ctx, reindexFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	catalog, err := r.Reindex(ctx)
+	if err != nil {
+		return err
+	}
+
+	tags := len(catalog.List())
+	fmt.Fprintf(cli.out, "Indexed %d tags and %d images in %s\n", tags, len(catalog.Images), remote.CatalogKey)
+	fmt.Fprintf(cli.out, "Listed the objects of the remote in %s\n", remote.IndexKey)
+
+	return nil
+}
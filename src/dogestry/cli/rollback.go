@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"dogestry/remote"
+)
+
+const RollbackHelpMessage string = `  Point TAG on REMOTE back at an image it pointed at before.
+
+  Without -to, TAG goes back to the image it pointed at before it last
+  moved. The move is recorded in the tag's history like a push.
+
+  Arguments:
+    REMOTE       Name of REMOTE.
+    IMAGE[:TAG]  Name of IMAGE. TAG is optional, and defaults to 'latest'.
+
+  Options:
+    -to N        Point TAG at the image entry N of 'dogestry log' moved it to.
+    -override-immutable
+                 Move TAG even if the remote's policy marks it immutable.
+
+  Examples:
+    dogestry rollback s3://DockerBucket/Path/?region=us-east-1 myapp:prod
+    dogestry rollback -to 3 s3://DockerBucket/Path/?region=us-east-1 myapp:prod`
+
+func (cli *DogestryCli) CmdRollback(ctx context.Context, args ...string) error {
+	rollbackFlags := cli.Subcmd("rollback", "[OPTIONS] REMOTE IMAGE[:TAG]", RollbackHelpMessage)
+	to := rollbackFlags.Int("to", -1, "entry of 'dogestry log' to go back to")
+	overrideImmutable := rollbackFlags.Bool("override-immutable", false, "move the tag even if the remote policy marks it immutable")
+	if err := rollbackFlags.Parse(args); err != nil {
+		return nil
+	}
+
+	if len(rollbackFlags.Args()) < 2 {
+		fmt.Fprintln(cli.err, "Error: IMAGE and REMOTE not specified")
+		rollbackFlags.Usage()
+		os.Exit(2)
+	}
+
+	r, err := cli.GetRemote(ctx, rollbackFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	repo, tag := remote.NormaliseImageName(rollbackFlags.Arg(1))
+	history, err := r.TagHistory(ctx, repo, tag)
+	if err != nil {
+		return err
+	}
+
+	id, err := rollbackTarget(repo, tag, history, *to)
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.ImageMetadata(ctx, id); err != nil {
+		return fmt.Errorf("image %s is no longer on the remote: %v", id.Short(), err)
+	}
+
+	current, err := r.ParseTag(ctx, repo, tag)
+	if err != nil {
+		return err
+	}
+
+	// don't undo a push that happened since we looked
+	if current == "" {
+		r.SetExpectedID(remote.ExpectNoTag)
+	} else {
+		r.SetExpectedID(current)
+	}
+	r.SetOverrideImmutable(*overrideImmutable)
+
+	if err := r.SetTag(ctx, repo, tag, id); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "%s:%s now points at %s (was %s)\n", repo, tag, id.Short(), current.Short())
+	return nil
+}
+
+// rollbackTarget picks the image to point the tag at from its history,
+// oldest entry first. to counts back from the most recent entry like
+// 'dogestry log' does, a negative to means the image before the last move.
+func rollbackTarget(repo, tag string, history []remote.TagHistoryEntry, to int) (remote.ID, error) {
+	if len(history) == 0 {
+		return "", fmt.Errorf("no history recorded for %s:%s", repo, tag)
+	}
+
+	if to < 0 {
+		last := history[len(history)-1]
+		if last.Old == "" {
+			return "", fmt.Errorf("%s:%s didn't exist before its last push, use -to to pick an image", repo, tag)
+		}
+		return last.Old, nil
+	}
+
+	if to >= len(history) {
+		return "", fmt.Errorf("%s:%s has no history entry %d, the oldest is %d", repo, tag, to, len(history)-1)
+	}
+
+	return history[len(history)-1-to].New, nil
+}
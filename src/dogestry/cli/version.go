@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -11,6 +12,6 @@ func PrintVersion() error {
 	return err
 }
 
-func (cli *DogestryCli) CmdVersion(args ...string) error {
+func (cli *DogestryCli) CmdVersion(ctx context.Context, args ...string) error {
 	return PrintVersion()
 }
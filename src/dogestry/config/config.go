@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
 func NewConfig(useMetaService bool) (Config, error) {
@@ -20,26 +21,62 @@ func NewConfig(useMetaService bool) (Config, error) {
 		c.AWS.SecretAccessKey = os.Getenv("AWS_SECRET_KEY")
 	}
 
+	c.AWS.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	if c.AWS.SessionToken == "" {
+		c.AWS.SessionToken = os.Getenv("AWS_SECURITY_TOKEN")
+	}
+
+	c.AWS.Profile = os.Getenv("AWS_PROFILE")
+	if c.AWS.Profile == "" {
+		c.AWS.Profile = os.Getenv("AWS_DEFAULT_PROFILE")
+	}
+
+	c.GCS.CredentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	c.GCS.EmulatorHost = os.Getenv("STORAGE_EMULATOR_HOST")
+
+	c.SSH.AgentSocket = os.Getenv("SSH_AUTH_SOCK")
+
 	c.Docker.Connection = os.Getenv("DOCKER_HOST")
 
 	if c.Docker.Connection == "" {
 		c.Docker.Connection = "unix:///var/run/docker.sock"
 	}
 
+	// without keys in the environment, the S3 remote looks for credentials
+	// further down the chain, see remote.newCredentialProvider
 	c.AWS.UseMetaService = useMetaService
 
-	if !useMetaService && (c.AWS.AccessKeyID == "" || c.AWS.SecretAccessKey == "") {
-		return c, errors.New("AWS_ACCESS_KEY_ID/AWS_ACCESS_KEY or AWS_SECRET_ACCESS_KEY/AWS_SECRET_KEY are missing.")
-	}
-
 	return c, nil
 }
 
+// NewAzureConfig reads the Azure storage account from the environment:
+// AZURE_STORAGE_CONNECTION_STRING, then AZ_ACCOUNT_NAME, AZ_ACCOUNT_KEY,
+// AZ_SAS_TOKEN, AZ_CLOUD and AZ_BLOB_ENDPOINT, which override it.
 func NewAzureConfig() (Config, error) {
 	c := Config{}
 
-	c.Azure.AccountName = os.Getenv("AZ_ACCOUNT_NAME")
-	c.Azure.AccountKey = os.Getenv("AZ_ACCOUNT_KEY")
+	if connectionString := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); connectionString != "" {
+		if err := c.SetAzureConnectionString(connectionString); err != nil {
+			return c, err
+		}
+	}
+
+	for env, setting := range map[string]*string{
+		"AZ_ACCOUNT_NAME":  &c.Azure.AccountName,
+		"AZ_ACCOUNT_KEY":   &c.Azure.AccountKey,
+		"AZ_SAS_TOKEN":     &c.Azure.SASToken,
+		"AZ_BLOB_ENDPOINT": &c.Azure.BlobEndpoint,
+	} {
+		if value := os.Getenv(env); value != "" {
+			*setting = value
+		}
+	}
+
+	if cloud := os.Getenv("AZ_CLOUD"); cloud != "" {
+		if err := c.SetAzureCloud(cloud); err != nil {
+			return c, err
+		}
+	}
 
 	c.Docker.Connection = os.Getenv("DOCKER_HOST")
 
@@ -47,8 +84,8 @@ func NewAzureConfig() (Config, error) {
 		c.Docker.Connection = "unix:///var/run/docker.sock"
 	}
 
-	if c.Azure.AccountName == "" || c.Azure.AccountKey == "" {
-		return c, errors.New("AZ_ACCOUNT_NAME or AZ_ACCOUNT_KEY is missing.")
+	if (c.Azure.AccountName == "" && c.Azure.BlobEndpoint == "") || (c.Azure.AccountKey == "" && c.Azure.SASToken == "") {
+		return c, errors.New("AZ_ACCOUNT_NAME and AZ_ACCOUNT_KEY or AZ_SAS_TOKEN, or AZURE_STORAGE_CONNECTION_STRING, are missing.")
 	}
 
 	c.Azure.Active = true
@@ -61,17 +98,87 @@ type Config struct {
 		S3URL           *url.URL
 		AccessKeyID     string
 		SecretAccessKey string
-		UseMetaService  bool
+		// set with temporary keys
+		SessionToken string
+		// profile of the shared credentials and config files
+		Profile        string
+		UseMetaService bool
+		// options of the objects pushed to the remote in use, see
+		// UseRemote. The S3 URL's query can override them.
+		Objects S3Objects
 	}
 	Azure struct {
 		Active      bool
 		AccountName string
 		AccountKey  string
-		Blob        *BlobSpec
+		// shared access signature used instead of the key, eg. one scoped
+		// to the container
+		SASToken string
+		// storage endpoints of the cloud, empty for the public one, see
+		// SetAzureCloud
+		EndpointSuffix string
+		// blob service URL replacing https://<account>.blob.<suffix>, eg.
+		// Azurite's
+		BlobEndpoint string
+		// http or https, the default
+		Protocol string
+		Blob     *BlobSpec
+	}
+	GCS struct {
+		// gs://bucket/path
+		URL *url.URL
+		// service account key or authorized user file, empty for the
+		// application default credentials, see remote.newGCSTokenSource
+		CredentialsFile string
+		// host of a fake GCS server, eg. localhost:4443, which is used
+		// without credentials unless CredentialsFile is set
+		EmulatorHost string
+	}
+	SSH struct {
+		// ssh://user@host[:port]/path
+		URL *url.URL
+		// private key tried after the agent's keys, ~/.ssh/id_* if empty
+		KeyFile string
+		// where the host's key is checked, ~/.ssh/known_hosts if empty
+		KnownHostsFile string
+		// socket of the SSH agent, empty for none
+		AgentSocket string
 	}
 	Docker struct {
 		Connection string
 	}
+	// CacheDir, if set, keeps work dirs and transfer journals between runs
+	// so that interrupted pushes and pulls can be resumed.
+	CacheDir string
+	// Transfer tunes remote transfers. Zero values mean the defaults.
+	Transfer struct {
+		UploadWorkers   int
+		DownloadWorkers int
+		// parts (S3) or blocks (Azure) of a single file sent at once
+		PartConcurrency int
+		// limit for all transfers in the process together, 0 for none
+		BytesPerSecond int64
+		// codec layers are pushed with, see remote.LookupCodec
+		Compression string
+	}
+	// Remotes are the remotes named in the config file, see LoadFile.
+	Remotes map[string]*Remote
+	// Defaults are the settings of every remote: the defaults of the
+	// flags, overridden by the [defaults] section of the config file.
+	Defaults Settings
+	// Flags are the settings given on the command line, which win over
+	// the config file.
+	Flags Settings
+	// Encryption of the remote in use, see UseRemote.
+	Encryption Encryption
+	// Retry configures how transient remote errors are retried. A zero
+	// Attempts means the remote's default policy.
+	Retry struct {
+		Attempts  int
+		BaseDelay time.Duration
+		MaxDelay  time.Duration
+		Jitter    float64
+	}
 }
 
 type BlobSpec struct {
@@ -91,6 +198,45 @@ func (c *Config) SetS3URL(rawurl string) error {
 	return nil
 }
 
+// SetGCSURL sets the bucket, and the path in it, of a gs:// remote.
+func (c *Config) SetGCSURL(rawurl string) error {
+	urlStruct, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if urlStruct.Scheme != "gs" || urlStruct.Host == "" {
+		return fmt.Errorf("invalid GCS remote '%s', expected eg. gs://bucket/path/", rawurl)
+	}
+
+	c.GCS.URL = urlStruct
+
+	return nil
+}
+
+// SetSSHURL sets the host, user and path of an ssh:// remote. The key and
+// known_hosts parameters of the URL's query set KeyFile and KnownHostsFile.
+func (c *Config) SetSSHURL(rawurl string) error {
+	urlStruct, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if urlStruct.Scheme != "ssh" || urlStruct.Hostname() == "" {
+		return fmt.Errorf("invalid SSH remote '%s', expected eg. ssh://user@host/path/", rawurl)
+	}
+
+	query := urlStruct.Query()
+	if key := query.Get("key"); key != "" {
+		c.SSH.KeyFile = key
+	}
+	if knownHosts := query.Get("known_hosts"); knownHosts != "" {
+		c.SSH.KnownHostsFile = knownHosts
+	}
+
+	c.SSH.URL = urlStruct
+
+	return nil
+}
+
 func (c *Config) SetBlobSpec(s string) error {
 	if s == "" {
 		c.Azure.Blob = &BlobSpec{"", "", false}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AzureClouds are the storage endpoint suffixes of the Azure clouds, by the
+// names the Azure SDKs give them.
+var AzureClouds = map[string]string{
+	"AzurePublicCloud":       "core.windows.net",
+	"AzureChinaCloud":        "core.chinacloudapi.cn",
+	"AzureUSGovernmentCloud": "core.usgovcloudapi.net",
+	"AzureGermanCloud":       "core.cloudapi.de",
+}
+
+// the well-known development account of the Azurite emulator
+const (
+	AzuriteAccountName  = "devstoreaccount1"
+	AzuriteAccountKey   = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	AzuriteBlobEndpoint = "http://127.0.0.1:10000/devstoreaccount1"
+)
+
+// SetAzureCloud sets the storage endpoints to those of the Azure cloud
+// named, eg. AzureChinaCloud.
+func (c *Config) SetAzureCloud(name string) error {
+	suffix, ok := AzureClouds[name]
+	if !ok {
+		var names []string
+		for name := range AzureClouds {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown Azure cloud '%s', expected one of %s", name, strings.Join(names, ", "))
+	}
+
+	c.Azure.EndpointSuffix = suffix
+	return nil
+}
+
+// SetAzureConnectionString sets the account from a storage connection
+// string, as the Azure portal gives them:
+//
+//	DefaultEndpointsProtocol=https;AccountName=<name>;AccountKey=<key>;EndpointSuffix=core.windows.net
+//
+// BlobEndpoint, SharedAccessSignature and UseDevelopmentStorage=true, for
+// Azurite, are understood too. The other services' endpoints are ignored.
+func (c *Config) SetAzureConnectionString(s string) error {
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid Azure connection string, expected name=value in '%s'", part)
+		}
+
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch name {
+		case "AccountName":
+			c.Azure.AccountName = value
+		case "AccountKey":
+			c.Azure.AccountKey = value
+		case "SharedAccessSignature":
+			c.Azure.SASToken = value
+		case "BlobEndpoint":
+			c.Azure.BlobEndpoint = value
+		case "EndpointSuffix":
+			c.Azure.EndpointSuffix = value
+		case "DefaultEndpointsProtocol":
+			if value != "http" && value != "https" {
+				return fmt.Errorf("invalid Azure connection string, DefaultEndpointsProtocol is %s, expected http or https", value)
+			}
+			c.Azure.Protocol = value
+		case "UseDevelopmentStorage":
+			if strings.EqualFold(value, "true") {
+				c.Azure.AccountName = AzuriteAccountName
+				c.Azure.AccountKey = AzuriteAccountKey
+				c.Azure.BlobEndpoint = AzuriteBlobEndpoint
+			}
+		}
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -28,7 +29,54 @@ func TestNewAzureConfig(t *testing.T) {
 	os.Unsetenv("AZ_ACCOUNT_KEY")
 
 	c, err = NewAzureConfig()
-	if err == nil || err.Error() != "AZ_ACCOUNT_NAME or AZ_ACCOUNT_KEY is missing." {
+	if err == nil || err.Error() != "AZ_ACCOUNT_NAME and AZ_ACCOUNT_KEY or AZ_SAS_TOKEN, or AZURE_STORAGE_CONNECTION_STRING, are missing." {
 		t.Error("should return error when evn vars are not set")
 	}
+
+	// a SAS token will do instead of the key
+	os.Setenv("AZURE_STORAGE_CONNECTION_STRING", "BlobEndpoint=https://name.blob.core.windows.net/;SharedAccessSignature=sv=2019-02-02&sig=abc")
+	os.Setenv("AZ_CLOUD", "AzureUSGovernmentCloud")
+	defer os.Unsetenv("AZURE_STORAGE_CONNECTION_STRING")
+	defer os.Unsetenv("AZ_CLOUD")
+
+	c, err = NewAzureConfig()
+	if err != nil {
+		t.Fatalf("Failed to create config. Error: %v", err)
+	}
+	if c.Azure.SASToken != "sv=2019-02-02&sig=abc" || c.Azure.BlobEndpoint != "https://name.blob.core.windows.net/" {
+		t.Errorf("SAS token and endpoint should come from the connection string: %+v", c.Azure)
+	}
+	if c.Azure.EndpointSuffix != "core.usgovcloudapi.net" || !c.Azure.Active {
+		t.Errorf("should use the US government cloud: %+v", c.Azure)
+	}
+
+	os.Setenv("AZ_CLOUD", "AzureMoonCloud")
+	if _, err = NewAzureConfig(); err == nil || !strings.HasPrefix(err.Error(), "unknown Azure cloud 'AzureMoonCloud', expected one of AzureChinaCloud, ") {
+		t.Errorf("should reject unknown clouds: %v", err)
+	}
+}
+
+func TestSetAzureConnectionString(t *testing.T) {
+	c := Config{}
+	err := c.SetAzureConnectionString("DefaultEndpointsProtocol=http;AccountName=name;AccountKey=a2V5==;EndpointSuffix=core.chinacloudapi.cn;QueueEndpoint=https://q;")
+	if err != nil {
+		t.Fatalf("Failed to parse connection string. Error: %v", err)
+	}
+	if c.Azure.AccountName != "name" || c.Azure.AccountKey != "a2V5==" || c.Azure.EndpointSuffix != "core.chinacloudapi.cn" || c.Azure.Protocol != "http" {
+		t.Errorf("account should come from the connection string: %+v", c.Azure)
+	}
+
+	c = Config{}
+	if err := c.SetAzureConnectionString("UseDevelopmentStorage=true"); err != nil {
+		t.Fatalf("Failed to parse connection string. Error: %v", err)
+	}
+	if c.Azure.AccountName != AzuriteAccountName || c.Azure.AccountKey != AzuriteAccountKey || c.Azure.BlobEndpoint != AzuriteBlobEndpoint {
+		t.Errorf("should use Azurite's account: %+v", c.Azure)
+	}
+
+	for _, s := range []string{"AccountName", "DefaultEndpointsProtocol=ftp"} {
+		if err := c.SetAzureConnectionString(s); err == nil {
+			t.Errorf("%s should be invalid", s)
+		}
+	}
 }
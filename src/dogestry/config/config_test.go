@@ -8,6 +8,8 @@ import (
 func TestNewConfig(t *testing.T) {
 	os.Setenv("AWS_ACCESS_KEY_ID", "access")
 	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	os.Setenv("AWS_SESSION_TOKEN", "token")
+	os.Setenv("AWS_PROFILE", "prod")
 	c, err := NewConfig(false)
 	if err != nil {
 		t.Fatalf("Failed to create config. Error: %v", err)
@@ -18,18 +20,30 @@ func TestNewConfig(t *testing.T) {
 	if c.AWS.SecretAccessKey != "secret" {
 		t.Error("SecretAccessKey should be 'secret': " + c.AWS.SecretAccessKey)
 	}
+	if c.AWS.SessionToken != "token" {
+		t.Error("SessionToken should be 'token': " + c.AWS.SessionToken)
+	}
+	if c.AWS.Profile != "prod" {
+		t.Error("Profile should be 'prod': " + c.AWS.Profile)
+	}
 	if c.Docker.Connection == "" {
 		t.Error("config.Docker.Connection should not be empty.")
 	}
 
+	os.Unsetenv("AWS_SESSION_TOKEN")
+	os.Unsetenv("AWS_PROFILE")
 	os.Unsetenv("AWS_ACCESS_KEY_ID")
 	os.Unsetenv("AWS_ACCESS_KEY")
 	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
 	os.Unsetenv("AWS_SECRET_KEY")
 
+	// credentials can come from elsewhere, see remote.newCredentialProvider
 	c, err = NewConfig(false)
-	if err == nil || err.Error() != "AWS_ACCESS_KEY_ID/AWS_ACCESS_KEY or AWS_SECRET_ACCESS_KEY/AWS_SECRET_KEY are missing." {
-		t.Error("should return error when evn vars are not set")
+	if err != nil {
+		t.Error("should not return an error when env vars are not set")
+	}
+	if c.AWS.AccessKeyID != "" || c.AWS.SessionToken != "" {
+		t.Error("keys should be empty when env vars are not set")
 	}
 
 	c, err = NewConfig(true)
@@ -37,3 +51,66 @@ func TestNewConfig(t *testing.T) {
 		t.Error("should not renturn an error")
 	}
 }
+
+func TestGCS(t *testing.T) {
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/etc/dogestry/key.json")
+	os.Setenv("STORAGE_EMULATOR_HOST", "localhost:4443")
+	defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+	defer os.Unsetenv("STORAGE_EMULATOR_HOST")
+
+	c, err := NewConfig(false)
+	if err != nil {
+		t.Fatalf("Failed to create config. Error: %v", err)
+	}
+	if c.GCS.CredentialsFile != "/etc/dogestry/key.json" {
+		t.Error("CredentialsFile should be '/etc/dogestry/key.json': " + c.GCS.CredentialsFile)
+	}
+	if c.GCS.EmulatorHost != "localhost:4443" {
+		t.Error("EmulatorHost should be 'localhost:4443': " + c.GCS.EmulatorHost)
+	}
+
+	if err := c.SetGCSURL("gs://bucket/team-a/"); err != nil {
+		t.Fatal(err)
+	}
+	if c.GCS.URL.Host != "bucket" || c.GCS.URL.Path != "/team-a/" {
+		t.Error("URL should be gs://bucket/team-a/: " + c.GCS.URL.String())
+	}
+
+	for _, rawurl := range []string{"s3://bucket/", "gs:///team-a"} {
+		if err := c.SetGCSURL(rawurl); err == nil {
+			t.Errorf("%s should be invalid", rawurl)
+		}
+	}
+}
+
+func TestSSH(t *testing.T) {
+	os.Setenv("SSH_AUTH_SOCK", "/tmp/ssh-agent.sock")
+	defer os.Unsetenv("SSH_AUTH_SOCK")
+
+	c, err := NewConfig(false)
+	if err != nil {
+		t.Fatalf("Failed to create config. Error: %v", err)
+	}
+	if c.SSH.AgentSocket != "/tmp/ssh-agent.sock" {
+		t.Error("AgentSocket should be '/tmp/ssh-agent.sock': " + c.SSH.AgentSocket)
+	}
+
+	if err := c.SetSSHURL("ssh://deploy@storage.local:2222/srv/docker/?key=/etc/dogestry/id_ed25519&known_hosts=/etc/dogestry/known_hosts"); err != nil {
+		t.Fatal(err)
+	}
+	if c.SSH.URL.User.Username() != "deploy" || c.SSH.URL.Host != "storage.local:2222" || c.SSH.URL.Path != "/srv/docker/" {
+		t.Error("URL should be deploy@storage.local:2222/srv/docker/: " + c.SSH.URL.String())
+	}
+	if c.SSH.KeyFile != "/etc/dogestry/id_ed25519" {
+		t.Error("KeyFile should be '/etc/dogestry/id_ed25519': " + c.SSH.KeyFile)
+	}
+	if c.SSH.KnownHostsFile != "/etc/dogestry/known_hosts" {
+		t.Error("KnownHostsFile should be '/etc/dogestry/known_hosts': " + c.SSH.KnownHostsFile)
+	}
+
+	for _, rawurl := range []string{"sftp://host/path", "ssh:///path"} {
+		if err := c.SetSSHURL(rawurl); err == nil {
+			t.Errorf("%s should be invalid", rawurl)
+		}
+	}
+}
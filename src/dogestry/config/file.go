@@ -0,0 +1,336 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"dogestry/utils"
+)
+
+// DefaultFile is the config file used when -config isn't given, if it
+// exists.
+const DefaultFile = "dogestry.cfg"
+
+// Remote holds the settings of a remote named in the config file.
+type Remote struct {
+	// the remote as it would be given on the command line
+	URL        string
+	Encryption Encryption
+	S3         S3Objects
+	// transfer and retry settings, over those of [defaults]
+	Settings Settings
+}
+
+// Settings are transfer and retry settings by name, the same as the
+// command line flags they can be given with, eg. upload-workers = 8. Values
+// are checked when they're read, see Config.ApplySettings.
+type Settings map[string]string
+
+// settingNames are the names Settings can have.
+var settingNames = map[string]bool{
+	"upload-workers":   true,
+	"download-workers": true,
+	"part-concurrency": true,
+	"limit-rate":       true,
+	"compression":      true,
+	"retries":          true,
+	"retry-delay":      true,
+	"retry-max-delay":  true,
+	"retry-jitter":     true,
+}
+
+// IsSetting tells whether name is a transfer or retry setting, which the
+// flag of the same name sets too.
+func IsSetting(name string) bool {
+	return settingNames[name]
+}
+
+// S3Objects sets how S3 stores the objects pushed to a remote. Empty fields
+// leave it to the bucket's defaults, except for the ACL which is private.
+type S3Objects struct {
+	// server-side encryption, AES256 or aws:kms
+	SSE string
+	// KMS key for aws:kms, the account's default key if empty
+	SSEKMSKeyID  string
+	StorageClass string
+	// canned ACL, eg bucket-owner-full-control
+	ACL string
+}
+
+// Encryption configures client-side encryption of the objects pushed to a
+// remote. A zero value means objects are pushed in the clear.
+type Encryption struct {
+	// file holding a 32-byte key, raw, hex or base64 encoded
+	KeyFile    string
+	Passphrase string
+}
+
+// Enabled tells whether a key or passphrase is configured.
+func (e Encryption) Enabled() bool {
+	return e.KeyFile != "" || e.Passphrase != ""
+}
+
+// LoadFile reads the config file at path into c. Sections look like
+//
+//	[defaults]
+//	upload-workers = 8
+//	retries = 10
+//
+//	[remote "prod"]
+//	url = s3://bucket/path/?region=us-east-1
+//	encryption-keyfile = /etc/dogestry/prod.key
+//	compression = zstd
+//
+// [defaults] has transfer and retry settings for every remote, which the
+// section of a remote can override. Flags given on the command line win
+// over both. Lines starting with # or ; are comments.
+func (c *Config) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := c.parseFile(f); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) parseFile(r io.Reader) error {
+	if c.Remotes == nil {
+		c.Remotes = make(map[string]*Remote)
+	}
+	if c.Defaults == nil {
+		c.Defaults = make(Settings)
+	}
+
+	var remote *Remote
+	// in [defaults] rather than a remote's section
+	inDefaults := false
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if line == "[defaults]" {
+				remote, inDefaults = nil, true
+				continue
+			}
+
+			name, err := parseSection(line)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+
+			inDefaults = false
+			remote = c.Remotes[name]
+			if remote == nil {
+				remote = &Remote{}
+				c.Remotes[name] = remote
+			}
+			continue
+		}
+
+		if remote == nil && !inDefaults {
+			return fmt.Errorf("line %d: setting outside of a [remote \"NAME\"] or [defaults] section", lineNo)
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("line %d: expected NAME = VALUE", lineNo)
+		}
+
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		value, err := parseValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineNo, err)
+		}
+
+		if inDefaults {
+			err = c.Defaults.set(name, value)
+		} else {
+			err = remote.set(name, value)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for name, r := range c.Remotes {
+		if r.URL == "" {
+			return fmt.Errorf("remote %s has no url", name)
+		}
+	}
+
+	return nil
+}
+
+// parseSection returns the name of the remote a section header is for.
+func parseSection(line string) (string, error) {
+	if !strings.HasSuffix(line, "]") {
+		return "", fmt.Errorf("unterminated section header %s", line)
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(line[1:len(line)-1]), " ", 2)
+	if len(fields) != 2 || fields[0] != "remote" {
+		return "", fmt.Errorf("unknown section %s, expected [remote \"NAME\"] or [defaults]", line)
+	}
+
+	name, err := strconv.Unquote(strings.TrimSpace(fields[1]))
+	if err != nil || name == "" {
+		return "", fmt.Errorf("invalid remote name in %s", line)
+	}
+
+	return name, nil
+}
+
+// parseValue unquotes value if it's quoted.
+func parseValue(value string) (string, error) {
+	if strings.HasPrefix(value, `"`) {
+		return strconv.Unquote(value)
+	}
+	return value, nil
+}
+
+func (r *Remote) set(name, value string) error {
+	switch name {
+	case "url":
+		r.URL = value
+	case "encryption-keyfile":
+		r.Encryption.KeyFile = value
+	case "encryption-passphrase":
+		r.Encryption.Passphrase = value
+	case "s3-sse":
+		r.S3.SSE = value
+	case "s3-sse-kms-key-id":
+		r.S3.SSEKMSKeyID = value
+	case "s3-storage-class":
+		r.S3.StorageClass = value
+	case "s3-acl":
+		r.S3.ACL = value
+	default:
+		if r.Settings == nil {
+			r.Settings = make(Settings)
+		}
+		return r.Settings.set(name, value)
+	}
+	return nil
+}
+
+// set checks that value can be used for the setting name, and keeps it.
+func (s Settings) set(name, value string) error {
+	if !IsSetting(name) {
+		return fmt.Errorf("unknown setting %s", name)
+	}
+
+	var scratch Config
+	if err := scratch.applySetting(name, value); err != nil {
+		return err
+	}
+
+	s[name] = value
+	return nil
+}
+
+// ApplySettings sets the transfer and retry settings of c from s.
+func (c *Config) ApplySettings(s Settings) error {
+	for name, value := range s {
+		if err := c.applySetting(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) applySetting(name, value string) error {
+	var err error
+	switch name {
+	case "upload-workers":
+		c.Transfer.UploadWorkers, err = parseCount(name, value)
+	case "download-workers":
+		c.Transfer.DownloadWorkers, err = parseCount(name, value)
+	case "part-concurrency":
+		c.Transfer.PartConcurrency, err = parseCount(name, value)
+	case "retries":
+		c.Retry.Attempts, err = parseCount(name, value)
+	case "limit-rate":
+		c.Transfer.BytesPerSecond = 0
+		if value != "" {
+			c.Transfer.BytesPerSecond, err = utils.ParseSize(value)
+		}
+	case "compression":
+		c.Transfer.Compression = value
+	case "retry-delay":
+		c.Retry.BaseDelay, err = time.ParseDuration(value)
+	case "retry-max-delay":
+		c.Retry.MaxDelay, err = time.ParseDuration(value)
+	case "retry-jitter":
+		c.Retry.Jitter, err = strconv.ParseFloat(value, 64)
+		if err == nil && (c.Retry.Jitter < 0 || c.Retry.Jitter > 1) {
+			return fmt.Errorf("%s must be between 0 and 1", name)
+		}
+	default:
+		return fmt.Errorf("unknown setting %s", name)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// parseCount parses a number of workers or attempts, which is at least 1.
+func parseCount(name, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("must be at least 1")
+	}
+	return n, nil
+}
+
+// UseRemote selects the settings of the remote named, or with the URL,
+// nameOrURL and returns the URL to reach it at. Remotes not in the config
+// file are used with the defaults. Transfer and retry settings come from
+// [defaults], then the remote's section, then Flags.
+func (c *Config) UseRemote(nameOrURL string) string {
+	remote, ok := c.Remotes[nameOrURL]
+	if !ok {
+		for _, r := range c.Remotes {
+			if r.URL == nameOrURL {
+				remote, ok = r, true
+				break
+			}
+		}
+	}
+
+	// checked when they were read
+	c.ApplySettings(c.Defaults)
+	defer c.ApplySettings(c.Flags)
+
+	if !ok {
+		c.Encryption = Encryption{}
+		c.AWS.Objects = S3Objects{}
+		return nameOrURL
+	}
+
+	c.Encryption = remote.Encryption
+	c.AWS.Objects = remote.S3
+	c.ApplySettings(remote.Settings)
+	return remote.URL
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFile(t *testing.T) {
+	c := Config{}
+	err := c.parseFile(strings.NewReader(`
+# remotes
+[remote "prod"]
+url = s3://bucket/path/?region=us-east-1
+encryption-keyfile = /etc/dogestry/prod.key
+s3-sse = aws:kms
+s3-storage-class = STANDARD_IA
+
+[remote "dev"]
+  url = "s3://dev-bucket/"
+  ; passphrases can be quoted
+  Encryption-Passphrase = "correct horse"
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config. Error: %v", err)
+	}
+
+	if len(c.Remotes) != 2 {
+		t.Fatalf("expected 2 remotes, got %d", len(c.Remotes))
+	}
+
+	if url := c.UseRemote("prod"); url != "s3://bucket/path/?region=us-east-1" {
+		t.Error("prod should use its url: " + url)
+	}
+	if c.Encryption.KeyFile != "/etc/dogestry/prod.key" || !c.Encryption.Enabled() {
+		t.Errorf("prod should be encrypted with its keyfile: %+v", c.Encryption)
+	}
+	if c.AWS.Objects != (S3Objects{SSE: "aws:kms", StorageClass: "STANDARD_IA"}) {
+		t.Errorf("prod should use its S3 object options: %+v", c.AWS.Objects)
+	}
+
+	if url := c.UseRemote("s3://dev-bucket/"); url != "s3://dev-bucket/" {
+		t.Error("remotes should be found by url: " + url)
+	}
+	if c.Encryption.Passphrase != "correct horse" {
+		t.Errorf("dev should be encrypted with its passphrase: %+v", c.Encryption)
+	}
+
+	if url := c.UseRemote("s3://other/"); url != "s3://other/" {
+		t.Error("other remotes should be used as given: " + url)
+	}
+	if c.Encryption.Enabled() {
+		t.Error("other remotes shouldn't be encrypted")
+	}
+	if c.AWS.Objects != (S3Objects{}) {
+		t.Errorf("other remotes should use the bucket's defaults: %+v", c.AWS.Objects)
+	}
+}
+
+func TestParseFileErrors(t *testing.T) {
+	for input, expected := range map[string]string{
+		`url = s3://bucket/`:                      `line 1: setting outside of a [remote "NAME"] or [defaults] section`,
+		`[s3]`:                                    `line 1: unknown section [s3], expected [remote "NAME"] or [defaults]`,
+		"[remote \"a\"]\nurl = x\nregion = eu":    "line 3: unknown setting region",
+		"[remote \"a\"]\nurl":                     "line 2: expected NAME = VALUE",
+		"[remote \"a\"]\nencryption-keyfile = /k": "remote a has no url",
+		"[defaults]\nretries = 0":                 "line 2: retries: must be at least 1",
+		"[defaults]\nretry-jitter = 2":            "line 2: retry-jitter must be between 0 and 1",
+		"[defaults]\nurl = s3://bucket/":          "line 2: unknown setting url",
+		"[remote \"a\"]\nretry-delay = soon":      `line 2: retry-delay: time: invalid duration "soon"`,
+	} {
+		c := Config{}
+		err := c.parseFile(strings.NewReader(input))
+		if err == nil || err.Error() != expected {
+			t.Errorf("parsing %q should fail with %q, got %v", input, expected, err)
+		}
+	}
+}
+
+func TestSettings(t *testing.T) {
+	// the defaults of the flags
+	c := Config{Defaults: Settings{"upload-workers": "4", "compression": "gzip", "retries": "5", "retry-delay": "1s"}}
+	err := c.parseFile(strings.NewReader(`
+[defaults]
+upload-workers = 8
+retries = 10
+limit-rate = 10MB
+
+[remote "prod"]
+url = s3://bucket/
+compression = zstd
+upload-workers = 16
+retry-delay = 2s
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config. Error: %v", err)
+	}
+
+	c.UseRemote("prod")
+	if c.Transfer.UploadWorkers != 16 || c.Transfer.Compression != "zstd" || c.Retry.BaseDelay != 2*time.Second {
+		t.Errorf("prod should use its settings: %+v %+v", c.Transfer, c.Retry)
+	}
+	if c.Retry.Attempts != 10 || c.Transfer.BytesPerSecond != 10000000 {
+		t.Errorf("prod should use the defaults it doesn't override: %+v %+v", c.Transfer, c.Retry)
+	}
+
+	c.UseRemote("s3://other/")
+	if c.Transfer.UploadWorkers != 8 || c.Retry.Attempts != 10 {
+		t.Errorf("other remotes should use the defaults: %+v %+v", c.Transfer, c.Retry)
+	}
+	if c.Transfer.Compression != "gzip" || c.Retry.BaseDelay != time.Second {
+		t.Errorf("other remotes shouldn't use the settings of prod: %+v %+v", c.Transfer, c.Retry)
+	}
+
+	// flags given on the command line win
+	c.Flags = Settings{"upload-workers": "2", "compression": "none"}
+	c.UseRemote("prod")
+	if c.Transfer.UploadWorkers != 2 || c.Transfer.Compression != "none" || c.Retry.BaseDelay != 2*time.Second {
+		t.Errorf("flags should override the config file: %+v %+v", c.Transfer, c.Retry)
+	}
+}
@@ -0,0 +1,578 @@
+package remote
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dogestry/config"
+	"github.com/AdRoll/goamz/aws"
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+// how long before they expire credentials are refreshed, so that requests
+// signed with them have time to complete
+const credentialsRefreshWindow = 5 * time.Minute
+
+const (
+	defaultSTSEndpoint  = "https://sts.amazonaws.com"
+	defaultIMDSEndpoint = "http://169.254.169.254"
+	stsVersion          = "2011-06-15"
+)
+
+// awsCredentials are keys to sign requests with. Expires is zero for keys
+// that don't expire.
+type awsCredentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Expires      time.Time
+}
+
+// auth returns the credentials for goamz.
+func (creds awsCredentials) auth() aws.Auth {
+	// goamz looks for new credentials itself when a token has no expiry
+	expires := creds.Expires
+	if expires.IsZero() {
+		expires = time.Now().Add(24 * time.Hour)
+	}
+	return *aws.NewAuth(creds.AccessKey, creds.SecretKey, creds.SessionToken, expires)
+}
+
+// keys returns the credentials for s3gof3r.
+func (creds awsCredentials) keys() s3gof3r.Keys {
+	return s3gof3r.Keys{AccessKey: creds.AccessKey, SecretKey: creds.SecretKey, SecurityToken: creds.SessionToken}
+}
+
+// credentialProvider is a source of AWS credentials.
+type credentialProvider interface {
+	retrieve() (awsCredentials, error)
+	String() string
+}
+
+// newCredentialProvider picks where the credentials come from, the way the
+// AWS CLI and SDKs do: the profile of AWS_PROFILE, keys in the environment,
+// a web identity token (EKS service accounts), the default profile of the
+// shared credentials and config files, and at last the instance metadata
+// service. -use-metaservice goes straight to the latter.
+func newCredentialProvider(cfg config.Config) (credentialProvider, error) {
+	if cfg.AWS.UseMetaService {
+		return instanceCredentials{}, nil
+	}
+
+	profiles, err := loadSharedProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	// a profile asked for wins, it may take the environment's keys
+	if cfg.AWS.Profile != "" {
+		return profiles.provider(cfg, cfg.AWS.Profile, map[string]bool{})
+	}
+
+	if cfg.AWS.AccessKeyID != "" && cfg.AWS.SecretAccessKey != "" {
+		return environmentCredentials(cfg), nil
+	}
+
+	if tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); tokenFile != "" && roleARN != "" {
+		return webIdentityCredentials{
+			roleARN:     roleARN,
+			tokenFile:   tokenFile,
+			sessionName: os.Getenv("AWS_ROLE_SESSION_NAME"),
+		}, nil
+	}
+
+	if _, ok := profiles["default"]; ok {
+		return profiles.provider(cfg, "default", map[string]bool{})
+	}
+
+	return instanceCredentials{}, nil
+}
+
+func environmentCredentials(cfg config.Config) staticCredentials {
+	return staticCredentials{creds: awsCredentials{
+		AccessKey:    cfg.AWS.AccessKeyID,
+		SecretKey:    cfg.AWS.SecretAccessKey,
+		SessionToken: cfg.AWS.SessionToken,
+	}, source: "environment"}
+}
+
+// staticCredentials are keys given as such, in the environment or a
+// profile.
+type staticCredentials struct {
+	creds  awsCredentials
+	source string
+}
+
+func (p staticCredentials) retrieve() (awsCredentials, error) {
+	return p.creds, nil
+}
+
+func (p staticCredentials) String() string {
+	return p.source
+}
+
+// sharedProfiles are the settings of the profiles in the shared credentials
+// and config files, the former winning.
+type sharedProfiles map[string]map[string]string
+
+func loadSharedProfiles() (sharedProfiles, error) {
+	home, _ := os.UserHomeDir()
+
+	profiles := sharedProfiles{}
+
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = filepath.Join(home, ".aws", "config")
+	}
+	if err := profiles.load(configFile, true); err != nil {
+		return nil, err
+	}
+
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	if err := profiles.load(credentialsFile, false); err != nil {
+		return nil, err
+	}
+
+	return profiles, nil
+}
+
+// load reads an INI file into the profiles. Sections of the config file
+// other than default are named "profile name". Missing files are skipped.
+func (profiles sharedProfiles) load(path string, isConfig bool) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var section map[string]string
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if isConfig && name != "default" {
+				if !strings.HasPrefix(name, "profile ") {
+					// sso-session and services sections
+					section = nil
+					continue
+				}
+				name = strings.TrimSpace(strings.TrimPrefix(name, "profile "))
+			}
+
+			if profiles[name] == nil {
+				profiles[name] = map[string]string{}
+			}
+			section = profiles[name]
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			// nested settings, eg. s3 =, come indented
+			if strings.HasPrefix(scanner.Text(), " ") || strings.HasPrefix(scanner.Text(), "\t") {
+				continue
+			}
+			return fmt.Errorf("%s:%d: expected name = value", path, n)
+		}
+		if section != nil {
+			section[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	return scanner.Err()
+}
+
+// provider returns the provider of profile name. seen guards against
+// source_profile loops.
+func (profiles sharedProfiles) provider(cfg config.Config, name string, seen map[string]bool) (credentialProvider, error) {
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("AWS profile %s not found in the shared credentials or config files", name)
+	}
+	if seen[name] {
+		return nil, fmt.Errorf("source_profiles of AWS profile %s loop", name)
+	}
+	seen[name] = true
+
+	static := func() (credentialProvider, error) {
+		if profile["aws_access_key_id"] == "" || profile["aws_secret_access_key"] == "" {
+			return nil, fmt.Errorf("AWS profile %s has no aws_access_key_id and aws_secret_access_key", name)
+		}
+		return staticCredentials{creds: awsCredentials{
+			AccessKey:    profile["aws_access_key_id"],
+			SecretKey:    profile["aws_secret_access_key"],
+			SessionToken: profile["aws_session_token"],
+		}, source: "profile " + name}, nil
+	}
+
+	roleARN := profile["role_arn"]
+	if roleARN == "" {
+		return static()
+	}
+
+	if tokenFile := profile["web_identity_token_file"]; tokenFile != "" {
+		return webIdentityCredentials{roleARN: roleARN, tokenFile: tokenFile, sessionName: profile["role_session_name"]}, nil
+	}
+
+	var source credentialProvider
+	var err error
+	switch sourceProfile, credentialSource := profile["source_profile"], profile["credential_source"]; {
+	case sourceProfile == name:
+		// the profile's own keys assume its role
+		source, err = static()
+	case sourceProfile != "":
+		source, err = profiles.provider(cfg, sourceProfile, seen)
+	case credentialSource == "Environment":
+		if cfg.AWS.AccessKeyID == "" || cfg.AWS.SecretAccessKey == "" {
+			return nil, fmt.Errorf("AWS profile %s takes its credentials from the environment, but AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY is missing", name)
+		}
+		source = environmentCredentials(cfg)
+	case credentialSource == "Ec2InstanceMetadata":
+		source = instanceCredentials{}
+	case credentialSource != "":
+		return nil, fmt.Errorf("AWS profile %s has an unsupported credential_source %s, expected Environment or Ec2InstanceMetadata", name, credentialSource)
+	default:
+		return nil, fmt.Errorf("AWS profile %s has a role_arn but no source_profile or credential_source", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	role := assumeRoleCredentials{
+		source:      newCredentialCache(source),
+		roleARN:     roleARN,
+		externalID:  profile["external_id"],
+		sessionName: profile["role_session_name"],
+	}
+	if duration := profile["duration_seconds"]; duration != "" {
+		seconds, err := strconv.Atoi(duration)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("AWS profile %s has an invalid duration_seconds %s", name, duration)
+		}
+		role.duration = time.Duration(seconds) * time.Second
+	}
+
+	return role, nil
+}
+
+// assumeRoleCredentials are those of a role assumed with the credentials of
+// source.
+type assumeRoleCredentials struct {
+	source      *credentialCache
+	roleARN     string
+	externalID  string
+	sessionName string
+	// zero for STS's default of an hour
+	duration time.Duration
+}
+
+func (p assumeRoleCredentials) retrieve() (awsCredentials, error) {
+	sourceCreds, err := p.source.get()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"RoleArn":         {p.roleARN},
+		"RoleSessionName": {roleSessionName(p.sessionName)},
+	}
+	if p.externalID != "" {
+		form.Set("ExternalId", p.externalID)
+	}
+	if p.duration > 0 {
+		form.Set("DurationSeconds", strconv.Itoa(int(p.duration.Seconds())))
+	}
+
+	return callSTS(form, &sourceCreds)
+}
+
+func (p assumeRoleCredentials) String() string {
+	return fmt.Sprintf("role %s assumed with %s", p.roleARN, p.source.provider)
+}
+
+// webIdentityCredentials are those of a role assumed with the OIDC token in
+// tokenFile, which is read again at each refresh as it's rotated.
+type webIdentityCredentials struct {
+	roleARN     string
+	tokenFile   string
+	sessionName string
+}
+
+func (p webIdentityCredentials) retrieve() (awsCredentials, error) {
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("reading web identity token: %v", err)
+	}
+
+	return callSTS(url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"RoleArn":          {p.roleARN},
+		"RoleSessionName":  {roleSessionName(p.sessionName)},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}, nil)
+}
+
+func (p webIdentityCredentials) String() string {
+	return fmt.Sprintf("role %s assumed with web identity %s", p.roleARN, p.tokenFile)
+}
+
+func roleSessionName(name string) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprintf("dogestry-%d", time.Now().UnixNano())
+}
+
+// stsResponse is the answer to both AssumeRole and
+// AssumeRoleWithWebIdentity, or an error.
+type stsResponse struct {
+	Results []struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		}
+	} `xml:",any"`
+	Error struct {
+		Code    string
+		Message string
+	}
+}
+
+// callSTS posts the STS action in form, signed with creds unless nil, and
+// returns the credentials it answers with. AWS_ENDPOINT_URL_STS overrides
+// the global endpoint.
+func callSTS(form url.Values, creds *awsCredentials) (awsCredentials, error) {
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_STS")
+	if endpoint == "" {
+		endpoint = defaultSTSEndpoint
+	}
+
+	form.Set("Version", stsVersion)
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	if creds != nil {
+		if creds.SessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+		}
+		aws.NewV4Signer(creds.auth(), "sts", aws.USEast).Sign(req)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("STS %s: %v", form.Get("Action"), err)
+	}
+	defer resp.Body.Close()
+
+	var result stsResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil && err != io.EOF {
+		return awsCredentials{}, fmt.Errorf("STS %s: %s, %v", form.Get("Action"), resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("STS %s of %s: %s %s", form.Get("Action"), form.Get("RoleArn"), result.Error.Code, result.Error.Message)
+	}
+
+	for _, r := range result.Results {
+		if c := r.Credentials; c.AccessKeyId != "" {
+			return awsCredentials{AccessKey: c.AccessKeyId, SecretKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expires: c.Expiration}, nil
+		}
+	}
+	return awsCredentials{}, fmt.Errorf("STS %s: no credentials in the response", form.Get("Action"))
+}
+
+// instanceCredentials are those of the EC2 instance's role, from the
+// instance metadata service. IMDSv2 is tried first, then v1.
+// AWS_EC2_METADATA_SERVICE_ENDPOINT overrides where the service is.
+type instanceCredentials struct{}
+
+func (p instanceCredentials) retrieve() (awsCredentials, error) {
+	if disabled, _ := strconv.ParseBool(os.Getenv("AWS_EC2_METADATA_DISABLED")); disabled {
+		return awsCredentials{}, errors.New("no AWS credentials found and the instance metadata service is disabled")
+	}
+
+	endpoint := strings.TrimSuffix(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+	if endpoint == "" {
+		endpoint = defaultIMDSEndpoint
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	token := ""
+	req, err := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	if resp, err := client.Do(req); err == nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			token = string(body)
+		}
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequest("GET", endpoint+"/latest/meta-data/iam/security-credentials/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("no AWS credentials found, and the instance metadata service can't be reached: %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("instance metadata service: %s", resp.Status)
+		}
+		return body, nil
+	}
+
+	roles, err := get("")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, errors.New("instance metadata service: the instance has no role")
+	}
+
+	body, err := get(role)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	var c struct {
+		Code            string
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(body, &c); err != nil {
+		return awsCredentials{}, fmt.Errorf("instance metadata service: %v", err)
+	}
+	if c.Code != "" && c.Code != "Success" {
+		return awsCredentials{}, fmt.Errorf("instance metadata service: credentials of %s: %s", role, c.Code)
+	}
+
+	return awsCredentials{AccessKey: c.AccessKeyId, SecretKey: c.SecretAccessKey, SessionToken: c.Token, Expires: c.Expiration}, nil
+}
+
+func (p instanceCredentials) String() string {
+	return "instance metadata"
+}
+
+// credentialCache holds the credentials of provider, and gets new ones
+// when they're about to expire so that long pushes and pulls outlive them.
+type credentialCache struct {
+	provider credentialProvider
+
+	mu      sync.Mutex
+	current awsCredentials
+}
+
+func newCredentialCache(provider credentialProvider) *credentialCache {
+	return &credentialCache{provider: provider}
+}
+
+// get returns credentials valid for a while yet. If refreshing fails, the
+// current ones are kept as long as they are valid.
+func (c *credentialCache) get() (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.current.AccessKey != "" && (c.current.Expires.IsZero() || time.Until(c.current.Expires) > credentialsRefreshWindow) {
+		return c.current, nil
+	}
+
+	creds, err := c.provider.retrieve()
+	if err != nil {
+		if c.current.AccessKey != "" && time.Now().Before(c.current.Expires) {
+			log.Printf("refreshing AWS credentials from %s: %v, using the current ones until %s", c.provider, err, c.current.Expires.Format(time.RFC3339))
+			return c.current, nil
+		}
+		return awsCredentials{}, err
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials from %s", c.provider)
+	}
+
+	c.current = creds
+	return creds, nil
+}
+
+// sign returns credentials to sign a request with. Errors were reported
+// when the remote was created; should refreshing fail later, the request
+// goes out with the last credentials and AWS answers why.
+func (c *credentialCache) sign() awsCredentials {
+	creds, err := c.get()
+	if err != nil {
+		log.Printf("refreshing AWS credentials from %s: %v", c.provider, err)
+		c.mu.Lock()
+		creds = c.current
+		c.mu.Unlock()
+	}
+	return creds
+}
+
+// s3gof3rSigner signs s3gof3r's requests again with the current
+// credentials, as s3gof3r keeps the keys it was created with.
+type s3gof3rSigner struct {
+	base   http.RoundTripper
+	remote *S3Remote
+}
+
+func (t s3gof3rSigner) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.remote.credentials == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	s3 := &s3gof3r.S3{Domain: t.remote.endpoint.domain, Keys: t.remote.credentials.sign().keys()}
+
+	signed := req.Clone(req.Context())
+	signed.Header.Del("X-Amz-Security-Token")
+	signed.Header.Del("Date")
+	s3.Bucket(t.remote.BucketName).Sign(signed)
+	return t.base.RoundTrip(signed)
+}
@@ -0,0 +1,396 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dogestry/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type AWSCredentialsSuite struct {
+	dir string
+	env map[string]string
+	// form and headers of the last STS call
+	stsForm    url.Values
+	stsHeaders http.Header
+	sts        *httptest.Server
+}
+
+var _ = Suite(&AWSCredentialsSuite{})
+
+var credentialsEnv = []string{
+	"AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE", "AWS_ENDPOINT_URL_STS",
+	"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_ROLE_SESSION_NAME",
+	"AWS_EC2_METADATA_SERVICE_ENDPOINT", "AWS_EC2_METADATA_DISABLED",
+}
+
+func (s *AWSCredentialsSuite) SetUpTest(c *C) {
+	s.env = map[string]string{}
+	for _, name := range credentialsEnv {
+		s.env[name] = os.Getenv(name)
+		os.Unsetenv(name)
+	}
+
+	s.dir = c.MkDir()
+	os.Setenv("AWS_CONFIG_FILE", filepath.Join(s.dir, "config"))
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(s.dir, "credentials"))
+
+	s.sts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.stsForm, s.stsHeaders = r.PostForm, r.Header
+
+		if r.PostForm.Get("RoleArn") == "arn:aws:iam::123:role/denied" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>not allowed</Message></Error></ErrorResponse>`)
+			return
+		}
+
+		action := r.PostForm.Get("Action")
+		fmt.Fprintf(w, `<%sResponse><%sResult><Credentials>
+			<AccessKeyId>rolekey</AccessKeyId><SecretAccessKey>rolesecret</SecretAccessKey>
+			<SessionToken>roletoken</SessionToken><Expiration>2030-01-02T03:04:05Z</Expiration>
+			</Credentials></%sResult></%sResponse>`, action, action, action, action)
+	}))
+	os.Setenv("AWS_ENDPOINT_URL_STS", s.sts.URL)
+}
+
+func (s *AWSCredentialsSuite) TearDownTest(c *C) {
+	s.sts.Close()
+	for name, value := range s.env {
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+func (s *AWSCredentialsSuite) writeFile(c *C, name, content string) string {
+	path := filepath.Join(s.dir, name)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0600), IsNil)
+	return path
+}
+
+func (s *AWSCredentialsSuite) writeProfiles(c *C) {
+	s.writeFile(c, "credentials", `
+[default]
+aws_access_key_id = defaultkey
+aws_secret_access_key = defaultsecret
+
+[dev]
+aws_access_key_id = devkey
+aws_secret_access_key = devsecret
+aws_session_token = devtoken
+`)
+	s.writeFile(c, "config", `
+[default]
+region = us-east-1
+
+[profile dev]
+s3 =
+  max_concurrent_requests = 20
+
+[profile ops]
+role_arn = arn:aws:iam::123:role/ops
+source_profile = dev
+external_id = shared-secret
+role_session_name = ci
+duration_seconds = 900
+
+[profile env]
+role_arn = arn:aws:iam::123:role/env
+credential_source = Environment
+
+[profile denied]
+role_arn = arn:aws:iam::123:role/denied
+source_profile = dev
+
+[profile loop-a]
+role_arn = arn:aws:iam::123:role/a
+source_profile = loop-b
+
+[profile loop-b]
+role_arn = arn:aws:iam::123:role/b
+source_profile = loop-a
+
+[profile orphan]
+role_arn = arn:aws:iam::123:role/orphan
+
+[sso-session corp]
+sso_region = us-east-1
+`)
+}
+
+func retrieve(c *C, cfg config.Config) (awsCredentials, error) {
+	provider, err := newCredentialProvider(cfg)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	return provider.retrieve()
+}
+
+func (s *AWSCredentialsSuite) TestEnvironment(c *C) {
+	s.writeProfiles(c)
+
+	cfg := config.Config{}
+	cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey, cfg.AWS.SessionToken = "abc", "123", "token"
+
+	// keys in the environment win over the default profile
+	creds, err := retrieve(c, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(creds, DeepEquals, awsCredentials{AccessKey: "abc", SecretKey: "123", SessionToken: "token"})
+
+	// but not over a profile asked for
+	cfg.AWS.Profile = "dev"
+	creds, err = retrieve(c, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(creds.AccessKey, Equals, "devkey")
+}
+
+func (s *AWSCredentialsSuite) TestProfiles(c *C) {
+	s.writeProfiles(c)
+
+	creds, err := retrieve(c, config.Config{})
+	c.Assert(err, IsNil)
+	c.Assert(creds, DeepEquals, awsCredentials{AccessKey: "defaultkey", SecretKey: "defaultsecret"})
+
+	cfg := config.Config{}
+	cfg.AWS.Profile = "dev"
+	creds, err = retrieve(c, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(creds, DeepEquals, awsCredentials{AccessKey: "devkey", SecretKey: "devsecret", SessionToken: "devtoken"})
+
+	for profile, expected := range map[string]string{
+		"missing": "AWS profile missing not found in the shared credentials or config files",
+		"loop-a":  "source_profiles of AWS profile loop-a loop",
+		"orphan":  "AWS profile orphan has a role_arn but no source_profile or credential_source",
+		"env":     "AWS profile env takes its credentials from the environment, .*",
+		"denied":  "STS AssumeRole of arn:aws:iam::123:role/denied: AccessDenied not allowed",
+	} {
+		cfg.AWS.Profile = profile
+		_, err = retrieve(c, cfg)
+		c.Assert(err, ErrorMatches, expected, Commentf(profile))
+	}
+}
+
+func (s *AWSCredentialsSuite) TestAssumeRole(c *C) {
+	s.writeProfiles(c)
+
+	cfg := config.Config{}
+	cfg.AWS.Profile = "ops"
+	creds, err := retrieve(c, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(creds, DeepEquals, awsCredentials{
+		AccessKey:    "rolekey",
+		SecretKey:    "rolesecret",
+		SessionToken: "roletoken",
+		Expires:      time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+
+	c.Assert(s.stsForm, DeepEquals, url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {"arn:aws:iam::123:role/ops"},
+		"RoleSessionName": {"ci"},
+		"ExternalId":      {"shared-secret"},
+		"DurationSeconds": {"900"},
+	})
+
+	// signed with the source profile's temporary keys
+	c.Assert(s.stsHeaders.Get("Authorization"), Matches, "AWS4-HMAC-SHA256 Credential=devkey/.*/us-east-1/sts/aws4_request, .*")
+	c.Assert(s.stsHeaders.Get("X-Amz-Security-Token"), Equals, "devtoken")
+
+	// the environment's keys can assume a role too
+	cfg.AWS.Profile = "env"
+	cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey = "abc", "123"
+	creds, err = retrieve(c, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(creds.AccessKey, Equals, "rolekey")
+	c.Assert(s.stsForm.Get("RoleArn"), Equals, "arn:aws:iam::123:role/env")
+	c.Assert(s.stsHeaders.Get("Authorization"), Matches, "AWS4-HMAC-SHA256 Credential=abc/.*")
+	c.Assert(s.stsHeaders.Get("X-Amz-Security-Token"), Equals, "")
+}
+
+func (s *AWSCredentialsSuite) TestWebIdentity(c *C) {
+	s.writeProfiles(c)
+	token := s.writeFile(c, "token", "oidc-token\n")
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", token)
+	os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123:role/pod")
+
+	creds, err := retrieve(c, config.Config{})
+	c.Assert(err, IsNil)
+	c.Assert(creds.AccessKey, Equals, "rolekey")
+	c.Assert(creds.SessionToken, Equals, "roletoken")
+
+	c.Assert(s.stsForm.Get("Action"), Equals, "AssumeRoleWithWebIdentity")
+	c.Assert(s.stsForm.Get("RoleArn"), Equals, "arn:aws:iam::123:role/pod")
+	c.Assert(s.stsForm.Get("WebIdentityToken"), Equals, "oidc-token")
+	c.Assert(s.stsForm.Get("RoleSessionName"), Matches, "dogestry-[0-9]+")
+	c.Assert(s.stsHeaders.Get("Authorization"), Equals, "")
+
+	// and from a profile
+	os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	s.writeFile(c, "config", "[profile pod]\nrole_arn = arn:aws:iam::123:role/profile-pod\nweb_identity_token_file = "+token+"\n")
+	cfg := config.Config{}
+	cfg.AWS.Profile = "pod"
+	_, err = retrieve(c, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(s.stsForm.Get("RoleArn"), Equals, "arn:aws:iam::123:role/profile-pod")
+}
+
+// fakeIMDS serves the credentials of role web, with IMDSv2 tokens unless
+// v1Only.
+func fakeIMDS(v1Only bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if v1Only || r.Method != "PUT" || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, "imds-token")
+			return
+		}
+
+		if !v1Only && r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "web\n")
+		case "/latest/meta-data/iam/security-credentials/web":
+			fmt.Fprint(w, `{"Code": "Success", "AccessKeyId": "instancekey", "SecretAccessKey": "instancesecret",
+				"Token": "instancetoken", "Expiration": "2030-01-02T03:04:05Z"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func (s *AWSCredentialsSuite) TestInstanceMetadata(c *C) {
+	expected := awsCredentials{
+		AccessKey:    "instancekey",
+		SecretKey:    "instancesecret",
+		SessionToken: "instancetoken",
+		Expires:      time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	for _, v1Only := range []bool{false, true} {
+		imds := fakeIMDS(v1Only)
+		os.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", imds.URL)
+
+		// without anything else, and whatever else with -use-metaservice
+		creds, err := retrieve(c, config.Config{})
+		c.Assert(err, IsNil)
+		c.Assert(creds, DeepEquals, expected)
+
+		cfg := config.Config{}
+		cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey, cfg.AWS.UseMetaService = "abc", "123", true
+		creds, err = retrieve(c, cfg)
+		c.Assert(err, IsNil)
+		c.Assert(creds, DeepEquals, expected)
+
+		imds.Close()
+	}
+
+	os.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	_, err := retrieve(c, config.Config{})
+	c.Assert(err, ErrorMatches, "no AWS credentials found and the instance metadata service is disabled")
+}
+
+// countingProvider hands out new credentials at each call, valid for ttl.
+type countingProvider struct {
+	calls int
+	ttl   time.Duration
+	fail  bool
+}
+
+func (p *countingProvider) retrieve() (awsCredentials, error) {
+	if p.fail {
+		return awsCredentials{}, errors.New("STS is down")
+	}
+	p.calls++
+	return awsCredentials{
+		AccessKey:    fmt.Sprintf("key-%d", p.calls),
+		SecretKey:    "secret",
+		SessionToken: fmt.Sprintf("token-%d", p.calls),
+		Expires:      time.Now().Add(p.ttl),
+	}, nil
+}
+
+func (p *countingProvider) String() string {
+	return "counting"
+}
+
+func (s *AWSCredentialsSuite) TestRefresh(c *C) {
+	provider := &countingProvider{ttl: time.Hour}
+	cache := newCredentialCache(provider)
+
+	for i := 0; i < 3; i++ {
+		creds, err := cache.get()
+		c.Assert(err, IsNil)
+		c.Assert(creds.AccessKey, Equals, "key-1")
+	}
+
+	// about to expire
+	provider.ttl = time.Minute
+	cache.current.Expires = time.Now().Add(time.Minute)
+	creds, err := cache.get()
+	c.Assert(err, IsNil)
+	c.Assert(creds.AccessKey, Equals, "key-2")
+	creds, err = cache.get()
+	c.Assert(err, IsNil)
+	c.Assert(creds.AccessKey, Equals, "key-3")
+
+	// credentials still valid are kept when refreshing fails
+	provider.fail = true
+	creds, err = cache.get()
+	c.Assert(err, IsNil)
+	c.Assert(creds.AccessKey, Equals, "key-3")
+
+	cache.current.Expires = time.Now().Add(-time.Second)
+	_, err = cache.get()
+	c.Assert(err, ErrorMatches, "STS is down")
+}
+
+func (s *AWSCredentialsSuite) TestRefreshDuringTransfers(c *C) {
+	fake, _, imageRoot := setUpLayoutRemote(c, 3)
+	defer fake.Close()
+
+	cfg := config.Config{}
+	cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey = "abc", "123"
+	c.Assert(cfg.SetS3URL("s3://bucket/?pathstyle=true&endpoint="+url.QueryEscape(fake.server.URL)), IsNil)
+
+	remote, err := NewS3Remote(cfg)
+	c.Assert(err, IsNil)
+
+	// credentials that need refreshing at every request
+	provider := &countingProvider{ttl: time.Minute}
+	remote.credentials = newCredentialCache(provider)
+
+	ctx := context.Background()
+	c.Assert(remote.Push(ctx, "app:latest", imageRoot), IsNil)
+	dst := filepath.Join(c.MkDir(), pushImageId)
+	c.Assert(remote.PullImageId(ctx, pushImageId, dst), IsNil)
+
+	// goamz, presigned and s3gof3r requests alike
+	seen := map[string]bool{}
+	for i, token := range fake.tokens {
+		c.Assert(strings.HasPrefix(token, "token-"), Equals, true, Commentf("%s without fresh credentials", fake.requests[i]))
+		c.Assert(seen[token], Equals, false, Commentf("%s with used credentials", fake.requests[i]))
+		seen[token] = true
+	}
+	c.Assert(len(seen) > 5, Equals, true)
+}
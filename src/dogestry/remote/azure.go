@@ -1,113 +1,133 @@
 package remote
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"dogestry/config"
+	"dogestry/storage"
+	"dogestry/utils"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
-	"github.com/MSOpenTech/azure-sdk-for-go/storage"
-	"dogestry/config"
-	"dogestry/utils"
 	docker "github.com/fsouza/go-dockerclient"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 func NewAzureRemote(config config.Config) (*AzureRemote, error) {
-	return &AzureRemote{config: config}, nil
+	envelope, err := newEnvelope(config.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureRemote{config: config, retry: newRetryPolicy(config), envelope: envelope}, nil
 }
 
 type AzureRemote struct {
-	config config.Config
+	config            config.Config
+	retry             RetryPolicy
+	journal           *Journal
+	expectedID        ID
+	overrideImmutable bool
+	// nil unless objects are encrypted
+	envelope *envelope
 }
 
-func (remote *AzureRemote) Push(image, imageRoot string) error {
-	var err error
+func (remote *AzureRemote) Push(ctx context.Context, image, imageRoot string) error {
+	u := objectUploader{
+		store:             remote,
+		put:               remote.putFile,
+		config:            remote.config,
+		name:              "Azure",
+		expectedID:        remote.expectedID,
+		overrideImmutable: remote.overrideImmutable,
+		envelope:          remote.envelope,
+	}
+	return u.pushImage(ctx, imageRoot)
+}
 
-	keysToPush, err := remote.localKeys(imageRoot)
+// pull a single image from the remote
+func (remote *AzureRemote) PullImageId(ctx context.Context, id ID, dst string) error {
+	rootKey := "images/" + string(id)
+	imageKeys, err := remote.repoKeys(ctx, "/"+rootKey)
 	if err != nil {
-		return fmt.Errorf("error calculating keys to push: %v", err)
-	}
-
-	if len(keysToPush) == 0 {
-		log.Println("There are no files to push")
-		return nil
+		return err
 	}
 
-	type putFileResult struct {
-		host string
-		err  error
+	if err := remote.getFiles(ctx, dst, rootKey, imageKeys); err != nil {
+		return err
 	}
 
-	putFileErrChan := make(chan putFileResult)
-	putFilesChan := remote.makeAzFilesChan(keysToPush)
-
-	defer close(putFileErrChan)
+	return remote.getLayerBlob(ctx, dst)
+}
 
-	numGoroutines := 25
-	goroutineQuitChans := make([]chan bool, numGoroutines)
-	for i := 0; i < numGoroutines; i++ {
-		goroutineQuitChans[i] = make(chan bool)
+// getLayerBlob downloads the layer of an image pulled to dst from its blob,
+// if the image has one.
+func (remote *AzureRemote) getLayerBlob(ctx context.Context, dst string) error {
+	digest, ok, err := pulledLayerDigest(dst)
+	if err != nil || !ok {
+		return err
 	}
 
-	println("Pushing files to Azure remote:")
-	for i := 0; i < numGoroutines; i++ {
-		go func(i int) {
-			select {
-			case <-goroutineQuitChans[i]:
-				return
-			default:
-				for putFile := range putFilesChan {
-					putFileErr := remote.putFile(putFile.KeyDef.fullPath, &putFile.KeyDef)
-
-					if (putFileErr != nil) && ((putFileErr != io.EOF) && (!strings.Contains(putFileErr.Error(), "EOF"))) {
-						putFileErrChan <- putFileResult{putFile.Key, putFileErr}
-						return
-					}
-
-					putFileErrChan <- putFileResult{}
-				}
-			}
-		}(i)
+	key := blobKey(digest)
+	blobKeys, err := remote.repoKeys(ctx, key)
+	if err != nil {
+		return err
 	}
 
-	for i := 0; i < len(keysToPush); i++ {
-		p := <-putFileErrChan
-		if p.err != nil {
-			// Close all running goroutines
-			for i := 0; i < numGoroutines; i++ {
-				select {
-				case goroutineQuitChans[i] <- true:
-				default:
-				}
-			}
-
-			log.Printf("error when uploading to Azure: %v", p.err)
-			return fmt.Errorf("Error when uploading to Azure: %v", p.err)
+	// the blob's codec is in its key, repoKeys names keys by blob,
+	// including the path of the remote
+	var keyDef *azKeyDef
+	var codec *Codec
+	for _, c := range codecs {
+		if k, ok := blobKeys[remote.blobPath(key+c.Ext)]; ok {
+			keyDef, codec = k, c
+			break
 		}
 	}
+	if keyDef == nil {
+		return fmt.Errorf("layer blob %s is missing from the remote", digest)
+	}
 
-	return nil
-}
+	if remote.journal == nil {
+		svc, err := remote.azureBlobClient()
+		if err != nil {
+			return err
+		}
 
-// pull a single image from the remote
-func (remote *AzureRemote) PullImageId(id ID, dst string) error {
-	rootKey := "images/" + string(id)
-	imageKeys, err := remote.repoKeys("/" + rootKey)
+		object := objectInfo{Key: remote.objectKey(keyDef.remotePath), Size: keyDef.size}
+		return streamBlobPull(ctx, remote.retry, remote.envelope, dst, digest, codec, object, func() (io.ReadCloser, error) {
+			return svc.GetBlob(remote.config.Azure.Blob.Container, keyDef.remotePath)
+		})
+	}
+
+	// a resumed download needs the blob as it's stored on disk
+	layer := filepath.Join(dst, "layer.tar"+codec.Ext)
+	err = remote.retry.Do(ctx, "download "+keyDef.key, func() error {
+		return remote.getFile(ctx, layer, keyDef)
+	})
 	if err != nil {
 		return err
 	}
 
-	return remote.getFiles(dst, rootKey, imageKeys)
+	if err := remote.envelope.openFile(remote.objectKey(keyDef.remotePath), layer); err != nil {
+		return err
+	}
+
+	return finishBlobPull(dst, digest, codec)
 }
 
 // map repo:tag to id (like git rev-parse)
-func (remote *AzureRemote) ParseTag(repo, tag string) (ID, error) {
+func (remote *AzureRemote) ParseTag(ctx context.Context, repo, tag string) (ID, error) {
 	svc, err := remote.azureBlobClient()
 	if err != nil {
 		return "", err
@@ -115,14 +135,18 @@ func (remote *AzureRemote) ParseTag(repo, tag string) (ID, error) {
 
 	path := remote.tagFilePath(repo, tag)
 
-	exists, err := svc.BlobExists(remote.config.Azure.Blob.Container, path)
+	var exists bool
+	err = remote.retry.Do(ctx, "check tag "+repo+":"+tag, func() (err error) {
+		exists, err = svc.BlobExists(remote.config.Azure.Blob.Container, path)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 
 	if exists {
 		// Read the ID from the blob
-		s, err := remote.getAsString(svc, remote.config.Azure.Blob.Container, path)
+		s, err := remote.getAsString(ctx, svc, remote.config.Azure.Blob.Container, path)
 		if err != nil && err != io.EOF {
 			return "", err
 		}
@@ -134,12 +158,16 @@ func (remote *AzureRemote) ParseTag(repo, tag string) (ID, error) {
 }
 
 // map a ref-like to id. "ref-like" could be a ref or an id.
-func (remote *AzureRemote) ResolveImageNameToId(image string) (ID, error) {
-	return ResolveImageNameToId(remote, image)
+func (remote *AzureRemote) ResolveImageNameToId(ctx context.Context, image string) (ID, error) {
+	return ResolveImageNameToId(ctx, remote, image)
 }
 
-func (remote *AzureRemote) ImageFullId(id ID) (ID, error) {
-	remoteKeys, err := remote.repoKeys("/images")
+func (remote *AzureRemote) ImageFullId(ctx context.Context, id ID) (ID, error) {
+	if fullID, ok := catalogFullID(ctx, remote, id); ok {
+		return fullID, nil
+	}
+
+	remoteKeys, err := remote.repoKeys(ctx, "/images")
 	if err != nil {
 		return "", err
 	}
@@ -156,7 +184,7 @@ func (remote *AzureRemote) ImageFullId(id ID) (ID, error) {
 }
 
 // Download the json file at images/{id}/json
-func (remote *AzureRemote) ImageMetadata(id ID) (docker.Image, error) {
+func (remote *AzureRemote) ImageMetadata(ctx context.Context, id ID) (docker.Image, error) {
 	blob := remote.config.Azure.Blob
 
 	path := filepath.Join("images", string(id), "json")
@@ -172,7 +200,7 @@ func (remote *AzureRemote) ImageMetadata(id ID) (docker.Image, error) {
 		return image, err
 	}
 
-	s, err := remote.getAsString(svc, blob.Container, path)
+	s, err := remote.getAsString(ctx, svc, blob.Container, path)
 	if err != nil {
 		return image, err
 	}
@@ -198,29 +226,84 @@ func (remote *AzureRemote) ParseImagePath(path string, prefix string) (repo, tag
 }
 
 // walk the image history on the remote, starting at id
-func (remote *AzureRemote) WalkImages(id ID, walker ImageWalkFn) error {
-	return WalkImages(remote, id, walker)
+func (remote *AzureRemote) WalkImages(ctx context.Context, id ID, walker ImageWalkFn) error {
+	return WalkImages(ctx, remote, id, walker)
 }
 
 // checks the config and connectivity of the remote
-func (remote *AzureRemote) Validate() error {
+func (remote *AzureRemote) Validate(ctx context.Context) error {
 	_, err := remote.azureBlobClient()
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if err := checkLayout(ctx, remote); err != nil {
+		return err
+	}
+
+	return checkEncryption(ctx, remote, remote.envelope)
+}
+
+// record transfer progress in journal
+func (remote *AzureRemote) SetJournal(journal *Journal) {
+	remote.journal = journal
 }
 
 // describe the remote
+func (remote *AzureRemote) SetExpectedID(id ID) {
+	remote.expectedID = id
+}
+
+func (remote *AzureRemote) SetOverrideImmutable(override bool) {
+	remote.overrideImmutable = override
+}
+
+func (remote *AzureRemote) Policy(ctx context.Context) (Policy, error) {
+	return readPolicy(ctx, remote)
+}
+
+func (remote *AzureRemote) SetTag(ctx context.Context, repo, tag string, id ID) error {
+	return setTag(ctx, remote, repo, tag, id, remote.expectedID, remote.overrideImmutable)
+}
+
+func (remote *AzureRemote) TagHistory(ctx context.Context, repo, tag string) ([]TagHistoryEntry, error) {
+	history, _, err := readTagHistory(ctx, remote, repo, tag)
+	return history, err
+}
+
+func (remote *AzureRemote) PutTagMetadata(ctx context.Context, meta TagMetadata) error {
+	return putTagMetadata(ctx, remote, meta)
+}
+
+func (remote *AzureRemote) TagMetadata(ctx context.Context, repo, tag string) (TagMetadata, error) {
+	return readTagMetadata(ctx, remote, repo, tag)
+}
+
+func (remote *AzureRemote) Reindex(ctx context.Context) (*Catalog, error) {
+	return reindex(ctx, remote)
+}
+
+func (remote *AzureRemote) Layout(ctx context.Context) (Layout, error) {
+	layout, _, err := readLayout(ctx, remote)
+	return layout, err
+}
+
+func (remote *AzureRemote) Migrate(ctx context.Context, to int) error {
+	return migrate(ctx, remote, to)
+}
+
 func (remote *AzureRemote) Desc() string {
 	return fmt.Sprintf("Azure blob storage(%s)", remote.config.Azure.Blob.String())
 }
 
 // List images on the remote
-func (remote *AzureRemote) List() (images []Image, err error) {
-	keys, err := remote.repoKeys("repositories")
+func (remote *AzureRemote) List(ctx context.Context) (images []Image, err error) {
+	if images, ok := listCatalog(ctx, remote); ok {
+		return images, nil
+	}
+
+	keys, err := remote.repoKeys(ctx, "repositories")
 
 	if err != nil {
 		return nil, err
@@ -248,6 +331,8 @@ type azKeyDef struct {
 	fullPath string
 
 	remotePath string
+	size       int64
+	etag       string
 
 	remote *AzureRemote
 }
@@ -267,29 +352,8 @@ func (k azKeys) Get(key string, remote *AzureRemote) *azKeyDef {
 	return k[key]
 }
 
-type azPutFileTuple struct {
-	Key    string
-	KeyDef azKeyDef
-}
-
-func (remote *AzureRemote) makeAzFilesChan(keysToPush azKeys) <-chan azPutFileTuple {
-	putFilesChan := make(chan azPutFileTuple, len(keysToPush))
-	go func() {
-		defer close(putFilesChan)
-		for key, localKey := range keysToPush {
-			keyDefClone := *localKey
-			putFilesChan <- azPutFileTuple{key, keyDefClone}
-		}
-	}()
-	return putFilesChan
-}
-
 func (remote *AzureRemote) azureBlobClient() (*storage.BlobStorageClient, error) {
-	acctName := remote.config.Azure.AccountName
-	acctKey := remote.config.Azure.AccountKey
-
-	client, err := storage.NewBasicClient(acctName, acctKey)
-
+	client, err := newAzureClient(remote.config)
 	if err != nil {
 		return nil, err
 	}
@@ -299,71 +363,72 @@ func (remote *AzureRemote) azureBlobClient() (*storage.BlobStorageClient, error)
 	return &svc, nil
 }
 
-func (remote *AzureRemote) getAsString(service *storage.BlobStorageClient, container, path string) (string, error) {
-	f, err := service.GetBlob(container, path)
-	if err != nil {
-		return "", err
-	}
-
-	defer f.Close()
+// newAzureClient returns a client for the account of cfg: authorized by its
+// key or a SAS token, in the public or another cloud, or at a blob endpoint
+// of its own such as Azurite's.
+func newAzureClient(cfg config.Config) (storage.Client, error) {
+	az := cfg.Azure
 
-	buf := bufio.NewReader(f)
-
-	// Read until null terminator
-	b, err := buf.ReadBytes(0)
-	if err != nil && err != io.EOF {
-		return "", err
+	suffix := az.EndpointSuffix
+	if suffix == "" {
+		suffix = storage.DefaultBaseURL
 	}
+	useHTTPS := az.Protocol != "http"
 
-	if err == io.EOF {
-		return string(b), nil
+	var client storage.Client
+	var err error
+	if az.AccountKey != "" {
+		client, err = storage.NewClient(az.AccountName, az.AccountKey, suffix, storage.DefaultAPIVersion, useHTTPS)
+	} else {
+		client, err = storage.NewSASClient(az.AccountName, az.SASToken, suffix, storage.DefaultAPIVersion, useHTTPS)
 	}
-
-	// Don't return the null terminator
-	return string(b[:len(b)-1]), nil
-}
-
-// Get repository keys from the local work dir.
-// Returned as a map of azKeyDef's for ease of comparison.
-func (remote *AzureRemote) localKeys(root string) (azKeys, error) {
-	localKeys := make(azKeys)
-
-	if root[len(root)-1] != '/' {
-		root = root + "/"
+	if err != nil {
+		return client, err
 	}
 
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
+	if az.BlobEndpoint != "" {
+		return client.WithBlobEndpoint(az.BlobEndpoint)
+	}
+	return client, nil
+}
 
-		sum, err := utils.Sha1File(path)
+func (remote *AzureRemote) getAsString(ctx context.Context, service *storage.BlobStorageClient, container, path string) (string, error) {
+	var b []byte
+	err := remote.retry.Do(ctx, "get "+path, func() error {
+		f, err := service.GetBlob(container, path)
 		if err != nil {
 			return err
 		}
 
-		key := strings.TrimPrefix(path, root)
-
-		// note that we pre-populate the sum here
-		localKeys[key] = &azKeyDef{
-			key:      key,
-			sum:      sum,
-			fullPath: path,
-		}
+		defer f.Close()
 
-		return nil
+		b, err = ioutil.ReadAll(f)
+		return err
 	})
-
 	if err != nil {
-		return localKeys, err
+		return "", err
+	}
+
+	if bytes.HasPrefix(b, []byte(envelopeMagic)) {
+		b, err = remote.envelope.open(remote.objectKey(path), b)
+		return string(b), err
+	}
+	if err := remote.envelope.checkClear(remote.objectKey(path)); err != nil {
+		return "", err
 	}
 
-	return localKeys, nil
+	// Don't return the null terminator, or anything after it
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+
+	return string(b), nil
 }
 
 // put a file with key from imageRoot to the s3 bucket
-func (remote *AzureRemote) putFile(src string, key *azKeyDef) error {
+func (remote *AzureRemote) putFile(ctx context.Context, key *uploadKeyDef) error {
 	dstKey := key.key
+	src := key.fullPath
 
 	blob := remote.config.Azure.Blob
 
@@ -371,6 +436,12 @@ func (remote *AzureRemote) putFile(src string, key *azKeyDef) error {
 		dstKey = fmt.Sprintf("%s/%s", blob.Path, dstKey)
 	}
 
+	state := remote.journal.Upload(dstKey, key.sum)
+	if state.Done {
+		log.Printf("Key %s already uploaded", dstKey)
+		return nil
+	}
+
 	f, err := os.Open(src)
 	if err != nil {
 		return err
@@ -383,63 +454,338 @@ func (remote *AzureRemote) putFile(src string, key *azKeyDef) error {
 		return err
 	}
 
+	uploaded, err := remote.uploadedBlocks(ctx, service, blob, dstKey, state)
+	if err != nil {
+		return err
+	}
+
 	// Create the block, if it doesn't exist
 	// Copy to Azure Blob Storage
-	blocks, err := remote.putAzureBlocks(service, f, blob, dstKey)
+	blocks, err := remote.putAzureBlocks(ctx, service, f, blob, dstKey, uploaded, func(blockId string) error {
+		state.Blocks = append(state.Blocks, blockId)
+		return remote.journal.SetUpload(dstKey, state)
+	})
 	if err != nil {
 		return err
 	}
 
 	if len(blocks) > 0 {
-		err = service.PutBlockList(blob.Container, dstKey, blocks)
+		err = remote.retry.Do(ctx, "commit blocks of "+dstKey, func() error {
+			return service.PutBlockList(blob.Container, dstKey, blocks)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return remote.journal.SetUpload(dstKey, UploadState{Sum: key.sum, Done: true})
 }
 
-const maxBlockSize int64 = 4000000
+func (remote *AzureRemote) statObject(ctx context.Context, key string) (objectInfo, error) {
+	svc, err := remote.azureBlobClient()
+	if err != nil {
+		return objectInfo{}, err
+	}
 
-func (remote *AzureRemote) putAzureBlocks(svc *storage.BlobStorageClient, f *os.File, blob *config.BlobSpec, dst string) ([]storage.Block, error) {
-	arr := make([]byte, maxBlockSize)
+	container := remote.config.Azure.Blob.Container
+	path := remote.blobPath(key)
 
-	firstId, nBlocks := remote.firstBlockId(f)
-	id := firstId
-	blocks := make([]storage.Block, nBlocks)
+	var exists bool
+	err = remote.retry.Do(ctx, "check "+path, func() (err error) {
+		exists, err = svc.BlobExists(container, path)
+		return err
+	})
+	if err != nil {
+		return objectInfo{}, err
+	} else if !exists {
+		return objectInfo{}, errObjectNotFound
+	}
+
+	var props *storage.BlobProperties
+	err = remote.retry.Do(ctx, "get properties of "+path, func() (err error) {
+		props, err = svc.GetBlobProperties(container, path)
+		return err
+	})
+	if err != nil {
+		return objectInfo{}, err
+	}
+
+	return objectInfo{Key: key, Size: props.ContentLength, ETag: props.Etag}, nil
+}
+
+func (remote *AzureRemote) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	if _, err := remote.statObject(ctx, key); err != nil {
+		return nil, err
+	}
+
+	svc, err := remote.azureBlobClient()
+	if err != nil {
+		return nil, err
+	}
+
+	path := remote.blobPath(key)
 
-	var err error = nil
+	var rc io.ReadCloser
+	err = remote.retry.Do(ctx, "get "+path, func() (err error) {
+		rc, err = svc.GetBlob(remote.config.Azure.Blob.Container, path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	for n, e := f.Read(arr); n > 0 && (e == nil || e == io.EOF); n, e = f.Read(arr) {
-		strId := base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+	return remote.envelope.openReader(key, rc)
+}
 
-		putErr := svc.PutBlock(blob.Container, dst, strId, arr[:n])
+// copyObject copies within the storage account, which Azure authorises with
+// our shared key.
+func (remote *AzureRemote) copyObject(ctx context.Context, src, dst string) error {
+	svc, err := remote.azureBlobClient()
+	if err != nil {
+		return err
+	}
+
+	container := remote.config.Azure.Blob.Container
+	srcURL := svc.GetBlobURL(container, remote.blobPath(src))
+	dstPath := remote.blobPath(dst)
+
+	return remote.retry.Do(ctx, "copy "+src+" to "+dstPath, func() error {
+		return svc.CopyBlob(container, dstPath, srcURL)
+	})
+}
+
+func (remote *AzureRemote) deleteObject(ctx context.Context, key string) error {
+	svc, err := remote.azureBlobClient()
+	if err != nil {
+		return err
+	}
+
+	path := remote.blobPath(key)
+
+	return remote.retry.Do(ctx, "delete "+path, func() error {
+		_, err := svc.DeleteBlobIfExists(remote.config.Azure.Blob.Container, path)
+		return err
+	})
+}
+
+// blobPath returns the blob name of key, relative to the remote root.
+func (remote *AzureRemote) blobPath(key string) string {
+	if remote.config.Azure.Blob.PathPresent {
+		return remote.config.Azure.Blob.Path + "/" + key
+	}
+	return key
+}
+
+// objectKey is the key of the blob at path, as blobPath names it.
+func (remote *AzureRemote) objectKey(path string) string {
+	return strings.TrimPrefix(path, remote.blobPath(""))
+}
+
+func (remote *AzureRemote) getObject(ctx context.Context, key string) ([]byte, string, error) {
+	info, err := remote.statObject(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	svc, err := remote.azureBlobClient()
+	if err != nil {
+		return nil, "", err
+	}
 
-		if putErr != nil {
-			// We could re-try the block under certain conditions
-			// Note that, because we haven't committed any blocks,
-			// we don't have to worry about partial uploads
-			return nil, putErr
+	// read after the ETag: if the blob changes in between, conditional
+	// writes fail rather than going through against stale content
+	s, err := remote.getAsString(ctx, svc, remote.config.Azure.Blob.Container, remote.blobPath(key))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return []byte(s), info.ETag, nil
+}
+
+func (remote *AzureRemote) putObject(ctx context.Context, key string, data []byte) error {
+	return remote.putBlob(ctx, key, data, http.Header{})
+}
+
+func (remote *AzureRemote) putObjectIf(ctx context.Context, key string, data []byte, etag string) error {
+	headers := http.Header{}
+	if etag == "" {
+		headers.Set("If-None-Match", "*")
+	} else {
+		headers.Set("If-Match", etag)
+	}
+
+	return remote.putBlob(ctx, key, data, headers)
+}
+
+// putBlob writes a block blob in a single request through a SAS URL, the
+// vendored client has neither Put Blob nor conditional headers.
+func (remote *AzureRemote) putBlob(ctx context.Context, key string, data []byte, headers http.Header) error {
+	svc, err := remote.azureBlobClient()
+	if err != nil {
+		return err
+	}
+
+	data, err = remote.envelope.sealObject(key, data)
+	if err != nil {
+		return err
+	}
+
+	// with a SAS token, the client's URLs carry it
+	path := remote.blobPath(key)
+	url := svc.GetBlobURL(remote.config.Azure.Blob.Container, path)
+	if remote.config.Azure.AccountKey != "" {
+		url, err = svc.GetBlobSASURI(remote.config.Azure.Blob.Container, path, time.Now().Add(conditionalPutExpiry), "w")
+		if err != nil {
+			return err
 		}
+	}
+
+	headers.Set("x-ms-blob-type", string(storage.BlobTypeBlock))
+	headers.Set("x-ms-version", storage.DefaultAPIVersion)
+
+	return remote.retry.Do(ctx, "put "+path, func() error {
+		return conditionalPut(ctx, http.DefaultClient, url, headers, data, azureRespError)
+	})
+}
 
-		blocks[id-firstId] = storage.Block{strId, storage.BlockStatusUncommitted}
-		err = e
+func azureRespError(status int, body []byte) error {
+	err := storage.AzureStorageServiceError{StatusCode: status}
+	xml.Unmarshal(body, &err)
+	if err.Message == "" {
+		err.Message = http.StatusText(status)
+	}
+	return err
+}
 
-		id++
+// uploadedBlocks returns the blocks of dst recorded in the journal by an
+// earlier run that Azure still holds uncommitted. Those can be skipped.
+func (remote *AzureRemote) uploadedBlocks(ctx context.Context, svc *storage.BlobStorageClient, blob *config.BlobSpec, dst string, state UploadState) (map[string]bool, error) {
+	uploaded := make(map[string]bool)
+	if len(state.Blocks) == 0 {
+		return uploaded, nil
 	}
 
-	if err != nil && err != io.EOF {
+	var list storage.BlockListResponse
+	err := remote.retry.Do(ctx, "list blocks of "+dst, func() (err error) {
+		list, err = svc.GetBlockList(blob.Container, dst, storage.BlockListTypeUncommitted)
+		return err
+	})
+	if serr, ok := err.(storage.AzureStorageServiceError); ok && serr.StatusCode == 404 {
+		// nothing left, the uncommitted blocks expired
+		return uploaded, nil
+	} else if err != nil {
 		return nil, err
 	}
 
-	if nBlocks == 1 && id == 10 {
-		// Create an empty one and break
-		if createErr := svc.CreateBlockBlob(blob.Container, dst); createErr != nil {
-			return nil, createErr
+	pending := make(map[string]bool)
+	for _, b := range list.UncommittedBlocks {
+		pending[b.Name] = true
+	}
+
+	for _, id := range state.Blocks {
+		if pending[id] {
+			uploaded[id] = true
 		}
+	}
 
-		return blocks, nil
+	if len(uploaded) > 0 {
+		log.Printf("Resuming upload of %s, %d blocks already uploaded", dst, len(uploaded))
+	}
+
+	return uploaded, nil
+}
+
+const maxBlockSize int64 = 4000000
+
+// putAzureBlocks uploads f as uncommitted blocks, several at once, skipping
+// the ones in uploaded and calling done after each new block. If ctx is
+// cancelled the upload stops and the blocks are never committed, Azure
+// discards uncommitted blocks on its own and any existing blob is left
+// untouched.
+func (remote *AzureRemote) putAzureBlocks(ctx context.Context, svc *storage.BlobStorageClient, f *os.File, blob *config.BlobSpec, dst string, uploaded map[string]bool, done func(blockId string) error) ([]storage.Block, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	firstId, _ := remote.firstBlockId(f)
+	nBlocks := int((fi.Size() + maxBlockSize - 1) / maxBlockSize)
+
+	if nBlocks == 0 {
+		// Create an empty one and break
+		createErr := remote.retry.Do(ctx, "create "+dst, func() error {
+			return svc.CreateBlockBlob(blob.Container, dst)
+		})
+		return nil, createErr
+	}
+
+	blocks := make([]storage.Block, nBlocks)
+	for i := range blocks {
+		strId := base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(firstId + i)))
+		blocks[i] = storage.Block{strId, storage.BlockStatusUncommitted}
+	}
+
+	// Cancelled on the first failure, so the other blocks are abandoned too.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	blockc := make(chan int, nBlocks)
+	for i := range blocks {
+		blockc <- i
+	}
+	close(blockc)
+
+	errc := make(chan error, nBlocks)
+	var doneMu sync.Mutex
+
+	for w := 0; w < partConcurrency(remote.config) && w < nBlocks; w++ {
+		go func() {
+			buf := make([]byte, maxBlockSize)
+
+			for i := range blockc {
+				strId := blocks[i].ID
+				if uploaded[strId] {
+					errc <- nil
+					continue
+				}
+
+				if err := ctx.Err(); err != nil {
+					errc <- err
+					continue
+				}
+
+				n, err := f.ReadAt(buf, int64(i)*maxBlockSize)
+				if err != nil && err != io.EOF {
+					errc <- err
+					continue
+				}
+
+				if err := utils.Throttle(ctx, n); err != nil {
+					errc <- err
+					continue
+				}
+
+				// Blocks are retried individually. Because we haven't committed
+				// any blocks, we don't have to worry about partial uploads
+				err = remote.retry.Do(ctx, "put block of "+dst, func() error {
+					return svc.PutBlock(blob.Container, dst, strId, buf[:n])
+				})
+
+				if err == nil {
+					doneMu.Lock()
+					err = done(strId)
+					doneMu.Unlock()
+				}
+
+				errc <- err
+			}
+		}()
+	}
+
+	for range blocks {
+		if err := <-errc; err != nil {
+			return nil, err
+		}
 	}
 
 	return blocks, nil
@@ -472,44 +818,60 @@ func (remote *AzureRemote) firstBlockId(f *os.File) (firstId, numBlocks int) {
 }
 
 // get repository keys from azure
-func (remote *AzureRemote) repoKeys(prefix string) (azKeys, error) {
+func (remote *AzureRemote) repoKeys(ctx context.Context, prefix string) (azKeys, error) {
 	repoKeys := make(azKeys)
 
 	prefix = strings.Trim(prefix, "/")
 
-	svc, err := remote.azureBlobClient()
+	objects, err := listObjects(ctx, remote, prefix)
 	if err != nil {
-		return repoKeys, err
+		return repoKeys, fmt.Errorf("getting bucket contents at prefix '%s': %s", prefix, err)
 	}
 
-	blob := remote.config.Azure.Blob
+	for _, object := range objects {
+		name := remote.blobPath(object.Key)
+		plainKey := strings.TrimPrefix(name, "/")
 
-	if blob.PathPresent {
-		prefix = fmt.Sprintf("%s/%s", blob.Path, prefix)
-	}
+		if strings.HasSuffix(plainKey, ".sum") {
+			plainKey = strings.TrimSuffix(plainKey, ".sum")
+			repoKeys.Get(plainKey, remote).sumKey = name
 
-	params := storage.ListBlobsParameters{Prefix: prefix}
+		} else {
+			keyDef := repoKeys.Get(plainKey, remote)
+			keyDef.remotePath = name
+			keyDef.size = object.Size
+			keyDef.etag = object.ETag
+		}
+	}
 
-	resp, err := svc.ListBlobs(blob.Container, params)
+	return repoKeys, nil
+}
 
+func (remote *AzureRemote) listPage(ctx context.Context, prefix, marker string) ([]objectInfo, string, error) {
+	svc, err := remote.azureBlobClient()
 	if err != nil {
-		return repoKeys, fmt.Errorf("getting bucket contents at prefix '%s': %s", prefix, err)
+		return nil, "", err
 	}
 
-	for _, b := range resp.Blobs {
-
-		plainKey := strings.TrimPrefix(b.Name, "/")
+	// Azure markers are opaque, unlike S3's they aren't keys
+	root := remote.blobPath("")
+	params := storage.ListBlobsParameters{Prefix: remote.blobPath(prefix), Marker: marker}
 
-		if strings.HasSuffix(plainKey, ".sum") {
-			plainKey = strings.TrimSuffix(plainKey, ".sum")
-			repoKeys.Get(plainKey, remote).sumKey = b.Name
+	var resp storage.BlobListResponse
+	err = remote.retry.Do(ctx, "list "+params.Prefix, func() (err error) {
+		resp, err = svc.ListBlobs(remote.config.Azure.Blob.Container, params)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
 
-		} else {
-			repoKeys.Get(plainKey, remote).remotePath = b.Name
-		}
+	objects := make([]objectInfo, 0, len(resp.Blobs))
+	for _, b := range resp.Blobs {
+		objects = append(objects, objectInfo{Key: strings.TrimPrefix(b.Name, root), Size: b.Properties.ContentLength, ETag: b.Properties.Etag})
 	}
 
-	return repoKeys, nil
+	return objects, resp.NextMarker, nil
 }
 
 // get files from the azure blob to a local path, relative to rootKey
@@ -519,7 +881,7 @@ func (remote *AzureRemote) repoKeys(prefix string) (azKeys, error) {
 // rootKey: "images/456"
 // key: "images/456/json"
 // downloads to: "/tmp/rego/123/456/json"
-func (remote *AzureRemote) getFiles(dst, rootKey string, imageKeys azKeys) error {
+func (remote *AzureRemote) getFiles(ctx context.Context, dst, rootKey string, imageKeys azKeys) error {
 	blob := remote.config.Azure.Blob
 
 	if blob.PathPresent {
@@ -529,10 +891,21 @@ func (remote *AzureRemote) getFiles(dst, rootKey string, imageKeys azKeys) error
 	errMap := make(map[string]error)
 
 	for _, key := range imageKeys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		relKey := strings.TrimPrefix(key.key, rootKey)
 		relKey = strings.TrimPrefix(relKey, "/")
 
-		err := remote.getFile(filepath.Join(dst, relKey), key)
+		// a failed download starts the file over (or from the last
+		// checkpoint with a journal), so retry whole files
+		err := remote.retry.Do(ctx, "download "+key.key, func() error {
+			return remote.getFile(ctx, filepath.Join(dst, relKey), key)
+		})
+		if err == nil {
+			err = remote.envelope.openFile(remote.objectKey(key.remotePath), filepath.Join(dst, relKey))
+		}
 		if err != nil {
 			errMap[key.key] = err
 		}
@@ -546,14 +919,25 @@ func (remote *AzureRemote) getFiles(dst, rootKey string, imageKeys azKeys) error
 	return nil
 }
 
-func (remote *AzureRemote) getFile(dst string, key *azKeyDef) error {
-	log.Printf("Pulling key %s\n", key.key)
+func (remote *AzureRemote) getFile(ctx context.Context, dst string, key *azKeyDef) error {
+	log.Printf("Pulling key %s (%s)\n", key.key, utils.HumanSize(key.size))
 
 	svc, err := remote.azureBlobClient()
 	if err != nil {
 		return err
 	}
 
+	if remote.journal != nil {
+		container := key.remote.config.Azure.Blob.Container
+
+		return resumeDownload(ctx, remote.journal, dst, key.key, key.etag, key.size, func(offset int64) (io.ReadCloser, error) {
+			if offset == 0 {
+				return svc.GetBlob(container, key.remotePath)
+			}
+			return svc.GetBlobRange(container, key.remotePath, fmt.Sprintf("%d-", offset))
+		})
+	}
+
 	rdr, err := svc.GetBlob(key.remote.config.Azure.Blob.Container, key.remotePath)
 	if err != nil {
 		return err
@@ -568,8 +952,11 @@ func (remote *AzureRemote) getFile(dst string, key *azKeyDef) error {
 	if err != nil {
 		return err
 	}
+	defer to.Close()
+
+	progressReader := utils.NewProgressReader(rdr, key.size, key.key)
 
-	_, err = io.Copy(to, rdr)
+	_, err = io.Copy(to, utils.NewLimitedReader(ctx, progressReader))
 	if err != nil {
 		return err
 	}
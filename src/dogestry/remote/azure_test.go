@@ -1,13 +1,14 @@
 package remote
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 
-	"github.com/pborman/uuid"
-	"github.com/MSOpenTech/azure-sdk-for-go/storage"
 	"dogestry/config"
+	"dogestry/storage"
+	"github.com/pborman/uuid"
 	. "gopkg.in/check.v1"
 )
 
@@ -63,7 +64,7 @@ func (s *SAz) TestRepoKeys(c *C) {
 	svc.PutBlock(container, "Neo", "AAAB", []byte{57, 58, 59})
 	svc.PutBlockList(container, "Neo", []storage.Block{storage.Block{"AAAB", storage.BlockStatusUncommitted}})
 
-	keys, err := s.remote.repoKeys("")
+	keys, err := s.remote.repoKeys(context.Background(), "")
 	c.Assert(err, IsNil)
 
 	c.Log(keys["Nelson"])
@@ -76,7 +77,7 @@ func (s *SAz) TestLocalKeys(c *C) {
 	dumpFile(s.TempDir, "file1", "hello world")
 	dumpFile(s.TempDir, "dir/file2", "hello mars")
 
-	keys, err := s.remote.localKeys(s.TempDir)
+	keys, err := localUploadKeys(s.TempDir)
 	c.Assert(err, IsNil)
 
 	c.Assert(keys["file1"].key, Equals, "file1")
@@ -118,11 +119,11 @@ func (s *SAz) TestResolveImageNameToId(c *C) {
 
 	c.Log(azId)
 
-	id, err := s.remote.ResolveImageNameToId("ruby")
+	id, err := s.remote.ResolveImageNameToId(context.Background(), "ruby")
 	c.Assert(err, IsNil)
 
 	c.Assert(string(id), Equals, rubyId)
 
-	id, err = s.remote.ResolveImageNameToId("rubyx")
+	id, err = s.remote.ResolveImageNameToId(context.Background(), "rubyx")
 	c.Assert(err, Not(IsNil))
 }
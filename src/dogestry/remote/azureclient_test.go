@@ -0,0 +1,115 @@
+package remote
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"time"
+
+	"dogestry/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type AzureClientSuite struct {
+	fake *fakeAzure
+}
+
+var _ = Suite(&AzureClientSuite{})
+
+func (s *AzureClientSuite) SetUpTest(c *C) {
+	s.fake = newFakeAzure()
+	s.fake.put("container/images/a/json", "a")
+	s.fake.put("container/images/b/json", "b")
+}
+
+func (s *AzureClientSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+// read gets a blob and lists the container through remote.
+func (s *AzureClientSuite) read(c *C, remote *AzureRemote) {
+	ctx := context.Background()
+
+	data, _, err := remote.getObject(ctx, "images/a/json")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "a")
+
+	objects, _, err := remote.listPage(ctx, "images/", "")
+	c.Assert(err, IsNil)
+	c.Assert(objects, HasLen, 2)
+}
+
+func (s *AzureClientSuite) TestAzurite(c *C) {
+	cfg := config.Config{}
+	c.Assert(cfg.SetAzureConnectionString("UseDevelopmentStorage=true"), IsNil)
+	c.Assert(cfg.Azure.BlobEndpoint, Equals, "http://127.0.0.1:10000/devstoreaccount1")
+
+	// the fake stands in for Azurite
+	s.fake.pathPrefix = "/devstoreaccount1"
+	cfg.Azure.BlobEndpoint = s.fake.server.URL + "/devstoreaccount1/"
+	cfg.SetBlobSpec("container")
+	s.read(c, &AzureRemote{config: cfg})
+
+	for i, request := range s.fake.requests {
+		c.Assert(request, Matches, "(GET|HEAD) /devstoreaccount1/container.*")
+		c.Assert(s.fake.authorizations[i], Matches, "SharedKey devstoreaccount1:.+")
+	}
+
+	client, err := newAzureClient(cfg)
+	c.Assert(err, IsNil)
+	sasURL, err := client.GetBlobService().GetBlobSASURI("container", "a", time.Now().Add(time.Hour), "w")
+	c.Assert(err, IsNil)
+	c.Assert(sasURL, Matches, s.fake.server.URL+"/devstoreaccount1/container/a\\?.*sig=.*")
+}
+
+func (s *AzureClientSuite) TestSAS(c *C) {
+	cfg := config.Config{}
+	cfg.Azure.AccountName = "fake"
+	cfg.Azure.SASToken = "?sv=2019-02-02&sr=c&sp=rwl&sig=c2lnbmF0dXJl"
+	cfg.SetBlobSpec("container")
+	s.read(c, &AzureRemote{config: cfg})
+
+	for i, request := range s.fake.requests {
+		c.Assert(request, Matches, ".*sig=c2lnbmF0dXJl.*")
+		c.Assert(s.fake.authorizations[i], Equals, "")
+	}
+
+	// blobs are written and copied with the token itself
+	client, err := newAzureClient(cfg)
+	c.Assert(err, IsNil)
+	u, err := url.Parse(client.GetBlobService().GetBlobURL("container", "a"))
+	c.Assert(err, IsNil)
+	c.Assert(u.Host, Equals, "fake.blob.core.windows.net")
+	c.Assert(u.Path, Equals, "/container/a")
+	c.Assert(u.Query().Get("sig"), Equals, "c2lnbmF0dXJl")
+
+	// which can't be passed off as a SAS of other permissions
+	_, err = client.GetBlobService().GetBlobSASURI("container", "a", time.Now().Add(time.Hour), "r")
+	c.Assert(err, ErrorMatches, "storage: a client authorized by a SAS token can't create others")
+
+	cfg.Azure.SASToken = "sv=2019-02-02&sr=c"
+	_, err = newAzureClient(cfg)
+	c.Assert(err, ErrorMatches, "azure: SAS token has no signature")
+}
+
+func (s *AzureClientSuite) TestClouds(c *C) {
+	cfg := config.Config{}
+	cfg.Azure.AccountName = "fake"
+	cfg.Azure.AccountKey = base64.StdEncoding.EncodeToString([]byte("fake key"))
+	c.Assert(cfg.SetAzureCloud("AzureChinaCloud"), IsNil)
+
+	client, err := newAzureClient(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(client.GetBlobService().GetBlobURL("container", "a"), Equals, "https://fake.blob.core.chinacloudapi.cn/container/a")
+
+	cfg.Azure.EndpointSuffix = ""
+	cfg.Azure.Protocol = "http"
+	client, err = newAzureClient(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(client.GetBlobService().GetBlobURL("container", "a"), Equals, "http://fake.blob.core.windows.net/container/a")
+
+	cfg.Azure.BlobEndpoint = "azurite:10000"
+	_, err = newAzureClient(cfg)
+	c.Assert(err, ErrorMatches, "azure: invalid blob endpoint azurite:10000")
+}
@@ -0,0 +1,315 @@
+package remote
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"dogestry/utils"
+)
+
+// blobsLayoutVersion is the first layout storing layers as content-addressed
+// blobs: images/<id>/layer.tar is replaced by images/<id>/layer.digest,
+// naming a blob under blobs/sha256/ that identical layers share.
+const blobsLayoutVersion = 2
+
+// layerDigestFile is the file next to an image's json that names the blob
+// holding its layer. The json itself stays as docker exported it, as docker
+// load checks it.
+const layerDigestFile = "layer.digest"
+
+const digestAlgorithm = "sha256"
+
+// blobKey is where the blob with digest, eg. sha256:<hex>, is stored.
+func blobKey(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// parseDigest checks that s is a digest dogestry can verify.
+func parseDigest(s string) (string, error) {
+	digest := strings.TrimSpace(s)
+
+	hexSum := strings.TrimPrefix(digest, digestAlgorithm+":")
+	if hexSum == digest {
+		return "", fmt.Errorf("unsupported digest '%s', expected %s:<hex>", digest, digestAlgorithm)
+	}
+
+	if _, err := hex.DecodeString(hexSum); err != nil || len(hexSum) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid digest '%s'", digest)
+	}
+
+	return digest, nil
+}
+
+// readerDigest returns the digest of everything read from r.
+func readerDigest(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return digestAlgorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileDigest(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return readerDigest(f)
+}
+
+// layerBlobKeys returns what prepareBlobs does for a remote that stores
+// blobs, and nil for one that doesn't. Layers are compressed with the codec
+// called compression if the remote's layout allows it.
+func layerBlobKeys(ctx context.Context, store objectStore, imageRoot, compression string) (map[string]string, error) {
+	layout, _, err := readLayout(ctx, store)
+	if err != nil || layout.Version < blobsLayoutVersion {
+		return nil, err
+	}
+
+	codec, err := LookupCodec(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if layout.Version < compressedLayoutVersion && codec.Ext != "" {
+		log.Printf("Remote has layout version %d, pushing layers uncompressed; 'dogestry migrate' moves it to a layout storing them compressed", layout.Version)
+		codec = codecs[0]
+	}
+
+	return prepareBlobs(ctx, store, imageRoot, codec)
+}
+
+// prepareBlobs writes a layer.digest next to every layer exported to
+// imageRoot, and returns the remote key of each layer by the key it has in
+// imageRoot: its blob, or "" if the blob is on the remote already. Layers
+// are compressed with codec next to layer.tar, which isn't pushed then.
+func prepareBlobs(ctx context.Context, store objectStore, imageRoot string, codec *Codec) (map[string]string, error) {
+	layers, err := filepath.Glob(filepath.Join(imageRoot, "images", "*", "layer.tar"))
+	if err != nil {
+		return nil, err
+	}
+
+	blobKeys := make(map[string]string)
+	present := make(map[string]bool)
+	// identical layers in this push are only sent once
+	sent := make(map[string]bool)
+
+	for _, layer := range layers {
+		digest, err := fileDigest(layer)
+		if err != nil {
+			return nil, err
+		}
+
+		dir := filepath.Dir(layer)
+		if err := ioutil.WriteFile(filepath.Join(dir, layerDigestFile), []byte(digest), 0600); err != nil {
+			return nil, err
+		}
+
+		key := path.Join("images", filepath.Base(dir), "layer.tar")
+
+		// only the layer in codec is pushed, even if an earlier push
+		// compressed it differently
+		for _, c := range codecs {
+			blobKeys[key+c.Ext] = ""
+		}
+
+		if _, ok := present[digest]; !ok {
+			storedKey, err := findBlob(ctx, store, digest)
+			if err != nil {
+				return nil, err
+			}
+			present[digest] = storedKey != ""
+		}
+
+		if present[digest] {
+			log.Printf("Layer of %s is already on the remote as %s", filepath.Base(dir), digest)
+			continue
+		}
+		if sent[digest] {
+			continue
+		}
+		sent[digest] = true
+
+		if codec.Ext != "" {
+			log.Printf("Compressing layer of %s with %s", filepath.Base(dir), codec.Name)
+			if err := compressFile(codec, layer, layer+codec.Ext); err != nil {
+				return nil, fmt.Errorf("compressing layer of %s: %v", filepath.Base(dir), err)
+			}
+		}
+
+		blobKeys[key+codec.Ext] = blobKey(digest) + codec.Ext
+	}
+
+	return blobKeys, nil
+}
+
+// findBlob returns the key the blob with digest is stored as, in any codec,
+// or "" if the remote doesn't have it.
+func findBlob(ctx context.Context, store objectStore, digest string) (string, error) {
+	objects, err := listObjects(ctx, store, blobKey(digest))
+	if err != nil {
+		return "", err
+	}
+
+	for _, object := range objects {
+		if _, ok := blobCodec(digest, object.Key); ok {
+			return object.Key, nil
+		}
+	}
+
+	return "", nil
+}
+
+// pulledLayerDigest returns the digest in the layer.digest pulled to dst,
+// and ok false if the image was pushed with its layer.tar.
+func pulledLayerDigest(dst string) (digest string, ok bool, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(dst, layerDigestFile))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	digest, err = parseDigest(string(data))
+	return digest, err == nil, err
+}
+
+// finishBlobPull decompresses the layer downloaded to dst with codec and
+// checks it against digest.
+func finishBlobPull(dst, digest string, codec *Codec) error {
+	layer := filepath.Join(dst, "layer.tar")
+
+	var actual string
+	var err error
+	if codec.Ext == "" {
+		actual, err = fileDigest(layer)
+	} else {
+		actual, err = decompressLayer(codec, layer+codec.Ext)
+	}
+	if err != nil {
+		return err
+	}
+
+	return checkPulledLayer(dst, digest, actual)
+}
+
+// streamBlobPull pulls object, the blob of the layer with digest compressed
+// with codec, into the image pulled to dst. The blob is decrypted with e,
+// decompressed and hashed as it's read through open, which starts it over
+// whenever the download is retried.
+func streamBlobPull(ctx context.Context, retry RetryPolicy, e *envelope, dst, digest string, codec *Codec, object objectInfo, open func() (io.ReadCloser, error)) error {
+	var actual string
+	err := retry.Do(ctx, "download "+object.Key, func() error {
+		log.Printf("Pulling key %s (%s)\n", object.Key, utils.HumanSize(object.Size))
+
+		rc, err := open()
+		if err != nil {
+			return err
+		}
+
+		progressReader := utils.NewProgressReader(rc, object.Size, object.Key)
+		r, err := e.newOpener(utils.NewLimitedReader(ctx, progressReader), object.Key)
+		if err != nil {
+			rc.Close()
+			return err
+		}
+
+		actual, err = writeLayer(codec, struct {
+			io.Reader
+			io.Closer
+		}{r, rc}, dst)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return checkPulledLayer(dst, digest, actual)
+}
+
+// checkPulledLayer checks the layer.tar pulled to dst, whose digest is
+// actual, against digest and removes layer.digest, which docker doesn't know.
+func checkPulledLayer(dst, digest, actual string) error {
+	if actual != digest {
+		os.Remove(filepath.Join(dst, "layer.tar"))
+		return fmt.Errorf("layer %s is corrupt, its digest is %s", digest, actual)
+	}
+
+	return os.Remove(filepath.Join(dst, layerDigestFile))
+}
+
+// migrateToBlobs moves every layer of the remote behind store into a
+// content-addressed blob. Each image is done in an order that leaves it
+// readable, so the migration can be interrupted and rerun at any point.
+func migrateToBlobs(ctx context.Context, store objectStore) error {
+	objects, err := listObjects(ctx, store, "images/")
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		if path.Base(object.Key) != "layer.tar" {
+			continue
+		}
+
+		if err := migrateLayer(ctx, store, path.Dir(object.Key)); err != nil {
+			return fmt.Errorf("%s: %v", object.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateLayer moves the layer.tar under imageDir into a blob: copy it to
+// the blob unless that exists, write layer.digest, then delete layer.tar.
+func migrateLayer(ctx context.Context, store objectStore, imageDir string) error {
+	layerKey := path.Join(imageDir, "layer.tar")
+	digestKey := path.Join(imageDir, layerDigestFile)
+
+	// a rerun after layer.digest was written only has the delete left
+	if _, err := store.statObject(ctx, digestKey); err == nil {
+		return store.deleteObject(ctx, layerKey)
+	} else if err != errObjectNotFound {
+		return err
+	}
+
+	r, err := store.openObject(ctx, layerKey)
+	if err != nil {
+		return err
+	}
+	digest, err := readerDigest(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	dstKey := blobKey(digest)
+	if _, err := store.statObject(ctx, dstKey); err == errObjectNotFound {
+		log.Printf("Moving %s to %s", layerKey, dstKey)
+		if err := store.copyObject(ctx, layerKey, dstKey); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		log.Printf("Layer %s is already stored as %s", layerKey, dstKey)
+	}
+
+	if err := store.putObject(ctx, digestKey, []byte(digest)); err != nil {
+		return err
+	}
+
+	return store.deleteObject(ctx, layerKey)
+}
@@ -0,0 +1,213 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type BlobSuite struct {
+	fake      *fakeS3
+	remote    *S3Remote
+	imageRoot string
+}
+
+var _ = Suite(&BlobSuite{})
+
+func (s *BlobSuite) SetUpTest(c *C) {
+	s.fake, s.remote, s.imageRoot = setUpLayoutRemote(c, 2)
+}
+
+// setUpLayoutRemote returns a fake S3 remote with the layout version, and
+// an image exported to push to it.
+func setUpLayoutRemote(c *C, version int) (*fakeS3, *S3Remote, string) {
+	fake := newFakeS3()
+	remote := fake.remote("bucket")
+	fake.put(LayoutKey, fmt.Sprintf(`{"version": %d}`, version))
+
+	dir := c.MkDir()
+	journal, err := OpenJournal(filepath.Join(dir, "push.journal"), remote.Desc())
+	c.Assert(err, IsNil)
+	remote.SetJournal(journal)
+
+	imageRoot := filepath.Join(dir, "image")
+	files := map[string]string{
+		"images/" + pushImageId + "/json":      `{"id":"` + pushImageId + `"}`,
+		"images/" + pushImageId + "/layer.tar": "layer contents",
+		"images/" + pushImageId + "/VERSION":   "1.0",
+		"repositories/app/latest":              pushImageId,
+	}
+	for name, content := range files {
+		path := filepath.Join(imageRoot, name)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+	}
+
+	return fake, remote, imageRoot
+}
+
+func (s *BlobSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+func digestOf(c *C, content string) string {
+	digest, err := readerDigest(strings.NewReader(content))
+	c.Assert(err, IsNil)
+	return digest
+}
+
+func (s *BlobSuite) TestBlobKey(c *C) {
+	digest := digestOf(c, "layer contents")
+	c.Assert(blobKey(digest), Equals, "blobs/sha256/"+strings.TrimPrefix(digest, "sha256:"))
+
+	_, err := parseDigest(digest + "\n")
+	c.Assert(err, IsNil)
+	_, err = parseDigest("md5:abc")
+	c.Assert(err, ErrorMatches, "unsupported digest 'md5:abc'.*")
+	_, err = parseDigest("sha256:abc")
+	c.Assert(err, ErrorMatches, "invalid digest 'sha256:abc'")
+}
+
+func (s *BlobSuite) TestPushToBlobs(c *C) {
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	digest := digestOf(c, "layer contents")
+	layer, ok := s.fake.get(blobKey(digest))
+	c.Assert(ok, Equals, true)
+	c.Assert(layer, Equals, "layer contents")
+
+	ref, _ := s.fake.get("images/" + pushImageId + "/" + layerDigestFile)
+	c.Assert(ref, Equals, digest)
+
+	_, ok = s.fake.get("images/" + pushImageId + "/layer.tar")
+	c.Assert(ok, Equals, false)
+
+	// the image is found and walked through its json as before
+	id, err := s.remote.ImageFullId(context.Background(), ID(pushImageId[:12]))
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID(pushImageId))
+}
+
+func (s *BlobSuite) TestPushSkipsPresentBlob(c *C) {
+	digest := digestOf(c, "layer contents")
+	s.fake.put(blobKey(digest), "layer contents")
+
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	for _, key := range s.fake.writes {
+		c.Assert(strings.HasPrefix(key, "blobs/"), Equals, false, Commentf("wrote %s", key))
+	}
+
+	ref, _ := s.fake.get("images/" + pushImageId + "/" + layerDigestFile)
+	c.Assert(ref, Equals, digest)
+}
+
+func (s *BlobSuite) TestPushToLegacyLayout(c *C) {
+	s.fake.put(LayoutKey, `{"version": 1}`)
+
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	_, ok := s.fake.get("images/" + pushImageId + "/layer.tar")
+	c.Assert(ok, Equals, true)
+	_, ok = s.fake.get("images/" + pushImageId + "/" + layerDigestFile)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *BlobSuite) TestMigrate(c *C) {
+	ctx := context.Background()
+	s.fake.put(LayoutKey, `{"version": 1}`)
+
+	// two builds of the same layer, and a different one
+	s.fake.put("images/aaaa/json", `{"id":"aaaa"}`)
+	s.fake.put("images/aaaa/layer.tar", "same layer")
+	s.fake.put(md5Key("images/aaaa/layer.tar"), hexMd5([]byte("same layer")))
+	s.fake.put("images/bbbb/json", `{"id":"bbbb","parent":"aaaa"}`)
+	s.fake.put("images/bbbb/layer.tar", "same layer")
+	s.fake.put("images/cccc/json", `{"id":"cccc"}`)
+	s.fake.put("images/cccc/layer.tar", "other layer")
+
+	// interrupted half way
+	s.fake.fail = func(method, key string) bool {
+		return method == "DELETE" && key == "images/bbbb/layer.tar"
+	}
+	c.Assert(s.remote.Migrate(ctx, 2), ErrorMatches, ".*images/bbbb/layer.tar.*")
+
+	layout, err := s.remote.Layout(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(layout.MigratingTo, Equals, 2)
+
+	s.fake.fail = nil
+	c.Assert(s.remote.Migrate(ctx, 2), IsNil)
+
+	layout, err = s.remote.Layout(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(layout, DeepEquals, Layout{Version: 2})
+
+	same := digestOf(c, "same layer")
+	for _, id := range []string{"aaaa", "bbbb"} {
+		ref, _ := s.fake.get("images/" + id + "/" + layerDigestFile)
+		c.Assert(ref, Equals, same)
+		_, ok := s.fake.get("images/" + id + "/layer.tar")
+		c.Assert(ok, Equals, false)
+	}
+
+	var blobs []string
+	for _, key := range s.fake.keys() {
+		if strings.HasPrefix(key, "blobs/") {
+			blobs = append(blobs, key)
+		}
+	}
+	c.Assert(blobs, HasLen, 2)
+
+	sum, ok := s.fake.get(md5Key(blobKey(same)))
+	c.Assert(ok, Equals, true)
+	c.Assert(sum, Equals, hexMd5([]byte("same layer")))
+
+	// the catalog finds layer sizes through the blobs
+	catalog, err := s.remote.Reindex(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(catalog.Images["bbbb"], Equals, CatalogImage{Parent: "aaaa", Size: int64(len("same layer"))})
+}
+
+func (s *BlobSuite) TestPullBlob(c *C) {
+	azure := newFakeAzure()
+	defer azure.Close()
+
+	digest := digestOf(c, "layer contents")
+	azure.put("container/images/"+pushImageId+"/json", `{"id":"`+pushImageId+`"}`)
+	azure.put("container/images/"+pushImageId+"/"+layerDigestFile, digest)
+	azure.put("container/"+blobKey(digest), "layer contents")
+
+	dst := filepath.Join(c.MkDir(), pushImageId)
+	err := azure.remote("container").PullImageId(context.Background(), pushImageId, dst)
+	c.Assert(err, IsNil)
+
+	layer, err := ioutil.ReadFile(filepath.Join(dst, "layer.tar"))
+	c.Assert(err, IsNil)
+	c.Assert(string(layer), Equals, "layer contents")
+
+	_, err = os.Stat(filepath.Join(dst, layerDigestFile))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *BlobSuite) TestPullCorruptBlob(c *C) {
+	azure := newFakeAzure()
+	defer azure.Close()
+
+	digest := digestOf(c, "layer contents")
+	azure.put("container/images/"+pushImageId+"/json", `{"id":"`+pushImageId+`"}`)
+	azure.put("container/images/"+pushImageId+"/"+layerDigestFile, digest)
+	azure.put("container/"+blobKey(digest), "tampered")
+
+	dst := filepath.Join(c.MkDir(), pushImageId)
+	err := azure.remote("container").PullImageId(context.Background(), pushImageId, dst)
+	c.Assert(err, ErrorMatches, "layer sha256:.* is corrupt, .*")
+
+	_, err = os.Stat(filepath.Join(dst, "layer.tar"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
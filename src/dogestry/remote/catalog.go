@@ -0,0 +1,397 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// CatalogKey is the object at the root of a remote holding its Catalog.
+const CatalogKey = "dogestry-catalog.json"
+
+// how many tags and image documents Reindex reads at once
+const reindexWorkers = 25
+
+// how often updating the catalog is retried when a concurrent update got
+// there first
+const catalogAttempts = 5
+
+// Catalog indexes the tags and images of a remote, so listing it or
+// resolving a short ID takes a single read instead of listing every key.
+// Only Reindex creates it; once it exists Push and SetTag keep it up to
+// date.
+type Catalog struct {
+	// repo -> tag -> image
+	Tags   map[string]map[string]ID `json:"tags"`
+	Images map[ID]CatalogImage      `json:"images"`
+}
+
+// CatalogImage is what the catalog knows about an image.
+type CatalogImage struct {
+	Parent ID `json:"parent,omitempty"`
+	// size of the layer
+	Size int64 `json:"size"`
+}
+
+func newCatalog() *Catalog {
+	return &Catalog{Tags: make(map[string]map[string]ID), Images: make(map[ID]CatalogImage)}
+}
+
+// SetTag points repo:tag at id.
+func (c *Catalog) SetTag(repo, tag string, id ID) {
+	if c.Tags[repo] == nil {
+		c.Tags[repo] = make(map[string]ID)
+	}
+	c.Tags[repo][tag] = id
+}
+
+// List returns the tagged images, sorted by repo and tag.
+func (c *Catalog) List() []Image {
+	var images []Image
+	for repo, tags := range c.Tags {
+		for tag := range tags {
+			images = append(images, Image{repo, tag})
+		}
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Repository != images[j].Repository {
+			return images[i].Repository < images[j].Repository
+		}
+		return images[i].Tag < images[j].Tag
+	})
+
+	return images
+}
+
+// FullID returns the image whose ID starts with prefix.
+func (c *Catalog) FullID(prefix ID) (ID, bool) {
+	for id := range c.Images {
+		if strings.HasPrefix(string(id), string(prefix)) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// readCatalog returns the catalog of the remote behind store and the ETag
+// of its object. The catalog is nil if the remote doesn't have one.
+func readCatalog(ctx context.Context, store objectStore) (*Catalog, string, error) {
+	data, etag, err := store.getObject(ctx, CatalogKey)
+	if err == errObjectNotFound {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	catalog := newCatalog()
+	if err := json.Unmarshal(data, catalog); err != nil {
+		return nil, "", fmt.Errorf("invalid %s: %v", CatalogKey, err)
+	}
+
+	return catalog, etag, nil
+}
+
+// updateCatalog applies update to the remote's catalog, if it has one.
+// Concurrent updates are serialised with conditional writes.
+func updateCatalog(ctx context.Context, store objectStore, update func(c *Catalog)) error {
+	for attempt := 1; ; attempt++ {
+		catalog, etag, err := readCatalog(ctx, store)
+		if err != nil || catalog == nil {
+			return err
+		}
+
+		update(catalog)
+
+		data, err := json.Marshal(catalog)
+		if err != nil {
+			return err
+		}
+
+		err = store.putObjectIf(ctx, CatalogKey, data, etag)
+		if err != errPreconditionFailed || attempt == catalogAttempts {
+			return err
+		}
+	}
+}
+
+// catalogImages adds the images exported to imageRoot to the remote's
+// catalog.
+func catalogImages(ctx context.Context, store objectStore, imageRoot string) error {
+	dirs, err := ioutil.ReadDir(filepath.Join(imageRoot, "images"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	images := make(map[ID]CatalogImage)
+	for _, dir := range dirs {
+		dirPath := filepath.Join(imageRoot, "images", dir.Name())
+
+		data, err := ioutil.ReadFile(filepath.Join(dirPath, "json"))
+		if err != nil {
+			return err
+		}
+
+		var img docker.Image
+		if err := json.Unmarshal(data, &img); err != nil {
+			return fmt.Errorf("invalid json for image %s: %v", dir.Name(), err)
+		}
+
+		var size int64
+		if info, err := os.Stat(filepath.Join(dirPath, "layer.tar")); err == nil {
+			size = info.Size()
+		}
+
+		images[ID(dir.Name())] = CatalogImage{Parent: ID(img.Parent), Size: size}
+	}
+
+	return updateCatalog(ctx, store, func(c *Catalog) {
+		for id, img := range images {
+			c.Images[id] = img
+		}
+	})
+}
+
+// catalogTags points the tags in the remote's catalog at their IDs.
+func catalogTags(ctx context.Context, store objectStore, tags []tagRef) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	return updateCatalog(ctx, store, func(c *Catalog) {
+		for _, t := range tags {
+			c.SetTag(t.Repo, t.Tag, t.ID)
+		}
+	})
+}
+
+// reindex builds the catalog from the tags and images on the remote and
+// the index of its objects, and stores them, replacing any there were.
+func reindex(ctx context.Context, store objectStore) (*Catalog, error) {
+	catalog, err := buildCatalog(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := buildIndex(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeIndex(ctx, store, index); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(catalog)
+	if err != nil {
+		return nil, err
+	}
+
+	return catalog, store.putObject(ctx, CatalogKey, data)
+}
+
+func buildCatalog(ctx context.Context, store objectStore) (*Catalog, error) {
+	catalog := newCatalog()
+
+	tagObjects, err := listObjects(ctx, store, "repositories/")
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []tagRef
+	for _, object := range tagObjects {
+		if strings.HasSuffix(object.Key, ".sum") {
+			continue
+		}
+
+		repo, tag := ParseImagePath(object.Key, "repositories/")
+		tags = append(tags, tagRef{Repo: repo, Tag: tag})
+	}
+
+	err = parallel(ctx, len(tags), func(i int) (err error) {
+		tags[i].ID, _, err = readTag(ctx, store, tags[i].Repo, tags[i].Tag)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tags {
+		if t.ID != "" {
+			catalog.SetTag(t.Repo, t.Tag, t.ID)
+		}
+	}
+
+	imageObjects, err := listObjects(ctx, store, "images/")
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[ID]int64)
+	var ids, blobIDs []ID
+	for _, object := range imageObjects {
+		id, file := path.Split(strings.TrimPrefix(object.Key, "images/"))
+		id = strings.TrimSuffix(id, "/")
+
+		switch file {
+		case "layer.tar":
+			sizes[ID(id)] = object.Size
+		case layerDigestFile:
+			blobIDs = append(blobIDs, ID(id))
+		case "json":
+			// images without json never finished uploading
+			ids = append(ids, ID(id))
+		}
+	}
+
+	if len(blobIDs) > 0 {
+		if err := blobSizes(ctx, store, blobIDs, sizes); err != nil {
+			return nil, err
+		}
+	}
+
+	parents := make([]ID, len(ids))
+	err = parallel(ctx, len(ids), func(i int) error {
+		data, _, err := store.getObject(ctx, path.Join("images", string(ids[i]), "json"))
+		if err != nil {
+			return fmt.Errorf("reading json of image %s: %v", ids[i].Short(), err)
+		}
+
+		var img docker.Image
+		if err := json.Unmarshal(data, &img); err != nil {
+			return fmt.Errorf("invalid json for image %s: %v", ids[i].Short(), err)
+		}
+
+		parents[i] = ID(img.Parent)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		catalog.Images[id] = CatalogImage{Parent: parents[i], Size: sizes[id]}
+	}
+
+	return catalog, nil
+}
+
+// blobSizes adds the size of the layer blob of every image in ids to sizes.
+func blobSizes(ctx context.Context, store objectStore, ids []ID, sizes map[ID]int64) error {
+	blobObjects, err := listObjects(ctx, store, "blobs/")
+	if err != nil {
+		return err
+	}
+
+	blobSize := make(map[string]int64)
+	for _, object := range blobObjects {
+		blobSize[object.Key] = object.Size
+	}
+
+	digests := make([]string, len(ids))
+	err = parallel(ctx, len(ids), func(i int) error {
+		data, _, err := store.getObject(ctx, path.Join("images", string(ids[i]), layerDigestFile))
+		if err != nil {
+			return fmt.Errorf("reading layer digest of image %s: %v", ids[i].Short(), err)
+		}
+
+		digests[i], err = parseDigest(string(data))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// compressed blobs count with the size they're stored with
+	for i, id := range ids {
+		for _, c := range codecs {
+			if size, ok := blobSize[blobKey(digests[i])+c.Ext]; ok {
+				sizes[id] = size
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// parallel calls fn for 0 to n-1, reindexWorkers at a time, and returns
+// the first error.
+func parallel(ctx context.Context, n int, fn func(i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	indexes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+
+	for w := 0; w < reindexWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				if ctx.Err() != nil {
+					return
+				}
+
+				if err := fn(i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// listCatalog returns the images in the remote's catalog, or ok false if
+// it doesn't have one.
+func listCatalog(ctx context.Context, store objectStore) ([]Image, bool) {
+	catalog, _, err := readCatalog(ctx, store)
+	if err != nil {
+		log.Printf("Warning: unable to read %s, listing the remote: %v", CatalogKey, err)
+		return nil, false
+	}
+	if catalog == nil {
+		return nil, false
+	}
+
+	return catalog.List(), true
+}
+
+// catalogFullID looks id up in the remote's catalog. Images pushed by older
+// versions may not be in it, so not finding it isn't conclusive.
+func catalogFullID(ctx context.Context, store objectStore, id ID) (ID, bool) {
+	catalog, _, err := readCatalog(ctx, store)
+	if err != nil || catalog == nil {
+		return "", false
+	}
+
+	return catalog.FullID(id)
+}
@@ -0,0 +1,295 @@
+package remote
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// compressedLayoutVersion is the first layout whose layer blobs may be
+// compressed. The codec of a blob is recorded in its key, see Codec.Ext, so
+// blobs pushed uncompressed or with another codec stay readable.
+const compressedLayoutVersion = 3
+
+// DefaultCompression is the codec layers are pushed with when
+// Transfer.Compression isn't set.
+const DefaultCompression = "gzip"
+
+// Codec compresses layer blobs.
+type Codec struct {
+	Name string
+	// appended to the key of blobs compressed with the codec
+	Ext string
+
+	compress   func(w io.Writer) (io.WriteCloser, error)
+	decompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+// codecs are all the codecs dogestry reads, uncompressed first.
+var codecs = []*Codec{
+	{
+		Name: "none",
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(r), nil
+		},
+	},
+	{
+		Name: "gzip",
+		Ext:  ".gz",
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		// there's no zstd implementation vendored, so use the zstd command
+		Name: "zstd",
+		Ext:  ".zst",
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return commandWriter(w, "zstd", "-q", "-c")
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return commandReader(r, "zstd", "-q", "-d", "-c")
+		},
+	},
+}
+
+// LookupCodec returns the codec called name, checking that it can be used
+// here. An empty name is DefaultCompression.
+func LookupCodec(name string) (*Codec, error) {
+	if name == "" {
+		name = DefaultCompression
+	}
+
+	for _, c := range codecs {
+		if c.Name != name {
+			continue
+		}
+
+		if c.Name == "zstd" {
+			if _, err := exec.LookPath("zstd"); err != nil {
+				return nil, fmt.Errorf("zstd compression needs the zstd command: %v", err)
+			}
+		}
+		return c, nil
+	}
+
+	var names []string
+	for _, c := range codecs {
+		names = append(names, c.Name)
+	}
+	return nil, fmt.Errorf("unknown compression '%s', expected one of %s", name, strings.Join(names, ", "))
+}
+
+// blobCodec returns the codec of the blob stored as key, the blob key of
+// digest with the codec's extension.
+func blobCodec(digest, key string) (*Codec, bool) {
+	for _, c := range codecs {
+		if key == blobKey(digest)+c.Ext {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// compressFile writes src compressed with codec to dst.
+func compressFile(codec *Codec, src, dst string) (err error) {
+	from, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := to.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	w, err := codec.compress(to)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, from); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// decompressLayer decompresses the blob pulled to src, compressed with
+// codec, into the layer.tar next to it and returns the layer's digest. src is
+// removed once it's decompressed.
+func decompressLayer(codec *Codec, src string) (string, error) {
+	from, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := writeLayer(codec, from, filepath.Dir(src))
+	if err != nil {
+		return "", err
+	}
+
+	return digest, os.Remove(src)
+}
+
+// writeLayer decompresses the blob read from r, compressed with codec, into
+// the layer.tar in dir and returns the layer's digest. r is closed. Errors
+// reading r are returned as they are, for the retry policy to recognise.
+func writeLayer(codec *Codec, r io.ReadCloser, dir string) (digest string, err error) {
+	defer r.Close()
+
+	dst := filepath.Join(dir, "layer.tar")
+	to, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if closeErr := to.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	src := &sourceReader{Reader: r}
+	codecErr := func(err error) error {
+		if src.err != nil {
+			return src.err
+		}
+		return fmt.Errorf("decompressing layer.tar%s: %v", codec.Ext, err)
+	}
+
+	dr, err := codec.decompress(src)
+	if err != nil {
+		return "", codecErr(err)
+	}
+	defer func() {
+		if err != nil {
+			// a command reader would otherwise read the rest of r
+			r.Close()
+		}
+		if closeErr := dr.Close(); err == nil && closeErr != nil {
+			err = codecErr(closeErr)
+		}
+	}()
+
+	// hash while decompressing, rather than reading the layer again
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(to, h), dr); err != nil {
+		if _, ok := err.(*os.PathError); ok {
+			return "", err
+		}
+		return "", codecErr(err)
+	}
+
+	return digestAlgorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sourceReader keeps the error reading a compressed blob, to tell it from
+// the blob being corrupt.
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// cmdWriteCloser feeds what's written to it to a command. Close waits for
+// the command to exit.
+type cmdWriteCloser struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdWriteCloser) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		c.cmd.Wait()
+		return err
+	}
+	return c.cmd.Wait()
+}
+
+// commandWriter runs name with args, writing its output to w.
+func commandWriter(w io.Writer, name string, args ...string) (io.WriteCloser, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &cmdWriteCloser{stdin, cmd}, nil
+}
+
+// cmdReadCloser reads the output of a command. Close waits for the command
+// to exit.
+type cmdReadCloser struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdReadCloser) Close() error {
+	// the command has written everything if it was read to the end
+	io.Copy(ioutil.Discard, c.ReadCloser)
+	return c.cmd.Wait()
+}
+
+// commandReader runs name with args on what's read from r.
+func commandReader(r io.Reader, name string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &cmdReadCloser{stdout, cmd}, nil
+}
@@ -0,0 +1,206 @@
+package remote
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type CompressionSuite struct {
+	fake      *fakeS3
+	remote    *S3Remote
+	imageRoot string
+}
+
+var _ = Suite(&CompressionSuite{})
+
+func (s *CompressionSuite) SetUpTest(c *C) {
+	s.fake, s.remote, s.imageRoot = setUpLayoutRemote(c, 3)
+}
+
+func (s *CompressionSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+func gzipped(c *C, content string) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(content))
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	return buf.String()
+}
+
+func gunzipped(c *C, content string) string {
+	r, err := gzip.NewReader(strings.NewReader(content))
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *CompressionSuite) TestLookupCodec(c *C) {
+	codec, err := LookupCodec("")
+	c.Assert(err, IsNil)
+	c.Assert(codec.Name, Equals, DefaultCompression)
+
+	codec, err = LookupCodec("none")
+	c.Assert(err, IsNil)
+	c.Assert(codec.Ext, Equals, "")
+
+	_, err = LookupCodec("lzma")
+	c.Assert(err, ErrorMatches, "unknown compression 'lzma', expected one of none, gzip, zstd")
+}
+
+func (s *CompressionSuite) TestPushCompressed(c *C) {
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	digest := digestOf(c, "layer contents")
+	layer, ok := s.fake.get(blobKey(digest) + ".gz")
+	c.Assert(ok, Equals, true)
+	c.Assert(gunzipped(c, layer), Equals, "layer contents")
+
+	ref, _ := s.fake.get("images/" + pushImageId + "/" + layerDigestFile)
+	c.Assert(ref, Equals, digest)
+
+	for _, key := range s.fake.keys() {
+		c.Assert(strings.HasPrefix(key, "images/"+pushImageId+"/layer.tar"), Equals, false, Commentf("pushed %s", key))
+	}
+	_, ok = s.fake.get(blobKey(digest))
+	c.Assert(ok, Equals, false)
+}
+
+func (s *CompressionSuite) TestPushUncompressed(c *C) {
+	s.remote.config.Transfer.Compression = "none"
+
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	layer, ok := s.fake.get(blobKey(digestOf(c, "layer contents")))
+	c.Assert(ok, Equals, true)
+	c.Assert(layer, Equals, "layer contents")
+}
+
+func (s *CompressionSuite) TestPushSkipsUncompressedBlob(c *C) {
+	// pushed before the remote was migrated
+	digest := digestOf(c, "layer contents")
+	s.fake.put(blobKey(digest), "layer contents")
+
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	for _, key := range s.fake.writes {
+		c.Assert(strings.HasPrefix(key, "blobs/"), Equals, false, Commentf("wrote %s", key))
+	}
+}
+
+func (s *CompressionSuite) TestPushToUncompressedLayout(c *C) {
+	s.fake.put(LayoutKey, `{"version": 2}`)
+
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	layer, ok := s.fake.get(blobKey(digestOf(c, "layer contents")))
+	c.Assert(ok, Equals, true)
+	c.Assert(layer, Equals, "layer contents")
+}
+
+func (s *CompressionSuite) TestMigrate(c *C) {
+	ctx := context.Background()
+	s.fake.put(LayoutKey, `{"version": 2}`)
+
+	digest := digestOf(c, "layer contents")
+	s.fake.put(blobKey(digest), "layer contents")
+
+	c.Assert(s.remote.Migrate(ctx, 3), IsNil)
+
+	layout, err := s.remote.Layout(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(layout, DeepEquals, Layout{Version: 3})
+
+	// blobs stay as they are
+	layer, ok := s.fake.get(blobKey(digest))
+	c.Assert(ok, Equals, true)
+	c.Assert(layer, Equals, "layer contents")
+}
+
+func (s *CompressionSuite) TestReindexSizes(c *C) {
+	digest := digestOf(c, "layer contents")
+	compressed := gzipped(c, "layer contents")
+	s.fake.put("images/aaaa/json", `{"id":"aaaa"}`)
+	s.fake.put("images/aaaa/"+layerDigestFile, digest)
+	s.fake.put(blobKey(digest)+".gz", compressed)
+
+	catalog, err := s.remote.Reindex(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(catalog.Images["aaaa"], Equals, CatalogImage{Size: int64(len(compressed))})
+}
+
+func (s *CompressionSuite) pull(c *C, blobs map[string]string) (string, error) {
+	azure := newFakeAzure()
+	defer azure.Close()
+
+	azure.put("container/images/"+pushImageId+"/json", `{"id":"`+pushImageId+`"}`)
+	azure.put("container/images/"+pushImageId+"/"+layerDigestFile, digestOf(c, "layer contents"))
+	for key, content := range blobs {
+		azure.put("container/"+key, content)
+	}
+
+	dst := filepath.Join(c.MkDir(), pushImageId)
+	return dst, azure.remote("container").PullImageId(context.Background(), pushImageId, dst)
+}
+
+func (s *CompressionSuite) TestPullCompressed(c *C) {
+	key := blobKey(digestOf(c, "layer contents"))
+	dst, err := s.pull(c, map[string]string{key + ".gz": gzipped(c, "layer contents")})
+	c.Assert(err, IsNil)
+
+	layer, err := ioutil.ReadFile(filepath.Join(dst, "layer.tar"))
+	c.Assert(err, IsNil)
+	c.Assert(string(layer), Equals, "layer contents")
+
+	// docker only gets the layer
+	files, err := ioutil.ReadDir(dst)
+	c.Assert(err, IsNil)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	c.Assert(names, DeepEquals, []string{"json", "layer.tar"})
+}
+
+func (s *CompressionSuite) TestPullCorruptCompressed(c *C) {
+	key := blobKey(digestOf(c, "layer contents"))
+	dst, err := s.pull(c, map[string]string{key + ".gz": gzipped(c, "tampered")})
+	c.Assert(err, ErrorMatches, "layer sha256:.* is corrupt, .*")
+
+	_, err = os.Stat(filepath.Join(dst, "layer.tar"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	_, err = s.pull(c, map[string]string{key + ".gz": "not gzip"})
+	c.Assert(err, ErrorMatches, "decompressing layer.tar.gz: .*")
+}
+
+func (s *CompressionSuite) TestZstd(c *C) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		c.Skip("the zstd command isn't installed")
+	}
+
+	s.remote.config.Transfer.Compression = "zstd"
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	key := blobKey(digestOf(c, "layer contents"))
+	compressed, ok := s.fake.get(key + ".zst")
+	c.Assert(ok, Equals, true)
+
+	dst, err := s.pull(c, map[string]string{key + ".zst": compressed})
+	c.Assert(err, IsNil)
+
+	layer, err := ioutil.ReadFile(filepath.Join(dst, "layer.tar"))
+	c.Assert(err, IsNil)
+	c.Assert(string(layer), Equals, "layer contents")
+}
@@ -0,0 +1,88 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// how long the presigned URLs used for conditional writes are valid
+const conditionalPutExpiry = 15 * time.Minute
+
+// errPreconditionFailed is returned by conditionalPut when the backend
+// rejected the write because of its If-Match or If-None-Match header.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// conditionalPut PUTs body to a presigned URL. The vendored S3 and Azure
+// clients can't send If-Match headers, so compare-and-swap writes go through
+// here, sent with client. Any other failure is turned into the backend's error type by
+// respErr, so the retry policy recognises it.
+func conditionalPut(ctx context.Context, client *http.Client, url string, headers http.Header, body []byte, respErr func(status int, body []byte) error) error {
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed, resp.StatusCode == http.StatusConflict:
+		// 409 is S3 losing a race between two conditional writes, or Azure
+		// refusing to overwrite with If-None-Match: *
+		return errPreconditionFailed
+	case resp.StatusCode >= 300:
+		return respErr(resp.StatusCode, respBody)
+	}
+
+	return nil
+}
+
+// casTag points repo:tag at id if it currently satisfies expected, see
+// SetExpectedID. read returns the tag's current ID and an ETag for it, both
+// empty if the tag doesn't exist. write stores id on condition that the tag
+// still has etag, or doesn't exist for an empty etag.
+func casTag(repo, tag string, id, expected ID, read func() (ID, string, error), write func(etag string) error) error {
+	actual, etag, err := read()
+	if err != nil {
+		return err
+	}
+
+	if !tagMatches(actual, expected) {
+		return &TagConflictError{Repo: repo, Tag: tag, Expected: expected, Actual: actual}
+	}
+
+	err = write(etag)
+	if err != errPreconditionFailed {
+		return err
+	}
+
+	// The tag moved since we read it. If it moved to id, that was either
+	// our own write answered too late and retried, or an identical push.
+	actual, _, err = read()
+	if err != nil {
+		return err
+	}
+
+	if actual == id {
+		return nil
+	}
+
+	return &TagConflictError{Repo: repo, Tag: tag, Expected: expected, Actual: actual}
+}
@@ -0,0 +1,124 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"dogestry/utils"
+)
+
+// objectDownloader pulls images from a store whose objects can be read from
+// an offset, resuming downloads with a journal.
+type objectDownloader struct {
+	store objectStore
+	// reads key from offset on, as stored
+	fetch   func(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+	retry   RetryPolicy
+	journal *Journal
+	// nil unless objects are encrypted
+	envelope *envelope
+}
+
+// pullImage downloads objects, the files of an image under prefix, to dst
+// and then the image's layer blob, if it has one.
+func (d objectDownloader) pullImage(ctx context.Context, prefix string, objects []objectInfo, dst string) error {
+	for _, object := range objects {
+		object := object
+		name := filepath.Join(dst, strings.TrimPrefix(object.Key, prefix))
+
+		// a failed download starts the file over (or from the last
+		// checkpoint with a journal), so retry whole files
+		err := d.retry.Do(ctx, "download "+object.Key, func() error {
+			return d.getFile(ctx, name, object)
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := d.envelope.openFile(object.Key, name); err != nil {
+			return err
+		}
+	}
+
+	return d.getLayerBlob(ctx, dst)
+}
+
+// getLayerBlob downloads the layer of an image pulled to dst from its blob,
+// if the image has one.
+func (d objectDownloader) getLayerBlob(ctx context.Context, dst string) error {
+	digest, ok, err := pulledLayerDigest(dst)
+	if err != nil || !ok {
+		return err
+	}
+
+	key, err := findBlob(ctx, d.store, digest)
+	if err != nil {
+		return err
+	}
+	codec, ok := blobCodec(digest, key)
+	if !ok {
+		return fmt.Errorf("layer blob %s is missing from the remote", digest)
+	}
+
+	object, err := d.store.statObject(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if d.journal == nil {
+		return streamBlobPull(ctx, d.retry, d.envelope, dst, digest, codec, object, func() (io.ReadCloser, error) {
+			return d.fetch(ctx, key, 0)
+		})
+	}
+
+	// a resumed download needs the blob as it's stored on disk
+	layer := filepath.Join(dst, "layer.tar"+codec.Ext)
+	err = d.retry.Do(ctx, "download "+key, func() error {
+		return d.getFile(ctx, layer, object)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := d.envelope.openFile(key, layer); err != nil {
+		return err
+	}
+
+	return finishBlobPull(dst, digest, codec)
+}
+
+// getFile downloads object to dst, resuming it with a journal.
+func (d objectDownloader) getFile(ctx context.Context, dst string, object objectInfo) error {
+	log.Printf("Pulling key %s (%s)\n", object.Key, utils.HumanSize(object.Size))
+
+	if d.journal != nil {
+		return resumeDownload(ctx, d.journal, dst, object.Key, object.ETag, object.Size, func(offset int64) (io.ReadCloser, error) {
+			return d.fetch(ctx, object.Key, offset)
+		})
+	}
+
+	rc, err := d.fetch(ctx, object.Key, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	to, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+
+	progressReader := utils.NewProgressReader(rc, object.Size, object.Key)
+	_, err = io.Copy(to, utils.NewLimitedReader(ctx, progressReader))
+	return err
+}
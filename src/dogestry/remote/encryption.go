@@ -0,0 +1,618 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"dogestry/config"
+	"dogestry/utils"
+)
+
+// encryptionFeature is the layout feature of remotes holding encrypted
+// objects, so that versions of dogestry that can't decrypt them refuse the
+// remote rather than reading ciphertext as tags.
+const encryptionFeature = "encryption"
+
+// Every encrypted object starts with envelopeMagic and a line of JSON, the
+// envelopeHeader, followed by the data in segments of up to SegmentSize
+// bytes, each sealed with AES-GCM under the object's own data key. The data
+// key is sealed with the key of the remote, the key encryption key. Both are
+// bound to the key of the object and its header, see additionalData.
+const envelopeMagic = "dogestry-envelope-v1\n"
+
+const envelopeSegmentSize = 64 * 1024
+
+// larger segments in headers are refused rather than allocated
+const maxSegmentSize = 16 * 1024 * 1024
+
+// PBKDF2-SHA256 rounds deriving a key from a passphrase
+const passphraseIterations = 200000
+
+// sealedExt is appended to the encrypted copies of files being pushed.
+const sealedExt = ".sealed"
+
+// errEncrypted is returned reading an encrypted object without a key.
+var errEncrypted = errors.New("object is encrypted, configure encryption-keyfile or encryption-passphrase for the remote")
+
+type envelopeHeader struct {
+	// "keyfile" or "passphrase"
+	KeyType string `json:"keyType"`
+	// identifies the key of a keyfile, to tell a wrong one apart from a
+	// corrupt object
+	KeyID string `json:"keyId,omitempty"`
+	// salt the passphrase was derived with
+	Salt []byte `json:"salt,omitempty"`
+	// nonce and sealed data key
+	WrappedKey []byte `json:"wrappedKey"`
+	// segment nonces are Nonce, the segment number and a flag set for the
+	// last segment
+	Nonce       []byte `json:"nonce"`
+	SegmentSize int    `json:"segmentSize"`
+}
+
+// envelope encrypts and decrypts objects with the key of a remote. A nil
+// envelope leaves objects in the clear, and refuses encrypted ones.
+type envelope struct {
+	keyType string
+	// the key of a keyfile, or the one derived for salt
+	key   []byte
+	keyID string
+	salt  []byte
+
+	// set once the remote is known to be encrypted, objects in the clear
+	// are refused then, apart from the layout descriptor
+	required bool
+
+	passphrase string
+	mu         sync.Mutex
+	// keys derived from the passphrase by salt, for objects sealed by
+	// other pushes
+	derived map[string][]byte
+}
+
+// newEnvelope returns the envelope for the encryption settings of a remote,
+// nil if it isn't encrypted.
+func newEnvelope(cfg config.Encryption) (*envelope, error) {
+	switch {
+	case cfg.KeyFile != "" && cfg.Passphrase != "":
+		return nil, errors.New("configure either encryption-keyfile or encryption-passphrase, not both")
+	case cfg.KeyFile != "":
+		key, err := readKeyFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &envelope{keyType: "keyfile", key: key, keyID: keyID(key)}, nil
+	case cfg.Passphrase != "":
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+
+		e := &envelope{keyType: "passphrase", passphrase: cfg.Passphrase, salt: salt, derived: make(map[string][]byte)}
+		key, err := e.derive(salt)
+		if err != nil {
+			return nil, err
+		}
+		e.key = key
+		return e, nil
+	}
+
+	return nil, nil
+}
+
+// readKeyFile reads a 32-byte key, stored raw, hex or base64 encoded.
+func readKeyFile(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 32 {
+		return data, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%s must hold a 32-byte key, raw, hex or base64 encoded", name)
+}
+
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (e *envelope) derive(salt []byte) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if key, ok := e.derived[string(salt)]; ok {
+		return key, nil
+	}
+
+	key, err := pbkdf2.Key(sha256.New, e.passphrase, salt, passphraseIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	e.derived[string(salt)] = key
+	return key, nil
+}
+
+// additionalData is what the data key and segments of the object key are
+// authenticated with besides themselves: the key of the object on the remote
+// and its header, so that an object can't be passed off as another one or
+// have its header altered. The data key is sealed before it's in the header,
+// so for it the header is serialized without WrappedKey.
+func additionalData(key string, header []byte) []byte {
+	ad := make([]byte, 4, 4+len(key)+len(header))
+	binary.BigEndian.PutUint32(ad, uint32(len(key)))
+	ad = append(ad, key...)
+	return append(ad, header...)
+}
+
+// wrapAdditionalData is the additionalData of the data key of the object key
+// with header h.
+func wrapAdditionalData(key string, h envelopeHeader) ([]byte, error) {
+	h.WrappedKey = nil
+	header, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return additionalData(key, header), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyFor returns the key encryption key of an object with header h.
+func (e *envelope) keyFor(h envelopeHeader) ([]byte, error) {
+	if h.KeyType != e.keyType {
+		return nil, fmt.Errorf("object is encrypted with a %s, the remote is configured with a %s", h.KeyType, e.keyType)
+	}
+
+	if e.keyType == "passphrase" {
+		return e.derive(h.Salt)
+	}
+
+	if h.KeyID != e.keyID {
+		return nil, fmt.Errorf("object is encrypted with key %s, the configured key is %s", h.KeyID, e.keyID)
+	}
+	return e.key, nil
+}
+
+// newSealer writes the header of a new object stored as key to w and returns
+// a writer encrypting the data into w. It must be closed to write the last
+// segment.
+func (e *envelope) newSealer(w io.Writer, key string) (io.WriteCloser, error) {
+	dataKey := make([]byte, 32)
+	nonce := make([]byte, 7)
+	wrapNonce := make([]byte, 12)
+	for _, b := range [][]byte{dataKey, nonce, wrapNonce} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+	}
+
+	kek, err := newGCM(e.key)
+	if err != nil {
+		return nil, err
+	}
+
+	h := envelopeHeader{
+		KeyType:     e.keyType,
+		KeyID:       e.keyID,
+		Salt:        e.salt,
+		Nonce:       nonce,
+		SegmentSize: envelopeSegmentSize,
+	}
+	wrapAD, err := wrapAdditionalData(key, h)
+	if err != nil {
+		return nil, err
+	}
+	h.WrappedKey = kek.Seal(wrapNonce, wrapNonce, dataKey, wrapAD)
+
+	header, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(w, envelopeMagic+string(header)+"\n"); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealer{w: w, aead: aead, nonce: nonce, ad: additionalData(key, header), buf: make([]byte, 0, envelopeSegmentSize)}, nil
+}
+
+// newOpener returns a reader decrypting r, the object stored as key. Objects
+// that aren't encrypted are read as they are.
+func (e *envelope) newOpener(r io.Reader, key string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(envelopeMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(magic) != envelopeMagic {
+		if err := e.checkClear(key); err != nil {
+			return nil, err
+		}
+		return br, nil
+	}
+	if e == nil {
+		return nil, errEncrypted
+	}
+
+	br.Discard(len(envelopeMagic))
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %v", err)
+	}
+
+	header := bytes.TrimSuffix(line, []byte("\n"))
+
+	var h envelopeHeader
+	if err := json.Unmarshal(header, &h); err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %v", err)
+	}
+	if h.SegmentSize <= 0 || h.SegmentSize > maxSegmentSize || len(h.Nonce) != 7 || len(h.WrappedKey) < 12 {
+		return nil, errors.New("invalid encryption header")
+	}
+
+	kek, err := e.keyFor(h)
+	if err != nil {
+		return nil, err
+	}
+
+	kekAEAD, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	wrapAD, err := wrapAdditionalData(key, h)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := kekAEAD.Open(nil, h.WrappedKey[:12], h.WrappedKey[12:], wrapAD)
+	if err != nil {
+		return nil, errors.New("unable to decrypt the key of the object, wrong passphrase, corrupt object or not stored as " + key)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &opener{r: br, aead: aead, nonce: h.Nonce, ad: additionalData(key, header), segment: make([]byte, h.SegmentSize+aead.Overhead())}, nil
+}
+
+func segmentNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type sealer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	ad    []byte
+	n     uint32
+	buf   []byte
+}
+
+func (s *sealer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full segment is only sealed once more data follows, the last
+		// one is sealed differently
+		if len(s.buf) == cap(s.buf) {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *sealer) flush(last bool) error {
+	sealed := s.aead.Seal(nil, segmentNonce(s.nonce, s.n, last), s.buf, s.ad)
+	s.n++
+	s.buf = s.buf[:0]
+
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+func (s *sealer) Close() error {
+	return s.flush(true)
+}
+
+type opener struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	ad      []byte
+	n       uint32
+	segment []byte
+	// decrypted data not read yet
+	buf  []byte
+	done bool
+}
+
+func (o *opener) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (o *opener) next() error {
+	n, err := io.ReadFull(o.r, o.segment)
+	last := false
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	case nil:
+		if _, err := o.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	plain, err := o.aead.Open(o.segment[:0], segmentNonce(o.nonce, o.n, last), o.segment[:n], o.ad)
+	if err != nil {
+		return errors.New("encrypted object is corrupt or truncated")
+	}
+
+	o.n++
+	o.buf = plain
+	o.done = last
+	return nil
+}
+
+// seal encrypts data, to be stored as key. A nil envelope returns it as it
+// is.
+func (e *envelope) seal(key string, data []byte) ([]byte, error) {
+	if e == nil {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	w, err := e.newSealer(&buf, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// sealObject encrypts the data of the object key. The layout descriptor is
+// left in the clear, it tells readers the remote is encrypted.
+func (e *envelope) sealObject(key string, data []byte) ([]byte, error) {
+	if key == LayoutKey {
+		return data, nil
+	}
+	return e.seal(key, data)
+}
+
+// checkClear fails for the object key, found in the clear, if the remote is
+// encrypted. Otherwise anyone able to write to it could swap a sealed tag
+// for one of their own.
+func (e *envelope) checkClear(key string) error {
+	if e == nil || !e.required || key == LayoutKey {
+		return nil
+	}
+	return fmt.Errorf("%s isn't encrypted, but the remote is", key)
+}
+
+// open decrypts data, the object stored as key, if it's encrypted.
+func (e *envelope) open(key string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		if err := e.checkClear(key); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	r, err := e.newOpener(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// openReader decrypts what's read from rc, the object stored as key, if it's
+// encrypted.
+func (e *envelope) openReader(key string, rc io.ReadCloser) (io.ReadCloser, error) {
+	r, err := e.newOpener(rc, key)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, rc}, nil
+}
+
+// sealFile writes an encrypted copy of src for pushing as key, and returns
+// its path and sha1. The copy is named after the sha1 of src, so one left by
+// an interrupted push is reused and its upload can be resumed.
+func (e *envelope) sealFile(key, src, sum string) (string, string, error) {
+	dst := src + "." + sum + sealedExt
+
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		if err := e.writeSealed(key, src, dst); err != nil {
+			return "", "", err
+		}
+	} else if err != nil {
+		return "", "", err
+	}
+
+	sealedSum, err := utils.Sha1File(dst)
+	return dst, sealedSum, err
+}
+
+func (e *envelope) writeSealed(key, src, dst string) error {
+	from, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	tmp := dst + ".tmp"
+	to, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer to.Close()
+
+	w, err := e.newSealer(to, key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, from); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := to.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// openFile decrypts the file at name, pulled from key, in place if it's
+// encrypted.
+func (e *envelope) openFile(key, name string) error {
+	from, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	r, err := e.newOpener(from, key)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if _, ok := r.(*opener); !ok {
+		return nil
+	}
+
+	tmp := name + ".tmp"
+	to, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer to.Close()
+
+	if _, err := io.Copy(to, r); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if err := to.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// checkEncryption fails if the remote behind store is encrypted but no key
+// is configured for it. With a key, objects of an encrypted remote must be
+// sealed from then on.
+func checkEncryption(ctx context.Context, store objectStore, e *envelope) error {
+	layout, _, err := readLayout(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	if !layout.HasFeature(encryptionFeature) {
+		return nil
+	}
+	if e == nil {
+		return errors.New("remote is encrypted, configure encryption-keyfile or encryption-passphrase for it")
+	}
+	e.required = true
+	return nil
+}
+
+// markEncrypted adds encryptionFeature to the layout of the remote behind
+// store before the first encrypted push to it. Objects are sealed for their
+// key, so the remote must store layers as blobs already: migrating would
+// move them.
+func markEncrypted(ctx context.Context, store objectStore) error {
+	layout, etag, err := readLayout(ctx, store)
+	if err != nil || layout.HasFeature(encryptionFeature) {
+		return err
+	}
+	if layout.Version < blobsLayoutVersion {
+		return fmt.Errorf("remote has layout version %d, run 'dogestry migrate' before pushing encrypted images to it", layout.Version)
+	}
+
+	log.Printf("Marking the remote as encrypted in %s", LayoutKey)
+	layout.Features = append(layout.Features, encryptionFeature)
+	_, err = writeLayout(ctx, store, layout, etag)
+	return err
+}
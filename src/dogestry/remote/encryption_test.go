@@ -0,0 +1,257 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"dogestry/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type EncryptionSuite struct {
+	fake      *fakeS3
+	remote    *S3Remote
+	imageRoot string
+	keyFile   string
+}
+
+var _ = Suite(&EncryptionSuite{})
+
+func (s *EncryptionSuite) SetUpTest(c *C) {
+	s.fake, s.remote, s.imageRoot = setUpLayoutRemote(c, 3)
+
+	s.keyFile = filepath.Join(c.MkDir(), "key")
+	c.Assert(ioutil.WriteFile(s.keyFile, []byte(hex.EncodeToString(bytes.Repeat([]byte{7}, 32))+"\n"), 0600), IsNil)
+
+	var err error
+	s.remote.envelope, err = newEnvelope(config.Encryption{KeyFile: s.keyFile})
+	c.Assert(err, IsNil)
+}
+
+func (s *EncryptionSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+func (s *EncryptionSuite) TestRoundTrip(c *C) {
+	e, err := newEnvelope(config.Encryption{Passphrase: "secret"})
+	c.Assert(err, IsNil)
+
+	for _, size := range []int{0, 1, envelopeSegmentSize - 1, envelopeSegmentSize, envelopeSegmentSize + 1, 3 * envelopeSegmentSize} {
+		data := bytes.Repeat([]byte("x"), size)
+
+		sealed, err := e.seal("key", data)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.HasPrefix(sealed, []byte(envelopeMagic)), Equals, true)
+		c.Assert(bytes.Contains(sealed, []byte("xxxx")), Equals, false)
+
+		opened, err := e.open("key", sealed)
+		c.Assert(err, IsNil, Commentf("size %d", size))
+		c.Assert(opened, DeepEquals, data, Commentf("size %d", size))
+	}
+
+	// another process derives its own salt, but reads objects sealed here
+	other, err := newEnvelope(config.Encryption{Passphrase: "secret"})
+	c.Assert(err, IsNil)
+	sealed, err := e.seal("key", []byte("layer"))
+	c.Assert(err, IsNil)
+	opened, err := other.open("key", sealed)
+	c.Assert(err, IsNil)
+	c.Assert(string(opened), Equals, "layer")
+
+	wrong, err := newEnvelope(config.Encryption{Passphrase: "guess"})
+	c.Assert(err, IsNil)
+	_, err = wrong.open("key", sealed)
+	c.Assert(err, ErrorMatches, "unable to decrypt the key of the object, .*")
+}
+
+func (s *EncryptionSuite) TestTamperedObject(c *C) {
+	e := s.remote.envelope
+	data := bytes.Repeat([]byte("x"), 2*envelopeSegmentSize+10)
+
+	sealed, err := e.seal("key", data)
+	c.Assert(err, IsNil)
+
+	// the last segment is missing
+	_, err = e.open("key", sealed[:len(sealed)-26])
+	c.Assert(err, ErrorMatches, "encrypted object is corrupt or truncated")
+
+	flipped := append([]byte{}, sealed...)
+	flipped[len(flipped)-100] ^= 1
+	_, err = e.open("key", flipped)
+	c.Assert(err, ErrorMatches, "encrypted object is corrupt or truncated")
+}
+
+func (s *EncryptionSuite) TestBoundToKey(c *C) {
+	e := s.remote.envelope
+	sealed, err := e.seal("repositories/app/latest", []byte("tag"))
+	c.Assert(err, IsNil)
+
+	// an object can't be passed off as another
+	_, err = e.open("repositories/app/stable", sealed)
+	c.Assert(err, ErrorMatches, "unable to decrypt the key of the object, .*")
+
+	// nor have its header changed, even in ways that read the same
+	header := bytes.Index(sealed, []byte(`{"keyType":`))
+	altered := append(append(append([]byte{}, sealed[:header]...), []byte(`{ "keyType":`)...), sealed[header+len(`{"keyType":`):]...)
+	_, err = e.open("repositories/app/latest", altered)
+	c.Assert(err, ErrorMatches, "encrypted object is corrupt or truncated")
+
+	opened, err := e.open("repositories/app/latest", sealed)
+	c.Assert(err, IsNil)
+	c.Assert(string(opened), Equals, "tag")
+
+	// swapping pushed objects is noticed too
+	ctx := context.Background()
+	c.Assert(s.remote.Push(ctx, "app:latest", s.imageRoot), IsNil)
+	tag, _ := s.fake.get("repositories/app/latest")
+	s.fake.put("repositories/app/stable", tag)
+	_, err = s.remote.ParseTag(ctx, "app", "stable")
+	c.Assert(err, ErrorMatches, "unable to decrypt the key of the object, .*")
+}
+
+func (s *EncryptionSuite) TestEncryptOldLayout(c *C) {
+	fake, remote, imageRoot := setUpLayoutRemote(c, 1)
+	defer fake.Close()
+	remote.envelope = s.remote.envelope
+
+	err := remote.Push(context.Background(), "app:latest", imageRoot)
+	c.Assert(err, ErrorMatches, "remote has layout version 1, run 'dogestry migrate' before pushing encrypted images to it")
+}
+
+func (s *EncryptionSuite) TestKeys(c *C) {
+	other := filepath.Join(c.MkDir(), "other")
+	c.Assert(ioutil.WriteFile(other, bytes.Repeat([]byte{8}, 32), 0600), IsNil)
+	e, err := newEnvelope(config.Encryption{KeyFile: other})
+	c.Assert(err, IsNil)
+
+	sealed, err := s.remote.envelope.seal("key", []byte("tag"))
+	c.Assert(err, IsNil)
+	_, err = e.open("key", sealed)
+	c.Assert(err, ErrorMatches, "object is encrypted with key [0-9a-f]{16}, the configured key is [0-9a-f]{16}")
+
+	// plain objects are read as they are, encrypted ones need a key
+	var none *envelope
+	opened, err := none.open("key", []byte("tag"))
+	c.Assert(err, IsNil)
+	c.Assert(string(opened), Equals, "tag")
+	_, err = none.open("key", sealed)
+	c.Assert(err, Equals, errEncrypted)
+
+	c.Assert(ioutil.WriteFile(other, []byte("short"), 0600), IsNil)
+	_, err = newEnvelope(config.Encryption{KeyFile: other})
+	c.Assert(err, ErrorMatches, ".* must hold a 32-byte key, raw, hex or base64 encoded")
+
+	_, err = newEnvelope(config.Encryption{KeyFile: other, Passphrase: "secret"})
+	c.Assert(err, ErrorMatches, "configure either .*")
+}
+
+func (s *EncryptionSuite) TestPush(c *C) {
+	ctx := context.Background()
+	c.Assert(s.remote.Push(ctx, "app:latest", s.imageRoot), IsNil)
+
+	layout, err := s.remote.Layout(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(layout.HasFeature(encryptionFeature), Equals, true)
+
+	for _, key := range s.fake.keys() {
+		if key == LayoutKey || strings.HasSuffix(key, ".md5") {
+			continue
+		}
+
+		content, _ := s.fake.get(key)
+		c.Assert(strings.HasPrefix(content, envelopeMagic), Equals, true, Commentf("%s isn't encrypted", key))
+		c.Assert(strings.Contains(content, pushImageId), Equals, false, Commentf("%s leaks the image ID", key))
+	}
+
+	// reads decrypt
+	id, err := s.remote.ParseTag(ctx, "app", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID(pushImageId))
+
+	img, err := s.remote.ImageMetadata(ctx, pushImageId)
+	c.Assert(err, IsNil)
+	c.Assert(img.ID, Equals, pushImageId)
+
+	history, err := s.remote.TagHistory(ctx, "app", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 1)
+
+	// without the key the remote is refused
+	s.remote.envelope = nil
+	c.Assert(s.remote.Validate(ctx), ErrorMatches, "remote is encrypted, .*")
+}
+
+func (s *EncryptionSuite) TestPull(c *C) {
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	azure := newFakeAzure()
+	defer azure.Close()
+
+	for _, key := range s.fake.keys() {
+		content, _ := s.fake.get(key)
+		azure.put("container/"+key, content)
+	}
+
+	r := azure.remote("container")
+	r.envelope = s.remote.envelope
+
+	ctx := context.Background()
+	id, err := r.ParseTag(ctx, "app", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID(pushImageId))
+
+	dst := filepath.Join(c.MkDir(), pushImageId)
+	c.Assert(r.PullImageId(ctx, pushImageId, dst), IsNil)
+
+	for name, content := range map[string]string{
+		"json":      `{"id":"` + pushImageId + `"}`,
+		"VERSION":   "1.0",
+		"layer.tar": "layer contents",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dst, name))
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, content)
+	}
+
+	r.envelope = nil
+	c.Assert(r.Validate(ctx), ErrorMatches, "remote is encrypted, .*")
+	_, err = r.ParseTag(ctx, "app", "latest")
+	c.Assert(err, Equals, errEncrypted)
+}
+
+func (s *EncryptionSuite) TestPlaintextSwapped(c *C) {
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	azure := newFakeAzure()
+	defer azure.Close()
+
+	// somebody with write access to the container swaps sealed objects for
+	// their own, in the clear
+	for _, key := range s.fake.keys() {
+		content, _ := s.fake.get(key)
+		switch key {
+		case "repositories/app/latest":
+			content = "bbbb"
+		case "images/" + pushImageId + "/json":
+			content = `{"id":"` + pushImageId + `","config":{"Cmd":["evil"]}}`
+		}
+		azure.put("container/"+key, content)
+	}
+
+	r := azure.remote("container")
+	r.envelope = s.remote.envelope
+
+	ctx := context.Background()
+	c.Assert(r.Validate(ctx), IsNil)
+
+	_, err := r.ParseTag(ctx, "app", "latest")
+	c.Assert(err, ErrorMatches, "repositories/app/latest isn't encrypted, but the remote is")
+
+	dst := filepath.Join(c.MkDir(), pushImageId)
+	c.Assert(r.PullImageId(ctx, pushImageId, dst), ErrorMatches, "error downloading files from S3")
+}
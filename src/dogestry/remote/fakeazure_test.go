@@ -0,0 +1,168 @@
+package remote
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"dogestry/config"
+)
+
+// fakeAzure is an in-memory Azure blob service, speaking enough of the REST
+// API for listing and reading blobs. The storage client always talks to
+// <account>.blob.core.windows.net, so while it's open every connection made
+// through http.DefaultTransport ends up here.
+type fakeAzure struct {
+	mu     sync.Mutex
+	server *httptest.Server
+	// by container/name
+	blobs map[string][]byte
+
+	// blobs per listing when it doesn't ask for fewer
+	pageSize int
+	// requests made, as "METHOD path?query"
+	requests []string
+	// the Authorization header of each request
+	authorizations []string
+	// path of the blob endpoint, eg. Azurite's account
+	pathPrefix string
+
+	transport http.RoundTripper
+}
+
+func newFakeAzure() *fakeAzure {
+	f := &fakeAzure{blobs: make(map[string][]byte), pageSize: 5000}
+	f.server = httptest.NewTLSServer(f)
+
+	addr := f.server.Listener.Addr().String()
+	f.transport = http.DefaultTransport
+	http.DefaultTransport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	return f
+}
+
+func (f *fakeAzure) Close() {
+	http.DefaultTransport = f.transport
+	f.server.Close()
+}
+
+// remote returns an AzureRemote for blobSpec, a container and optional path.
+func (f *fakeAzure) remote(blobSpec string) *AzureRemote {
+	cfg := config.Config{}
+	cfg.Azure.Active = true
+	cfg.Azure.AccountName = "fake"
+	cfg.Azure.AccountKey = base64.StdEncoding.EncodeToString([]byte("fake key"))
+	cfg.SetBlobSpec(blobSpec)
+
+	return &AzureRemote{config: cfg}
+}
+
+func (f *fakeAzure) put(name, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blobs[name] = []byte(content)
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+	f.authorizations = append(f.authorizations, r.Header.Get("Authorization"))
+
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, f.pathPrefix), "/")
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == "GET" && query.Get("comp") == "list":
+		f.list(w, name, query)
+	case r.Method == "HEAD" || r.Method == "GET":
+		content, ok := f.blobs[name]
+		if !ok {
+			// HEAD responses have no body, not even for errors
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("Etag", etag(content))
+		if r.Method == "GET" {
+			w.Write(content)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeAzure) list(w http.ResponseWriter, container string, query map[string][]string) {
+	get := func(name string) string {
+		if len(query[name]) > 0 {
+			return query[name][0]
+		}
+		return ""
+	}
+
+	prefix := container + "/" + get("prefix")
+	max := f.pageSize
+	if n, err := strconv.Atoi(get("maxresults")); err == nil && n < max {
+		max = n
+	}
+
+	// markers are opaque to clients, so don't hand out plain names
+	after := ""
+	if marker := get("marker"); marker != "" {
+		decoded, _ := base64.URLEncoding.DecodeString(marker)
+		after = container + "/" + string(decoded)
+	}
+
+	var names []string
+	for name := range f.blobs {
+		if strings.HasPrefix(name, prefix) && name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	type properties struct {
+		ContentLength int64 `xml:"Content-Length"`
+		Etag          string
+	}
+	type blob struct {
+		Name       string
+		Properties properties
+	}
+	result := struct {
+		XMLName    xml.Name `xml:"EnumerationResults"`
+		Prefix     string
+		Marker     string
+		NextMarker string
+		Blobs      []blob `xml:"Blobs>Blob"`
+	}{Prefix: get("prefix"), Marker: get("marker")}
+
+	if len(names) > max {
+		names = names[:max]
+		last := strings.TrimPrefix(names[max-1], container+"/")
+		result.NextMarker = base64.URLEncoding.EncodeToString([]byte(last))
+	}
+
+	for _, name := range names {
+		content := f.blobs[name]
+		result.Blobs = append(result.Blobs, blob{strings.TrimPrefix(name, container+"/"), properties{int64(len(content)), etag(content)}})
+	}
+
+	writeXML(w, result)
+}
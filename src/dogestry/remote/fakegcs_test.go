@@ -0,0 +1,375 @@
+package remote
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeGCS is an in-memory Google Cloud Storage server, speaking enough of
+// the JSON API for a remote, with a token endpoint for service accounts.
+type fakeGCS struct {
+	mu     sync.Mutex
+	server *httptest.Server
+	bucket string
+
+	// by name
+	objects    map[string]*fakeGCSObject
+	generation int64
+	// resumable upload sessions by id
+	sessions map[string]*fakeGCSSession
+
+	// objects per listing
+	pageSize int
+	// requests made, as "METHOD path?query"
+	requests []string
+
+	// the service account the token endpoint accepts assertions of, and
+	// the token it issues. Storage requests need it when set.
+	key   *rsa.PrivateKey
+	token string
+	// chunks to only keep half of before failing with a 503
+	failChunks int
+	// chunks after which their session is forgotten, as if it expired
+	expireChunks int
+}
+
+type fakeGCSObject struct {
+	data       []byte
+	generation int64
+}
+
+type fakeGCSSession struct {
+	name string
+	size int64
+	data []byte
+}
+
+func newFakeGCS(bucket string) *fakeGCS {
+	f := &fakeGCS{
+		bucket:   bucket,
+		objects:  make(map[string]*fakeGCSObject),
+		sessions: make(map[string]*fakeGCSSession),
+		pageSize: 1000,
+	}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeGCS) Close() {
+	f.server.Close()
+}
+
+func (f *fakeGCS) put(name, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.generation++
+	f.objects[name] = &fakeGCSObject{data: []byte(data), generation: f.generation}
+}
+
+func (f *fakeGCS) get(name string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.objects[name]
+	if !ok {
+		return "", false
+	}
+	return string(object.data), true
+}
+
+// serviceAccount generates the key of a service account and returns its
+// credentials file, whose assertions the token endpoint then requires.
+func (f *fakeGCS) serviceAccount() ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	f.key, f.token = key, "ya29.fake"
+	f.mu.Unlock()
+
+	return json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "dogestry@project.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      f.server.URL + "/token",
+	})
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.EscapedPath()+"?"+r.URL.RawQuery)
+
+	if r.URL.Path == "/token" {
+		f.issueToken(w, r)
+		return
+	}
+
+	if f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token {
+		f.error(w, http.StatusUnauthorized, "authError", "Invalid Credentials")
+		return
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		s, err := url.PathUnescape(segment)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		segments = append(segments, s)
+	}
+
+	if r.Method == "PUT" && len(segments) == 3 && segments[0] == "upload" && segments[1] == "session" {
+		f.putChunk(w, r, segments[2])
+		return
+	}
+
+	upload := len(segments) > 0 && segments[0] == "upload"
+	if upload {
+		segments = segments[1:]
+	}
+
+	switch {
+	case len(segments) < 4 || segments[0] != "storage" || segments[3] != f.bucket:
+		f.error(w, http.StatusNotFound, "notFound", "Not Found")
+	case upload && r.Method == "POST":
+		f.upload(w, r)
+	case len(segments) == 4 && r.Method == "GET":
+		json.NewEncoder(w).Encode(map[string]string{"name": f.bucket})
+	case len(segments) == 5 && r.Method == "GET":
+		f.list(w, r)
+	case len(segments) == 6 && r.Method == "GET":
+		f.getObject(w, r, segments[5])
+	case len(segments) == 6 && r.Method == "DELETE":
+		if _, ok := f.objects[segments[5]]; !ok {
+			f.error(w, http.StatusNotFound, "notFound", "No such object")
+			return
+		}
+		delete(f.objects, segments[5])
+		w.WriteHeader(http.StatusNoContent)
+	case len(segments) == 11 && r.Method == "POST" && segments[6] == "rewriteTo":
+		src, ok := f.objects[segments[5]]
+		if !ok {
+			f.error(w, http.StatusNotFound, "notFound", "No such object")
+			return
+		}
+		object := f.store(segments[10], src.data)
+		json.NewEncoder(w).Encode(map[string]interface{}{"done": true, "resource": object})
+	default:
+		http.Error(w, "unsupported", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeGCS) error(w http.ResponseWriter, status int, reason, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %q, "errors": [{"reason": %q}]}}`, status, message, reason)
+}
+
+// store writes a new generation of name and returns its metadata.
+func (f *fakeGCS) store(name string, data []byte) map[string]string {
+	f.generation++
+	f.objects[name] = &fakeGCSObject{data: data, generation: f.generation}
+	return f.metadata(name)
+}
+
+func (f *fakeGCS) metadata(name string) map[string]string {
+	object := f.objects[name]
+	return map[string]string{
+		"bucket":     f.bucket,
+		"name":       name,
+		"size":       strconv.Itoa(len(object.data)),
+		"generation": strconv.FormatInt(object.generation, 10),
+	}
+}
+
+func (f *fakeGCS) getObject(w http.ResponseWriter, r *http.Request, name string) {
+	object, ok := f.objects[name]
+	if !ok {
+		f.error(w, http.StatusNotFound, "notFound", "No such object: "+f.bucket+"/"+name)
+		return
+	}
+
+	if r.URL.Query().Get("alt") != "media" {
+		json.NewEncoder(w).Encode(f.metadata(name))
+		return
+	}
+
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(object.generation, 10))
+	if rng := r.Header.Get("Range"); rng != "" {
+		var offset int
+		fmt.Sscanf(rng, "bytes=%d-", &offset)
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(object.data[offset:])
+		return
+	}
+	w.Write(object.data)
+}
+
+func (f *fakeGCS) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// page tokens are the index of the first object of the page
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	if start > len(names) {
+		start = len(names)
+	}
+	end := start + f.pageSize
+	list := map[string]interface{}{}
+	if end < len(names) {
+		list["nextPageToken"] = strconv.Itoa(end)
+	} else {
+		end = len(names)
+	}
+
+	var items []map[string]string
+	for _, name := range names[start:end] {
+		items = append(items, f.metadata(name))
+	}
+	list["items"] = items
+
+	json.NewEncoder(w).Encode(list)
+}
+
+func (f *fakeGCS) upload(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+
+	if match := query.Get("ifGenerationMatch"); match != "" {
+		generation := int64(0)
+		if object, ok := f.objects[name]; ok {
+			generation = object.generation
+		}
+		if match != strconv.FormatInt(generation, 10) {
+			f.error(w, http.StatusPreconditionFailed, "conditionNotMet", "At least one of the pre-conditions you specified did not hold.")
+			return
+		}
+	}
+
+	switch query.Get("uploadType") {
+	case "media":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(f.store(name, data))
+	case "resumable":
+		size, _ := strconv.ParseInt(r.Header.Get("X-Upload-Content-Length"), 10, 64)
+		id := strconv.Itoa(len(f.sessions) + 1)
+		f.sessions[id] = &fakeGCSSession{name: name, size: size}
+		w.Header().Set("Location", f.server.URL+"/upload/session/"+id)
+	default:
+		http.Error(w, "unsupported uploadType", http.StatusBadRequest)
+	}
+}
+
+// putChunk takes a chunk of a resumable upload, or answers how much of it
+// was received.
+func (f *fakeGCS) putChunk(w http.ResponseWriter, r *http.Request, id string) {
+	session, ok := f.sessions[id]
+	if !ok {
+		f.error(w, http.StatusNotFound, "notFound", "No such upload session")
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var first, last, size int64
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &size); err == nil {
+		if first != int64(len(session.data)) || last-first+1 != int64(len(data)) {
+			http.Error(w, "unexpected range "+r.Header.Get("Content-Range"), http.StatusBadRequest)
+			return
+		}
+
+		if f.failChunks > 0 {
+			f.failChunks--
+			session.data = append(session.data, data[:len(data)/2]...)
+			f.error(w, http.StatusServiceUnavailable, "backendError", "Backend Error")
+			return
+		}
+		session.data = append(session.data, data...)
+
+		if f.expireChunks > 0 && int64(len(session.data)) < session.size {
+			f.expireChunks--
+			delete(f.sessions, id)
+		}
+	}
+
+	if int64(len(session.data)) == session.size {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(f.store(session.name, session.data))
+		return
+	}
+
+	if len(session.data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+// issueToken checks the JWT assertion of the service account.
+func (f *fakeGCS) issueToken(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || f.key == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "unsupported_grant_type"}`)
+		return
+	}
+
+	parts := strings.Split(r.FormValue("assertion"), ".")
+	var claims struct {
+		Iss   string `json:"iss"`
+		Scope string `json:"scope"`
+		Aud   string `json:"aud"`
+	}
+	if len(parts) == 3 {
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if rsa.VerifyPKCS1v15(&f.key.PublicKey, crypto.SHA256, digest[:], signature) == nil {
+			json.Unmarshal(payload, &claims)
+		}
+	}
+
+	if claims.Iss != "dogestry@project.iam.gserviceaccount.com" || claims.Scope != gcsScope || claims.Aud != f.server.URL+"/token" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "Invalid JWT Signature."}`)
+		return
+	}
+
+	fmt.Fprintf(w, `{"access_token": %q, "expires_in": 3599, "token_type": "Bearer"}`, f.token)
+}
@@ -0,0 +1,380 @@
+package remote
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dogestry/config"
+	"dogestry/s3"
+	"github.com/AdRoll/goamz/aws"
+)
+
+// fakeS3 is an in-memory S3 bucket, speaking enough of the path style REST
+// API for goamz: objects with range gets, conditional puts and copies,
+// listings with markers and multipart uploads. Unlike testutil.HTTPServer it
+// answers requests in any order, so it works with parallel workers.
+type fakeS3 struct {
+	mu      sync.Mutex
+	server  *httptest.Server
+	objects map[string][]byte
+	uploads map[string]*fakeUpload
+	nextID  int
+
+	// keys in the order they were written
+	writes []string
+	// x-amz-* headers of the last write of each key
+	written map[string]http.Header
+	// max-keys used when a listing doesn't ask for fewer
+	pageSize int
+	// requests made, as "METHOD path?query"
+	requests []string
+	// the security token of each request, in its headers or presigned URL
+	tokens []string
+	// requests for which fail returns true get a 403
+	fail func(method, key string) bool
+	// requests for which drop returns true have their connection closed
+	// without an answer
+	drop func(method, key string) bool
+}
+
+type fakeUpload struct {
+	key     string
+	parts   map[int][]byte
+	headers http.Header
+}
+
+func newFakeS3() *fakeS3 {
+	f := &fakeS3{
+		objects:  make(map[string][]byte),
+		uploads:  make(map[string]*fakeUpload),
+		written:  make(map[string]http.Header),
+		pageSize: 1000,
+	}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeS3) Close() {
+	f.server.Close()
+}
+
+// remote returns an S3Remote for bucket on the fake server.
+func (f *fakeS3) remote(bucket string) *S3Remote {
+	auth, _ := aws.GetAuth("abc", "123", "", time.Time{})
+	client := s3.New(auth, aws.Region{Name: "faux-region-1", S3Endpoint: f.server.URL})
+
+	cfg := config.Config{}
+	cfg.SetS3URL("s3://" + bucket + "/")
+
+	return &S3Remote{
+		config:     cfg,
+		BucketName: bucket,
+		client:     client,
+		endpoint:   s3Endpoint{region: client.Region},
+	}
+}
+
+func (f *fakeS3) put(key, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = []byte(content)
+}
+
+func (f *fakeS3) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, ok := f.objects[key]
+	return string(content), ok
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func etag(content []byte) string {
+	sum := md5.Sum(content)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+	token := r.Header.Get("X-Amz-Security-Token")
+	if token == "" {
+		token = r.URL.Query().Get("x-amz-security-token")
+	}
+	f.tokens = append(f.tokens, token)
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if f.fail != nil && f.fail(r.Method, key) {
+		writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	if f.drop != nil && f.drop(r.Method, key) {
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+		}
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == "GET":
+		f.list(w, query)
+	case r.Method == "POST" && query["uploads"] != nil:
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = &fakeUpload{key: key, parts: make(map[int][]byte), headers: amzHeaders(r.Header)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Key      string
+			UploadId string
+		}{Key: key, UploadId: id})
+	case query.Get("uploadId") != "":
+		f.multipart(w, r.Method, key, query, body)
+	case r.Method == "PUT":
+		current, exists := f.objects[key]
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || etag(current) != match) {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		source := r.Header.Get("x-amz-copy-source")
+		if source != "" {
+			source, _ = url.PathUnescape(source)
+			parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+			copied, ok := f.objects[parts[len(parts)-1]]
+			if !ok {
+				writeError(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			body = copied
+		}
+
+		f.objects[key] = body
+		f.writes = append(f.writes, key)
+		f.written[key] = amzHeaders(r.Header)
+		w.Header().Set("ETag", etag(body))
+
+		if source != "" {
+			writeXML(w, struct {
+				XMLName      xml.Name `xml:"CopyObjectResult"`
+				ETag         string
+				LastModified string
+			}{ETag: etag(body), LastModified: "2015-01-01T00:00:00.000Z"})
+		}
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" || r.Method == "HEAD":
+		content, ok := f.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		w.Header().Set("ETag", etag(content))
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); strings.HasPrefix(rng, "bytes=") {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+			content = content[start:]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(status)
+		if r.Method == "GET" {
+			w.Write(content)
+		}
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// amzHeaders returns the x-amz-* headers of a request, but the ones every
+// request has.
+func amzHeaders(h http.Header) http.Header {
+	amz := http.Header{}
+	for name, values := range h {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") && name != "x-amz-date" && name != "x-amz-copy-source" {
+			amz[name] = values
+		}
+	}
+	return amz
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query map[string][]string) {
+	get := func(name string) string {
+		if len(query[name]) > 0 {
+			return query[name][0]
+		}
+		return ""
+	}
+
+	prefix, marker := get("prefix"), get("marker")
+	max := f.pageSize
+	if n, err := strconv.Atoi(get("max-keys")); err == nil && n < max {
+		max = n
+	}
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type contents struct {
+		Key          string
+		Size         int64
+		ETag         string
+		LastModified string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Prefix      string
+		Marker      string
+		MaxKeys     int
+		IsTruncated bool
+		NextMarker  string `xml:",omitempty"`
+		Contents    []contents
+	}{Prefix: prefix, Marker: marker, MaxKeys: max}
+
+	if len(keys) > max {
+		keys = keys[:max]
+		result.IsTruncated = true
+		// like S3, only set with a delimiter; clients use the last key
+		if get("delimiter") != "" {
+			result.NextMarker = keys[max-1]
+		}
+	}
+
+	for _, key := range keys {
+		content := f.objects[key]
+		result.Contents = append(result.Contents, contents{key, int64(len(content)), etag(content), "2015-01-01T00:00:00.000Z"})
+	}
+
+	writeXML(w, result)
+}
+
+func (f *fakeS3) multipart(w http.ResponseWriter, method, key string, query map[string][]string, body []byte) {
+	id := query["uploadId"][0]
+	up, ok := f.uploads[id]
+	if !ok || up.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	switch method {
+	case "PUT":
+		n, _ := strconv.Atoi(query["partNumber"][0])
+		up.parts[n] = body
+		w.Header().Set("ETag", etag(body))
+	case "GET":
+		type part struct {
+			PartNumber int
+			ETag       string
+			Size       int64
+		}
+		result := struct {
+			XMLName xml.Name `xml:"ListPartsResult"`
+			Part    []part
+		}{}
+		var numbers []int
+		for n := range up.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		for _, n := range numbers {
+			result.Part = append(result.Part, part{n, etag(up.parts[n]), int64(len(up.parts[n]))})
+		}
+		writeXML(w, result)
+	case "POST":
+		complete := struct {
+			Part []struct {
+				PartNumber int
+				ETag       string
+			}
+		}{}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+
+		var content, sums []byte
+		for _, p := range complete.Part {
+			data, ok := up.parts[p.PartNumber]
+			// s3gof3r leaves the quotes out
+			if !ok || strings.Trim(etag(data), `"`) != strings.Trim(p.ETag, `"`) {
+				writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			content = append(content, data...)
+			sum := md5.Sum(data)
+			sums = append(sums, sum[:]...)
+		}
+
+		f.objects[key] = content
+		f.writes = append(f.writes, key)
+		f.written[key] = up.headers
+		delete(f.uploads, id)
+
+		sum := md5.Sum(sums)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string
+			ETag    string
+		}{Key: key, ETag: fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(complete.Part))})
+	case "DELETE":
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
@@ -0,0 +1,212 @@
+package remote
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fakeSFTP is an in-process SSH server that serves SFTP on a directory,
+// letting in the client key it generates.
+type fakeSFTP struct {
+	listener net.Listener
+	// of the agent, once started
+	agentListener net.Listener
+	dir           string
+	config        *ssh.ServerConfig
+
+	hostKey   ssh.Signer
+	clientKey ed25519.PrivateKey
+
+	mu sync.Mutex
+	// live connections, to drop
+	conns []*ssh.ServerConn
+	// connections made so far
+	logins int
+	// the users that logged in, by login
+	users []string
+}
+
+func newFakeSFTP(dir string) (*fakeSFTP, error) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	clientPub, err := ssh.NewPublicKey(clientKey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fakeSFTP{dir: dir, hostKey: hostSigner, clientKey: clientKey}
+	f.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientPub.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	f.config.AddHostKey(hostSigner)
+
+	f.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go f.serve()
+	return f, nil
+}
+
+func (f *fakeSFTP) Addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeSFTP) Close() {
+	f.listener.Close()
+	if f.agentListener != nil {
+		f.agentListener.Close()
+	}
+	f.drop()
+}
+
+// drop closes the connections made so far.
+func (f *fakeSFTP) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeSFTP) serve() {
+	for {
+		netConn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			conn, chans, reqs, err := ssh.NewServerConn(netConn, f.config)
+			if err != nil {
+				netConn.Close()
+				return
+			}
+
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.logins++
+			f.users = append(f.users, conn.User())
+			f.mu.Unlock()
+
+			go ssh.DiscardRequests(reqs)
+			for newChan := range chans {
+				if newChan.ChannelType() != "session" {
+					newChan.Reject(ssh.UnknownChannelType, "unsupported")
+					continue
+				}
+				go f.session(newChan)
+			}
+		}()
+	}
+}
+
+// session serves the sftp subsystem, and nothing else.
+func (f *fakeSFTP) session(newChan ssh.NewChannel) {
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	for req := range reqs {
+		// the payload is the length prefixed name of the subsystem
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+
+		server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(f.dir))
+		if err != nil {
+			return
+		}
+		server.Serve()
+		server.Close()
+		return
+	}
+}
+
+// knownHosts writes a known_hosts file with the host key of the server, or
+// of another if key is given.
+func (f *fakeSFTP) knownHosts(dir string, key ssh.PublicKey) (string, error) {
+	if key == nil {
+		key = f.hostKey.PublicKey()
+	}
+
+	name := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(f.Addr())}, key)
+	return name, ioutil.WriteFile(name, []byte(line+"\n"), 0600)
+}
+
+// keyFile writes the client key as a PEM file.
+func (f *fakeSFTP) keyFile(dir string) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(f.clientKey)
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Join(dir, "id_ed25519")
+	return name, ioutil.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// agent serves an SSH agent holding the client key on a socket in dir,
+// and returns the socket.
+func (f *fakeSFTP) agent(dir string) (string, error) {
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: f.clientKey}); err != nil {
+		return "", err
+	}
+
+	name := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", name)
+	if err != nil {
+		return "", err
+	}
+
+	f.agentListener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return name, nil
+}
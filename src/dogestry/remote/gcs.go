@@ -0,0 +1,812 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"dogestry/config"
+	"dogestry/utils"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const defaultGCSEndpoint = "https://storage.googleapis.com"
+
+// Files larger than gcsChunkSize go up in a resumable upload, a chunk at
+// a time, so that a failure only resends the chunk. Chunks must be a
+// multiple of 256KiB.
+const gcsChunkSize int64 = 8 * 1024 * 1024
+
+// errGCSSessionExpired is returned for resumable upload sessions GCS no
+// longer knows, they last a week.
+var errGCSSessionExpired = errors.New("the resumable upload session expired")
+
+// NewGCSRemote returns a remote in the Google Cloud Storage bucket of
+// config.GCS.URL, talking to the JSON API.
+func NewGCSRemote(config config.Config) (*GCSRemote, error) {
+	u := config.GCS.URL
+	if u == nil || u.Scheme != "gs" || u.Host == "" {
+		return nil, errors.New("invalid GCS remote, expected eg. gs://bucket/path/")
+	}
+
+	endpoint := defaultGCSEndpoint
+	if e := u.Query().Get("endpoint"); e != "" {
+		endpoint = e
+	} else if host := config.GCS.EmulatorHost; host != "" {
+		endpoint = host
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+	}
+
+	envelope, err := newEnvelope(config.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := &GCSRemote{
+		config:   config,
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   http.DefaultClient,
+		retry:    newRetryPolicy(config),
+		envelope: envelope,
+	}
+
+	provider, err := newGCSTokenProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	if provider != nil {
+		remote.tokens = &gcsTokenCache{provider: provider}
+	}
+
+	return remote, nil
+}
+
+type GCSRemote struct {
+	config config.Config
+	bucket string
+	// path in the bucket, without slashes around it
+	prefix   string
+	endpoint string
+	client   *http.Client
+	// nil for anonymous requests to a fake server
+	tokens *gcsTokenCache
+
+	retry             RetryPolicy
+	journal           *Journal
+	expectedID        ID
+	overrideImmutable bool
+	// nil unless objects are encrypted
+	envelope *envelope
+}
+
+func (remote *GCSRemote) Push(ctx context.Context, image, imageRoot string) error {
+	u := objectUploader{
+		store:             remote,
+		put:               remote.putFile,
+		config:            remote.config,
+		name:              "GCS",
+		expectedID:        remote.expectedID,
+		overrideImmutable: remote.overrideImmutable,
+		envelope:          remote.envelope,
+	}
+	return u.pushImage(ctx, imageRoot)
+}
+
+// putFile uploads a file in one request, or in a resumable upload if it's
+// larger than a chunk. With a journal, a rerun continues the resumable
+// upload where it stopped.
+func (remote *GCSRemote) putFile(ctx context.Context, keyDef *uploadKeyDef) error {
+	name := remote.objectName(keyDef.key)
+
+	state := remote.journal.Upload(name, keyDef.sum)
+	if state.Done {
+		log.Printf("Key %s already uploaded", name)
+		return nil
+	}
+
+	f, err := os.Open(keyDef.fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() > gcsChunkSize {
+		err = remote.putResumable(ctx, name, f, info.Size(), state)
+	} else {
+		err = remote.retry.Do(ctx, "upload "+name, func() error {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			body := utils.NewLimitedReader(ctx, utils.NewProgressReader(f, info.Size(), keyDef.fullPath))
+			_, err := remote.upload(ctx, name, body, info.Size(), "")
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	return remote.journal.SetUpload(name, UploadState{Sum: keyDef.sum, Done: true})
+}
+
+// putResumable sends f to name in chunks of a resumable upload session,
+// which is journaled so that a rerun carries on with it.
+func (remote *GCSRemote) putResumable(ctx context.Context, name string, f *os.File, size int64, state UploadState) error {
+	var offset int64
+	if state.Session != "" {
+		err := remote.retry.Do(ctx, "check upload of "+name, func() (err error) {
+			offset, err = remote.uploadedBytes(ctx, state.Session, size)
+			return err
+		})
+		switch {
+		case err == errGCSSessionExpired:
+			log.Printf("Restarting upload of %s: %v", name, err)
+			state.Session, offset = "", 0
+		case err != nil:
+			return err
+		case offset == size:
+			return nil
+		default:
+			log.Printf("Resuming upload of %s at %s of %s", name, utils.HumanSize(offset), utils.HumanSize(size))
+		}
+	}
+
+	start := func() error {
+		err := remote.retry.Do(ctx, "start upload of "+name, func() (err error) {
+			state.Session, err = remote.startResumable(ctx, name, size)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return remote.journal.SetUpload(name, state)
+	}
+
+	if state.Session == "" {
+		if err := start(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Pushing key %s (%s) in a resumable upload\n", name, utils.HumanSize(size))
+
+	// sessions expiring one after the other are given up on like any
+	// other failure
+	restarts := 0
+	for offset < size {
+		err := remote.retry.Do(ctx, fmt.Sprintf("upload %s at %d", name, offset), func() error {
+			next, err := remote.putChunk(ctx, state.Session, f, offset, size)
+			if err != nil {
+				// part of the chunk may have been kept, carry on from there
+				if kept, statusErr := remote.uploadedBytes(ctx, state.Session, size); statusErr == nil {
+					offset = kept
+				}
+				return err
+			}
+
+			offset = next
+			return nil
+		})
+		if err == errGCSSessionExpired && restarts < remote.retry.Attempts {
+			restarts++
+			log.Printf("Restarting upload of %s: %v", name, err)
+			offset = 0
+			if err := start(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startResumable starts a resumable upload of size bytes to name, and
+// returns the URI of its session.
+func (remote *GCSRemote) startResumable(ctx context.Context, name string, size int64) (string, error) {
+	query := url.Values{"uploadType": {"resumable"}, "name": {name}}
+	req, err := remote.newRequest(ctx, "POST", remote.uploadURL(query), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	resp, err := remote.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", fmt.Errorf("upload of %s: no session in the answer to %s", name, req.URL.Path)
+	}
+	return session, nil
+}
+
+// putChunk sends the chunk of f at offset and returns the offset GCS has
+// everything before.
+func (remote *GCSRemote) putChunk(ctx context.Context, session string, f *os.File, offset, size int64) (int64, error) {
+	n := size - offset
+	if n > gcsChunkSize {
+		n = gcsChunkSize
+	}
+
+	body := utils.NewLimitedReader(ctx, io.NewSectionReader(f, offset, n))
+	req, err := remote.newRequest(ctx, "PUT", session, body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size))
+
+	return remote.sessionOffset(req, size)
+}
+
+// uploadedBytes asks how much of the upload of session GCS has.
+func (remote *GCSRemote) uploadedBytes(ctx context.Context, session string, size int64) (int64, error) {
+	req, err := remote.newRequest(ctx, "PUT", session, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+
+	return remote.sessionOffset(req, size)
+}
+
+// sessionOffset sends a request of a resumable upload session and returns
+// the offset of the first byte GCS still needs, size once it's complete.
+func (remote *GCSRemote) sessionOffset(req *http.Request, size int64) (int64, error) {
+	resp, err := remote.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return size, nil
+	case http.StatusPermanentRedirect:
+		// Range: bytes=0-<last byte received>, missing if none was
+		r := resp.Header.Get("Range")
+		if r == "" {
+			return 0, nil
+		}
+		i := strings.LastIndex(r, "-")
+		last, err := strconv.ParseInt(r[i+1:], 10, 64)
+		if i == -1 || err != nil {
+			return 0, fmt.Errorf("resumable upload: unexpected range '%s'", r)
+		}
+		return last + 1, nil
+	case http.StatusNotFound, http.StatusGone:
+		return 0, errGCSSessionExpired
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return 0, gcsRespError(resp.StatusCode, body)
+}
+
+// pull a single image from the remote
+func (remote *GCSRemote) PullImageId(ctx context.Context, id ID, dst string) error {
+	prefix := "images/" + string(id) + "/"
+	objects, err := listObjects(ctx, remote, prefix)
+	if err != nil {
+		return err
+	}
+
+	d := objectDownloader{store: remote, fetch: remote.fetch, retry: remote.retry, journal: remote.journal, envelope: remote.envelope}
+	return d.pullImage(ctx, prefix, objects, dst)
+}
+
+// map repo:tag to id (like git rev-parse)
+func (remote *GCSRemote) ParseTag(ctx context.Context, repo, tag string) (ID, error) {
+	id, _, err := readTag(ctx, remote, repo, tag)
+	return id, err
+}
+
+// map a ref-like to id. "ref-like" could be a ref or an id.
+func (remote *GCSRemote) ResolveImageNameToId(ctx context.Context, image string) (ID, error) {
+	return ResolveImageNameToId(ctx, remote, image)
+}
+
+func (remote *GCSRemote) ImageFullId(ctx context.Context, id ID) (ID, error) {
+	if fullID, ok := catalogFullID(ctx, remote, id); ok {
+		return fullID, nil
+	}
+
+	it := newObjectIterator(ctx, remote, "images/")
+	for it.Next() {
+		imageID := strings.SplitN(strings.TrimPrefix(it.Object().Key, "images/"), "/", 2)[0]
+		if strings.HasPrefix(imageID, string(id)) {
+			return ID(imageID), nil
+		}
+	}
+	if err := it.Err(); err != nil {
+		return "", err
+	}
+
+	return "", ErrNoSuchImage
+}
+
+// Download the json file at images/{id}/json
+func (remote *GCSRemote) ImageMetadata(ctx context.Context, id ID) (docker.Image, error) {
+	image := docker.Image{}
+
+	data, _, err := remote.getObject(ctx, "images/"+string(id)+"/json")
+	if err == errObjectNotFound {
+		return image, ErrNoSuchImage
+	} else if err != nil {
+		return image, err
+	}
+
+	err = json.Unmarshal(data, &image)
+	return image, err
+}
+
+// return repo, tag from a file path (or GCS object name)
+func (remote *GCSRemote) ParseImagePath(path string, prefix string) (repo, tag string) {
+	return ParseImagePath(path, prefix)
+}
+
+// walk the image history on the remote, starting at id
+func (remote *GCSRemote) WalkImages(ctx context.Context, id ID, walker ImageWalkFn) error {
+	return WalkImages(ctx, remote, id, walker)
+}
+
+// checks the config and connectivity of the remote
+func (remote *GCSRemote) Validate(ctx context.Context) error {
+	err := remote.retry.Do(ctx, "get bucket", func() error {
+		req, err := remote.newRequest(ctx, "GET", remote.endpoint+"/storage/v1/b/"+url.PathEscape(remote.bucket), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := remote.do(req, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("%s unable to reach the GCS bucket: %s", remote.Desc(), err)
+	}
+
+	if err := checkLayout(ctx, remote); err != nil {
+		return err
+	}
+
+	return checkEncryption(ctx, remote, remote.envelope)
+}
+
+// record transfer progress in journal
+func (remote *GCSRemote) SetJournal(journal *Journal) {
+	remote.journal = journal
+}
+
+func (remote *GCSRemote) SetExpectedID(id ID) {
+	remote.expectedID = id
+}
+
+func (remote *GCSRemote) SetOverrideImmutable(override bool) {
+	remote.overrideImmutable = override
+}
+
+func (remote *GCSRemote) Policy(ctx context.Context) (Policy, error) {
+	return readPolicy(ctx, remote)
+}
+
+func (remote *GCSRemote) SetTag(ctx context.Context, repo, tag string, id ID) error {
+	return setTag(ctx, remote, repo, tag, id, remote.expectedID, remote.overrideImmutable)
+}
+
+func (remote *GCSRemote) TagHistory(ctx context.Context, repo, tag string) ([]TagHistoryEntry, error) {
+	history, _, err := readTagHistory(ctx, remote, repo, tag)
+	return history, err
+}
+
+func (remote *GCSRemote) PutTagMetadata(ctx context.Context, meta TagMetadata) error {
+	return putTagMetadata(ctx, remote, meta)
+}
+
+func (remote *GCSRemote) TagMetadata(ctx context.Context, repo, tag string) (TagMetadata, error) {
+	return readTagMetadata(ctx, remote, repo, tag)
+}
+
+func (remote *GCSRemote) Reindex(ctx context.Context) (*Catalog, error) {
+	return reindex(ctx, remote)
+}
+
+func (remote *GCSRemote) Layout(ctx context.Context) (Layout, error) {
+	layout, _, err := readLayout(ctx, remote)
+	return layout, err
+}
+
+func (remote *GCSRemote) Migrate(ctx context.Context, to int) error {
+	return migrate(ctx, remote, to)
+}
+
+// describe the remote
+func (remote *GCSRemote) Desc() string {
+	desc := "gcs(bucket=" + remote.bucket
+	if remote.prefix != "" {
+		desc += ", path=" + remote.prefix
+	}
+	if remote.endpoint != defaultGCSEndpoint {
+		desc += ", endpoint=" + remote.endpoint
+	}
+	return desc + ")"
+}
+
+// List images on the remote
+func (remote *GCSRemote) List(ctx context.Context) ([]Image, error) {
+	if images, ok := listCatalog(ctx, remote); ok {
+		return images, nil
+	}
+
+	var images []Image
+	it := newObjectIterator(ctx, remote, "repositories/")
+	for it.Next() {
+		repo, tag := ParseImagePath(it.Object().Key, "repositories/")
+		images = append(images, Image{repo, tag})
+	}
+
+	return images, it.Err()
+}
+
+// gcsObject is the metadata of an object in the JSON API.
+type gcsObject struct {
+	Name       string `json:"name"`
+	Size       int64  `json:"size,string"`
+	Generation int64  `json:"generation,string"`
+}
+
+// info describes the object, its generation standing for the ETag so that
+// conditional writes can ask for it.
+func (remote *GCSRemote) info(object gcsObject) objectInfo {
+	key := object.Name
+	if remote.prefix != "" {
+		key = strings.TrimPrefix(key, remote.prefix+"/")
+	}
+	return objectInfo{Key: key, Size: object.Size, ETag: strconv.FormatInt(object.Generation, 10)}
+}
+
+func (remote *GCSRemote) objectName(key string) string {
+	if remote.prefix != "" {
+		return remote.prefix + "/" + key
+	}
+	return key
+}
+
+// objectURL is the URL of the metadata of the object of key, and of its
+// content with alt=media.
+func (remote *GCSRemote) objectURL(key string) string {
+	return remote.endpoint + "/storage/v1/b/" + url.PathEscape(remote.bucket) + "/o/" + url.PathEscape(remote.objectName(key))
+}
+
+func (remote *GCSRemote) uploadURL(query url.Values) string {
+	return remote.endpoint + "/upload/storage/v1/b/" + url.PathEscape(remote.bucket) + "/o?" + query.Encode()
+}
+
+// newRequest returns a request authorized with the current token.
+func (remote *GCSRemote) newRequest(ctx context.Context, method, rawurl string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, rawurl, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if remote.tokens != nil {
+		token, err := remote.tokens.get()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	}
+
+	return req, nil
+}
+
+// do sends req and fails unless GCS answers with one of the ok statuses.
+// A 404 is errObjectNotFound.
+func (remote *GCSRemote) do(req *http.Request, ok ...int) (*http.Response, error) {
+	resp, err := remote.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, errObjectNotFound
+	case http.StatusPreconditionFailed:
+		return nil, errPreconditionFailed
+	}
+	return nil, gcsRespError(resp.StatusCode, body)
+}
+
+// gcsError is an error answer of the JSON API.
+type gcsError struct {
+	StatusCode int
+	Reason     string
+	Message    string
+}
+
+func (e *gcsError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("GCS: %d %s: %s", e.StatusCode, e.Reason, e.Message)
+	}
+	return fmt.Sprintf("GCS: %d %s", e.StatusCode, e.Message)
+}
+
+func gcsRespError(status int, body []byte) error {
+	var resp struct {
+		Error struct {
+			Message string `json:"message"`
+			Errors  []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+
+	e := &gcsError{StatusCode: status, Message: http.StatusText(status)}
+	if json.Unmarshal(body, &resp) == nil && resp.Error.Message != "" {
+		e.Message = resp.Error.Message
+		if len(resp.Error.Errors) > 0 {
+			e.Reason = resp.Error.Errors[0].Reason
+		}
+	}
+	return e
+}
+
+// upload writes size bytes of body to name in a single request. A non-empty
+// generation only replaces that generation, "0" only creates the object.
+func (remote *GCSRemote) upload(ctx context.Context, name string, body io.Reader, size int64, generation string) (gcsObject, error) {
+	query := url.Values{"uploadType": {"media"}, "name": {name}}
+	if generation != "" {
+		query.Set("ifGenerationMatch", generation)
+	}
+
+	req, err := remote.newRequest(ctx, "POST", remote.uploadURL(query), body)
+	if err != nil {
+		return gcsObject{}, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := remote.do(req, http.StatusOK)
+	if err != nil {
+		return gcsObject{}, err
+	}
+	defer resp.Body.Close()
+
+	var object gcsObject
+	err = json.NewDecoder(resp.Body).Decode(&object)
+	return object, err
+}
+
+// fetch streams the content of key from offset on, as stored.
+func (remote *GCSRemote) fetch(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	resp, err := remote.fetchResponse(ctx, key, offset)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (remote *GCSRemote) fetchResponse(ctx context.Context, key string, offset int64) (*http.Response, error) {
+	req, err := remote.newRequest(ctx, "GET", remote.objectURL(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		return remote.do(req, http.StatusPartialContent)
+	}
+
+	return remote.do(req, http.StatusOK)
+}
+
+func (remote *GCSRemote) getObject(ctx context.Context, key string) ([]byte, string, error) {
+	var data []byte
+	var generation string
+	err := remote.retry.Do(ctx, "get "+key, func() error {
+		resp, err := remote.fetchResponse(ctx, key, 0)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		generation = resp.Header.Get("X-Goog-Generation")
+		data, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err = remote.envelope.open(key, data)
+	return data, generation, err
+}
+
+func (remote *GCSRemote) putObject(ctx context.Context, key string, data []byte) error {
+	return remote.putBytes(ctx, key, data, "")
+}
+
+func (remote *GCSRemote) putObjectIf(ctx context.Context, key string, data []byte, etag string) error {
+	if etag == "" {
+		etag = "0"
+	}
+	return remote.putBytes(ctx, key, data, etag)
+}
+
+func (remote *GCSRemote) putBytes(ctx context.Context, key string, data []byte, generation string) error {
+	data, err := remote.envelope.sealObject(key, data)
+	if err != nil {
+		return err
+	}
+
+	return remote.retry.Do(ctx, "put "+key, func() error {
+		_, err := remote.upload(ctx, remote.objectName(key), bytes.NewReader(data), int64(len(data)), generation)
+		return err
+	})
+}
+
+func (remote *GCSRemote) statObject(ctx context.Context, key string) (objectInfo, error) {
+	var object gcsObject
+	err := remote.retry.Do(ctx, "check "+key, func() error {
+		req, err := remote.newRequest(ctx, "GET", remote.objectURL(key), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := remote.do(req, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		return json.NewDecoder(resp.Body).Decode(&object)
+	})
+	if err != nil {
+		return objectInfo{}, err
+	}
+
+	return remote.info(object), nil
+}
+
+func (remote *GCSRemote) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := remote.retry.Do(ctx, "get "+key, func() (err error) {
+		rc, err = remote.fetch(ctx, key, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return remote.envelope.openReader(key, rc)
+}
+
+// copyObject rewrites src to dst, which large objects may take several
+// calls for.
+func (remote *GCSRemote) copyObject(ctx context.Context, src, dst string) error {
+	rewriteURL := remote.objectURL(src) + "/rewriteTo/b/" + url.PathEscape(remote.bucket) + "/o/" + url.PathEscape(remote.objectName(dst))
+
+	var token string
+	for {
+		var rewrite struct {
+			Done         bool   `json:"done"`
+			RewriteToken string `json:"rewriteToken"`
+		}
+
+		err := remote.retry.Do(ctx, "copy "+src+" to "+dst, func() error {
+			rawurl := rewriteURL
+			if token != "" {
+				rawurl += "?rewriteToken=" + url.QueryEscape(token)
+			}
+
+			req, err := remote.newRequest(ctx, "POST", rawurl, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := remote.do(req, http.StatusOK)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			return json.NewDecoder(resp.Body).Decode(&rewrite)
+		})
+		if err != nil {
+			return err
+		}
+
+		if rewrite.Done {
+			return nil
+		}
+		token = rewrite.RewriteToken
+	}
+}
+
+func (remote *GCSRemote) deleteObject(ctx context.Context, key string) error {
+	err := remote.retry.Do(ctx, "delete "+key, func() error {
+		req, err := remote.newRequest(ctx, "DELETE", remote.objectURL(key), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := remote.do(req, http.StatusNoContent, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	})
+	if err == errObjectNotFound {
+		return nil
+	}
+	return err
+}
+
+// listPage lists a page of up to 1000 objects, the marker is the page
+// token of the API.
+func (remote *GCSRemote) listPage(ctx context.Context, prefix, marker string) ([]objectInfo, string, error) {
+	query := url.Values{"prefix": {remote.objectName(prefix)}}
+	if marker != "" {
+		query.Set("pageToken", marker)
+	}
+
+	var list struct {
+		Items         []gcsObject `json:"items"`
+		NextPageToken string      `json:"nextPageToken"`
+	}
+	err := remote.retry.Do(ctx, "list "+prefix, func() error {
+		req, err := remote.newRequest(ctx, "GET", remote.endpoint+"/storage/v1/b/"+url.PathEscape(remote.bucket)+"/o?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := remote.do(req, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		return json.NewDecoder(resp.Body).Decode(&list)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	objects := make([]objectInfo, 0, len(list.Items))
+	for _, item := range list.Items {
+		objects = append(objects, remote.info(item))
+	}
+
+	return objects, list.NextPageToken, nil
+}
@@ -0,0 +1,290 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dogestry/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type GCSSuite struct {
+	fake      *fakeGCS
+	cfg       config.Config
+	imageRoot string
+}
+
+var _ = Suite(&GCSSuite{})
+
+func (s *GCSSuite) SetUpTest(c *C) {
+	s.fake = newFakeGCS("bucket")
+	s.fake.put("team-a/"+LayoutKey, `{"version": 3}`)
+
+	s.cfg = config.Config{}
+	s.cfg.GCS.EmulatorHost = s.fake.server.URL
+	s.cfg.Retry.Attempts, s.cfg.Retry.BaseDelay, s.cfg.Retry.MaxDelay = 3, time.Millisecond, 10*time.Millisecond
+	c.Assert(s.cfg.SetGCSURL("gs://bucket/team-a/"), IsNil)
+
+	s.imageRoot = filepath.Join(c.MkDir(), "image")
+	s.writeImage(c, "layer contents")
+}
+
+func (s *GCSSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+func (s *GCSSuite) writeImage(c *C, layer string) {
+	files := map[string]string{
+		"images/" + pushImageId + "/json":      `{"id":"` + pushImageId + `"}`,
+		"images/" + pushImageId + "/layer.tar": layer,
+		"images/" + pushImageId + "/VERSION":   "1.0",
+		"repositories/app/latest":              pushImageId,
+	}
+	for name, content := range files {
+		path := filepath.Join(s.imageRoot, name)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+	}
+}
+
+func (s *GCSSuite) remote(c *C) *GCSRemote {
+	remote, err := NewGCSRemote(s.cfg)
+	c.Assert(err, IsNil)
+	c.Assert(remote.Validate(context.Background()), IsNil)
+	return remote
+}
+
+func (s *GCSSuite) TestPushPull(c *C) {
+	ctx := context.Background()
+	remote := s.remote(c)
+	c.Assert(remote.Desc(), Equals, "gcs(bucket=bucket, path=team-a, endpoint="+s.fake.server.URL+")")
+
+	c.Assert(remote.Push(ctx, "app:latest", s.imageRoot), IsNil)
+
+	tag, ok := s.fake.get("team-a/repositories/app/latest")
+	c.Assert(ok, Equals, true)
+	c.Assert(tag, Equals, pushImageId)
+	_, ok = s.fake.get("team-a/" + blobKey(digestOf(c, "layer contents")) + ".gz")
+	c.Assert(ok, Equals, true)
+
+	images, err := remote.List(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(images, DeepEquals, []Image{{"app", "latest"}})
+
+	id, err := remote.ImageFullId(ctx, ID(pushImageId[:12]))
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID(pushImageId))
+
+	// with and without a journal
+	for _, journal := range []bool{false, true} {
+		r := s.remote(c)
+		if journal {
+			j, err := OpenJournal(filepath.Join(c.MkDir(), "pull.journal"), r.Desc())
+			c.Assert(err, IsNil)
+			r.SetJournal(j)
+		}
+
+		id, err := r.ParseTag(ctx, "app", "latest")
+		c.Assert(err, IsNil)
+		c.Assert(id, Equals, ID(pushImageId))
+
+		dst := filepath.Join(c.MkDir(), pushImageId)
+		c.Assert(r.PullImageId(ctx, id, dst), IsNil)
+
+		layer, err := ioutil.ReadFile(filepath.Join(dst, "layer.tar"))
+		c.Assert(err, IsNil)
+		c.Assert(string(layer), Equals, "layer contents")
+	}
+}
+
+func (s *GCSSuite) TestTags(c *C) {
+	ctx := context.Background()
+	remote := s.remote(c)
+	c.Assert(remote.Push(ctx, "app:latest", s.imageRoot), IsNil)
+
+	c.Assert(remote.SetTag(ctx, "app", "prod", pushImageId), IsNil)
+	id, err := remote.ParseTag(ctx, "app", "prod")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID(pushImageId))
+
+	history, err := remote.TagHistory(ctx, "app", "prod")
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 1)
+}
+
+func (s *GCSSuite) TestConditionalWrites(c *C) {
+	ctx := context.Background()
+	remote := s.remote(c)
+
+	c.Assert(remote.putObjectIf(ctx, "doc", []byte("one"), ""), IsNil)
+	c.Assert(remote.putObjectIf(ctx, "doc", []byte("two"), ""), Equals, errPreconditionFailed)
+
+	data, generation, err := remote.getObject(ctx, "doc")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "one")
+	c.Assert(generation, Not(Equals), "")
+
+	c.Assert(remote.putObjectIf(ctx, "doc", []byte("two"), generation), IsNil)
+	c.Assert(remote.putObjectIf(ctx, "doc", []byte("three"), generation), Equals, errPreconditionFailed)
+
+	stored, _ := s.fake.get("team-a/doc")
+	c.Assert(stored, Equals, "two")
+
+	c.Assert(remote.deleteObject(ctx, "doc"), IsNil)
+	c.Assert(remote.deleteObject(ctx, "doc"), IsNil)
+	_, _, err = remote.getObject(ctx, "doc")
+	c.Assert(err, Equals, errObjectNotFound)
+}
+
+func (s *GCSSuite) TestListPages(c *C) {
+	s.fake.pageSize = 2
+	for i := 0; i < 5; i++ {
+		s.fake.put("team-a/images/"+strings.Repeat("a", i+1)+"/json", "{}")
+	}
+	// outside of the remote's path
+	s.fake.put("images/b/json", "{}")
+
+	objects, err := listObjects(context.Background(), s.remote(c), "images/")
+	c.Assert(err, IsNil)
+	c.Assert(objects, HasLen, 5)
+	c.Assert(objects[0].Key, Equals, "images/a/json")
+	c.Assert(objects[0].Size, Equals, int64(2))
+}
+
+// largeLayer writes a layer that goes up in a resumable upload, even
+// gzipped, and returns it.
+func (s *GCSSuite) largeLayer(c *C) []byte {
+	s.cfg.Transfer.Compression = "none"
+	layer := make([]byte, gcsChunkSize+gcsChunkSize/2)
+	rand.New(rand.NewSource(1)).Read(layer)
+	s.writeImage(c, string(layer))
+	return layer
+}
+
+func (s *GCSSuite) TestResumableUpload(c *C) {
+	layer := s.largeLayer(c)
+	s.fake.failChunks = 1
+
+	c.Assert(s.remote(c).Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	data, ok := s.fake.get("team-a/" + blobKey(digestOf(c, string(layer))))
+	c.Assert(ok, Equals, true)
+	c.Assert(bytes.Equal([]byte(data), layer), Equals, true)
+
+	var sessions int
+	for _, request := range s.fake.requests {
+		if strings.Contains(request, "uploadType=resumable") {
+			sessions++
+		}
+	}
+	c.Assert(sessions, Equals, 1)
+}
+
+func (s *GCSSuite) TestSessionExpired(c *C) {
+	layer := s.largeLayer(c)
+	s.fake.expireChunks = 1
+
+	c.Assert(s.remote(c).Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	data, ok := s.fake.get("team-a/" + blobKey(digestOf(c, string(layer))))
+	c.Assert(ok, Equals, true)
+	c.Assert(bytes.Equal([]byte(data), layer), Equals, true)
+
+	// the upload started over in a session of its own
+	var sessions int
+	for _, request := range s.fake.requests {
+		if strings.Contains(request, "uploadType=resumable") {
+			sessions++
+		}
+	}
+	c.Assert(sessions, Equals, 2)
+}
+
+func (s *GCSSuite) TestResumeSession(c *C) {
+	ctx := context.Background()
+	layer := s.largeLayer(c)
+	remote := s.remote(c)
+
+	journal, err := OpenJournal(filepath.Join(c.MkDir(), "push.journal"), remote.Desc())
+	c.Assert(err, IsNil)
+	remote.SetJournal(journal)
+
+	// an earlier push sent the first chunk
+	path := filepath.Join(s.imageRoot, "images", pushImageId, "layer.tar")
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	name := "team-a/images/" + pushImageId + "/layer.tar"
+	session, err := remote.startResumable(ctx, name, int64(len(layer)))
+	c.Assert(err, IsNil)
+	offset, err := remote.putChunk(ctx, session, f, 0, int64(len(layer)))
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, gcsChunkSize)
+
+	keyDef := &uploadKeyDef{key: "images/" + pushImageId + "/layer.tar", sum: "sum", fullPath: path}
+	c.Assert(journal.SetUpload(name, UploadState{Sum: "sum", Session: session}), IsNil)
+
+	s.fake.requests = nil
+	c.Assert(remote.putFile(ctx, keyDef), IsNil)
+
+	// the state of the session, then its last chunk
+	c.Assert(s.fake.requests, HasLen, 2)
+	data, _ := s.fake.get(name)
+	c.Assert(bytes.Equal([]byte(data), layer), Equals, true)
+	c.Assert(journal.Upload(name, "sum").Done, Equals, true)
+
+	// sessions GCS forgot start over
+	c.Assert(journal.SetUpload(name, UploadState{Sum: "other", Session: s.fake.server.URL + "/upload/session/gone"}), IsNil)
+	keyDef.sum = "other"
+	c.Assert(remote.putFile(ctx, keyDef), IsNil)
+	data, _ = s.fake.get(name)
+	c.Assert(bytes.Equal([]byte(data), layer), Equals, true)
+}
+
+func (s *GCSSuite) TestServiceAccount(c *C) {
+	key, err := s.fake.serviceAccount()
+	c.Assert(err, IsNil)
+
+	// anonymous requests are refused
+	remote, err := NewGCSRemote(s.cfg)
+	c.Assert(err, IsNil)
+	c.Assert(remote.Validate(context.Background()), ErrorMatches, ".*GCS: 401 authError: Invalid Credentials")
+
+	s.cfg.GCS.CredentialsFile = filepath.Join(c.MkDir(), "key.json")
+	c.Assert(ioutil.WriteFile(s.cfg.GCS.CredentialsFile, key, 0600), IsNil)
+
+	s.fake.requests = nil
+	c.Assert(s.remote(c).Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	// the token is kept for the whole push
+	var tokens int
+	for _, request := range s.fake.requests {
+		if strings.HasPrefix(request, "POST /token") {
+			tokens++
+		}
+	}
+	c.Assert(tokens, Equals, 1)
+}
+
+func (s *GCSSuite) TestEndpoint(c *C) {
+	s.cfg.GCS.EmulatorHost = "localhost:4443"
+	remote, err := NewGCSRemote(s.cfg)
+	c.Assert(err, IsNil)
+	c.Assert(remote.endpoint, Equals, "http://localhost:4443")
+	c.Assert(remote.tokens, IsNil)
+
+	c.Assert(s.cfg.SetGCSURL("gs://bucket/?endpoint="+url.QueryEscape("https://storage.internal")), IsNil)
+	remote, err = NewGCSRemote(s.cfg)
+	c.Assert(err, IsNil)
+	c.Assert(remote.Desc(), Equals, "gcs(bucket=bucket, endpoint=https://storage.internal)")
+	c.Assert(remote.objectURL("images/a b/json"), Equals, "https://storage.internal/storage/v1/b/bucket/o/images%2Fa%20b%2Fjson")
+}
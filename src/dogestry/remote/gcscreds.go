@@ -0,0 +1,339 @@
+package remote
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"dogestry/config"
+)
+
+const (
+	gcsScope              = "https://www.googleapis.com/auth/devstorage.read_write"
+	defaultGoogleTokenURI = "https://oauth2.googleapis.com/token"
+	defaultGCEMetadata    = "metadata.google.internal"
+)
+
+// gcsToken is an OAuth2 access token to authorize requests with.
+type gcsToken struct {
+	AccessToken string
+	Expires     time.Time
+}
+
+// gcsTokenProvider is a source of access tokens.
+type gcsTokenProvider interface {
+	retrieve() (gcsToken, error)
+	String() string
+}
+
+// googleCredentials is a credentials file of either type the Google tools
+// write: a service account key, or the user gcloud logged in as.
+type googleCredentials struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// newGCSTokenProvider returns where the GCS remote gets its tokens, as the
+// Google client libraries look for them: the file named by
+// GOOGLE_APPLICATION_CREDENTIALS, gcloud's application default credentials,
+// then the metadata server of the GCE instance or GKE pod. It returns nil,
+// for anonymous requests, when a fake server is used without credentials.
+func newGCSTokenProvider(cfg config.Config) (gcsTokenProvider, error) {
+	if cfg.GCS.CredentialsFile != "" {
+		return loadGoogleCredentials(cfg.GCS.CredentialsFile)
+	}
+
+	if cfg.GCS.EmulatorHost != "" {
+		return nil, nil
+	}
+
+	if path := wellKnownGoogleCredentials(); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			return loadGoogleCredentials(path)
+		}
+	}
+
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = defaultGCEMetadata
+	}
+	return metadataTokenProvider{host: host}, nil
+}
+
+// wellKnownGoogleCredentials is where 'gcloud auth application-default
+// login' writes the user's credentials.
+func wellKnownGoogleCredentials() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return filepath.Join(dir, "application_default_credentials.json")
+	}
+	if dir := os.Getenv("APPDATA"); dir != "" {
+		return filepath.Join(dir, "gcloud", "application_default_credentials.json")
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+	}
+	return ""
+}
+
+func loadGoogleCredentials(path string) (gcsTokenProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds googleCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("Google credentials %s: %v", path, err)
+	}
+
+	switch creds.Type {
+	case "service_account":
+		key, err := parseRSAPrivateKey(creds.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("Google credentials %s: %v", path, err)
+		}
+		if creds.TokenURI == "" {
+			creds.TokenURI = defaultGoogleTokenURI
+		}
+		return &serviceAccountProvider{email: creds.ClientEmail, keyID: creds.PrivateKeyID, key: key, tokenURI: creds.TokenURI}, nil
+	case "authorized_user":
+		return authorizedUserProvider{clientID: creds.ClientID, clientSecret: creds.ClientSecret, refreshToken: creds.RefreshToken, tokenURI: defaultGoogleTokenURI}, nil
+	}
+
+	return nil, fmt.Errorf("Google credentials %s: unsupported type '%s', expected service_account or authorized_user", path, creds.Type)
+}
+
+// parseRSAPrivateKey reads the PEM key of a service account, PKCS#8 as
+// Google issues them, or PKCS#1.
+func parseRSAPrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("private_key isn't a PEM key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("private_key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private_key isn't an RSA key")
+	}
+	return key, nil
+}
+
+// serviceAccountProvider exchanges a JWT signed with the key of a service
+// account for a token (RFC 7523).
+type serviceAccountProvider struct {
+	email    string
+	keyID    string
+	key      *rsa.PrivateKey
+	tokenURI string
+}
+
+func (p *serviceAccountProvider) retrieve() (gcsToken, error) {
+	assertion, err := p.assertion(time.Now())
+	if err != nil {
+		return gcsToken{}, err
+	}
+
+	return postTokenRequest(p.tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+}
+
+// assertion returns the JWT asking for a token of the storage scope.
+func (p *serviceAccountProvider) assertion(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": p.keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   p.email,
+		"scope": gcsScope,
+		"aud":   p.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (p *serviceAccountProvider) String() string {
+	return "service account " + p.email
+}
+
+// authorizedUserProvider refreshes the token of the user gcloud logged in
+// as.
+type authorizedUserProvider struct {
+	clientID     string
+	clientSecret string
+	refreshToken string
+	tokenURI     string
+}
+
+func (p authorizedUserProvider) retrieve() (gcsToken, error) {
+	return postTokenRequest(p.tokenURI, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+		"refresh_token": {p.refreshToken},
+	})
+}
+
+func (p authorizedUserProvider) String() string {
+	return "gcloud application default credentials"
+}
+
+// googleTokenResponse is the answer of the token endpoint and of the
+// metadata server.
+type googleTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (r googleTokenResponse) token() gcsToken {
+	return gcsToken{AccessToken: r.AccessToken, Expires: time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)}
+}
+
+func postTokenRequest(tokenURI string, form url.Values) (gcsToken, error) {
+	resp, err := http.PostForm(tokenURI, form)
+	if err != nil {
+		return gcsToken{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gcsToken{}, err
+	}
+
+	var r googleTokenResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return gcsToken{}, fmt.Errorf("token endpoint %s: %s", tokenURI, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || r.AccessToken == "" {
+		if r.ErrorDescription != "" {
+			return gcsToken{}, fmt.Errorf("token endpoint %s: %s: %s", tokenURI, r.Error, r.ErrorDescription)
+		}
+		return gcsToken{}, fmt.Errorf("token endpoint %s: %s %s", tokenURI, resp.Status, r.Error)
+	}
+
+	return r.token(), nil
+}
+
+// metadataTokenProvider gets the tokens of the service account of the GCE
+// instance, or of the GKE pod with workload identity, from the metadata
+// server.
+type metadataTokenProvider struct {
+	host string
+}
+
+func (p metadataTokenProvider) retrieve() (gcsToken, error) {
+	req, err := http.NewRequest("GET", "http://"+p.host+"/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(gcsScope), nil)
+	if err != nil {
+		return gcsToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return gcsToken{}, fmt.Errorf("no Google credentials found, set GOOGLE_APPLICATION_CREDENTIALS, and the metadata server can't be reached: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gcsToken{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return gcsToken{}, fmt.Errorf("metadata server: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var r googleTokenResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return gcsToken{}, fmt.Errorf("metadata server: %v", err)
+	}
+
+	return r.token(), nil
+}
+
+func (p metadataTokenProvider) String() string {
+	return "the metadata server"
+}
+
+// gcsTokenCache holds the token of provider, and gets a new one when it's
+// about to expire so that long pushes and pulls outlive it.
+type gcsTokenCache struct {
+	provider gcsTokenProvider
+
+	mu      sync.Mutex
+	current gcsToken
+}
+
+// get returns a token valid for a while yet. If refreshing fails, the
+// current one is kept as long as it's valid.
+func (c *gcsTokenCache) get() (gcsToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.current.AccessToken != "" && time.Until(c.current.Expires) > credentialsRefreshWindow {
+		return c.current, nil
+	}
+
+	token, err := c.provider.retrieve()
+	if err != nil {
+		if c.current.AccessToken != "" && time.Now().Before(c.current.Expires) {
+			log.Printf("refreshing Google credentials from %s: %v, using the current ones until %s", c.provider, err, c.current.Expires.Format(time.RFC3339))
+			return c.current, nil
+		}
+		return gcsToken{}, err
+	}
+
+	c.current = token
+	return token, nil
+}
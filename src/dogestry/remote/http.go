@@ -0,0 +1,134 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+
+	"dogestry/config"
+)
+
+// httpFetcher reads a remote mirrored on a web server, eg. a CDN or a
+// static file server in front of a copy of a bucket. Listings come from
+// the remote's index, see IndexKey.
+type httpFetcher struct {
+	base   *url.URL
+	client *http.Client
+
+	mu sync.Mutex
+	// loaded on the first listing
+	index *Index
+	// what the remote's objects are opened with, for the index
+	envelope *envelope
+}
+
+// objectURL returns the URL of key, keeping the query of the base URL.
+func (f *httpFetcher) objectURL(key string) string {
+	u := *f.base
+	u.Path = path.Join(u.Path, key)
+	u.RawPath = ""
+	return u.String()
+}
+
+func (f *httpFetcher) fetch(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	resp, err := httpGet(ctx, f.client, f.objectURL(key), offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (f *httpFetcher) statObject(ctx context.Context, key string) (objectInfo, error) {
+	req, err := http.NewRequest("HEAD", f.objectURL(key), nil)
+	if err != nil {
+		return objectInfo{}, err
+	}
+
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if urlErr, ok := err.(*url.Error); ok {
+		urlErr.URL = redactURL(urlErr.URL)
+		return objectInfo{}, urlErr
+	} else if err != nil {
+		return objectInfo{}, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return objectInfo{Key: key, Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}, nil
+	case http.StatusNotFound:
+		return objectInfo{}, errObjectNotFound
+	}
+
+	return objectInfo{}, &httpStatusError{URL: redactURL(req.URL.String()), StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// listPage lists everything under prefix at once from the index.
+func (f *httpFetcher) listPage(ctx context.Context, prefix, marker string) ([]objectInfo, string, error) {
+	index, err := f.loadIndex(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return index.list(prefix, marker), "", nil
+}
+
+func (f *httpFetcher) loadIndex(ctx context.Context) (*Index, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.index != nil {
+		return f.index, nil
+	}
+
+	rc, err := f.fetch(ctx, IndexKey, 0)
+	if err == errObjectNotFound {
+		return nil, fmt.Errorf("%s has no %s to list it, create it with 'dogestry reindex' on the remote it mirrors", redactURL(f.base.String()), IndexKey)
+	} else if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = f.envelope.open(IndexKey, data); err != nil {
+		return nil, err
+	}
+
+	if f.index, err = parseIndex(data); err != nil {
+		return nil, err
+	}
+
+	return f.index, nil
+}
+
+// NewHTTPRemote returns a read-only remote pulling over HTTP(S) GETs from
+// the standard layout at rawurl. Push and the other writes fail with
+// ErrReadOnly.
+func NewHTTPRemote(cfg config.Config, rawurl string) (Remote, error) {
+	base, err := url.Parse(rawurl)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("invalid HTTP remote '%s', expected eg. https://mirror.local/docker/", rawurl)
+	}
+
+	envelope, err := newEnvelope(cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := &readOnlyRemote{
+		fetcher:  &httpFetcher{base: base, client: http.DefaultClient, envelope: envelope},
+		desc:     fmt.Sprintf("http(url=%s)", redactURL(base.Redacted())),
+		retry:    newRetryPolicy(cfg),
+		envelope: envelope,
+	}
+
+	return remote, nil
+}
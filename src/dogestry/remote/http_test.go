@@ -0,0 +1,187 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"dogestry/config"
+	docker "github.com/fsouza/go-dockerclient"
+
+	. "gopkg.in/check.v1"
+)
+
+type HTTPSuite struct {
+	fake   *fakeS3
+	remote *S3Remote
+}
+
+var _ = Suite(&HTTPSuite{})
+
+// SetUpTest reindexes the S3 remote before pushing, so that the push has
+// to keep the index up to date.
+func (s *HTTPSuite) SetUpTest(c *C) {
+	var imageRoot string
+	s.fake, _, imageRoot = setUpLayoutRemote(c, 3)
+	s.fake.put("team-a/"+LayoutKey, `{"version": 3}`)
+
+	cfg := config.Config{}
+	cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey = "abc", "123"
+	c.Assert(cfg.SetS3URL("s3://bucket/team-a/?pathstyle=true&endpoint="+url.QueryEscape(s.fake.server.URL)), IsNil)
+
+	var err error
+	s.remote, err = NewS3Remote(cfg)
+	c.Assert(err, IsNil)
+
+	ctx := context.Background()
+	_, err = s.remote.Reindex(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(s.remote.Push(ctx, "app:latest", imageRoot), IsNil)
+}
+
+func (s *HTTPSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+// mirror returns an HTTP remote reading the S3 remote through the fake's
+// path-style URLs, like a web server in front of the bucket would.
+func (s *HTTPSuite) mirror(c *C) Remote {
+	r, err := NewHTTPRemote(config.Config{}, s.fake.server.URL+"/bucket/team-a")
+	c.Assert(err, IsNil)
+	c.Assert(r.Validate(context.Background()), IsNil)
+	return r
+}
+
+func (s *HTTPSuite) TestIndex(c *C) {
+	data, ok := s.fake.get("team-a/" + IndexKey)
+	c.Assert(ok, Equals, true)
+	index, err := parseIndex([]byte(data))
+	c.Assert(err, IsNil)
+
+	var keys []string
+	for key := range index.Objects {
+		keys = append(keys, key)
+	}
+	// VERSION, json, layer.digest, the blob and the tag
+	c.Assert(keys, HasLen, 5, Commentf("%v", keys))
+	c.Assert(index.Objects["repositories/app/latest"].Size, Equals, int64(len(pushImageId)))
+
+	// reindexing lists the same objects
+	_, err = s.remote.Reindex(context.Background())
+	c.Assert(err, IsNil)
+	data, _ = s.fake.get("team-a/" + IndexKey)
+	reindexed, err := parseIndex([]byte(data))
+	c.Assert(err, IsNil)
+	c.Assert(reindexed.Objects, HasLen, 5)
+
+	// so does moving a tag
+	c.Assert(s.remote.SetTag(context.Background(), "app", "prod", pushImageId), IsNil)
+	data, _ = s.fake.get("team-a/" + IndexKey)
+	tagged, err := parseIndex([]byte(data))
+	c.Assert(err, IsNil)
+	_, ok = tagged.Objects["repositories/app/prod"]
+	c.Assert(ok, Equals, true)
+}
+
+func (s *HTTPSuite) TestPull(c *C) {
+	ctx := context.Background()
+
+	// with and without a journal
+	for _, journal := range []bool{false, true} {
+		r := s.mirror(c)
+		c.Assert(r.Desc(), Equals, "http(url="+s.fake.server.URL+"/bucket/team-a)")
+		if journal {
+			j, err := OpenJournal(filepath.Join(c.MkDir(), "pull.journal"), r.Desc())
+			c.Assert(err, IsNil)
+			r.SetJournal(j)
+		}
+
+		s.fake.requests = nil
+
+		id, err := r.ParseTag(ctx, "app", "latest")
+		c.Assert(err, IsNil)
+		c.Assert(id, Equals, ID(pushImageId))
+
+		var walked []ID
+		err = r.WalkImages(ctx, id, func(id ID, _ docker.Image, err error) error {
+			walked = append(walked, id)
+			return err
+		})
+		c.Assert(err, IsNil)
+		c.Assert(walked, DeepEquals, []ID{pushImageId})
+
+		dst := filepath.Join(c.MkDir(), pushImageId)
+		c.Assert(r.PullImageId(ctx, id, dst), IsNil)
+
+		layer, err := ioutil.ReadFile(filepath.Join(dst, "layer.tar"))
+		c.Assert(err, IsNil)
+		c.Assert(string(layer), Equals, "layer contents")
+
+		// plain GETs and HEADs of objects, no listing
+		for _, request := range s.fake.requests {
+			c.Assert(request, Matches, `(GET|HEAD) /bucket/team-a/.+\?`)
+		}
+	}
+}
+
+func (s *HTTPSuite) TestList(c *C) {
+	ctx := context.Background()
+
+	images, err := s.mirror(c).List(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(images, DeepEquals, []Image{{"app", "latest"}})
+
+	// from the index without a catalog
+	s.fake.mu.Lock()
+	delete(s.fake.objects, "team-a/"+CatalogKey)
+	s.fake.mu.Unlock()
+
+	r := s.mirror(c)
+	images, err = r.List(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(images, DeepEquals, []Image{{"app", "latest"}})
+
+	id, err := r.ResolveImageNameToId(ctx, pushImageId[:12])
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID(pushImageId))
+
+	// neither
+	s.fake.mu.Lock()
+	delete(s.fake.objects, "team-a/"+IndexKey)
+	s.fake.mu.Unlock()
+
+	_, err = s.mirror(c).List(ctx)
+	c.Assert(err, ErrorMatches, ".*/bucket/team-a has no dogestry-index.json to list it, create it with 'dogestry reindex' on the remote it mirrors")
+}
+
+func (s *HTTPSuite) TestStaleIndex(c *C) {
+	data, err := json.Marshal(newIndex())
+	c.Assert(err, IsNil)
+	s.fake.put("team-a/"+IndexKey, string(data))
+
+	err = s.mirror(c).PullImageId(context.Background(), pushImageId, c.MkDir())
+	c.Assert(err, ErrorMatches, `http\(url=.*\) lists no files of image 5d3ba16e6f0c`)
+}
+
+func (s *HTTPSuite) TestReadOnly(c *C) {
+	ctx := context.Background()
+	r := s.mirror(c)
+	s.fake.requests = nil
+
+	c.Assert(r.Push(ctx, "app:latest", c.MkDir()), Equals, ErrReadOnly)
+	c.Assert(r.SetTag(ctx, "app", "prod", pushImageId), Equals, ErrReadOnly)
+	_, err := r.Reindex(ctx)
+	c.Assert(err, Equals, ErrReadOnly)
+
+	for _, request := range s.fake.requests {
+		c.Assert(strings.HasPrefix(request, "PUT") || strings.HasPrefix(request, "DELETE"), Equals, false)
+	}
+}
+
+func (s *HTTPSuite) TestInvalidURL(c *C) {
+	_, err := NewHTTPRemote(config.Config{}, "ftp://mirror/docker")
+	c.Assert(err, ErrorMatches, "invalid HTTP remote 'ftp://mirror/docker', expected eg. https://mirror.local/docker/")
+}
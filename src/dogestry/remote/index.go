@@ -0,0 +1,219 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// IndexKey is the object at the root of a remote listing the objects of its
+// images, tags and blobs, so that remotes served by plain web servers,
+// which can't be listed, can still be pulled from. Only Reindex creates it;
+// once it exists Push, SetTag and Migrate keep it up to date.
+const IndexKey = "dogestry-index.json"
+
+// the prefixes of the objects listed in the index
+var indexPrefixes = []string{"images/", "repositories/", "blobs/"}
+
+// Index lists the objects of a remote.
+type Index struct {
+	// by key, relative to the root of the remote
+	Objects map[string]IndexObject `json:"objects"`
+}
+
+type IndexObject struct {
+	Size int64  `json:"size"`
+	ETag string `json:"etag,omitempty"`
+}
+
+func newIndex() *Index {
+	return &Index{Objects: make(map[string]IndexObject)}
+}
+
+func (index *Index) add(object objectInfo) {
+	index.Objects[object.Key] = IndexObject{Size: object.Size, ETag: object.ETag}
+}
+
+// list returns the objects whose key starts with prefix, after marker,
+// sorted by key.
+func (index *Index) list(prefix, marker string) []objectInfo {
+	var objects []objectInfo
+	for key, object := range index.Objects {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			objects = append(objects, objectInfo{Key: key, Size: object.Size, ETag: object.ETag})
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects
+}
+
+// readIndex returns the index of the remote behind store and the ETag of
+// its object. The index is nil if the remote doesn't have one.
+func readIndex(ctx context.Context, store objectStore) (*Index, string, error) {
+	data, etag, err := store.getObject(ctx, IndexKey)
+	if err == errObjectNotFound {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	index, err := parseIndex(data)
+	return index, etag, err
+}
+
+func parseIndex(data []byte) (*Index, error) {
+	index := newIndex()
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", IndexKey, err)
+	}
+
+	return index, nil
+}
+
+// updateIndex adds objects to the remote's index, if it has one.
+// Concurrent updates are serialised with conditional writes.
+func updateIndex(ctx context.Context, store objectStore, objects []objectInfo) error {
+	if len(objects) == 0 {
+		return nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		index, etag, err := readIndex(ctx, store)
+		if err != nil || index == nil {
+			return err
+		}
+
+		for _, object := range objects {
+			index.add(object)
+		}
+
+		data, err := json.Marshal(index)
+		if err != nil {
+			return err
+		}
+
+		err = store.putObjectIf(ctx, IndexKey, data, etag)
+		if err != errPreconditionFailed || attempt == catalogAttempts {
+			return err
+		}
+	}
+}
+
+// buildIndex lists the objects of the remote's images, tags and blobs.
+func buildIndex(ctx context.Context, store objectStore) (*Index, error) {
+	index := newIndex()
+	for _, prefix := range indexPrefixes {
+		objects, err := listObjects(ctx, store, prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range objects {
+			index.add(object)
+		}
+	}
+
+	return index, nil
+}
+
+func writeIndex(ctx context.Context, store objectStore, index *Index) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return store.putObject(ctx, IndexKey, data)
+}
+
+// hasIndex reports whether the remote has an index.
+func hasIndex(ctx context.Context, store objectStore) (bool, error) {
+	_, err := store.statObject(ctx, IndexKey)
+	if err == errObjectNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// refreshIndex rebuilds the remote's index, if it has one, after objects
+// were moved around.
+func refreshIndex(ctx context.Context, store objectStore) error {
+	if ok, err := hasIndex(ctx, store); !ok {
+		return err
+	}
+
+	index, err := buildIndex(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	return writeIndex(ctx, store, index)
+}
+
+// indexImages adds the objects of the images exported to imageRoot, and
+// the blobs of their layers, to the remote's index.
+func indexImages(ctx context.Context, store objectStore, imageRoot string) error {
+	if ok, err := hasIndex(ctx, store); !ok {
+		return err
+	}
+
+	dirs, err := ioutil.ReadDir(filepath.Join(imageRoot, "images"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var added []objectInfo
+	for _, dir := range dirs {
+		objects, err := listObjects(ctx, store, "images/"+dir.Name()+"/")
+		if err != nil {
+			return err
+		}
+		added = append(added, objects...)
+
+		for _, object := range objects {
+			if path.Base(object.Key) != layerDigestFile {
+				continue
+			}
+
+			blob, err := layerBlob(ctx, store, object.Key)
+			if err != nil {
+				return err
+			}
+			added = append(added, blob)
+		}
+	}
+
+	return updateIndex(ctx, store, added)
+}
+
+// indexTags adds the objects of tags to the remote's index.
+func indexTags(ctx context.Context, store objectStore, tags []tagRef) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	if ok, err := hasIndex(ctx, store); !ok {
+		return err
+	}
+
+	var added []objectInfo
+	for _, t := range tags {
+		object, err := store.statObject(ctx, tagKey(t.Repo, t.Tag))
+		if err == errObjectNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		added = append(added, object)
+	}
+
+	return updateIndex(ctx, store, added)
+}
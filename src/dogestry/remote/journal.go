@@ -0,0 +1,312 @@
+package remote
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"dogestry/utils"
+)
+
+// Journal records the progress of a push or pull so that rerunning an
+// interrupted command resumes where it stopped instead of starting over.
+// It's kept as a JSON file next to the work dir and saved after every step.
+//
+// All methods are safe to call on a nil *Journal, which records nothing.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+
+	Remote    string                    `json:"remote"`
+	Uploads   map[string]*UploadState   `json:"uploads"`
+	Downloads map[string]*DownloadState `json:"downloads"`
+}
+
+// UploadState is the progress of a single file upload.
+type UploadState struct {
+	// sha1 of the local file the state applies to
+	Sum  string `json:"sum"`
+	Done bool   `json:"done,omitempty"`
+	// S3 multipart upload in progress
+	UploadID string `json:"uploadId,omitempty"`
+	// Azure blocks uploaded but not committed yet
+	Blocks []string `json:"blocks,omitempty"`
+	// URI of a GCS resumable upload session
+	Session string `json:"session,omitempty"`
+}
+
+// DownloadState is the progress of a single file download.
+type DownloadState struct {
+	// ETag of the remote object, a download is only continued if it still
+	// matches
+	ETag string `json:"etag"`
+	// bytes written to the local file so far, and their sha1
+	Offset int64  `json:"offset"`
+	Sum    string `json:"sum"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// OpenJournal loads the journal at path, or starts a new one if it doesn't
+// exist or was written for a different remote.
+func OpenJournal(path, remoteDesc string) (*Journal, error) {
+	j := &Journal{
+		path:      path,
+		Remote:    remoteDesc,
+		Uploads:   make(map[string]*UploadState),
+		Downloads: make(map[string]*DownloadState),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	saved := Journal{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("ignoring unreadable journal %s: %v", path, err)
+		return j, nil
+	}
+
+	if saved.Remote != remoteDesc {
+		return j, nil
+	}
+
+	if saved.Uploads != nil {
+		j.Uploads = saved.Uploads
+	}
+	if saved.Downloads != nil {
+		j.Downloads = saved.Downloads
+	}
+
+	return j, nil
+}
+
+// Upload returns the recorded state of the upload of key. The state is reset
+// if the local file changed since (its sha1 isn't sum), except for the S3
+// upload ID: parts are checked against their md5 before they're reused.
+func (j *Journal) Upload(key, sum string) UploadState {
+	if j == nil {
+		return UploadState{Sum: sum}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	state, ok := j.Uploads[key]
+	if !ok {
+		return UploadState{Sum: sum}
+	}
+	if state.Sum != sum {
+		return UploadState{Sum: sum, UploadID: state.UploadID}
+	}
+
+	state.Blocks = append([]string(nil), state.Blocks...)
+	return *state
+}
+
+func (j *Journal) SetUpload(key string, state UploadState) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Uploads[key] = &state
+	return j.save()
+}
+
+// Download returns the recorded state of the download of key, or a fresh
+// state if the remote object's etag changed since.
+func (j *Journal) Download(key, etag string) DownloadState {
+	if j == nil {
+		return DownloadState{ETag: etag}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	state, ok := j.Downloads[key]
+	if !ok || etag == "" || state.ETag != etag {
+		return DownloadState{ETag: etag}
+	}
+
+	return *state
+}
+
+func (j *Journal) SetDownload(key string, state DownloadState) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Downloads[key] = &state
+	return j.save()
+}
+
+// Remove deletes the journal file, once the transfer it recorded is done.
+func (j *Journal) Remove() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// save writes the journal atomically, so a crash never leaves a torn file.
+// Must be called with j.mu held.
+func (j *Journal) save() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), j.path)
+}
+
+// bytes written between journal checkpoints of a download
+const downloadCheckpoint = 8 * 1024 * 1024
+
+// openRangeFn opens the remote object for reading from offset onwards.
+type openRangeFn func(offset int64) (io.ReadCloser, error)
+
+// resumeDownload downloads key (size bytes, with the given etag) to dst,
+// continuing a download recorded in journal. The part of dst already on disk
+// is only kept if its sha1 matches the one recorded at the last checkpoint;
+// the rest is fetched through open with a range request.
+func resumeDownload(ctx context.Context, journal *Journal, dst, key, etag string, size int64, open openRangeFn) error {
+	state := journal.Download(key, etag)
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	to, err := os.OpenFile(dst, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+
+	digest := sha1.New()
+	offset, err := validatePartial(to, digest, state)
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 && offset == size {
+		log.Printf("Key %s already downloaded", key)
+		return nil
+	}
+
+	if offset > 0 {
+		log.Printf("Resuming key %s at %s of %s", key, utils.HumanSize(offset), utils.HumanSize(size))
+	} else {
+		digest.Reset()
+	}
+
+	if err := to.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := to.Seek(offset, 0); err != nil {
+		return err
+	}
+
+	from, err := open(offset)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	progressReader := utils.NewProgressReader(from, size-offset, key)
+	r := utils.NewLimitedReader(ctx, progressReader)
+	w := io.MultiWriter(to, digest)
+
+	for {
+		n, err := io.CopyN(w, r, downloadCheckpoint)
+		offset += n
+
+		if syncErr := to.Sync(); syncErr != nil {
+			return syncErr
+		}
+
+		state.Offset = offset
+		state.Sum = hex.EncodeToString(digest.Sum(nil))
+		state.Done = err == io.EOF
+		if journalErr := journal.SetDownload(key, state); journalErr != nil {
+			return journalErr
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if offset != size {
+		return fmt.Errorf("downloaded %d bytes of %s, expected %d", offset, key, size)
+	}
+
+	return nil
+}
+
+// validatePartial hashes the part of f recorded in state into digest and
+// returns the offset to continue from, 0 if f doesn't match the journal.
+func validatePartial(f *os.File, digest hash.Hash, state DownloadState) (int64, error) {
+	if state.Offset == 0 || state.Sum == "" {
+		return 0, nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < state.Offset {
+		return 0, nil
+	}
+
+	if _, err := io.CopyN(digest, f, state.Offset); err != nil {
+		return 0, err
+	}
+
+	if hex.EncodeToString(digest.Sum(nil)) != state.Sum {
+		log.Printf("Partial download %s doesn't match the journal, starting over", f.Name())
+		return 0, nil
+	}
+
+	return state.Offset, nil
+}
@@ -0,0 +1,119 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type JournalSuite struct {
+	TempDir string
+}
+
+var _ = Suite(&JournalSuite{})
+
+func (s *JournalSuite) SetUpTest(c *C) {
+	s.TempDir = c.MkDir()
+}
+
+func (s *JournalSuite) TestReopen(c *C) {
+	path := filepath.Join(s.TempDir, "work.journal")
+
+	j, err := OpenJournal(path, "remote-a")
+	c.Assert(err, IsNil)
+	c.Assert(j.SetUpload("images/1/layer.tar", UploadState{Sum: "abc", UploadID: "up-1"}), IsNil)
+	c.Assert(j.SetDownload("images/2/layer.tar", DownloadState{ETag: `"e"`, Offset: 10, Sum: "s"}), IsNil)
+
+	j, err = OpenJournal(path, "remote-a")
+	c.Assert(err, IsNil)
+	c.Assert(j.Upload("images/1/layer.tar", "abc"), DeepEquals, UploadState{Sum: "abc", UploadID: "up-1"})
+	c.Assert(j.Download("images/2/layer.tar", `"e"`).Offset, Equals, int64(10))
+
+	// the remote object changed
+	c.Assert(j.Download("images/2/layer.tar", `"f"`), DeepEquals, DownloadState{ETag: `"f"`})
+
+	// the local file changed, S3 parts are verified so the upload is kept
+	c.Assert(j.Upload("images/1/layer.tar", "def"), DeepEquals, UploadState{Sum: "def", UploadID: "up-1"})
+
+	// a journal for a different remote is ignored
+	j, err = OpenJournal(path, "remote-b")
+	c.Assert(err, IsNil)
+	c.Assert(j.Upload("images/1/layer.tar", "abc"), DeepEquals, UploadState{Sum: "abc"})
+
+	c.Assert(j.Remove(), IsNil)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *JournalSuite) TestNilJournal(c *C) {
+	var j *Journal
+
+	c.Assert(j.SetUpload("key", UploadState{Sum: "abc", Done: true}), IsNil)
+	c.Assert(j.Upload("key", "abc"), DeepEquals, UploadState{Sum: "abc"})
+	c.Assert(j.Remove(), IsNil)
+}
+
+func (s *JournalSuite) TestResumeDownload(c *C) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	dst := filepath.Join(s.TempDir, "layer.tar")
+
+	// an earlier run got the first 300 bytes
+	c.Assert(ioutil.WriteFile(dst, content[:300], 0600), IsNil)
+	partial := sha1.Sum(content[:300])
+
+	j, err := OpenJournal(filepath.Join(s.TempDir, "work.journal"), "remote")
+	c.Assert(err, IsNil)
+	c.Assert(j.SetDownload("key", DownloadState{ETag: "etag", Offset: 300, Sum: hex.EncodeToString(partial[:])}), IsNil)
+
+	var offsets []int64
+	open := func(offset int64) (io.ReadCloser, error) {
+		offsets = append(offsets, offset)
+		return ioutil.NopCloser(bytes.NewReader(content[offset:])), nil
+	}
+
+	err = resumeDownload(context.Background(), j, dst, "key", "etag", int64(len(content)), open)
+	c.Assert(err, IsNil)
+	c.Assert(offsets, DeepEquals, []int64{300})
+
+	got, err := ioutil.ReadFile(dst)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, content)
+	c.Assert(j.Download("key", "etag").Done, Equals, true)
+
+	// done files aren't downloaded again
+	err = resumeDownload(context.Background(), j, dst, "key", "etag", int64(len(content)), open)
+	c.Assert(err, IsNil)
+	c.Assert(offsets, DeepEquals, []int64{300})
+}
+
+func (s *JournalSuite) TestResumeDownloadCorruptPartial(c *C) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	dst := filepath.Join(s.TempDir, "layer.tar")
+
+	c.Assert(ioutil.WriteFile(dst, []byte("garbage garbage"), 0600), IsNil)
+
+	j, err := OpenJournal(filepath.Join(s.TempDir, "work.journal"), "remote")
+	c.Assert(err, IsNil)
+	c.Assert(j.SetDownload("key", DownloadState{ETag: "etag", Offset: 10, Sum: "not the sum"}), IsNil)
+
+	var offsets []int64
+	open := func(offset int64) (io.ReadCloser, error) {
+		offsets = append(offsets, offset)
+		return ioutil.NopCloser(bytes.NewReader(content[offset:])), nil
+	}
+
+	err = resumeDownload(context.Background(), j, dst, "key", "etag", int64(len(content)), open)
+	c.Assert(err, IsNil)
+	c.Assert(offsets, DeepEquals, []int64{0})
+
+	got, err := ioutil.ReadFile(dst)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, content)
+}
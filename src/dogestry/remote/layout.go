@@ -0,0 +1,207 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// LayoutKey is the object at the root of a remote describing how it's laid
+// out, see Layout.
+const LayoutKey = "dogestry.json"
+
+// LayoutVersion is the newest layout this version of dogestry reads and
+// writes.
+const LayoutVersion = 3
+
+// knownFeatures are the optional layout features this version of dogestry
+// understands. Remotes using any other feature are refused.
+var knownFeatures = map[string]bool{
+	encryptionFeature: true,
+}
+
+// migrations[n] moves a remote from layout n-1 to layout n. They must be
+// safe to run again: an interrupted migration is resumed by rerunning it.
+var migrations = map[int]func(ctx context.Context, store objectStore) error{
+	// the original layout, only the descriptor is new
+	1: func(ctx context.Context, store objectStore) error { return nil },
+
+	blobsLayoutVersion: migrateToBlobs,
+
+	// blobs already stored stay uncompressed, only new ones are compressed
+	compressedLayoutVersion: func(ctx context.Context, store objectStore) error { return nil },
+}
+
+// Layout declares the format of a remote, so that a dogestry too old to
+// understand it refuses to touch it. A remote without LayoutKey has layout
+// version 1, the one dogestry has always used.
+type Layout struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features,omitempty"`
+	// set while a migration to this version runs or after it failed
+	MigratingTo int `json:"migratingTo,omitempty"`
+}
+
+// HasFeature tells whether the remote uses the optional feature.
+func (l Layout) HasFeature(feature string) bool {
+	for _, f := range l.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// LayoutError is returned for remotes with a layout this version of
+// dogestry doesn't support.
+type LayoutError struct {
+	Version int
+	// features not known to this version
+	Features []string
+}
+
+func (e *LayoutError) Error() string {
+	if e.Version > LayoutVersion {
+		return fmt.Sprintf("remote has layout version %d, this dogestry only supports up to version %d, please upgrade it", e.Version, LayoutVersion)
+	}
+	return fmt.Sprintf("remote uses unsupported features: %s, please upgrade dogestry", strings.Join(e.Features, ", "))
+}
+
+// readLayout returns the layout of the remote behind store, and the ETag of
+// its descriptor, empty if there is none.
+func readLayout(ctx context.Context, store objectStore) (Layout, string, error) {
+	data, etag, err := store.getObject(ctx, LayoutKey)
+	if err == errObjectNotFound {
+		return Layout{Version: 1}, "", nil
+	} else if err != nil {
+		return Layout{}, "", err
+	}
+
+	var layout Layout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return Layout{}, "", fmt.Errorf("invalid %s: %v", LayoutKey, err)
+	}
+	if layout.Version < 1 {
+		return Layout{}, "", fmt.Errorf("invalid %s: bad version %d", LayoutKey, layout.Version)
+	}
+
+	return layout, etag, nil
+}
+
+// checkLayout fails with a *LayoutError if this version of dogestry can't
+// work with the remote behind store.
+func checkLayout(ctx context.Context, store objectStore) error {
+	layout, _, err := readLayout(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	if layout.Version > LayoutVersion {
+		return &LayoutError{Version: layout.Version}
+	}
+
+	var unknown []string
+	for _, f := range layout.Features {
+		if !knownFeatures[f] {
+			unknown = append(unknown, f)
+		}
+	}
+	if len(unknown) > 0 {
+		return &LayoutError{Version: layout.Version, Features: unknown}
+	}
+
+	if layout.MigratingTo != 0 {
+		log.Printf("Warning: a migration of this remote to layout version %d didn't finish, rerun 'dogestry migrate -to %d'", layout.MigratingTo, layout.MigratingTo)
+	}
+
+	return nil
+}
+
+// migrate moves the remote behind store to layout version to, one version
+// at a time. Rerunning it after a failure resumes the migration.
+func migrate(ctx context.Context, store objectStore, to int) error {
+	if to < 1 || to > LayoutVersion {
+		return fmt.Errorf("unknown layout version %d, this dogestry supports versions 1 to %d", to, LayoutVersion)
+	}
+
+	layout, etag, err := readLayout(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	if to < layout.Version {
+		return fmt.Errorf("remote has layout version %d, migrating back to version %d isn't supported", layout.Version, to)
+	}
+
+	if layout.MigratingTo > to {
+		return fmt.Errorf("a migration to layout version %d didn't finish, rerun it first", layout.MigratingTo)
+	}
+
+	if to == layout.Version && etag != "" && layout.MigratingTo == 0 {
+		log.Printf("Remote already has layout version %d", to)
+		return nil
+	}
+
+	version := layout.Version
+	switch {
+	case layout.MigratingTo != 0:
+		version = layout.MigratingTo - 1
+	case etag == "":
+		// a remote without descriptor has version 1, but still needs one
+		version = 0
+	}
+
+	for version < to {
+		next := version + 1
+		if layout.MigratingTo != 0 {
+			log.Printf("Resuming migration to layout version %d", next)
+		} else {
+			log.Printf("Migrating to layout version %d", next)
+		}
+
+		layout.MigratingTo = next
+		if etag, err = writeLayout(ctx, store, layout, etag); err != nil {
+			return err
+		}
+
+		if err := migrations[next](ctx, store); err != nil {
+			return fmt.Errorf("migrating to layout version %d: %v", next, err)
+		}
+
+		layout.Version = next
+		layout.MigratingTo = 0
+		if etag, err = writeLayout(ctx, store, layout, etag); err != nil {
+			return err
+		}
+
+		version = next
+	}
+
+	// layers moved
+	if err := refreshIndex(ctx, store); err != nil {
+		log.Printf("Warning: unable to update %s: %v", IndexKey, err)
+	}
+
+	return nil
+}
+
+// writeLayout stores layout, on condition that the descriptor still has
+// etag, and returns the ETag of the new descriptor.
+func writeLayout(ctx context.Context, store objectStore, layout Layout, etag string) (string, error) {
+	data, err := json.MarshalIndent(layout, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	err = store.putObjectIf(ctx, LayoutKey, data, etag)
+	if err == errPreconditionFailed {
+		return "", fmt.Errorf("%s was changed by someone else, is another migration running?", LayoutKey)
+	} else if err != nil {
+		return "", err
+	}
+
+	_, etag, err = store.getObject(ctx, LayoutKey)
+	return etag, err
+}
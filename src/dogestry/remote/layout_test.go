@@ -0,0 +1,94 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+
+	. "gopkg.in/check.v1"
+)
+
+type LayoutSuite struct {
+	fake   *fakeS3
+	remote *S3Remote
+}
+
+var _ = Suite(&LayoutSuite{})
+
+func (s *LayoutSuite) SetUpTest(c *C) {
+	s.fake = newFakeS3()
+	s.remote = s.fake.remote("bucket")
+}
+
+func (s *LayoutSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+func (s *LayoutSuite) storedLayout(c *C) Layout {
+	data, ok := s.fake.get(LayoutKey)
+	c.Assert(ok, Equals, true)
+
+	var layout Layout
+	c.Assert(json.Unmarshal([]byte(data), &layout), IsNil)
+	return layout
+}
+
+func (s *LayoutSuite) TestNoDescriptor(c *C) {
+	c.Assert(s.remote.Validate(context.Background()), IsNil)
+
+	layout, err := s.remote.Layout(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(layout, DeepEquals, Layout{Version: 1})
+}
+
+func (s *LayoutSuite) TestUnsupportedLayout(c *C) {
+	s.fake.put(LayoutKey, `{"version": 99}`)
+	err := s.remote.Validate(context.Background())
+	c.Assert(err, FitsTypeOf, &LayoutError{})
+	c.Assert(err, ErrorMatches, "remote has layout version 99, this dogestry only supports up to version 3, please upgrade it")
+
+	s.fake.put(LayoutKey, `{"version": 1, "features": ["teleport"]}`)
+	err = s.remote.Validate(context.Background())
+	c.Assert(err, ErrorMatches, "remote uses unsupported features: teleport, please upgrade dogestry")
+
+	s.fake.put(LayoutKey, `{"version": 0}`)
+	err = s.remote.Validate(context.Background())
+	c.Assert(err, ErrorMatches, "invalid dogestry.json: bad version 0")
+}
+
+func (s *LayoutSuite) TestMigrate(c *C) {
+	ctx := context.Background()
+
+	c.Assert(s.remote.Migrate(ctx, 1), IsNil)
+	c.Assert(s.storedLayout(c), DeepEquals, Layout{Version: 1})
+	c.Assert(s.remote.Validate(ctx), IsNil)
+
+	// nothing left to do
+	writes := len(s.fake.writes)
+	c.Assert(s.remote.Migrate(ctx, 1), IsNil)
+	c.Assert(s.fake.writes, HasLen, writes)
+
+	c.Assert(s.remote.Migrate(ctx, LayoutVersion+1), ErrorMatches, "unknown layout version .*")
+	c.Assert(s.remote.Migrate(ctx, 0), ErrorMatches, "unknown layout version 0.*")
+}
+
+func (s *LayoutSuite) TestResumeMigration(c *C) {
+	// interrupted before the descriptor was finished
+	s.fake.put(LayoutKey, `{"version": 1, "migratingTo": 1}`)
+	c.Assert(s.remote.Validate(context.Background()), IsNil)
+
+	c.Assert(s.remote.Migrate(context.Background(), 1), IsNil)
+	c.Assert(s.storedLayout(c), DeepEquals, Layout{Version: 1})
+}
+
+func (s *LayoutSuite) TestConcurrentMigration(c *C) {
+	// another migration writes the descriptor under our feet
+	s.fake.fail = func(method, key string) bool {
+		if method == "PUT" && key == LayoutKey {
+			s.fake.objects[key] = []byte(`{"version": 1, "migratingTo": 1}`)
+		}
+		return false
+	}
+
+	err := s.remote.Migrate(context.Background(), 1)
+	c.Assert(err, ErrorMatches, ".*another migration running.*")
+}
@@ -0,0 +1,137 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type ListSuite struct {
+	fake  *fakeS3
+	azure *fakeAzure
+}
+
+var _ = Suite(&ListSuite{})
+
+func (s *ListSuite) SetUpTest(c *C) {
+	s.fake = newFakeS3()
+	s.fake.pageSize = 2
+	s.azure = newFakeAzure()
+	s.azure.pageSize = 2
+}
+
+func (s *ListSuite) TearDownTest(c *C) {
+	s.fake.Close()
+	s.azure.Close()
+}
+
+// listRequests counts the listings in requests.
+func listRequests(requests []string, match string) int {
+	n := 0
+	for _, r := range requests {
+		if strings.HasPrefix(r, "GET ") && strings.Contains(r, match) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *ListSuite) TestS3Iterator(c *C) {
+	for i := 0; i < 5; i++ {
+		s.fake.put(fmt.Sprintf("images/%d/json", i), "{}")
+	}
+	s.fake.put("repositories/app/latest", "0")
+
+	objects, err := listObjects(context.Background(), s.fake.remote("bucket"), "images/")
+	c.Assert(err, IsNil)
+	c.Assert(objects, HasLen, 5)
+	c.Assert(objects[4], Equals, objectInfo{Key: "images/4/json", Size: 2, ETag: etag([]byte("{}"))})
+
+	c.Assert(listRequests(s.fake.requests, "prefix=images"), Equals, 3)
+}
+
+func (s *ListSuite) TestS3IteratorError(c *C) {
+	for i := 0; i < 5; i++ {
+		s.fake.put(fmt.Sprintf("images/%d/json", i), "{}")
+	}
+
+	lists := 0
+	s.fake.fail = func(method, key string) bool {
+		if method == "GET" && key == "" {
+			lists++
+		}
+		return lists == 2
+	}
+
+	it := newObjectIterator(context.Background(), s.fake.remote("bucket"), "images/")
+	n := 0
+	for it.Next() {
+		n++
+	}
+
+	c.Assert(n, Equals, 2)
+	c.Assert(it.Err(), ErrorMatches, ".*AccessDenied.*")
+	c.Assert(it.Next(), Equals, false)
+}
+
+func (s *ListSuite) TestS3List(c *C) {
+	tags := []string{"app/latest", "app/v1", "app/v2", "other/latest", "other/v1"}
+	for _, tag := range tags {
+		s.fake.put("repositories/"+tag, "0123456789abcdef")
+	}
+
+	images, err := s.fake.remote("bucket").List(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 5)
+	c.Assert(images[4], Equals, Image{"other", "v1"})
+}
+
+func (s *ListSuite) TestS3ImageFullId(c *C) {
+	for _, id := range []string{"0123", "4567", "89ab"} {
+		s.fake.put("images/"+id+"aaaaaaaaaaaa/json", "{}")
+		s.fake.put("images/"+id+"aaaaaaaaaaaa/layer.tar", "layer")
+	}
+
+	id, err := s.fake.remote("bucket").ImageFullId(context.Background(), "89a")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID("89abaaaaaaaaaaaa"))
+}
+
+func (s *ListSuite) TestAzureIterator(c *C) {
+	for i := 0; i < 5; i++ {
+		s.azure.put(fmt.Sprintf("container/sub/images/%d/json", i), "{}")
+	}
+	s.azure.put("container/images/0/json", "outside the path")
+
+	objects, err := listObjects(context.Background(), s.azure.remote("container/sub"), "images/")
+	c.Assert(err, IsNil)
+	c.Assert(objects, HasLen, 5)
+	c.Assert(objects[0].Key, Equals, "images/0/json")
+	c.Assert(objects[4].Key, Equals, "images/4/json")
+
+	c.Assert(listRequests(s.azure.requests, "comp=list"), Equals, 3)
+}
+
+func (s *ListSuite) TestAzureList(c *C) {
+	tags := []string{"app/latest", "app/v1", "app/v2", "other/latest", "other/v1"}
+	for _, tag := range tags {
+		s.azure.put("container/repositories/"+tag, "0123456789abcdef")
+	}
+
+	images, err := s.azure.remote("container").List(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 5)
+}
+
+func (s *ListSuite) TestAzureImageFullId(c *C) {
+	for _, id := range []string{"0123", "4567", "89ab"} {
+		s.azure.put("container/images/"+id+"aaaaaaaaaaaa/json", "{}")
+		s.azure.put("container/images/"+id+"aaaaaaaaaaaa/layer.tar", "layer")
+	}
+
+	id, err := s.azure.remote("container").ImageFullId(context.Background(), "89a")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID("89abaaaaaaaaaaaa"))
+}
@@ -0,0 +1,267 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"dogestry/config"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// ManifestVersion is the version of the manifests written by Presign.
+const ManifestVersion = 1
+
+// Manifest lists time-limited URLs to the objects needed to pull one image,
+// so that it can be pulled without credentials for the remote. See
+// Presign and NewManifestRemote.
+type Manifest struct {
+	Version int `json:"version"`
+	// the remote the URLs point into
+	Remote  string    `json:"remote"`
+	Image   string    `json:"image"`
+	ID      ID        `json:"id"`
+	Expires time.Time `json:"expires"`
+	// by key, relative to the root of the remote
+	Objects map[string]ManifestObject `json:"objects"`
+}
+
+type ManifestObject struct {
+	URL  string `json:"url"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag,omitempty"`
+}
+
+// presigner is a remote that can hand out URLs reading its objects without
+// credentials.
+type presigner interface {
+	objectStore
+
+	// presignObject returns a URL GETting key until expires.
+	presignObject(key string, expires time.Time) (string, error)
+}
+
+func (remote *S3Remote) presignObject(key string, expires time.Time) (string, error) {
+	return remote.getBucket().SignedURL(remote.remoteKey(key), expires), nil
+}
+
+func (remote *AzureRemote) presignObject(key string, expires time.Time) (string, error) {
+	// URLs with the configured token would hand out its permissions until
+	// it expires, rather than reads until expires
+	if remote.config.Azure.AccountKey == "" {
+		return "", errors.New("presigning URLs to an Azure remote needs its account key, not a SAS token")
+	}
+
+	svc, err := remote.azureBlobClient()
+	if err != nil {
+		return "", err
+	}
+
+	return svc.GetBlobSASURI(remote.config.Azure.Blob.Container, remote.blobPath(key), expires, "r")
+}
+
+// Presign writes a manifest of URLs, valid for ttl, to everything pulling
+// image from r reads: the layout, the tag, and the files and layer blobs
+// of the image and its ancestors.
+func Presign(ctx context.Context, r Remote, image string, ttl time.Duration) (*Manifest, error) {
+	signer, ok := r.(presigner)
+	if !ok {
+		return nil, fmt.Errorf("%s can't presign URLs", r.Desc())
+	}
+
+	repo, tag := NormaliseImageName(image)
+	id, err := r.ParseTag(ctx, repo, tag)
+	if err != nil {
+		return nil, err
+	} else if id == "" {
+		return nil, ErrNoSuchTag
+	}
+
+	manifest := &Manifest{
+		Version: ManifestVersion,
+		Remote:  r.Desc(),
+		Image:   repo + ":" + tag,
+		ID:      id,
+		Expires: time.Now().Add(ttl).UTC().Truncate(time.Second),
+		Objects: make(map[string]ManifestObject),
+	}
+
+	add := func(object objectInfo) error {
+		url, err := signer.presignObject(object.Key, manifest.Expires)
+		if err != nil {
+			return err
+		}
+
+		manifest.Objects[object.Key] = ManifestObject{URL: url, Size: object.Size, ETag: object.ETag}
+		return nil
+	}
+
+	for _, key := range []string{LayoutKey, tagKey(repo, tag)} {
+		object, err := signer.statObject(ctx, key)
+		if err == errObjectNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if err := add(object); err != nil {
+			return nil, err
+		}
+	}
+
+	err = r.WalkImages(ctx, id, func(id ID, _ docker.Image, err error) error {
+		if err != nil {
+			return fmt.Errorf("image %s: %v", id.Short(), err)
+		}
+
+		objects, err := listObjects(ctx, signer, "images/"+string(id)+"/")
+		if err != nil {
+			return err
+		}
+
+		for _, object := range objects {
+			if err := add(object); err != nil {
+				return err
+			}
+
+			if path.Base(object.Key) == layerDigestFile {
+				blob, err := layerBlob(ctx, signer, object.Key)
+				if err != nil {
+					return err
+				}
+				if err := add(blob); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// layerBlob describes the blob named by the layer.digest at key.
+func layerBlob(ctx context.Context, store objectStore, key string) (objectInfo, error) {
+	data, _, err := store.getObject(ctx, key)
+	if err != nil {
+		return objectInfo{}, err
+	}
+
+	digest, err := parseDigest(string(data))
+	if err != nil {
+		return objectInfo{}, err
+	}
+
+	blob, err := findBlob(ctx, store, digest)
+	if err != nil {
+		return objectInfo{}, err
+	} else if blob == "" {
+		return objectInfo{}, fmt.Errorf("layer blob %s is missing from the remote", digest)
+	}
+
+	return store.statObject(ctx, blob)
+}
+
+// manifestFetcher gets the objects of a manifest from their URLs.
+type manifestFetcher struct {
+	manifest *Manifest
+	// the objects of the manifest
+	index  *Index
+	client *http.Client
+}
+
+func (f *manifestFetcher) fetch(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	object, ok := f.manifest.Objects[key]
+	if !ok {
+		return nil, errObjectNotFound
+	}
+
+	resp, err := httpGet(ctx, f.client, object.URL, offset)
+	if e, ok := err.(*httpStatusError); ok && e.StatusCode == http.StatusForbidden && time.Now().After(f.manifest.Expires) {
+		return nil, fmt.Errorf("the URLs of the manifest of %s expired at %s, presign it again", f.manifest.Image, f.manifest.Expires.Local().Format(time.RFC3339))
+	} else if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (f *manifestFetcher) statObject(ctx context.Context, key string) (objectInfo, error) {
+	object, ok := f.manifest.Objects[key]
+	if !ok {
+		return objectInfo{}, errObjectNotFound
+	}
+
+	return objectInfo{Key: key, Size: object.Size, ETag: object.ETag}, nil
+}
+
+// listPage lists everything under prefix at once, the manifest is small.
+func (f *manifestFetcher) listPage(ctx context.Context, prefix, marker string) ([]objectInfo, string, error) {
+	return f.index.list(prefix, marker), "", nil
+}
+
+// NewManifestRemote returns a read-only remote pulling through the
+// manifest written by Presign at location, a file or an http(s) URL.
+func NewManifestRemote(ctx context.Context, cfg config.Config, location string) (Remote, error) {
+	client := http.DefaultClient
+
+	data, err := readManifest(ctx, client, location)
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s: %v", location, err)
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", location, err)
+	}
+	if manifest.Version != ManifestVersion {
+		return nil, fmt.Errorf("invalid manifest %s: bad version %d", location, manifest.Version)
+	}
+
+	envelope, err := newEnvelope(cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	index := newIndex()
+	for key, object := range manifest.Objects {
+		index.Objects[key] = IndexObject{Size: object.Size, ETag: object.ETag}
+	}
+
+	remote := &readOnlyRemote{
+		fetcher:  &manifestFetcher{manifest: manifest, index: index, client: client},
+		desc:     fmt.Sprintf("manifest(image=%s, remote=%s, expires=%s)", manifest.Image, manifest.Remote, manifest.Expires.Format(time.RFC3339)),
+		retry:    newRetryPolicy(cfg),
+		envelope: envelope,
+	}
+
+	return remote, remote.Validate(ctx)
+}
+
+func readManifest(ctx context.Context, client *http.Client, location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return ioutil.ReadFile(location)
+	}
+
+	resp, err := httpGet(ctx, client, location, 0)
+	if err == errObjectNotFound {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
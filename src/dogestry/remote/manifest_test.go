@@ -0,0 +1,197 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dogestry/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type ManifestSuite struct {
+	fake   *fakeS3
+	remote *S3Remote
+}
+
+var _ = Suite(&ManifestSuite{})
+
+func (s *ManifestSuite) SetUpTest(c *C) {
+	var imageRoot string
+	s.fake, _, imageRoot = setUpLayoutRemote(c, 3)
+	s.fake.put("team-a/"+LayoutKey, `{"version": 3}`)
+
+	cfg := config.Config{}
+	cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey = "abc", "123"
+	c.Assert(cfg.SetS3URL("s3://bucket/team-a/?pathstyle=true&endpoint="+url.QueryEscape(s.fake.server.URL)), IsNil)
+
+	var err error
+	s.remote, err = NewS3Remote(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(s.remote.Push(context.Background(), "app:latest", imageRoot), IsNil)
+}
+
+func (s *ManifestSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+// presign writes the manifest of image to a file.
+func (s *ManifestSuite) presign(c *C, image string) (string, *Manifest) {
+	manifest, err := Presign(context.Background(), s.remote, image, time.Hour)
+	c.Assert(err, IsNil)
+
+	data, err := json.Marshal(manifest)
+	c.Assert(err, IsNil)
+	name := filepath.Join(c.MkDir(), "manifest.json")
+	c.Assert(ioutil.WriteFile(name, data, 0600), IsNil)
+
+	return name, manifest
+}
+
+func (s *ManifestSuite) TestPresign(c *C) {
+	_, manifest := s.presign(c, "app")
+	c.Assert(manifest.Image, Equals, "app:latest")
+	c.Assert(manifest.ID, Equals, ID(pushImageId))
+
+	digest, _, err := s.remote.getObject(context.Background(), "images/"+pushImageId+"/"+layerDigestFile)
+	c.Assert(err, IsNil)
+
+	var keys []string
+	for key, object := range manifest.Objects {
+		keys = append(keys, key)
+		c.Assert(strings.HasPrefix(object.URL, s.fake.server.URL+"/bucket/team-a/"+key+"?"), Equals, true, Commentf("%s", object.URL))
+		c.Assert(strings.Contains(object.URL, "Signature="), Equals, true)
+	}
+	c.Assert(keys, HasLen, 6)
+	for _, key := range []string{LayoutKey, "repositories/app/latest", "images/" + pushImageId + "/json", blobKey(string(digest)) + ".gz"} {
+		_, ok := manifest.Objects[key]
+		c.Assert(ok, Equals, true, Commentf("%s missing from %v", key, keys))
+	}
+
+	_, err = Presign(context.Background(), s.remote, "app:missing", time.Hour)
+	c.Assert(err, Equals, ErrNoSuchTag)
+}
+
+func (s *ManifestSuite) TestPresignAzure(c *C) {
+	azure := newFakeAzure()
+	defer azure.Close()
+	for _, key := range s.fake.keys() {
+		if strings.HasPrefix(key, "team-a/") {
+			content, _ := s.fake.get(key)
+			azure.put("container/"+strings.TrimPrefix(key, "team-a/"), content)
+		}
+	}
+
+	r := azure.remote("container")
+	manifest, err := Presign(context.Background(), r, "app:latest", time.Hour)
+	c.Assert(err, IsNil)
+	c.Assert(manifest.Objects, HasLen, 6)
+
+	// read-only URLs, valid until the manifest expires
+	for key, object := range manifest.Objects {
+		u, err := url.Parse(object.URL)
+		c.Assert(err, IsNil)
+		c.Assert(u.Path, Equals, "/container/"+key)
+		c.Assert(u.Query()["sp"], DeepEquals, []string{"r"}, Commentf("%s", object.URL))
+		c.Assert(u.Query().Get("sr"), Equals, "b")
+		c.Assert(u.Query().Get("se"), Equals, manifest.Expires.Format(time.RFC3339))
+	}
+
+	// a SAS token can't be narrowed down without the key, and isn't
+	// handed out
+	r.config.Azure.AccountKey = ""
+	r.config.Azure.SASToken = "sv=2019-02-02&sr=c&sp=rwl&sig=c2lnbmF0dXJl"
+	_, err = Presign(context.Background(), r, "app:latest", time.Hour)
+	c.Assert(err, ErrorMatches, "presigning URLs to an Azure remote needs its account key, not a SAS token")
+}
+
+func (s *ManifestSuite) TestPull(c *C) {
+	ctx := context.Background()
+	name, _ := s.presign(c, "app:latest")
+
+	// with and without a journal
+	for _, journal := range []bool{false, true} {
+		r, err := NewManifestRemote(ctx, config.Config{}, name)
+		c.Assert(err, IsNil)
+		if journal {
+			j, err := OpenJournal(filepath.Join(c.MkDir(), "pull.journal"), r.Desc())
+			c.Assert(err, IsNil)
+			r.SetJournal(j)
+		}
+
+		id, err := r.ResolveImageNameToId(ctx, "app:latest")
+		c.Assert(err, IsNil)
+		c.Assert(id, Equals, ID(pushImageId))
+
+		fullID, err := r.ResolveImageNameToId(ctx, pushImageId[:12])
+		c.Assert(err, IsNil)
+		c.Assert(fullID, Equals, ID(pushImageId))
+
+		images, err := r.List(ctx)
+		c.Assert(err, IsNil)
+		c.Assert(images, DeepEquals, []Image{{"app", "latest"}})
+
+		s.fake.requests = nil
+		dst := filepath.Join(c.MkDir(), pushImageId)
+		c.Assert(r.PullImageId(ctx, id, dst), IsNil)
+
+		layer, err := ioutil.ReadFile(filepath.Join(dst, "layer.tar"))
+		c.Assert(err, IsNil)
+		c.Assert(string(layer), Equals, "layer contents")
+
+		// only presigned GETs
+		for _, request := range s.fake.requests {
+			c.Assert(strings.HasPrefix(request, "GET /bucket/team-a/"), Equals, true, Commentf("%s", request))
+			c.Assert(strings.Contains(request, "Signature="), Equals, true, Commentf("%s", request))
+		}
+	}
+}
+
+func (s *ManifestSuite) TestHTTP(c *C) {
+	name, _ := s.presign(c, "app:latest")
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Dir(name))))
+	defer server.Close()
+
+	r, err := NewManifestRemote(context.Background(), config.Config{}, server.URL+"/manifest.json")
+	c.Assert(err, IsNil)
+	c.Assert(r.Desc(), Matches, `manifest\(image=app:latest, remote=s3\(bucket=bucket, path=team-a, .*`)
+
+	_, err = NewManifestRemote(context.Background(), config.Config{}, server.URL+"/missing.json")
+	c.Assert(err, ErrorMatches, "manifest .*/missing.json: .*not exist")
+}
+
+func (s *ManifestSuite) TestReadOnly(c *C) {
+	ctx := context.Background()
+	name, _ := s.presign(c, "app:latest")
+	r, err := NewManifestRemote(ctx, config.Config{}, name)
+	c.Assert(err, IsNil)
+
+	c.Assert(r.Push(ctx, "app:latest", c.MkDir()), Equals, ErrReadOnly)
+	c.Assert(r.SetTag(ctx, "app", "prod", pushImageId), Equals, ErrReadOnly)
+	c.Assert(r.PutTagMetadata(ctx, TagMetadata{Repo: "app", Tag: "latest"}), Equals, ErrReadOnly)
+	c.Assert(r.Migrate(ctx, LayoutVersion), Equals, ErrReadOnly)
+	_, err = r.Reindex(ctx)
+	c.Assert(err, Equals, ErrReadOnly)
+}
+
+func (s *ManifestSuite) TestExpired(c *C) {
+	_, manifest := s.presign(c, "app:latest")
+	manifest.Expires = time.Now().Add(-time.Minute)
+	data, err := json.Marshal(manifest)
+	c.Assert(err, IsNil)
+	name := filepath.Join(c.MkDir(), "manifest.json")
+	c.Assert(ioutil.WriteFile(name, data, 0600), IsNil)
+
+	// what S3 answers to expired signatures
+	s.fake.fail = func(method, key string) bool { return true }
+
+	_, err = NewManifestRemote(context.Background(), config.Config{}, name)
+	c.Assert(err, ErrorMatches, "the URLs of the manifest of app:latest expired at .*, presign it again")
+}
@@ -0,0 +1,78 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+// ErrNoMetadata is returned by TagMetadata for tags pushed without one, eg.
+// by older versions of dogestry.
+var ErrNoMetadata = errors.New("No metadata")
+
+// TagMetadata describes the push that pointed a tag at an image. It's kept
+// next to the bare tag file, which is still what resolves the tag.
+type TagMetadata struct {
+	Repo            string    `json:"repo"`
+	Tag             string    `json:"tag"`
+	ID              ID        `json:"id"`
+	PushedAt        time.Time `json:"pushedAt"`
+	DockerHost      string    `json:"dockerHost,omitempty"`
+	DogestryVersion string    `json:"dogestryVersion,omitempty"`
+	// size of the image including its parent layers, and how many there are
+	Size   int64  `json:"size"`
+	Layers int    `json:"layers"`
+	User   string `json:"user,omitempty"`
+	// arbitrary key=value pairs given to push -label
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// The metadata of every push of a tag is kept, so that it's still there
+// after a rollback.
+func metadataKey(repo, tag string, id ID) string {
+	return path.Join("metadata", repo, tag, id.String()+".json")
+}
+
+// putTagMetadata stores meta for the tag and image it names. The user is
+// filled in if it's missing.
+func putTagMetadata(ctx context.Context, store objectStore, meta TagMetadata) error {
+	if meta.User == "" {
+		meta.User = currentUser()
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return store.putObject(ctx, metadataKey(meta.Repo, meta.Tag, meta.ID), data)
+}
+
+// readTagMetadata returns the metadata of the push that pointed repo:tag at
+// the image it has now.
+func readTagMetadata(ctx context.Context, store objectStore, repo, tag string) (TagMetadata, error) {
+	var meta TagMetadata
+
+	id, _, err := readTag(ctx, store, repo, tag)
+	if err != nil {
+		return meta, err
+	} else if id == "" {
+		return meta, ErrNoSuchTag
+	}
+
+	data, _, err := store.getObject(ctx, metadataKey(repo, tag, id))
+	if err == errObjectNotFound {
+		return TagMetadata{Repo: repo, Tag: tag, ID: id}, ErrNoMetadata
+	} else if err != nil {
+		return meta, err
+	}
+
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("invalid metadata for %s:%s: %v", repo, tag, err)
+	}
+
+	return meta, nil
+}
@@ -0,0 +1,114 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// PolicyKey is the object at the root of a remote holding its Policy.
+const PolicyKey = "dogestry-policy.json"
+
+// Policy holds the rules a remote sets for everyone pushing to it. It's
+// maintained by hand, eg. with the aws or az command line tools. A remote
+// without a policy object has no rules.
+type Policy struct {
+	// tag patterns, in path.Match syntax, that can't be moved once they
+	// exist. Patterns containing a ':' are matched against repo:tag,
+	// the others against the tag alone.
+	ImmutableTags []string `json:"immutableTags"`
+}
+
+// ImmutableTagError is returned when a push would move a tag protected by
+// the remote's policy.
+type ImmutableTagError struct {
+	Repo    string
+	Tag     string
+	Pattern string
+	Current ID
+}
+
+func (e *ImmutableTagError) Error() string {
+	return fmt.Sprintf("tag %s:%s is immutable (matches '%s' in the remote policy) and points at %s, use -override-immutable to move it",
+		e.Repo, e.Tag, e.Pattern, e.Current.Short())
+}
+
+func parsePolicy(data []byte) (Policy, error) {
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("invalid %s: %v", PolicyKey, err)
+	}
+
+	for _, pattern := range policy.ImmutableTags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return policy, fmt.Errorf("invalid %s: bad tag pattern '%s'", PolicyKey, pattern)
+		}
+	}
+
+	return policy, nil
+}
+
+// ImmutablePattern returns the pattern making repo:tag immutable, if any.
+func (p Policy) ImmutablePattern(repo, tag string) (string, bool) {
+	for _, pattern := range p.ImmutableTags {
+		name := tag
+		if strings.Contains(pattern, ":") {
+			name = repo + ":" + tag
+		}
+
+		if ok, _ := path.Match(pattern, name); ok {
+			return pattern, true
+		}
+	}
+
+	return "", false
+}
+
+// readPolicy returns the policy of the remote behind store.
+func readPolicy(ctx context.Context, store objectStore) (Policy, error) {
+	data, _, err := store.getObject(ctx, PolicyKey)
+	if err == errObjectNotFound {
+		return Policy{}, nil
+	} else if err != nil {
+		return Policy{}, err
+	}
+
+	return parsePolicy(data)
+}
+
+// checkImmutableTags fails if pointing tags at their IDs would move an
+// existing tag that the policy of store marks as immutable. Pushing the ID a
+// tag already has is fine. The immutable tags are marked with what was
+// checked, for writeTags to only write them over that.
+func checkImmutableTags(ctx context.Context, store objectStore, tags []tagRef) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	policy, err := readPolicy(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	for i := range tags {
+		t := &tags[i]
+		pattern, immutable := policy.ImmutablePattern(t.Repo, t.Tag)
+		if !immutable {
+			continue
+		}
+
+		current, etag, err := readTag(ctx, store, t.Repo, t.Tag)
+		if err != nil {
+			return err
+		}
+		t.immutable, t.checked, t.etag = pattern, current, etag
+
+		if current != "" && current != t.ID {
+			return &ImmutableTagError{Repo: t.Repo, Tag: t.Tag, Pattern: pattern, Current: current}
+		}
+	}
+
+	return nil
+}
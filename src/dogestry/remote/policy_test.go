@@ -0,0 +1,38 @@
+package remote
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type PolicySuite struct{}
+
+var _ = Suite(&PolicySuite{})
+
+func (s *PolicySuite) TestImmutablePattern(c *C) {
+	policy, err := parsePolicy([]byte(`{"immutableTags": ["v*", "release-*", "app:stable"]}`))
+	c.Assert(err, IsNil)
+
+	pattern, ok := policy.ImmutablePattern("app", "v1.2")
+	c.Assert(ok, Equals, true)
+	c.Assert(pattern, Equals, "v*")
+
+	_, ok = policy.ImmutablePattern("other", "release-2015")
+	c.Assert(ok, Equals, true)
+
+	_, ok = policy.ImmutablePattern("app", "stable")
+	c.Assert(ok, Equals, true)
+
+	_, ok = policy.ImmutablePattern("other", "stable")
+	c.Assert(ok, Equals, false)
+
+	_, ok = policy.ImmutablePattern("app", "latest")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *PolicySuite) TestParsePolicyErrors(c *C) {
+	_, err := parsePolicy([]byte(`{"immutableTags": "v*"}`))
+	c.Assert(err, ErrorMatches, "invalid dogestry-policy.json: .*")
+
+	_, err = parsePolicy([]byte(`{"immutableTags": ["v["]}`))
+	c.Assert(err, ErrorMatches, "invalid dogestry-policy.json: bad tag pattern 'v\\['")
+}
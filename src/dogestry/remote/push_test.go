@@ -0,0 +1,462 @@
+package remote
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dogestry/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type PushSuite struct {
+	fake      *fakeS3
+	remote    *S3Remote
+	imageRoot string
+}
+
+var _ = Suite(&PushSuite{})
+
+const pushImageId = "5d3ba16e6f0c1a55ec9da7c5c0e0c7e3f1f1ad1ff7e27a0b2bd3a4c5e6f7a8b9"
+
+func (s *PushSuite) SetUpTest(c *C) {
+	s.fake = newFakeS3()
+	s.remote = s.fake.remote("bucket")
+
+	// pushes go through the journal, which uses goamz rather than s3gof3r
+	dir := c.MkDir()
+	journal, err := OpenJournal(filepath.Join(dir, "push.journal"), s.remote.Desc())
+	c.Assert(err, IsNil)
+	s.remote.SetJournal(journal)
+
+	s.imageRoot = filepath.Join(dir, "image")
+	files := map[string]string{
+		"images/" + pushImageId + "/json":      `{"id":"` + pushImageId + `"}`,
+		"images/" + pushImageId + "/layer.tar": "layer contents",
+		"images/" + pushImageId + "/VERSION":   "1.0",
+		"repositories/app/latest":              pushImageId,
+	}
+	for name, content := range files {
+		path := filepath.Join(s.imageRoot, name)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+	}
+}
+
+func (s *PushSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+func (s *PushSuite) TestPublishPhase(c *C) {
+	c.Assert(publishPhase("images/123/layer.tar"), Equals, publishLayerData)
+	c.Assert(publishPhase("images/123/VERSION"), Equals, publishLayerData)
+	c.Assert(publishPhase("images/123/json"), Equals, publishLayerJSON)
+	c.Assert(publishPhase("repositories/app/latest"), Equals, publishTags)
+	c.Assert(publishPhase("repositories/org/json"), Equals, publishTags)
+}
+
+func (s *PushSuite) TestPushPublishesTagLast(c *C) {
+	err := s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, IsNil)
+
+	var writes []string
+	for _, key := range s.fake.writes {
+		if !strings.HasPrefix(key, ".md5/") && !strings.HasPrefix(key, "history/") {
+			writes = append(writes, key)
+		}
+	}
+
+	c.Assert(writes, HasLen, 4)
+	c.Assert(writes[2], Equals, "images/"+pushImageId+"/json")
+	c.Assert(writes[3], Equals, "repositories/app/latest")
+
+	tag, ok := s.fake.get("repositories/app/latest")
+	c.Assert(ok, Equals, true)
+	c.Assert(tag, Equals, pushImageId)
+}
+
+func (s *PushSuite) TestFailedPushKeepsOldTag(c *C) {
+	s.fake.put("repositories/app/latest", "old-image")
+	s.fake.fail = func(method, key string) bool {
+		return method == "PUT" && strings.HasSuffix(key, "layer.tar")
+	}
+
+	err := s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, NotNil)
+
+	tag, _ := s.fake.get("repositories/app/latest")
+	c.Assert(tag, Equals, "old-image")
+
+	_, ok := s.fake.get("images/" + pushImageId + "/json")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *PushSuite) TestPushVerifiesSizes(c *C) {
+	// S3 acknowledges the upload but stores a truncated layer
+	s.fake.fail = func(method, key string) bool {
+		if method == "HEAD" && strings.HasSuffix(key, "layer.tar") {
+			s.fake.objects[key] = []byte("layer")
+		}
+		return false
+	}
+
+	err := s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, ErrorMatches, ".*size on S3 is 5, expected 14.*")
+
+	_, ok := s.fake.get("repositories/app/latest")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *PushSuite) TestExpectIDMovesMatchingTag(c *C) {
+	s.fake.put("repositories/app/latest", "0123456789abcdef")
+	s.remote.SetExpectedID("0123456789ab")
+
+	err := s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, IsNil)
+
+	tag, _ := s.fake.get("repositories/app/latest")
+	c.Assert(tag, Equals, pushImageId)
+
+	sum, _ := s.fake.get(md5Key("repositories/app/latest"))
+	c.Assert(sum, Equals, hexMd5([]byte(pushImageId)))
+}
+
+func (s *PushSuite) TestExpectIDConflict(c *C) {
+	s.fake.put("repositories/app/latest", "fedcba9876543210")
+	s.remote.SetExpectedID("0123456789ab")
+
+	err := s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	conflict, ok := err.(*TagConflictError)
+	c.Assert(ok, Equals, true, Commentf("error: %v", err))
+	c.Assert(conflict.Actual, Equals, ID("fedcba9876543210"))
+	c.Assert(err, ErrorMatches, "tag conflict: app:latest points at fedcba987654, expected it to point at 0123456789ab")
+
+	tag, _ := s.fake.get("repositories/app/latest")
+	c.Assert(tag, Equals, "fedcba9876543210")
+}
+
+func (s *PushSuite) TestExpectNoTag(c *C) {
+	s.remote.SetExpectedID(ExpectNoTag)
+
+	err := s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, IsNil)
+
+	// the second push finds the tag created by the first
+	err = s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, FitsTypeOf, &TagConflictError{})
+}
+
+func (s *PushSuite) TestExpectIDLostRace(c *C) {
+	s.fake.put("repositories/app/latest", "0123456789abcdef")
+	s.remote.SetExpectedID("0123456789ab")
+
+	// another push moves the tag between our read and write
+	moved := false
+	s.fake.fail = func(method, key string) bool {
+		if method == "PUT" && key == "repositories/app/latest" && !moved {
+			s.fake.objects[key] = []byte("fedcba9876543210")
+			moved = true
+		}
+		return false
+	}
+
+	err := s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, FitsTypeOf, &TagConflictError{})
+	c.Assert(err.(*TagConflictError).Actual, Equals, ID("fedcba9876543210"))
+
+	tag, _ := s.fake.get("repositories/app/latest")
+	c.Assert(tag, Equals, "fedcba9876543210")
+}
+
+func (s *PushSuite) TestImmutableTag(c *C) {
+	s.fake.put(PolicyKey, `{"immutableTags": ["lat*"]}`)
+	s.fake.put("repositories/app/latest", "0123456789abcdef")
+
+	err := s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, FitsTypeOf, &ImmutableTagError{})
+	c.Assert(err, ErrorMatches, "tag app:latest is immutable .*")
+
+	// refused before any layer was uploaded
+	c.Assert(s.fake.writes, HasLen, 0)
+
+	s.remote.SetOverrideImmutable(true)
+	err = s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, IsNil)
+
+	tag, _ := s.fake.get("repositories/app/latest")
+	c.Assert(tag, Equals, pushImageId)
+
+	// pushing the same image again doesn't move the tag
+	s.remote.SetOverrideImmutable(false)
+	err = s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, IsNil)
+}
+
+func (s *PushSuite) TestImmutableTagCreated(c *C) {
+	s.fake.put(PolicyKey, `{"immutableTags": ["lat*"]}`)
+
+	err := s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, IsNil)
+}
+
+func (s *PushSuite) TestImmutableTagCreatedConcurrently(c *C) {
+	s.fake.put(PolicyKey, `{"immutableTags": ["v*"]}`)
+	ctx := context.Background()
+
+	tags := []tagRef{{Repo: "app", Tag: "v1", ID: ID(pushImageId)}}
+	c.Assert(checkImmutableTags(ctx, s.remote, tags), IsNil)
+
+	// another push creates the tag between the check and the write
+	s.fake.put("repositories/app/v1", "0123456789abcdef")
+
+	err := writeTags(ctx, s.remote, tags, "")
+	c.Assert(err, FitsTypeOf, &ImmutableTagError{})
+	c.Assert(err.(*ImmutableTagError).Current, Equals, ID("0123456789abcdef"))
+
+	tag, _ := s.fake.get("repositories/app/v1")
+	c.Assert(tag, Equals, "0123456789abcdef")
+
+	// unless it created it with the same ID
+	tags = []tagRef{{Repo: "app", Tag: "v2", ID: ID(pushImageId)}}
+	c.Assert(checkImmutableTags(ctx, s.remote, tags), IsNil)
+	s.fake.put("repositories/app/v2", pushImageId)
+
+	c.Assert(writeTags(ctx, s.remote, tags, ""), IsNil)
+}
+
+func (s *PushSuite) TestTagHistory(c *C) {
+	s.fake.put("repositories/app/latest", "0123456789abcdef")
+
+	err := s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, IsNil)
+
+	// pushing the same image again doesn't add an entry
+	err = s.remote.Push(context.Background(), "app:latest", s.imageRoot)
+	c.Assert(err, IsNil)
+
+	err = s.remote.SetTag(context.Background(), "app", "latest", "0123456789abcdef")
+	c.Assert(err, IsNil)
+
+	history, err := s.remote.TagHistory(context.Background(), "app", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 2)
+
+	c.Assert(history[0].Old, Equals, ID("0123456789abcdef"))
+	c.Assert(history[0].New, Equals, ID(pushImageId))
+	c.Assert(history[1].Old, Equals, ID(pushImageId))
+	c.Assert(history[1].New, Equals, ID("0123456789abcdef"))
+	c.Assert(time.Since(history[1].Time) < time.Minute, Equals, true)
+	c.Assert(history[1].Host, Not(Equals), "")
+
+	tag, _ := s.fake.get("repositories/app/latest")
+	c.Assert(tag, Equals, "0123456789abcdef")
+
+	history, err = s.remote.TagHistory(context.Background(), "app", "other")
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 0)
+}
+
+func (s *PushSuite) TestSetTagChecksPolicy(c *C) {
+	s.fake.put(PolicyKey, `{"immutableTags": ["prod"]}`)
+	s.fake.put("repositories/app/prod", "0123456789abcdef")
+
+	err := s.remote.SetTag(context.Background(), "app", "prod", ID(pushImageId))
+	c.Assert(err, FitsTypeOf, &ImmutableTagError{})
+
+	s.remote.SetOverrideImmutable(true)
+	s.remote.SetExpectedID("fedcba987654")
+	err = s.remote.SetTag(context.Background(), "app", "prod", ID(pushImageId))
+	c.Assert(err, FitsTypeOf, &TagConflictError{})
+
+	s.remote.SetExpectedID("0123456789ab")
+	err = s.remote.SetTag(context.Background(), "app", "prod", ID(pushImageId))
+	c.Assert(err, IsNil)
+}
+
+func (s *PushSuite) TestTagMetadata(c *C) {
+	ctx := context.Background()
+
+	_, err := s.remote.TagMetadata(ctx, "app", "latest")
+	c.Assert(err, Equals, ErrNoSuchTag)
+
+	// pushed by an older version
+	s.fake.put("repositories/app/latest", "0123456789abcdef")
+	meta, err := s.remote.TagMetadata(ctx, "app", "latest")
+	c.Assert(err, Equals, ErrNoMetadata)
+	c.Assert(meta.ID, Equals, ID("0123456789abcdef"))
+
+	c.Assert(s.remote.Push(ctx, "app:latest", s.imageRoot), IsNil)
+	err = s.remote.PutTagMetadata(ctx, TagMetadata{
+		Repo:   "app",
+		Tag:    "latest",
+		ID:     pushImageId,
+		Size:   1234,
+		Layers: 2,
+		Labels: map[string]string{"git": "1a2b3c4"},
+	})
+	c.Assert(err, IsNil)
+
+	// the bare tag file stays for older clients
+	tag, _ := s.fake.get("repositories/app/latest")
+	c.Assert(tag, Equals, pushImageId)
+
+	meta, err = s.remote.TagMetadata(ctx, "app", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(meta.Size, Equals, int64(1234))
+	c.Assert(meta.Labels["git"], Equals, "1a2b3c4")
+	c.Assert(meta.User, Not(Equals), "")
+
+	// after a rollback the tag has the older image's metadata, or none
+	c.Assert(s.remote.SetTag(ctx, "app", "latest", "0123456789abcdef"), IsNil)
+	_, err = s.remote.TagMetadata(ctx, "app", "latest")
+	c.Assert(err, Equals, ErrNoMetadata)
+}
+
+func (s *PushSuite) TestPushWithoutCatalog(c *C) {
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	// only reindex creates the catalog, a partial one would hide tags
+	_, ok := s.fake.get(CatalogKey)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *PushSuite) TestReindex(c *C) {
+	ctx := context.Background()
+
+	// more keys than fit on one page of listings
+	s.fake.pageSize = 2
+	s.fake.put("images/0123456789abcdef/json", `{"id":"0123456789abcdef"}`)
+	s.fake.put("images/0123456789abcdef/layer.tar", "base layer")
+	s.fake.put("images/fedcba9876543210/json", `{"id":"fedcba9876543210","parent":"0123456789abcdef"}`)
+	s.fake.put("images/fedcba9876543210/layer.tar", "layer")
+	s.fake.put("images/aaaaaaaaaaaaaaaa/layer.tar", "never finished")
+	s.fake.put("repositories/app/latest", "fedcba9876543210")
+	s.fake.put("repositories/app/base", "0123456789abcdef")
+	s.fake.put("repositories/other/latest", "0123456789abcdef")
+
+	catalog, err := s.remote.Reindex(ctx)
+	c.Assert(err, IsNil)
+
+	c.Assert(catalog.List(), DeepEquals, []Image{{"app", "base"}, {"app", "latest"}, {"other", "latest"}})
+	c.Assert(catalog.Tags["app"]["latest"], Equals, ID("fedcba9876543210"))
+	c.Assert(catalog.Images, DeepEquals, map[ID]CatalogImage{
+		"0123456789abcdef": {Size: 10},
+		"fedcba9876543210": {Parent: "0123456789abcdef", Size: 5},
+	})
+
+	stored, _, err := readCatalog(ctx, s.remote)
+	c.Assert(err, IsNil)
+	c.Assert(stored, DeepEquals, catalog)
+}
+
+func (s *PushSuite) TestPushUpdatesCatalog(c *C) {
+	ctx := context.Background()
+
+	s.fake.put("images/0123456789abcdef/json", `{"id":"0123456789abcdef"}`)
+	s.fake.put("repositories/app/latest", "0123456789abcdef")
+	_, err := s.remote.Reindex(ctx)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.remote.Push(ctx, "app:latest", s.imageRoot), IsNil)
+
+	catalog, _, err := readCatalog(ctx, s.remote)
+	c.Assert(err, IsNil)
+	c.Assert(catalog.Tags["app"]["latest"], Equals, ID(pushImageId))
+	c.Assert(catalog.Images[pushImageId], Equals, CatalogImage{Size: int64(len("layer contents"))})
+	c.Assert(catalog.Images, HasLen, 2)
+
+	// rollbacks go through the catalog too
+	c.Assert(s.remote.SetTag(ctx, "app", "latest", "0123456789abcdef"), IsNil)
+	catalog, _, err = readCatalog(ctx, s.remote)
+	c.Assert(err, IsNil)
+	c.Assert(catalog.Tags["app"]["latest"], Equals, ID("0123456789abcdef"))
+}
+
+func (s *PushSuite) TestReadPathsUseCatalog(c *C) {
+	ctx := context.Background()
+
+	s.fake.put("images/0123456789abcdef/json", `{"id":"0123456789abcdef"}`)
+	s.fake.put("repositories/app/latest", "0123456789abcdef")
+	_, err := s.remote.Reindex(ctx)
+	c.Assert(err, IsNil)
+
+	// listing the bucket would fail, only the catalog can be read
+	s.fake.fail = func(method, key string) bool {
+		return key != CatalogKey
+	}
+
+	images, err := s.remote.List(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(images, DeepEquals, []Image{{"app", "latest"}})
+
+	id, err := s.remote.ImageFullId(ctx, "0123")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID("0123456789abcdef"))
+}
+
+func (s *PushSuite) TestFailedUploadAbortsOnlyItsOwn(c *C) {
+	// another push of the same blob is under way
+	s.fake.uploads["theirs"] = &fakeUpload{key: "layer", parts: map[int][]byte{1: []byte("their part")}}
+
+	cfg := config.Config{}
+	cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey = "abc", "123"
+	cfg.Retry.Attempts = 1
+	c.Assert(cfg.SetS3URL("s3://bucket/?pathstyle=true&endpoint="+url.QueryEscape(s.fake.server.URL)), IsNil)
+	remote, err := NewS3Remote(cfg)
+	c.Assert(err, IsNil)
+
+	// interrupted before any of the file is read
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	src := filepath.Join(s.imageRoot, "images", pushImageId, "layer.tar")
+	c.Assert(remote.putFile(ctx, &uploadKeyDef{key: "layer", fullPath: src}), Equals, context.Canceled)
+
+	_, ok := s.fake.get("layer")
+	c.Assert(ok, Equals, false)
+	c.Assert(s.fake.uploads, HasLen, 1)
+	c.Assert(s.fake.uploads["theirs"], NotNil)
+}
+
+func (s *PushSuite) TestFailedResumableUploadAborted(c *C) {
+	cfg := config.Config{}
+	cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey = "abc", "123"
+	cfg.Retry.Attempts = 1
+	c.Assert(cfg.SetS3URL("s3://bucket/?pathstyle=true&sse=aws:kms&sse-kms-key-id=key&endpoint="+url.QueryEscape(s.fake.server.URL)), IsNil)
+	remote, err := NewS3Remote(cfg)
+	c.Assert(err, IsNil)
+
+	// KMS remotes upload through the resumable path, with or without a
+	// journal to resume from
+	s.fake.fail = func(method, key string) bool {
+		return method == "PUT" && key == "layer"
+	}
+	src := filepath.Join(s.imageRoot, "images", pushImageId, "layer.tar")
+	c.Assert(remote.putFileResumable(context.Background(), &uploadKeyDef{key: "layer", fullPath: src}), NotNil)
+
+	// no later run would find it, so it isn't kept
+	c.Assert(s.fake.uploads, HasLen, 0)
+	c.Assert(s.fake.requests[len(s.fake.requests)-1], Matches, "DELETE /bucket/layer\\?uploadId=.*")
+}
+
+func (s *PushSuite) TestDroppedUploadFails(c *C) {
+	cfg := config.Config{}
+	cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey = "abc", "123"
+	cfg.Retry.Attempts = 1
+	c.Assert(cfg.SetS3URL("s3://bucket/?pathstyle=true&endpoint="+url.QueryEscape(s.fake.server.URL)), IsNil)
+	remote, err := NewS3Remote(cfg)
+	c.Assert(err, IsNil)
+
+	// the connection is lost mid-upload, which surfaces as an EOF
+	s.fake.drop = func(method, key string) bool {
+		return method == "PUT" && key == "layer"
+	}
+	src := filepath.Join(s.imageRoot, "images", pushImageId, "layer.tar")
+	u := objectUploader{store: remote, put: remote.putKey, config: cfg, name: "S3"}
+	err = u.putFiles(context.Background(), uploadKeys{"layer": &uploadKeyDef{key: "layer", fullPath: src}})
+	c.Assert(err, ErrorMatches, "Error when uploading to S3: .*EOF.*")
+}
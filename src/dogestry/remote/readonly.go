@@ -0,0 +1,305 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// ErrReadOnly is returned by read-only remotes for anything that writes.
+var ErrReadOnly = errors.New("remote is read-only")
+
+// objectFetcher is the access read-only remotes have to their objects.
+// Keys are relative to the root of the remote.
+type objectFetcher interface {
+	// fetch streams key from offset on, as stored.
+	fetch(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+
+	statObject(ctx context.Context, key string) (objectInfo, error)
+
+	listPage(ctx context.Context, prefix, marker string) ([]objectInfo, string, error)
+}
+
+// readOnlyRemote is a Remote that can only be pulled from, through its
+// fetcher. Its writes fail with ErrReadOnly.
+type readOnlyRemote struct {
+	fetcher objectFetcher
+	desc    string
+	retry   RetryPolicy
+	journal *Journal
+	// nil unless objects are encrypted
+	envelope *envelope
+}
+
+func (remote *readOnlyRemote) Push(ctx context.Context, image, imageRoot string) error {
+	return ErrReadOnly
+}
+
+func (remote *readOnlyRemote) PullImageId(ctx context.Context, id ID, dst string) error {
+	prefix := "images/" + string(id) + "/"
+	objects, err := listObjects(ctx, remote, prefix)
+	if err != nil {
+		return err
+	}
+	// the image's json was there, so the listing is out of date
+	if len(objects) == 0 {
+		return fmt.Errorf("%s lists no files of image %s", remote.desc, id.Short())
+	}
+
+	d := objectDownloader{store: remote, fetch: remote.fetcher.fetch, retry: remote.retry, journal: remote.journal, envelope: remote.envelope}
+	return d.pullImage(ctx, prefix, objects, dst)
+}
+
+func (remote *readOnlyRemote) ParseTag(ctx context.Context, repo, tag string) (ID, error) {
+	id, _, err := readTag(ctx, remote, repo, tag)
+	return id, err
+}
+
+func (remote *readOnlyRemote) ResolveImageNameToId(ctx context.Context, image string) (ID, error) {
+	return ResolveImageNameToId(ctx, remote, image)
+}
+
+func (remote *readOnlyRemote) ImageFullId(ctx context.Context, id ID) (ID, error) {
+	if fullID, ok := catalogFullID(ctx, remote, id); ok {
+		return fullID, nil
+	}
+
+	objects, err := listObjects(ctx, remote, "images/")
+	if err != nil {
+		return "", err
+	}
+
+	for _, object := range objects {
+		imageID := strings.SplitN(strings.TrimPrefix(object.Key, "images/"), "/", 2)[0]
+		if strings.HasPrefix(imageID, string(id)) {
+			return ID(imageID), nil
+		}
+	}
+
+	return "", ErrNoSuchImage
+}
+
+func (remote *readOnlyRemote) ImageMetadata(ctx context.Context, id ID) (docker.Image, error) {
+	image := docker.Image{}
+
+	data, _, err := remote.getObject(ctx, "images/"+string(id)+"/json")
+	if err == errObjectNotFound {
+		return image, ErrNoSuchImage
+	} else if err != nil {
+		return image, err
+	}
+
+	err = json.Unmarshal(data, &image)
+	return image, err
+}
+
+func (remote *readOnlyRemote) ParseImagePath(path string, prefix string) (repo, tag string) {
+	return ParseImagePath(path, prefix)
+}
+
+func (remote *readOnlyRemote) WalkImages(ctx context.Context, id ID, walker ImageWalkFn) error {
+	return WalkImages(ctx, remote, id, walker)
+}
+
+func (remote *readOnlyRemote) Validate(ctx context.Context) error {
+	if err := checkLayout(ctx, remote); err != nil {
+		return err
+	}
+
+	return checkEncryption(ctx, remote, remote.envelope)
+}
+
+func (remote *readOnlyRemote) Desc() string {
+	return remote.desc
+}
+
+func (remote *readOnlyRemote) SetJournal(journal *Journal) {
+	remote.journal = journal
+}
+
+// tags can't be moved anyway
+func (remote *readOnlyRemote) SetExpectedID(id ID) {}
+
+func (remote *readOnlyRemote) SetOverrideImmutable(override bool) {}
+
+func (remote *readOnlyRemote) Policy(ctx context.Context) (Policy, error) {
+	return readPolicy(ctx, remote)
+}
+
+func (remote *readOnlyRemote) SetTag(ctx context.Context, repo, tag string, id ID) error {
+	return ErrReadOnly
+}
+
+func (remote *readOnlyRemote) TagHistory(ctx context.Context, repo, tag string) ([]TagHistoryEntry, error) {
+	history, _, err := readTagHistory(ctx, remote, repo, tag)
+	return history, err
+}
+
+func (remote *readOnlyRemote) PutTagMetadata(ctx context.Context, meta TagMetadata) error {
+	return ErrReadOnly
+}
+
+func (remote *readOnlyRemote) TagMetadata(ctx context.Context, repo, tag string) (TagMetadata, error) {
+	return readTagMetadata(ctx, remote, repo, tag)
+}
+
+func (remote *readOnlyRemote) Reindex(ctx context.Context) (*Catalog, error) {
+	return nil, ErrReadOnly
+}
+
+func (remote *readOnlyRemote) Layout(ctx context.Context) (Layout, error) {
+	layout, _, err := readLayout(ctx, remote)
+	return layout, err
+}
+
+func (remote *readOnlyRemote) Migrate(ctx context.Context, to int) error {
+	return ErrReadOnly
+}
+
+func (remote *readOnlyRemote) List(ctx context.Context) ([]Image, error) {
+	if images, ok := listCatalog(ctx, remote); ok {
+		return images, nil
+	}
+
+	objects, err := listObjects(ctx, remote, "repositories/")
+	if err != nil {
+		return nil, err
+	}
+
+	var images []Image
+	for _, object := range objects {
+		repo, tag := ParseImagePath(object.Key, "repositories/")
+		images = append(images, Image{repo, tag})
+	}
+
+	return images, nil
+}
+
+func (remote *readOnlyRemote) getObject(ctx context.Context, key string) ([]byte, string, error) {
+	var data []byte
+	err := remote.retry.Do(ctx, "get "+key, func() error {
+		rc, err := remote.fetcher.fetch(ctx, key, 0)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		data, err = io.ReadAll(rc)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err = remote.envelope.open(key, data)
+	return data, "", err
+}
+
+func (remote *readOnlyRemote) putObject(ctx context.Context, key string, data []byte) error {
+	return ErrReadOnly
+}
+
+func (remote *readOnlyRemote) putObjectIf(ctx context.Context, key string, data []byte, etag string) error {
+	return ErrReadOnly
+}
+
+func (remote *readOnlyRemote) statObject(ctx context.Context, key string) (objectInfo, error) {
+	var object objectInfo
+	err := remote.retry.Do(ctx, "check "+key, func() (err error) {
+		object, err = remote.fetcher.statObject(ctx, key)
+		return err
+	})
+	return object, err
+}
+
+func (remote *readOnlyRemote) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := remote.retry.Do(ctx, "get "+key, func() (err error) {
+		rc, err = remote.fetcher.fetch(ctx, key, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return remote.envelope.openReader(key, rc)
+}
+
+func (remote *readOnlyRemote) copyObject(ctx context.Context, src, dst string) error {
+	return ErrReadOnly
+}
+
+func (remote *readOnlyRemote) deleteObject(ctx context.Context, key string) error {
+	return ErrReadOnly
+}
+
+func (remote *readOnlyRemote) listPage(ctx context.Context, prefix, marker string) ([]objectInfo, string, error) {
+	var objects []objectInfo
+	var next string
+	err := remote.retry.Do(ctx, "list "+prefix, func() (err error) {
+		objects, next, err = remote.fetcher.listPage(ctx, prefix, marker)
+		return err
+	})
+	return objects, next, err
+}
+
+// httpStatusError is an unexpected answer of a web server.
+type httpStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("GET %s: %s", e.URL, e.Status)
+}
+
+// redactURL drops the query of rawurl, which holds the signature of
+// presigned URLs.
+func redactURL(rawurl string) string {
+	if i := strings.Index(rawurl, "?"); i != -1 {
+		return rawurl[:i] + "?..."
+	}
+	return rawurl
+}
+
+// httpGet gets rawurl from offset on. Missing objects are errObjectNotFound.
+func httpGet(ctx context.Context, client *http.Client, rawurl string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if urlErr, ok := err.(*url.Error); ok {
+		urlErr.URL = redactURL(urlErr.URL)
+		return nil, urlErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errObjectNotFound
+	case offset > 0 && resp.StatusCode == http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: the server doesn't serve ranges", redactURL(rawurl))
+	case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent:
+		resp.Body.Close()
+		return nil, &httpStatusError{URL: redactURL(rawurl), StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return resp, nil
+}
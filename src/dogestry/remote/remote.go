@@ -1,7 +1,10 @@
 package remote
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"path"
 	"strings"
 
 	"dogestry/config"
@@ -16,6 +19,43 @@ var (
 	BreakWalk      = errors.New("break walk")
 )
 
+// ExpectNoTag passed to SetExpectedID lets Push create tags, but not move
+// existing ones.
+const ExpectNoTag ID = "none"
+
+// TagConflictError is returned by Push when a tag doesn't point at the ID
+// given to SetExpectedID, typically because another push moved it.
+type TagConflictError struct {
+	Repo     string
+	Tag      string
+	Expected ID
+	// empty if the tag doesn't exist
+	Actual ID
+}
+
+func (e *TagConflictError) Error() string {
+	actual := "doesn't exist"
+	if e.Actual != "" {
+		actual = "points at " + string(e.Actual.Short())
+	}
+
+	expected := "not to exist"
+	if e.Expected != ExpectNoTag {
+		expected = "to point at " + string(e.Expected.Short())
+	}
+
+	return fmt.Sprintf("tag conflict: %s:%s %s, expected it %s", e.Repo, e.Tag, actual, expected)
+}
+
+// tagMatches tells whether a tag currently pointing at actual (empty if
+// missing) satisfies expected. IDs may be abbreviated.
+func tagMatches(actual, expected ID) bool {
+	if expected == ExpectNoTag {
+		return actual == ""
+	}
+	return actual != "" && strings.HasPrefix(actual.String(), expected.String())
+}
+
 type Image struct {
 	Repository string
 	Tag        string
@@ -23,46 +63,131 @@ type Image struct {
 
 type ImageWalkFn func(id ID, image docker.Image, err error) error
 
+// Remote is a store of images and tags. Every method that talks to the
+// backend takes a context; cancelling it aborts the operation in flight.
 type Remote interface {
 	// push image and parent images to remote
-	Push(image, imageRoot string) error
+	Push(ctx context.Context, image, imageRoot string) error
 
 	// pull a single image from the remote
-	PullImageId(id ID, imageRoot string) error
+	PullImageId(ctx context.Context, id ID, imageRoot string) error
 
 	// map repo:tag to id (like git rev-parse)
-	ParseTag(repo, tag string) (ID, error)
+	ParseTag(ctx context.Context, repo, tag string) (ID, error)
 
 	// map a ref-like to id. "ref-like" could be a ref or an id.
-	ResolveImageNameToId(image string) (ID, error)
+	ResolveImageNameToId(ctx context.Context, image string) (ID, error)
 
-	ImageFullId(id ID) (ID, error)
+	ImageFullId(ctx context.Context, id ID) (ID, error)
 
-	ImageMetadata(id ID) (docker.Image, error)
+	ImageMetadata(ctx context.Context, id ID) (docker.Image, error)
 
 	// return repo, tag from a file path (or S3 key)
 	ParseImagePath(path string, prefix string) (repo, tag string)
 
 	// walk the image history on the remote, starting at id
-	WalkImages(id ID, walker ImageWalkFn) error
+	WalkImages(ctx context.Context, id ID, walker ImageWalkFn) error
 
-	// checks the config and connectivity of the remote
-	Validate() error
+	// checks the config and connectivity of the remote, and that its
+	// layout is supported
+	Validate(ctx context.Context) error
 
 	// describe the remote
 	Desc() string
 
+	// record transfer progress in journal so interrupted pushes and pulls
+	// can be resumed. A nil journal disables it.
+	SetJournal(journal *Journal)
+
+	// make Push and SetTag update tags only if they point at id, or don't
+	// exist yet for ExpectNoTag. The check and the write are atomic on the
+	// backend; a mismatch fails with a *TagConflictError. An empty id
+	// disables it.
+	SetExpectedID(id ID)
+
+	// the rules stored at the root of the remote, see PolicyKey
+	Policy(ctx context.Context) (Policy, error)
+
+	// let Push and SetTag move tags the policy marks as immutable
+	SetOverrideImmutable(override bool)
+
+	// point repo:tag at id, an image already on the remote. Honours
+	// SetExpectedID and SetOverrideImmutable like Push.
+	SetTag(ctx context.Context, repo, tag string, id ID) error
+
+	// the moves of repo:tag recorded by Push and SetTag, oldest first
+	TagHistory(ctx context.Context, repo, tag string) ([]TagHistoryEntry, error)
+
+	// store the metadata of a push, after Push has moved the tag
+	PutTagMetadata(ctx context.Context, meta TagMetadata) error
+
+	// the metadata of the push that pointed repo:tag at its current image.
+	// ErrNoMetadata, along with the tag's ID, if it was pushed without.
+	TagMetadata(ctx context.Context, repo, tag string) (TagMetadata, error)
+
+	// rebuild the catalog from the tags and images on the remote, and the
+	// index of its objects, see CatalogKey and IndexKey
+	Reindex(ctx context.Context) (*Catalog, error)
+
+	// the layout of the remote, see LayoutKey
+	Layout(ctx context.Context) (Layout, error)
+
+	// rewrite the remote in place to layout version to. Rerunning it after
+	// a failure resumes the migration.
+	Migrate(ctx context.Context, to int) error
+
 	// List images on the remote
-	List() ([]Image, error)
+	List(ctx context.Context) ([]Image, error)
+}
+
+const (
+	DefaultUploadWorkers   = 25
+	DefaultPartConcurrency = 10
+)
+
+// number of files pushed at once
+func uploadWorkers(cfg config.Config) int {
+	if cfg.Transfer.UploadWorkers > 0 {
+		return cfg.Transfer.UploadWorkers
+	}
+	return DefaultUploadWorkers
 }
 
-func NewRemote(config config.Config) (Remote, error) {
+// number of parts or blocks of a single file sent at once
+func partConcurrency(cfg config.Config) int {
+	if cfg.Transfer.PartConcurrency > 0 {
+		return cfg.Transfer.PartConcurrency
+	}
+	return DefaultPartConcurrency
+}
+
+// Push publishes the files of an image in this order, see publishPhase.
+const (
+	publishLayerData = iota
+	publishLayerJSON
+	publishTags
+)
+
+// publishPhase returns when key is pushed. A layer counts as present once its
+// json is on the remote (see ImageMetadata), so the json goes after the rest
+// of the layer, and tags go after all layers.
+func publishPhase(key string) int {
+	switch {
+	case strings.HasPrefix(key, "repositories/"):
+		return publishTags
+	case path.Base(key) == "json":
+		return publishLayerJSON
+	}
+	return publishLayerData
+}
+
+func NewRemote(ctx context.Context, config config.Config) (Remote, error) {
 	remote, err := NewS3Remote(config)
 	if err != nil {
 		return nil, err
 	}
 
-	err = remote.Validate()
+	err = remote.Validate(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -79,17 +204,17 @@ func NormaliseImageName(image string) (string, string) {
 	}
 }
 
-func ResolveImageNameToId(remote Remote, image string) (ID, error) {
+func ResolveImageNameToId(ctx context.Context, remote Remote, image string) (ID, error) {
 	// first, try the repos
 	repoName, repoTag := NormaliseImageName(image)
-	if id, err := remote.ParseTag(repoName, repoTag); err != nil {
+	if id, err := remote.ParseTag(ctx, repoName, repoTag); err != nil {
 		return "", err
 	} else if id != "" {
 		return id, nil
 	}
 
 	// ok, no repo, search the images:
-	fullId, err := remote.ImageFullId(ID(image))
+	fullId, err := remote.ImageFullId(ctx, ID(image))
 	if err != nil {
 		return "", err
 	} else if fullId != "" {
@@ -114,12 +239,17 @@ func ParseImagePath(path string, prefix string) (repo, tag string) {
 // - BreakWalk - the walk stops and WalkImages returns nil (no error)
 // - other error - the walk stop and WalkImages returns the error.
 // - nil - the walk continues
-func WalkImages(remote Remote, id ID, walker ImageWalkFn) error {
+// The walk also stops, returning the context's error, if ctx is cancelled.
+func WalkImages(ctx context.Context, remote Remote, id ID, walker ImageWalkFn) error {
 	if id == "" {
 		return nil
 	}
 
-	img, err := remote.ImageMetadata(id)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	img, err := remote.ImageMetadata(ctx, id)
 	// image wasn't found
 	if err != nil {
 		return walker(id, docker.Image{}, err)
@@ -134,5 +264,5 @@ func WalkImages(remote Remote, id ID, walker ImageWalkFn) error {
 		return err
 	}
 
-	return remote.WalkImages(ID(img.Parent), walker)
+	return remote.WalkImages(ctx, ID(img.Parent), walker)
 }
@@ -0,0 +1,164 @@
+package remote
+
+import (
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+
+	"dogestry/config"
+	"dogestry/s3"
+	"dogestry/storage"
+	"github.com/pkg/sftp"
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+// RetryPolicy controls how remote operations are retried on transient
+// errors (5xx responses, throttling, timeouts and dropped connections).
+// Delays grow exponentially from BaseDelay up to MaxDelay; Jitter is the
+// fraction (0-1) of each delay that is randomised so parallel workers don't
+// retry in lockstep.
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Jitter    float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:  5,
+	BaseDelay: 500 * time.Millisecond,
+	MaxDelay:  30 * time.Second,
+	Jitter:    0.2,
+}
+
+// throttled requests back off this many times longer than other failures
+const throttleFactor = 4
+
+// newRetryPolicy returns the policy configured in cfg, or the default if
+// none is.
+func newRetryPolicy(cfg config.Config) RetryPolicy {
+	if cfg.Retry.Attempts == 0 {
+		return DefaultRetryPolicy
+	}
+
+	return RetryPolicy{
+		Attempts:  cfg.Retry.Attempts,
+		BaseDelay: cfg.Retry.BaseDelay,
+		MaxDelay:  cfg.Retry.MaxDelay,
+		Jitter:    cfg.Retry.Jitter,
+	}
+}
+
+// Do calls fn until it succeeds, returns an error that isn't worth retrying,
+// or the attempts run out. It returns the context's error if ctx is
+// cancelled while waiting to retry.
+func (p RetryPolicy) Do(ctx context.Context, desc string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryable(err) || attempt >= p.Attempts {
+			return err
+		}
+
+		delay := p.delay(attempt, isThrottled(err))
+		log.Printf("%s failed (attempt %d of %d), retrying in %v: %v", desc, attempt, p.Attempts, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// delay before retrying after the given (1-based) attempt failed
+func (p RetryPolicy) delay(attempt int, throttled bool) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if throttled {
+		delay *= throttleFactor
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		delay -= time.Duration(p.Jitter * rand.Float64() * float64(delay))
+	}
+
+	return delay
+}
+
+// isRetryable reports whether err is likely to be transient.
+func isRetryable(err error) bool {
+	switch err {
+	case nil, context.Canceled, context.DeadlineExceeded:
+		return false
+	case io.EOF, io.ErrUnexpectedEOF, sftp.ErrSSHFxConnectionLost:
+		return true
+	}
+
+	if isThrottled(err) {
+		return true
+	}
+
+	switch e := err.(type) {
+	case *url.Error:
+		return isRetryable(e.Err)
+	case net.Error:
+		return true
+	case *s3.Error:
+		switch e.Code {
+		case "InternalError", "RequestTimeout":
+			return true
+		}
+		return retryableStatus(e.StatusCode)
+	case *s3gof3r.RespError:
+		return retryableStatus(e.StatusCode)
+	case storage.AzureStorageServiceError:
+		switch e.Code {
+		case "InternalError", "OperationTimedOut":
+			return true
+		}
+		return retryableStatus(e.StatusCode)
+	case *httpStatusError:
+		return retryableStatus(e.StatusCode)
+	case *gcsError:
+		return e.Reason == "backendError" || retryableStatus(e.StatusCode)
+	}
+
+	return false
+}
+
+// isThrottled reports whether err means the backend is asking us to slow down.
+func isThrottled(err error) bool {
+	switch e := err.(type) {
+	case *s3.Error:
+		return e.Code == "SlowDown" || e.StatusCode == 429 || e.StatusCode == 503
+	case *s3gof3r.RespError:
+		return e.Code == "SlowDown" || e.StatusCode == 429 || e.StatusCode == 503
+	case storage.AzureStorageServiceError:
+		return e.Code == "ServerBusy" || e.StatusCode == 429 || e.StatusCode == 503
+	case *httpStatusError:
+		return e.StatusCode == 429 || e.StatusCode == 503
+	case *gcsError:
+		return e.Reason == "rateLimitExceeded" || e.StatusCode == 429 || e.StatusCode == 503
+	}
+
+	return false
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case 408, 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"dogestry/s3"
+	"dogestry/storage"
+	"github.com/rlmcpherson/s3gof3r"
+	. "gopkg.in/check.v1"
+)
+
+type RetrySuite struct{}
+
+var _ = Suite(&RetrySuite{})
+
+var testRetryPolicy = RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+func (s *RetrySuite) TestRetriesTransientErrors(c *C) {
+	calls := 0
+	err := testRetryPolicy.Do(context.Background(), "test", func() error {
+		calls++
+		if calls < 3 {
+			return &s3.Error{StatusCode: 500, Code: "InternalError"}
+		}
+		return nil
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(calls, Equals, 3)
+}
+
+func (s *RetrySuite) TestGivesUpAfterAttempts(c *C) {
+	calls := 0
+	err := testRetryPolicy.Do(context.Background(), "test", func() error {
+		calls++
+		return &s3gof3r.RespError{StatusCode: 503}
+	})
+
+	c.Assert(err, FitsTypeOf, &s3gof3r.RespError{})
+	c.Assert(calls, Equals, 3)
+}
+
+func (s *RetrySuite) TestDoesNotRetryPermanentErrors(c *C) {
+	calls := 0
+	notFound := &s3.Error{StatusCode: 404, Code: "NoSuchKey"}
+	err := testRetryPolicy.Do(context.Background(), "test", func() error {
+		calls++
+		return notFound
+	})
+
+	c.Assert(err, Equals, notFound)
+	c.Assert(calls, Equals, 1)
+}
+
+func (s *RetrySuite) TestStopsWhenCancelled(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{Attempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	calls := 0
+	err := policy.Do(ctx, "test", func() error {
+		calls++
+		cancel()
+		return errors.New("unexpected EOF")
+	})
+	// not a known transient error, so returned as is
+	c.Assert(err, ErrorMatches, "unexpected EOF")
+
+	err = policy.Do(ctx, "test", func() error {
+		calls++
+		return storage.AzureStorageServiceError{StatusCode: 500}
+	})
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(calls, Equals, 2)
+}
+
+func (s *RetrySuite) TestDelay(c *C) {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	c.Assert(policy.delay(1, false), Equals, time.Second)
+	c.Assert(policy.delay(2, false), Equals, 2*time.Second)
+	c.Assert(policy.delay(3, false), Equals, 4*time.Second)
+	c.Assert(policy.delay(10, false), Equals, 10*time.Second)
+
+	// throttling backs off harder, still capped
+	c.Assert(policy.delay(1, true), Equals, throttleFactor*time.Second)
+	c.Assert(policy.delay(3, true), Equals, 10*time.Second)
+
+	policy.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		d := policy.delay(1, false)
+		c.Assert(d <= time.Second && d >= 500*time.Millisecond, Equals, true)
+	}
+}
+
+func (s *RetrySuite) TestIsThrottled(c *C) {
+	c.Assert(isThrottled(&s3.Error{StatusCode: 503, Code: "SlowDown"}), Equals, true)
+	c.Assert(isThrottled(storage.AzureStorageServiceError{StatusCode: 503, Code: "ServerBusy"}), Equals, true)
+	c.Assert(isThrottled(&s3.Error{StatusCode: 500, Code: "InternalError"}), Equals, false)
+	c.Assert(isRetryable(context.Canceled), Equals, false)
+}
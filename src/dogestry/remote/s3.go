@@ -1,41 +1,77 @@
 package remote
 
 import (
+	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/AdRoll/goamz/aws"
-	"github.com/AdRoll/goamz/s3"
 	"dogestry/config"
+	"dogestry/s3"
 	"dogestry/utils"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/rlmcpherson/s3gof3r"
 )
 
 func NewS3Remote(config config.Config) (*S3Remote, error) {
-	s3, err := newS3Client(config)
+	endpoint, err := newS3Endpoint(config.AWS.S3URL)
 	if err != nil {
 		return &S3Remote{}, err
 	}
 
-	s3gof3rKeys, err := getS3gof3rKeys(config)
+	provider, err := newCredentialProvider(config)
 	if err != nil {
 		return &S3Remote{}, err
 	}
 
-	return &S3Remote{
+	credentials := newCredentialCache(provider)
+	creds, err := credentials.get()
+	if err != nil {
+		return &S3Remote{}, fmt.Errorf("AWS credentials from %s: %v", provider, err)
+	}
+
+	s3 := newS3Client(creds, endpoint)
+
+	envelope, err := newEnvelope(config.Encryption)
+	if err != nil {
+		return &S3Remote{}, err
+	}
+
+	objects, err := newS3Objects(config)
+	if err != nil {
+		return &S3Remote{}, err
+	}
+
+	remote := &S3Remote{
 		config:               config,
 		BucketName:           config.AWS.S3URL.Host,
 		client:               s3,
-		uploadDownloadClient: s3gof3r.New("", s3gof3rKeys),
-	}, nil
+		uploadDownloadClient: s3gof3r.New(endpoint.domain, creds.keys()),
+		credentials:          credentials,
+		endpoint:             endpoint,
+		retry:                newRetryPolicy(config),
+		envelope:             envelope,
+		objects:              objects,
+	}
+
+	base := endpoint.s3gof3rClient
+	if base == nil {
+		base = s3gof3r.ClientWithTimeout(s3gof3rTimeout)
+	}
+	remote.s3gof3rClient = &http.Client{Transport: s3gof3rSigner{base: base.Transport, remote: remote}}
+
+	return remote, nil
 }
 
 type S3Remote struct {
@@ -44,155 +80,155 @@ type S3Remote struct {
 	Bucket               *s3.Bucket
 	client               *s3.S3
 	uploadDownloadClient *s3gof3r.S3
+	retry                RetryPolicy
+	journal              *Journal
+	expectedID           ID
+	overrideImmutable    bool
+	// nil unless objects are encrypted
+	envelope *envelope
+	// SSE, storage class and ACL of the objects pushed
+	objects  s3Objects
+	endpoint s3Endpoint
+	// nil for remotes made by hand, which keep the client's keys
+	credentials *credentialCache
+	// signs s3gof3r's requests with the current credentials
+	s3gof3rClient *http.Client
 }
 
 var (
 	S3DefaultRegion = "us-east-1"
 )
 
-func getS3gof3rKeys(config config.Config) (s3gof3r.Keys, error) {
-	if config.AWS.UseMetaService {
-		return s3gof3r.InstanceKeys()
-	} else {
-		return s3gof3r.Keys{AccessKey: config.AWS.AccessKeyID, SecretKey: config.AWS.SecretAccessKey}, nil
-	}
-}
-
-// create a new s3 client from the url
-func newS3Client(config config.Config) (*s3.S3, error) {
-	auth, err := aws.GetAuth(config.AWS.AccessKeyID, config.AWS.SecretAccessKey, "", time.Now())
-	if err != nil {
-		return &s3.S3{}, err
-	}
-
-	var regionName string
-
-	regQuery := config.AWS.S3URL.Query()["region"]
-
-	if len(regQuery) > 0 && regQuery[0] != "" {
-		regionName = regQuery[0]
-	} else {
-		regionName = S3DefaultRegion
-	}
-
-	region := aws.Regions[regionName]
+// create a new s3 client for the endpoint
+func newS3Client(creds awsCredentials, endpoint s3Endpoint) *s3.S3 {
+	client := s3.New(creds.auth(), endpoint.region)
+	client.Client = endpoint.client
 
-	return s3.New(auth, region), nil
+	return client
 }
 
-func (remote *S3Remote) Validate() error {
+func (remote *S3Remote) Validate(ctx context.Context) error {
 	bucket := remote.getBucket()
 
-	_, err := bucket.List("", "", "", 1)
+	err := remote.retry.Do(ctx, "list bucket", func() error {
+		_, err := bucket.List(remote.remoteKey(""), "", "", 1)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("%s unable to ping s3 bucket: %s", remote.Desc(), err)
 	}
 
-	return nil
+	if err := checkLayout(ctx, remote); err != nil {
+		return err
+	}
+
+	return checkEncryption(ctx, remote, remote.envelope)
 }
 
 // Remote: describe the remote
 func (remote *S3Remote) Desc() string {
-	return fmt.Sprintf("s3(bucket=%s, region=%s)", remote.BucketName, remote.client.Region.Name)
+	if prefix := remote.pathPrefix(); prefix != "" {
+		return fmt.Sprintf("s3(bucket=%s, path=%s, %s)", remote.BucketName, prefix, remote.endpoint)
+	}
+	return fmt.Sprintf("s3(bucket=%s, %s)", remote.BucketName, remote.endpoint)
 }
 
-type putFileTuple struct {
-	Key    string
-	KeyDef keyDef
+func (remote *S3Remote) Push(ctx context.Context, image, imageRoot string) error {
+	u := objectUploader{
+		store:             remote,
+		put:               remote.putKey,
+		config:            remote.config,
+		name:              "S3",
+		expectedID:        remote.expectedID,
+		overrideImmutable: remote.overrideImmutable,
+		envelope:          remote.envelope,
+	}
+	return u.pushImage(ctx, imageRoot)
 }
 
-func makeFilesChan(keysToPush keys) <-chan putFileTuple {
-	putFilesChan := make(chan putFileTuple, len(keysToPush))
-	go func() {
-		defer close(putFilesChan)
-		for key, localKey := range keysToPush {
-			keyDefClone := *localKey
-			putFilesChan <- putFileTuple{key, keyDefClone}
-		}
-	}()
-	return putFilesChan
+// putKey uploads a local file. s3gof3r checks part ETags against their md5,
+// which KMS encrypted objects' ETags aren't, so those go through the
+// resumable path too.
+func (remote *S3Remote) putKey(ctx context.Context, keyDef *uploadKeyDef) error {
+	if remote.journal != nil || !remote.objects.md5ETags() {
+		return remote.putFileResumable(ctx, keyDef)
+	}
+	return remote.putFile(ctx, keyDef)
 }
 
-func (remote *S3Remote) Push(image, imageRoot string) error {
-	var err error
-
-	keysToPush, err := remote.localKeys(imageRoot)
+func (remote *S3Remote) PullImageId(ctx context.Context, id ID, dst string) error {
+	rootKey := "images/" + string(id)
+	imageKeys, err := remote.repoKeys(ctx, "/"+rootKey)
 	if err != nil {
-		return fmt.Errorf("error calculating keys to push: %v", err)
-	}
-
-	if len(keysToPush) == 0 {
-		log.Println("There are no files to push")
-		return nil
+		return err
 	}
 
-	type putFileResult struct {
-		host string
-		err  error
+	if err := remote.getFiles(ctx, dst, rootKey, imageKeys); err != nil {
+		return err
 	}
 
-	putFileErrChan := make(chan putFileResult)
-	putFilesChan := makeFilesChan(keysToPush)
-
-	defer close(putFileErrChan)
+	return remote.getLayerBlob(ctx, dst)
+}
 
-	numGoroutines := 25
-	goroutineQuitChans := make([]chan bool, numGoroutines)
-	for i := 0; i < numGoroutines; i++ {
-		goroutineQuitChans[i] = make(chan bool)
+// getLayerBlob downloads the layer of an image pulled to dst from its blob,
+// if the image has one.
+func (remote *S3Remote) getLayerBlob(ctx context.Context, dst string) error {
+	digest, ok, err := pulledLayerDigest(dst)
+	if err != nil || !ok {
+		return err
 	}
 
-	println("Pushing files to S3 remote:")
-	for i := 0; i < numGoroutines; i++ {
-		go func(i int) {
-			select {
-			case <-goroutineQuitChans[i]:
-				return
-			default:
-				for putFile := range putFilesChan {
-					putFileErr := remote.putFile(putFile.KeyDef.fullPath, &putFile.KeyDef)
-
-					if (putFileErr != nil) && ((putFileErr != io.EOF) && (!strings.Contains(putFileErr.Error(), "EOF"))) {
-						putFileErrChan <- putFileResult{putFile.Key, putFileErr}
-						return
-					}
-
-					putFileErrChan <- putFileResult{}
-				}
-			}
-		}(i)
+	key := blobKey(digest)
+	blobKeys, err := remote.repoKeys(ctx, key)
+	if err != nil {
+		return err
 	}
 
-	for i := 0; i < len(keysToPush); i++ {
-		p := <-putFileErrChan
-		if p.err != nil {
-			// Close all running goroutines
-			for i := 0; i < numGoroutines; i++ {
-				goroutineQuitChans[i] <- true
-			}
-
-			log.Printf("error when uploading to S3: %v", p.err)
-			return fmt.Errorf("Error when uploading to S3: %v", p.err)
+	// the blob's codec is in its key
+	var keyDef *keyDef
+	var codec *Codec
+	for _, c := range codecs {
+		if k, ok := blobKeys[key+c.Ext]; ok {
+			keyDef, codec = k, c
+			break
 		}
 	}
+	if keyDef == nil {
+		return fmt.Errorf("layer blob %s is missing from the remote", digest)
+	}
 
-	return nil
-}
+	if remote.journal == nil {
+		object := objectInfo{Key: keyDef.key, Size: keyDef.s3Key.Size}
+		return streamBlobPull(ctx, remote.retry, remote.envelope, dst, digest, codec, object, func() (io.ReadCloser, error) {
+			rc, _, err := remote.getUploadDownloadBucket().GetReader(remote.remoteKey(keyDef.key), remote.uploadDownloadConfig())
+			return rc, err
+		})
+	}
 
-func (remote *S3Remote) PullImageId(id ID, dst string) error {
-	rootKey := "images/" + string(id)
-	imageKeys, err := remote.repoKeys("/" + rootKey)
+	// a resumed download needs the blob as it's stored on disk
+	layer := filepath.Join(dst, "layer.tar"+codec.Ext)
+	err = remote.retry.Do(ctx, "download "+keyDef.key, func() error {
+		return remote.getFile(ctx, layer, keyDef)
+	})
 	if err != nil {
 		return err
 	}
 
-	return remote.getFiles(dst, rootKey, imageKeys)
+	if err := remote.envelope.openFile(keyDef.key, layer); err != nil {
+		return err
+	}
+
+	return finishBlobPull(dst, digest, codec)
 }
 
-func (remote *S3Remote) ParseTag(repo, tag string) (ID, error) {
+func (remote *S3Remote) ParseTag(ctx context.Context, repo, tag string) (ID, error) {
 	bucket := remote.getBucket()
 
-	file, err := bucket.Get(remote.tagFilePath(repo, tag))
+	var file []byte
+	err := remote.retry.Do(ctx, "get tag "+repo+":"+tag, func() (err error) {
+		file, err = bucket.Get(remote.remoteKey(remote.tagFilePath(repo, tag)))
+		return err
+	})
 	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
 		// doesn't exist yet, deal with it
 		return "", nil
@@ -200,15 +236,24 @@ func (remote *S3Remote) ParseTag(repo, tag string) (ID, error) {
 		return "", err
 	}
 
+	file, err = remote.envelope.open(tagKey(repo, tag), file)
+	if err != nil {
+		return "", err
+	}
+
 	return ID(file), nil
 }
 
-func (remote *S3Remote) ResolveImageNameToId(image string) (ID, error) {
-	return ResolveImageNameToId(remote, image)
+func (remote *S3Remote) ResolveImageNameToId(ctx context.Context, image string) (ID, error) {
+	return ResolveImageNameToId(ctx, remote, image)
 }
 
-func (remote *S3Remote) ImageFullId(id ID) (ID, error) {
-	remoteKeys, err := remote.repoKeys("/images")
+func (remote *S3Remote) ImageFullId(ctx context.Context, id ID) (ID, error) {
+	if fullID, ok := catalogFullID(ctx, remote, id); ok {
+		return fullID, nil
+	}
+
+	remoteKeys, err := remote.repoKeys(ctx, "/images")
 	if err != nil {
 		return "", err
 	}
@@ -224,15 +269,19 @@ func (remote *S3Remote) ImageFullId(id ID) (ID, error) {
 	return "", ErrNoSuchImage
 }
 
-func (remote *S3Remote) WalkImages(id ID, walker ImageWalkFn) error {
-	return WalkImages(remote, id, walker)
+func (remote *S3Remote) WalkImages(ctx context.Context, id ID, walker ImageWalkFn) error {
+	return WalkImages(ctx, remote, id, walker)
 }
 
-func (remote *S3Remote) ImageMetadata(id ID) (docker.Image, error) {
+func (remote *S3Remote) ImageMetadata(ctx context.Context, id ID) (docker.Image, error) {
 	jsonPath := path.Join(remote.imagePath(id), "json")
 	image := docker.Image{}
 
-	imageJson, err := remote.getBucket().Get(jsonPath)
+	var imageJson []byte
+	err := remote.retry.Do(ctx, "get "+jsonPath, func() (err error) {
+		imageJson, err = remote.getBucket().Get(remote.remoteKey(jsonPath))
+		return err
+	})
 	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
 		// doesn't exist yet, deal with it
 		return image, ErrNoSuchImage
@@ -240,6 +289,11 @@ func (remote *S3Remote) ImageMetadata(id ID) (docker.Image, error) {
 		return image, err
 	}
 
+	imageJson, err = remote.envelope.open(jsonPath, imageJson)
+	if err != nil {
+		return image, err
+	}
+
 	if err := json.Unmarshal(imageJson, &image); err != nil {
 		return image, err
 	}
@@ -247,18 +301,90 @@ func (remote *S3Remote) ImageMetadata(id ID) (docker.Image, error) {
 	return image, nil
 }
 
+func (remote *S3Remote) SetJournal(journal *Journal) {
+	remote.journal = journal
+}
+
+func (remote *S3Remote) SetExpectedID(id ID) {
+	remote.expectedID = id
+}
+
+func (remote *S3Remote) SetOverrideImmutable(override bool) {
+	remote.overrideImmutable = override
+}
+
+func (remote *S3Remote) Policy(ctx context.Context) (Policy, error) {
+	return readPolicy(ctx, remote)
+}
+
+func (remote *S3Remote) SetTag(ctx context.Context, repo, tag string, id ID) error {
+	return setTag(ctx, remote, repo, tag, id, remote.expectedID, remote.overrideImmutable)
+}
+
+func (remote *S3Remote) TagHistory(ctx context.Context, repo, tag string) ([]TagHistoryEntry, error) {
+	history, _, err := readTagHistory(ctx, remote, repo, tag)
+	return history, err
+}
+
+func (remote *S3Remote) PutTagMetadata(ctx context.Context, meta TagMetadata) error {
+	return putTagMetadata(ctx, remote, meta)
+}
+
+func (remote *S3Remote) TagMetadata(ctx context.Context, repo, tag string) (TagMetadata, error) {
+	return readTagMetadata(ctx, remote, repo, tag)
+}
+
+func (remote *S3Remote) Reindex(ctx context.Context) (*Catalog, error) {
+	return reindex(ctx, remote)
+}
+
+func (remote *S3Remote) Layout(ctx context.Context) (Layout, error) {
+	layout, _, err := readLayout(ctx, remote)
+	return layout, err
+}
+
+func (remote *S3Remote) Migrate(ctx context.Context, to int) error {
+	return migrate(ctx, remote, to)
+}
+
 func (remote *S3Remote) ParseImagePath(path string, prefix string) (repo, tag string) {
 	return ParseImagePath(path, prefix)
 }
 
+// getBucket returns the bucket, with credentials refreshed if they're
+// about to expire.
 func (remote *S3Remote) getBucket() *s3.Bucket {
-	return remote.client.Bucket(remote.BucketName)
+	if remote.credentials == nil {
+		return remote.client.Bucket(remote.BucketName)
+	}
+
+	client := *remote.client
+	client.Auth = remote.credentials.sign().auth()
+	return client.Bucket(remote.BucketName)
 }
 
 func (remote *S3Remote) getUploadDownloadBucket() *s3gof3r.Bucket {
 	return remote.uploadDownloadClient.Bucket(remote.config.AWS.S3URL.Host)
 }
 
+// s3gof3r retries each multipart part and download chunk on its own, so
+// only the attempt count is taken from the retry policy.
+func (remote *S3Remote) uploadDownloadConfig() *s3gof3r.Config {
+	conf := *s3gof3r.DefaultConfig
+	if remote.retry.Attempts > 0 {
+		conf.NTry = remote.retry.Attempts
+	}
+	conf.Concurrency = partConcurrency(remote.config)
+	conf.Scheme = remote.endpoint.scheme
+	conf.PathStyle = remote.endpoint.pathStyle
+	if remote.s3gof3rClient != nil {
+		conf.Client = remote.s3gof3rClient
+	} else if remote.endpoint.s3gof3rClient != nil {
+		conf.Client = remote.endpoint.s3gof3rClient
+	}
+	return &conf
+}
+
 type keyDef struct {
 	key    string
 	sumKey string
@@ -323,25 +449,23 @@ func (kd *keyDef) Sum() (sum string) {
 }
 
 // get repository keys from s3
-func (remote *S3Remote) repoKeys(prefix string) (keys, error) {
+func (remote *S3Remote) repoKeys(ctx context.Context, prefix string) (keys, error) {
 	repoKeys := make(keys)
 
 	prefix = strings.Trim(prefix, "/")
 
-	bucket := remote.getBucket()
-
-	cnt, err := bucket.List(prefix, "", "", 1000)
-
+	objects, err := listObjects(ctx, remote, prefix)
 	if err != nil {
 		return repoKeys, fmt.Errorf("getting bucket contents at prefix '%s': %s", prefix, err)
 	}
 
-	for _, key := range cnt.Contents {
-		if key.Key == "" {
+	for _, object := range objects {
+		if object.Key == "" {
 			continue
 		}
 
-		plainKey := strings.TrimPrefix(key.Key, "/")
+		plainKey := strings.TrimPrefix(object.Key, "/")
+		key := s3.Key{Key: remote.remoteKey(plainKey), Size: object.Size, ETag: object.ETag}
 
 		if strings.HasSuffix(plainKey, ".sum") {
 			plainKey = strings.TrimSuffix(plainKey, ".sum")
@@ -355,47 +479,200 @@ func (remote *S3Remote) repoKeys(prefix string) (keys, error) {
 	return repoKeys, nil
 }
 
-// Get repository keys from the local work dir.
-// Returned as a map of s3.Key's for ease of comparison.
-func (remote *S3Remote) localKeys(root string) (keys, error) {
-	localKeys := make(keys)
+// maximum keys per page when listing the bucket, S3 won't return more
+const s3ListPageSize = 1000
 
-	if root[len(root)-1] != '/' {
-		root = root + "/"
+func (remote *S3Remote) listPage(ctx context.Context, prefix, marker string) ([]objectInfo, string, error) {
+	root := remote.remoteKey("")
+	fullPrefix := remote.remoteKey(prefix)
+
+	var resp *s3.ListResp
+	err := remote.retry.Do(ctx, "list "+fullPrefix, func() (err error) {
+		resp, err = remote.getBucket().List(fullPrefix, "", remote.remoteKey(marker), s3ListPageSize)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
 	}
 
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
+	objects := make([]objectInfo, 0, len(resp.Contents))
+	for _, key := range resp.Contents {
+		objects = append(objects, objectInfo{Key: strings.TrimPrefix(key.Key, root), Size: key.Size, ETag: key.ETag})
+	}
+
+	if !resp.IsTruncated {
+		return objects, "", nil
+	}
+
+	// goamz fills NextMarker in from the last key when S3 leaves it out
+	return objects, strings.TrimPrefix(resp.NextMarker, root), nil
+}
+
+func (remote *S3Remote) getObject(ctx context.Context, key string) ([]byte, string, error) {
+	dstKey := remote.remoteKey(key)
 
-		sum, err := utils.Sha1File(path)
+	var data []byte
+	var etag string
+	err := remote.retry.Do(ctx, "get "+dstKey, func() error {
+		resp, err := remote.getBucket().GetResponse(dstKey)
 		if err != nil {
 			return err
 		}
+		defer resp.Body.Close()
+
+		data, err = ioutil.ReadAll(resp.Body)
+		etag = resp.Header.Get("ETag")
+		return err
+	})
+	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
+		return nil, "", errObjectNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
 
-		key := strings.TrimPrefix(path, root)
+	data, err = remote.envelope.open(key, data)
+	return data, etag, err
+}
 
-		// note that we pre-populate the sum here
-		localKeys[key] = &keyDef{
-			key:      key,
-			sum:      sum,
-			fullPath: path,
-		}
+func (remote *S3Remote) putObject(ctx context.Context, key string, data []byte) error {
+	dstKey := remote.remoteKey(key)
 
-		return nil
+	data, err := remote.envelope.sealObject(key, data)
+	if err != nil {
+		return err
+	}
+
+	err = remote.retry.Do(ctx, "put "+dstKey, func() error {
+		return remote.getBucket().Put(dstKey, data, "application/octet-stream", remote.objects.ACL(), remote.objects.options)
+	})
+	if err != nil {
+		return err
+	}
+
+	return remote.putMd5(ctx, dstKey, data)
+}
+
+// putObjectIf writes through a presigned URL, goamz can't send If-Match.
+func (remote *S3Remote) putObjectIf(ctx context.Context, key string, data []byte, etag string) error {
+	dstKey := remote.remoteKey(key)
+
+	headers := remote.objects.headers()
+	if etag == "" {
+		headers.Set("If-None-Match", "*")
+	} else {
+		headers.Set("If-Match", etag)
+	}
+
+	data, err := remote.envelope.sealObject(key, data)
+	if err != nil {
+		return err
+	}
+
+	// the object's options are signed, signing adds headers of its own
+	url := remote.getBucket().SignedURLWithMethod("PUT", dstKey, time.Now().Add(conditionalPutExpiry), nil, remote.objects.headers())
+	err = remote.retry.Do(ctx, "put "+dstKey, func() error {
+		return conditionalPut(ctx, remote.endpoint.presignedClient(), url, headers, data, s3RespError)
+	})
+	if err != nil {
+		return err
+	}
+
+	return remote.putMd5(ctx, dstKey, data)
+}
+
+func (remote *S3Remote) statObject(ctx context.Context, key string) (objectInfo, error) {
+	dstKey := remote.remoteKey(key)
+
+	var resp *http.Response
+	err := remote.retry.Do(ctx, "check "+dstKey, func() (err error) {
+		resp, err = remote.getBucket().Head(dstKey, nil)
+		return err
+	})
+	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
+		return objectInfo{}, errObjectNotFound
+	} else if err != nil {
+		return objectInfo{}, err
+	}
+	resp.Body.Close()
+
+	return objectInfo{Key: key, Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}, nil
+}
+
+func (remote *S3Remote) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	dstKey := remote.remoteKey(key)
+
+	var rc io.ReadCloser
+	err := remote.retry.Do(ctx, "get "+dstKey, func() (err error) {
+		rc, err = remote.getBucket().GetReader(dstKey)
+		return err
 	})
+	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
+		return nil, errObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return remote.envelope.openReader(key, rc)
+}
+
+// copyObject copies on S3, along with the md5 s3gof3r checks. S3 copies
+// objects of up to 5GB this way.
+func (remote *S3Remote) copyObject(ctx context.Context, src, dst string) error {
+	bucket := remote.getBucket()
+	srcKey, dstKey := remote.remoteKey(src), remote.remoteKey(dst)
 
+	err := remote.retry.Do(ctx, "copy "+srcKey+" to "+dstKey, func() error {
+		_, err := bucket.PutCopy(dstKey, remote.objects.ACL(), remote.objects.copyOptions(), bucket.Name+"/"+srcKey)
+		return err
+	})
 	if err != nil {
-		return localKeys, err
+		return err
+	}
+
+	err = remote.retry.Do(ctx, "copy md5 of "+srcKey, func() error {
+		_, err := bucket.PutCopy(remote.md5Key(dstKey), remote.objects.ACL(), remote.objects.copyOptions(), bucket.Name+"/"+remote.md5Key(srcKey))
+		return err
+	})
+	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
+		// pushed without one
+		return nil
 	}
 
-	return localKeys, nil
+	return err
+}
+
+func (remote *S3Remote) deleteObject(ctx context.Context, key string) error {
+	dstKey := remote.remoteKey(key)
+
+	// S3 deletes of missing keys succeed
+	return remote.retry.Do(ctx, "delete "+dstKey, func() error {
+		return remote.getBucket().Del(dstKey)
+	})
+}
+
+// putMd5 keeps the md5 s3gof3r checks on gets in line with objects written
+// through goamz.
+func (remote *S3Remote) putMd5(ctx context.Context, dstKey string, data []byte) error {
+	return remote.retry.Do(ctx, "put md5 of "+dstKey, func() error {
+		return remote.getBucket().Put(remote.md5Key(dstKey), []byte(hexMd5(data)), "text/plain", remote.objects.ACL(), remote.objects.options)
+	})
+}
+
+func s3RespError(status int, body []byte) error {
+	err := &s3.Error{StatusCode: status}
+	xml.Unmarshal(body, err)
+	if err.Message == "" {
+		err.Message = http.StatusText(status)
+	}
+	return err
 }
 
 // put a file with key from imageRoot to the s3 bucket
-func (remote *S3Remote) putFile(src string, key *keyDef) error {
+// If the upload fails or ctx is cancelled the multipart upload is aborted, so
+// no partial object is left behind.
+func (remote *S3Remote) putFile(ctx context.Context, key *uploadKeyDef) error {
 	dstKey := remote.remoteKey(key.key)
+	src := key.fullPath
 
 	f, err := os.Open(src)
 	if err != nil {
@@ -410,12 +687,24 @@ func (remote *S3Remote) putFile(src string, key *keyDef) error {
 
 	progressReader := utils.NewProgressReader(f, finfo.Size(), src)
 
+	// The upload gets a client of its own, so that it alone can be stopped.
+	conf := remote.uploadDownloadConfig()
+	transport := &stoppableTransport{base: conf.Client.Transport}
+	client := *conf.Client
+	client.Transport = transport
+	conf.Client = &client
+
 	// Open a PutWriter for actual file upload
-	w, err := remote.getUploadDownloadBucket().PutWriter(dstKey, nil, nil)
+	w, err := remote.getUploadDownloadBucket().PutWriter(dstKey, remote.objects.headers(), conf)
 	if err != nil {
 		return err
 	}
-	if _, err = io.Copy(w, progressReader); err != nil { // Copy to S3
+	if _, err = io.Copy(w, utils.NewLimitedReader(ctx, progressReader)); err != nil { // Copy to S3
+		// Closing the writer as is would complete the upload with partial
+		// content. With its parts refused, Close aborts this upload instead,
+		// and no other one to the same key, and stops its workers.
+		transport.stop()
+		w.Close()
 		return err
 	}
 	if err = w.Close(); err != nil {
@@ -425,6 +714,34 @@ func (remote *S3Remote) putFile(src string, key *keyDef) error {
 	return nil
 }
 
+var errUploadStopped = errors.New("upload stopped")
+
+// stoppableTransport lets the requests of a multipart upload through until
+// it's stopped, after which only the abort gets through.
+type stoppableTransport struct {
+	base    http.RoundTripper
+	stopped int32
+}
+
+func (t *stoppableTransport) stop() {
+	atomic.StoreInt32(&t.stopped, 1)
+}
+
+func (t *stoppableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(&t.stopped) == 1 && req.Method != "DELETE" {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, errUploadStopped
+	}
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
 // get files from the s3 bucket to a local path, relative to rootKey
 // eg
 //
@@ -432,14 +749,25 @@ func (remote *S3Remote) putFile(src string, key *keyDef) error {
 // rootKey: "images/456"
 // key: "images/456/json"
 // downloads to: "/tmp/rego/123/456/json"
-func (remote *S3Remote) getFiles(dst, rootKey string, imageKeys keys) error {
+func (remote *S3Remote) getFiles(ctx context.Context, dst, rootKey string, imageKeys keys) error {
 	errMap := make(map[string]error)
 
 	for _, key := range imageKeys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		relKey := strings.TrimPrefix(key.key, rootKey)
 		relKey = strings.TrimPrefix(relKey, "/")
 
-		err := remote.getFile(filepath.Join(dst, relKey), key)
+		// a failed download starts the file over (or from the last
+		// checkpoint with a journal), so retry whole files
+		err := remote.retry.Do(ctx, "download "+key.key, func() error {
+			return remote.getFile(ctx, filepath.Join(dst, relKey), key)
+		})
+		if err == nil {
+			err = remote.envelope.openFile(key.key, filepath.Join(dst, relKey))
+		}
 		if err != nil {
 			errMap[key.key] = err
 		}
@@ -454,10 +782,14 @@ func (remote *S3Remote) getFiles(dst, rootKey string, imageKeys keys) error {
 }
 
 // get a single file from the s3 bucket
-func (remote *S3Remote) getFile(dst string, key *keyDef) error {
+func (remote *S3Remote) getFile(ctx context.Context, dst string, key *keyDef) error {
+	if remote.journal != nil {
+		return remote.getFileResumable(ctx, dst, key)
+	}
+
 	log.Printf("Pulling key %s (%s)\n", key.key, utils.HumanSize(key.s3Key.Size))
 
-	from, _, err := remote.getUploadDownloadBucket().GetReader(key.key, nil)
+	from, _, err := remote.getUploadDownloadBucket().GetReader(remote.remoteKey(key.key), remote.uploadDownloadConfig())
 	if err != nil {
 		return err
 	}
@@ -471,10 +803,11 @@ func (remote *S3Remote) getFile(dst string, key *keyDef) error {
 	if err != nil {
 		return err
 	}
+	defer to.Close()
 
 	progressReader := utils.NewProgressReader(from, key.s3Key.Size, key.key)
 
-	_, err = io.Copy(to, progressReader)
+	_, err = io.Copy(to, utils.NewLimitedReader(ctx, progressReader))
 	if err != nil {
 		return err
 	}
@@ -492,45 +825,41 @@ func (remote *S3Remote) imagePath(id ID) string {
 	return filepath.Join("images", string(id))
 }
 
+// remoteKey returns where key is in the bucket: under the path of the
+// remote's URL, so that remotes can share a bucket.
 func (remote *S3Remote) remoteKey(key string) string {
+	if prefix := remote.pathPrefix(); prefix != "" {
+		return prefix + "/" + key
+	}
 	return key
 }
 
-func (remote *S3Remote) List() (images []Image, err error) {
-
-	bucket := remote.getBucket()
-	nextMarker := ""
-
-	var contents []s3.Key
-
-	for true {
-		resp, err := bucket.List("repositories/", "", nextMarker, 1000)
-		if err != nil {
-			log.Printf("%s unable to list images: %s", remote.Desc(), err)
-			return images, err
-		}
-
-		contents = append(contents, resp.Contents...)
+func (remote *S3Remote) pathPrefix() string {
+	if remote.config.AWS.S3URL == nil {
+		return ""
+	}
+	return strings.Trim(remote.config.AWS.S3URL.Path, "/")
+}
 
-		if resp.IsTruncated {
-			nextMarker = resp.NextMarker
-		} else {
-			break
-		}
+func (remote *S3Remote) List(ctx context.Context) (images []Image, err error) {
+	if images, ok := listCatalog(ctx, remote); ok {
+		return images, nil
 	}
 
-	for _, k := range contents {
-		if strings.HasSuffix(k.Key, ".sum") {
+	it := newObjectIterator(ctx, remote, "repositories/")
+	for it.Next() {
+		key := it.Object().Key
+		if strings.HasSuffix(key, ".sum") {
 			continue
 		}
-		repo, tag := remote.ParseImagePath(k.Key, "repositories/")
-		if err != nil {
-			log.Printf("error splitting S3 key: repositories/")
-			return images, err
-		}
 
-		image := Image{repo, tag}
-		images = append(images, image)
+		repo, tag := remote.ParseImagePath(key, "repositories/")
+		images = append(images, Image{repo, tag})
+	}
+
+	if err := it.Err(); err != nil {
+		log.Printf("%s unable to list images: %s", remote.Desc(), err)
+		return images, err
 	}
 
 	return images, nil
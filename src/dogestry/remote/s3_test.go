@@ -1,17 +1,19 @@
 package remote
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"dogestry/config"
+	"dogestry/s3"
 	"github.com/AdRoll/goamz/aws"
-	"github.com/AdRoll/goamz/s3"
 	"github.com/AdRoll/goamz/testutil"
-	"dogestry/config"
 	. "gopkg.in/check.v1"
 )
 
@@ -71,7 +73,7 @@ func (s *S) TestRepoKeys(c *C) {
 	testServer.Response(200, nil, GetListResultDump1)
 	testServer.Response(200, nil, nelsonSha)
 
-	keys, err := s.remote.repoKeys("")
+	keys, err := s.remote.repoKeys(context.Background(), "")
 	c.Assert(err, IsNil)
 
 	testServer.WaitRequests(2)
@@ -89,7 +91,7 @@ func (s *S) TestLocalKeys(c *C) {
 	dumpFile(s.TempDir, "file1", "hello world")
 	dumpFile(s.TempDir, "dir/file2", "hello mars")
 
-	keys, err := s.remote.localKeys(s.TempDir)
+	keys, err := localUploadKeys(s.TempDir)
 	c.Assert(err, IsNil)
 
 	c.Assert(keys["file1"].key, Equals, "file1")
@@ -106,7 +108,7 @@ func (s *S) TestResolveImageNameToId(c *C) {
 
 	testServer.Response(200, nil, "123")
 
-	id, err := s.remote.ResolveImageNameToId("ruby")
+	id, err := s.remote.ResolveImageNameToId(context.Background(), "ruby")
 	c.Assert(err, IsNil)
 
 	c.Assert(string(id), Equals, rubyId)
@@ -114,10 +116,49 @@ func (s *S) TestResolveImageNameToId(c *C) {
 	testServer.Flush()
 	testServer.Response(404, nil, "")
 
-	id, err = s.remote.ResolveImageNameToId("rubyx")
+	id, err = s.remote.ResolveImageNameToId(context.Background(), "rubyx")
 	c.Assert(err, Not(IsNil))
 }
 
+func (s *S) TestResumableGetFile(c *C) {
+	testServer.Flush()
+
+	dst := filepath.Join(s.TempDir, "resume/layer.tar")
+	c.Assert(dumpFile(s.TempDir, "resume/layer.tar", "hello"), IsNil)
+
+	journal, err := OpenJournal(filepath.Join(s.TempDir, "resume.journal"), s.remote.Desc())
+	c.Assert(err, IsNil)
+	journal.SetDownload("images/1/layer.tar", DownloadState{
+		ETag:   `"etag"`,
+		Offset: 5,
+		Sum:    "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", // sha1 of "hello"
+	})
+
+	s.remote.SetJournal(journal)
+	defer s.remote.SetJournal(nil)
+
+	testServer.Response(206, nil, " world")
+	testServer.Response(200, nil, "5eb63bbbe01eeed093cb22bb8f5acdc3") // md5 of "hello world"
+
+	key := &keyDef{
+		key:    "images/1/layer.tar",
+		s3Key:  s3.Key{Key: "images/1/layer.tar", Size: 11, ETag: `"etag"`},
+		remote: s.remote,
+	}
+
+	err = s.remote.getFile(context.Background(), dst, key)
+	c.Assert(err, IsNil)
+
+	reqs := testServer.WaitRequests(2)
+	c.Assert(reqs[0].Header.Get("Range"), Equals, "bytes=5-")
+	c.Assert(strings.HasSuffix(reqs[1].URL.Path, ".md5/images/1/layer.tar.md5"), Equals, true)
+
+	content, err := ioutil.ReadFile(dst)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "hello world")
+	c.Assert(journal.Download("images/1/layer.tar", `"etag"`).Done, Equals, true)
+}
+
 func dumpFile(temp, filename, content string) error {
 	out := filepath.Join(temp, filename)
 	if err := os.MkdirAll(filepath.Dir(out), 0700); err != nil {
@@ -0,0 +1,122 @@
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+// how long s3gof3r waits on connections, as its default client does
+const s3gof3rTimeout = 5 * time.Second
+
+// s3Endpoint is where a remote's S3 API is: AWS in the URL's region, or an
+// S3-compatible store (MinIO, Ceph RGW...) given by the endpoint parameter.
+type s3Endpoint struct {
+	region aws.Region
+	// for s3gof3r, the default domain on AWS
+	domain    string
+	scheme    string
+	pathStyle bool
+	// trust a CA bundle, nil for the clients' defaults
+	client        *http.Client
+	s3gof3rClient *http.Client
+}
+
+// newS3Endpoint reads the region, endpoint, pathstyle and cabundle
+// parameters of an S3 URL.
+func newS3Endpoint(s3URL *url.URL) (s3Endpoint, error) {
+	var e s3Endpoint
+	query := url.Values{}
+	if s3URL != nil {
+		query = s3URL.Query()
+	}
+
+	regionName := query.Get("region")
+	if regionName == "" {
+		regionName = S3DefaultRegion
+	}
+
+	if pathStyle := query.Get("pathstyle"); pathStyle != "" {
+		var err error
+		if e.pathStyle, err = strconv.ParseBool(pathStyle); err != nil {
+			return e, fmt.Errorf("invalid pathstyle '%s', expected true or false", pathStyle)
+		}
+	}
+
+	if bundle := query.Get("cabundle"); bundle != "" {
+		pem, err := ioutil.ReadFile(bundle)
+		if err != nil {
+			return e, fmt.Errorf("reading CA bundle: %v", err)
+		}
+
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return e, fmt.Errorf("CA bundle %s holds no PEM certificates", bundle)
+		}
+
+		tlsConfig := &tls.Config{RootCAs: roots}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		e.client = &http.Client{Transport: transport}
+
+		e.s3gof3rClient = s3gof3r.ClientWithTimeout(s3gof3rTimeout)
+		e.s3gof3rClient.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	}
+
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		region, ok := aws.Regions[regionName]
+		if !ok {
+			return e, fmt.Errorf("unknown region '%s', S3-compatible stores need an endpoint", regionName)
+		}
+
+		// goamz addresses AWS buckets by path already
+		e.region = region
+		e.scheme = "https"
+		return e, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return e, fmt.Errorf("invalid endpoint '%s', expected eg. https://minio.local:9000", endpoint)
+	}
+
+	// the region only goes into signatures
+	e.region = aws.Region{Name: regionName, S3Endpoint: u.Scheme + "://" + u.Host}
+	if !e.pathStyle {
+		e.region.S3BucketEndpoint = u.Scheme + "://${bucket}." + u.Host
+	}
+	e.domain = u.Host
+	e.scheme = u.Scheme
+
+	return e, nil
+}
+
+// String describes the endpoint for Desc.
+func (e s3Endpoint) String() string {
+	if e.domain == "" {
+		return "region=" + e.region.Name
+	}
+	return fmt.Sprintf("endpoint=%s, region=%s", e.region.S3Endpoint, e.region.Name)
+}
+
+// presignedClient returns the client presigned URLs are sent with.
+func (e s3Endpoint) presignedClient() *http.Client {
+	if e.client != nil {
+		return e.client
+	}
+	return http.DefaultClient
+}
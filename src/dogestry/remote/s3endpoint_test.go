@@ -0,0 +1,131 @@
+package remote
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+
+	"dogestry/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type S3EndpointSuite struct{}
+
+var _ = Suite(&S3EndpointSuite{})
+
+func s3EndpointFor(c *C, rawurl string) (s3Endpoint, error) {
+	u, err := url.Parse(rawurl)
+	c.Assert(err, IsNil)
+	return newS3Endpoint(u)
+}
+
+func (s *S3EndpointSuite) TestRegions(c *C) {
+	e, err := s3EndpointFor(c, "s3://bucket/path/")
+	c.Assert(err, IsNil)
+	c.Assert(e.region.Name, Equals, S3DefaultRegion)
+	c.Assert(e.domain, Equals, "")
+	c.Assert(e.scheme, Equals, "https")
+	c.Assert(e.client, IsNil)
+
+	e, err = s3EndpointFor(c, "s3://bucket/path/?region=eu-west-1")
+	c.Assert(err, IsNil)
+	c.Assert(e.region.S3Endpoint, Equals, "https://s3-eu-west-1.amazonaws.com")
+	c.Assert(e.String(), Equals, "region=eu-west-1")
+
+	_, err = s3EndpointFor(c, "s3://bucket/path/?region=eu-middle-1")
+	c.Assert(err, ErrorMatches, "unknown region 'eu-middle-1', S3-compatible stores need an endpoint")
+}
+
+func (s *S3EndpointSuite) TestEndpoint(c *C) {
+	e, err := s3EndpointFor(c, "s3://bucket/path/?endpoint=https://minio.local:9000")
+	c.Assert(err, IsNil)
+	c.Assert(e.region.Name, Equals, S3DefaultRegion)
+	c.Assert(e.region.S3Endpoint, Equals, "https://minio.local:9000")
+	c.Assert(e.region.S3BucketEndpoint, Equals, "https://${bucket}.minio.local:9000")
+	c.Assert(e.domain, Equals, "minio.local:9000")
+	c.Assert(e.pathStyle, Equals, false)
+
+	// any region goes, it's only signed
+	e, err = s3EndpointFor(c, "s3://bucket/path/?endpoint=http://rgw.local/&pathstyle=true&region=garage")
+	c.Assert(err, IsNil)
+	c.Assert(e.region.Name, Equals, "garage")
+	c.Assert(e.region.S3Endpoint, Equals, "http://rgw.local")
+	c.Assert(e.region.S3BucketEndpoint, Equals, "")
+	c.Assert(e.scheme, Equals, "http")
+	c.Assert(e.pathStyle, Equals, true)
+	c.Assert(e.String(), Equals, "endpoint=http://rgw.local, region=garage")
+}
+
+func (s *S3EndpointSuite) TestInvalidEndpoint(c *C) {
+	notPEM := filepath.Join(c.MkDir(), "ca.pem")
+	c.Assert(ioutil.WriteFile(notPEM, []byte("not a certificate"), 0644), IsNil)
+
+	for rawurl, expected := range map[string]string{
+		"s3://bucket/?endpoint=minio.local:9000":           "invalid endpoint 'minio.local:9000', expected eg. https://minio.local:9000",
+		"s3://bucket/?endpoint=https://minio.local/bucket": "invalid endpoint 'https://minio.local/bucket', .*",
+		"s3://bucket/?endpoint=http://rgw&pathstyle=yes":   "invalid pathstyle 'yes', expected true or false",
+		"s3://bucket/?cabundle=/nonexistent/ca.pem":        "reading CA bundle: .*",
+		"s3://bucket/?cabundle=" + notPEM:                  "CA bundle .* holds no PEM certificates",
+	} {
+		_, err := s3EndpointFor(c, rawurl)
+		c.Assert(err, ErrorMatches, expected, Commentf(rawurl))
+	}
+}
+
+// tlsRemote returns a remote for the bucket on server, with more query
+// parameters.
+func tlsRemote(c *C, server *httptest.Server, query string) *S3Remote {
+	cfg := config.Config{}
+	cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey = "abc", "123"
+	cfg.Retry.Attempts = 1
+	c.Assert(cfg.SetS3URL("s3://bucket/?pathstyle=true&endpoint="+url.QueryEscape(server.URL)+query), IsNil)
+
+	remote, err := NewS3Remote(cfg)
+	c.Assert(err, IsNil)
+	return remote
+}
+
+func (s *S3EndpointSuite) TestCABundle(c *C) {
+	fake := newFakeS3()
+	defer fake.Close()
+	fake.put(LayoutKey, `{"version": 3}`)
+
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	ctx := context.Background()
+	c.Assert(tlsRemote(c, server, "").Validate(ctx), ErrorMatches, ".*certificate.*")
+
+	bundle := filepath.Join(c.MkDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	c.Assert(ioutil.WriteFile(bundle, cert, 0644), IsNil)
+
+	remote := tlsRemote(c, server, "&cabundle="+url.QueryEscape(bundle))
+
+	// goamz
+	c.Assert(remote.Validate(ctx), IsNil)
+	c.Assert(remote.putObject(ctx, "a", []byte("content")), IsNil)
+
+	// presigned
+	c.Assert(remote.putObjectIf(ctx, "b", []byte("content"), ""), IsNil)
+
+	// s3gof3r, which keeps the md5 with the bucket in its key
+	src := filepath.Join(c.MkDir(), "c")
+	c.Assert(ioutil.WriteFile(src, []byte("uploaded"), 0644), IsNil)
+	c.Assert(remote.putFile(ctx, &uploadKeyDef{key: "c", fullPath: src}), IsNil)
+	uploaded, _ := fake.get("c")
+	c.Assert(uploaded, Equals, "uploaded")
+
+	dst := filepath.Join(c.MkDir(), "a")
+	c.Assert(remote.getFile(ctx, dst, &keyDef{key: "a"}), IsNil)
+	data, err := ioutil.ReadFile(dst)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "content")
+
+	_, ok := fake.get(".md5/bucket/a.md5")
+	c.Assert(ok, Equals, true)
+}
@@ -0,0 +1,129 @@
+package remote
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"dogestry/config"
+	"dogestry/s3"
+)
+
+var (
+	s3SSEModes = []string{string(s3.S3Managed), string(s3.KMSManaged)}
+
+	s3StorageClasses = []string{"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR"}
+
+	s3ACLs = []string{
+		string(s3.Private), string(s3.PublicRead), string(s3.PublicReadWrite), string(s3.AuthenticatedRead),
+		string(s3.BucketOwnerRead), string(s3.BucketOwnerFull),
+	}
+)
+
+// s3Objects holds the options every object pushed to S3 is written with:
+// server-side encryption, storage class and canned ACL. The zero value
+// writes private objects with the bucket's defaults.
+type s3Objects struct {
+	acl     s3.ACL
+	options s3.Options
+}
+
+// newS3Objects reads the options from the remote's config, overridden by the
+// sse, sse-kms-key-id, storage-class and acl parameters of the S3 URL.
+func newS3Objects(cfg config.Config) (s3Objects, error) {
+	objects := cfg.AWS.Objects
+	if cfg.AWS.S3URL != nil {
+		query := cfg.AWS.S3URL.Query()
+		queryOverride(&objects.SSE, query, "sse")
+		queryOverride(&objects.SSEKMSKeyID, query, "sse-kms-key-id")
+		queryOverride(&objects.StorageClass, query, "storage-class")
+		queryOverride(&objects.ACL, query, "acl")
+	}
+
+	o := s3Objects{acl: s3.Private}
+
+	switch {
+	case objects.SSE == "" && objects.SSEKMSKeyID != "", objects.SSE == string(s3.KMSManaged):
+		o.options.SSEKMS = true
+		o.options.SSEKMSKeyId = objects.SSEKMSKeyID
+	case objects.SSE == string(s3.S3Managed):
+		if objects.SSEKMSKeyID != "" {
+			return o, fmt.Errorf("a KMS key is set but sse is %s, expected %s", objects.SSE, s3.KMSManaged)
+		}
+		o.options.SSE = true
+	case objects.SSE != "":
+		return o, fmt.Errorf("unknown sse '%s', expected one of %s", objects.SSE, strings.Join(s3SSEModes, ", "))
+	}
+
+	if objects.StorageClass != "" {
+		if !contains(s3StorageClasses, objects.StorageClass) {
+			return o, fmt.Errorf("unknown storage class '%s', expected one of %s", objects.StorageClass, strings.Join(s3StorageClasses, ", "))
+		}
+		o.options.StorageClass = s3.StorageClass(objects.StorageClass)
+	}
+
+	if objects.ACL != "" {
+		if !contains(s3ACLs, objects.ACL) {
+			return o, fmt.Errorf("unknown acl '%s', expected one of %s", objects.ACL, strings.Join(s3ACLs, ", "))
+		}
+		o.acl = s3.ACL(objects.ACL)
+	}
+
+	return o, nil
+}
+
+func queryOverride(value *string, query url.Values, name string) {
+	if v := query.Get(name); v != "" {
+		*value = v
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL of the objects, private unless configured otherwise.
+func (o s3Objects) ACL() s3.ACL {
+	if o.acl == "" {
+		return s3.Private
+	}
+	return o.acl
+}
+
+// copyOptions keeps the options on copies, S3 doesn't carry them over.
+func (o s3Objects) copyOptions() s3.CopyOptions {
+	return s3.CopyOptions{Options: o.options}
+}
+
+// headers returns the options as request headers, for the writes that don't
+// go through goamz's Put: s3gof3r uploads and presigned PUTs.
+func (o s3Objects) headers() http.Header {
+	h := http.Header{}
+	h.Set("x-amz-acl", string(o.ACL()))
+	switch {
+	case o.options.SSE:
+		h.Set("x-amz-server-side-encryption", string(s3.S3Managed))
+	case o.options.SSEKMS:
+		h.Set("x-amz-server-side-encryption", string(s3.KMSManaged))
+		if o.options.SSEKMSKeyId != "" {
+			h.Set("x-amz-server-side-encryption-aws-kms-key-id", o.options.SSEKMSKeyId)
+		}
+	}
+	if o.options.StorageClass != "" {
+		h.Set("x-amz-storage-class", string(o.options.StorageClass))
+	}
+	return h
+}
+
+// md5ETags tells whether S3 answers with the md5 of the content as the
+// ETag. It doesn't for objects encrypted with KMS, which s3gof3r can't
+// upload as it checks every part's ETag.
+func (o s3Objects) md5ETags() bool {
+	return !o.options.SSEKMS
+}
@@ -0,0 +1,115 @@
+package remote
+
+import (
+	"context"
+	"net/http"
+
+	"dogestry/config"
+	"dogestry/s3"
+
+	. "gopkg.in/check.v1"
+)
+
+type S3ObjectsSuite struct {
+	fake      *fakeS3
+	remote    *S3Remote
+	imageRoot string
+}
+
+var _ = Suite(&S3ObjectsSuite{})
+
+func (s *S3ObjectsSuite) SetUpTest(c *C) {
+	s.fake, s.remote, s.imageRoot = setUpLayoutRemote(c, 3)
+}
+
+func (s *S3ObjectsSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+func s3ObjectsFor(c *C, rawurl string, objects config.S3Objects) (s3Objects, error) {
+	cfg := config.Config{}
+	c.Assert(cfg.SetS3URL(rawurl), IsNil)
+	cfg.AWS.Objects = objects
+	return newS3Objects(cfg)
+}
+
+func (s *S3ObjectsSuite) TestDefaults(c *C) {
+	o, err := s3ObjectsFor(c, "s3://bucket/", config.S3Objects{})
+	c.Assert(err, IsNil)
+	c.Assert(o.ACL(), Equals, s3.Private)
+	c.Assert(o.options, DeepEquals, s3.Options{})
+	c.Assert(o.headers(), DeepEquals, http.Header{"X-Amz-Acl": {"private"}})
+
+	// remotes made by hand are private too
+	c.Assert(s3Objects{}.ACL(), Equals, s3.Private)
+}
+
+func (s *S3ObjectsSuite) TestOptions(c *C) {
+	o, err := s3ObjectsFor(c, "s3://bucket/?region=eu-west-1&storage-class=STANDARD_IA&acl=bucket-owner-full-control",
+		config.S3Objects{SSE: "aws:kms", SSEKMSKeyID: "alias/dogestry", StorageClass: "GLACIER_IR"})
+	c.Assert(err, IsNil)
+
+	// the URL wins over the config
+	c.Assert(o.ACL(), Equals, s3.BucketOwnerFull)
+	c.Assert(o.options, DeepEquals, s3.Options{SSEKMS: true, SSEKMSKeyId: "alias/dogestry", StorageClass: "STANDARD_IA"})
+	c.Assert(o.md5ETags(), Equals, false)
+
+	// a KMS key implies aws:kms
+	o, err = s3ObjectsFor(c, "s3://bucket/?sse-kms-key-id=alias/dogestry", config.S3Objects{})
+	c.Assert(err, IsNil)
+	c.Assert(o.options, DeepEquals, s3.Options{SSEKMS: true, SSEKMSKeyId: "alias/dogestry"})
+
+	o, err = s3ObjectsFor(c, "s3://bucket/?sse=AES256", config.S3Objects{})
+	c.Assert(err, IsNil)
+	c.Assert(o.options, DeepEquals, s3.Options{SSE: true})
+	c.Assert(o.md5ETags(), Equals, true)
+}
+
+func (s *S3ObjectsSuite) TestInvalidOptions(c *C) {
+	for rawurl, expected := range map[string]string{
+		"s3://bucket/?sse=aes":                           "unknown sse 'aes', expected one of AES256, aws:kms",
+		"s3://bucket/?sse=AES256&sse-kms-key-id=key":     "a KMS key is set but sse is AES256, expected aws:kms",
+		"s3://bucket/?storage-class=GLACIER":             "unknown storage class 'GLACIER', expected one of .*",
+		"s3://bucket/?acl=public":                        "unknown acl 'public', expected one of private, .*",
+		"s3://bucket/?storage-class=standard&sse=AES256": "unknown storage class 'standard', .*",
+	} {
+		_, err := s3ObjectsFor(c, rawurl, config.S3Objects{})
+		c.Assert(err, ErrorMatches, expected, Commentf(rawurl))
+	}
+}
+
+func (s *S3ObjectsSuite) TestPush(c *C) {
+	var err error
+	s.remote.objects, err = s3ObjectsFor(c, "s3://bucket/?sse=aws:kms&sse-kms-key-id=key&storage-class=STANDARD_IA&acl=bucket-owner-full-control", config.S3Objects{})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	expected := http.Header{
+		"x-amz-acl":                    {"bucket-owner-full-control"},
+		"x-amz-server-side-encryption": {"aws:kms"},
+		"x-amz-server-side-encryption-aws-kms-key-id": {"key"},
+		"x-amz-storage-class":                         {"STANDARD_IA"},
+	}
+
+	// layers, their md5s, metadata, tags and their history alike
+	c.Assert(len(s.fake.written) > 5, Equals, true)
+	for key, headers := range s.fake.written {
+		c.Assert(headers, DeepEquals, expected, Commentf("%s was written without the options", key))
+	}
+}
+
+func (s *S3ObjectsSuite) TestCopy(c *C) {
+	var err error
+	s.remote.objects, err = s3ObjectsFor(c, "s3://bucket/?sse=AES256&storage-class=REDUCED_REDUNDANCY", config.S3Objects{})
+	c.Assert(err, IsNil)
+
+	s.fake.put("a", "content")
+	c.Assert(s.remote.copyObject(context.Background(), "a", "b"), IsNil)
+
+	c.Assert(s.fake.written["b"], DeepEquals, http.Header{
+		"x-amz-acl":                    {"private"},
+		"x-amz-server-side-encryption": {"AES256"},
+		"x-amz-storage-class":          {"REDUCED_REDUNDANCY"},
+	})
+}
@@ -0,0 +1,125 @@
+package remote
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"dogestry/config"
+
+	. "gopkg.in/check.v1"
+)
+
+type S3PathSuite struct {
+	fake      *fakeS3
+	imageRoot string
+}
+
+var _ = Suite(&S3PathSuite{})
+
+func (s *S3PathSuite) SetUpTest(c *C) {
+	s.fake, _, s.imageRoot = setUpLayoutRemote(c, 3)
+}
+
+func (s *S3PathSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+// remote returns a remote at path in the fake bucket, with s3gof3r too so
+// that it can pull.
+func (s *S3PathSuite) remote(c *C, path string) *S3Remote {
+	cfg := config.Config{}
+	cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey = "abc", "123"
+	c.Assert(cfg.SetS3URL("s3://bucket"+path+"?pathstyle=true&endpoint="+url.QueryEscape(s.fake.server.URL)), IsNil)
+
+	remote, err := NewS3Remote(cfg)
+	c.Assert(err, IsNil)
+	return remote
+}
+
+func (s *S3PathSuite) TestKeys(c *C) {
+	c.Assert(s.remote(c, "/").remoteKey("images/1/json"), Equals, "images/1/json")
+	c.Assert(s.remote(c, "").remoteKey("images/1/json"), Equals, "images/1/json")
+	c.Assert(s.remote(c, "/team-a").remoteKey("images/1/json"), Equals, "team-a/images/1/json")
+	c.Assert(s.remote(c, "/teams/b/").remoteKey("images/1/json"), Equals, "teams/b/images/1/json")
+
+	// journals of remotes in a bucket are told apart
+	c.Assert(s.remote(c, "/team-a/").Desc(), Equals, "s3(bucket=bucket, path=team-a, endpoint="+s.fake.server.URL+", region=us-east-1)")
+}
+
+func (s *S3PathSuite) TestPush(c *C) {
+	ctx := context.Background()
+	c.Assert(s.remote(c, "/team-a/").Push(ctx, "app:latest", s.imageRoot), IsNil)
+
+	for _, key := range s.fake.writes {
+		c.Assert(strings.HasPrefix(key, "team-a/") || strings.HasPrefix(key, ".md5/bucket/team-a/"), Equals, true, Commentf("wrote %s", key))
+	}
+	_, ok := s.fake.get("team-a/repositories/app/latest")
+	c.Assert(ok, Equals, true)
+}
+
+func (s *S3PathSuite) TestIsolation(c *C) {
+	ctx := context.Background()
+	a, b, root := s.remote(c, "/team-a/"), s.remote(c, "/team-b/"), s.remote(c, "/")
+	c.Assert(a.Push(ctx, "app:latest", s.imageRoot), IsNil)
+
+	for _, r := range []*S3Remote{b, root} {
+		id, err := r.ParseTag(ctx, "app", "latest")
+		c.Assert(err, IsNil)
+		c.Assert(id, Equals, ID(""))
+
+		images, err := r.List(ctx)
+		c.Assert(err, IsNil)
+		c.Assert(images, HasLen, 0)
+
+		_, err = r.ImageMetadata(ctx, pushImageId)
+		c.Assert(err, Equals, ErrNoSuchImage)
+
+		_, err = r.ImageFullId(ctx, ID(pushImageId[:12]))
+		c.Assert(err, Equals, ErrNoSuchImage)
+	}
+
+	// the layout at the root of the bucket isn't team-a's
+	layout, err := a.Layout(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(layout.Version, Equals, 1)
+
+	id, err := a.ParseTag(ctx, "app", "latest")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID(pushImageId))
+
+	images, err := a.List(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(images, HasLen, 1)
+}
+
+func (s *S3PathSuite) TestPull(c *C) {
+	ctx := context.Background()
+	c.Assert(s.remote(c, "/team-a/").Push(ctx, "app:latest", s.imageRoot), IsNil)
+
+	// with and without a journal
+	for _, journal := range []bool{false, true} {
+		r := s.remote(c, "/team-a/")
+		if journal {
+			j, err := OpenJournal(filepath.Join(c.MkDir(), "pull.journal"), r.Desc())
+			c.Assert(err, IsNil)
+			r.SetJournal(j)
+		}
+
+		dst := filepath.Join(c.MkDir(), pushImageId)
+		c.Assert(r.PullImageId(ctx, pushImageId, dst), IsNil)
+
+		layer, err := ioutil.ReadFile(filepath.Join(dst, "layer.tar"))
+		c.Assert(err, IsNil)
+		c.Assert(string(layer), Equals, "layer contents")
+
+		// nothing to pull from team-b
+		other := c.MkDir()
+		c.Assert(s.remote(c, "/team-b/").PullImageId(ctx, pushImageId, other), IsNil)
+		files, err := ioutil.ReadDir(other)
+		c.Assert(err, IsNil)
+		c.Assert(files, HasLen, 0)
+	}
+}
@@ -0,0 +1,338 @@
+package remote
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"dogestry/s3"
+	"dogestry/utils"
+)
+
+// s3gof3r keeps the md5 of every object it puts under this prefix and checks
+// it on gets, resumable transfers do the same so both can read each other's
+// objects.
+func md5Key(key string) string {
+	return ".md5/" + key + ".md5"
+}
+
+// md5Key returns the key of the md5 of key on this remote: s3gof3r puts the
+// bucket name in it when it addresses the bucket by path.
+func (remote *S3Remote) md5Key(key string) string {
+	if remote.endpoint.pathStyle || strings.Contains(remote.BucketName, ".") {
+		return md5Key(remote.BucketName + "/" + key)
+	}
+	return md5Key(key)
+}
+
+// putFileResumable uploads src as a multipart upload whose ID is recorded in
+// the journal. When resuming, parts that are already on S3 with the right
+// size and md5 are skipped. On failure the upload is left in place for the
+// next run to pick up, or aborted without a journal, as nothing could find
+// it again.
+func (remote *S3Remote) putFileResumable(ctx context.Context, key *uploadKeyDef) (err error) {
+	dstKey := remote.remoteKey(key.key)
+	src := key.fullPath
+
+	state := remote.journal.Upload(dstKey, key.sum)
+	if state.Done {
+		log.Printf("Key %s already uploaded", dstKey)
+		return nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	finfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := finfo.Size()
+
+	fileMd5, err := md5Section(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return err
+	}
+
+	multi, existing, err := remote.resumeMulti(ctx, dstKey, state.UploadID)
+	if err != nil {
+		return err
+	}
+	if remote.journal == nil {
+		defer func() {
+			if err != nil {
+				remote.abortMulti(multi)
+			}
+		}()
+	}
+
+	state.UploadID = multi.UploadId
+	if err := remote.journal.SetUpload(dstKey, state); err != nil {
+		return err
+	}
+
+	parts, err := remote.putParts(ctx, multi, f, size, existing)
+	if err != nil {
+		return err
+	}
+
+	err = remote.retry.Do(ctx, "complete upload of "+dstKey, func() error {
+		return multi.Complete(parts)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = remote.retry.Do(ctx, "put md5 of "+dstKey, func() error {
+		return remote.getBucket().Put(remote.md5Key(dstKey), []byte(fileMd5), "text/plain", remote.objects.ACL(), remote.objects.options)
+	})
+	if err != nil {
+		return err
+	}
+
+	return remote.journal.SetUpload(dstKey, UploadState{Sum: key.sum, Done: true})
+}
+
+// abortMulti aborts the multipart upload multi, so that its parts aren't
+// kept, and billed, forever.
+func (remote *S3Remote) abortMulti(multi *s3.Multi) {
+	if err := multi.Abort(); err != nil {
+		log.Printf("Warning: unable to abort the upload of %s: %v", multi.Key, err)
+	}
+}
+
+// resumeMulti returns the multipart upload with uploadID and its uploaded
+// parts by number, or starts a new upload if there's none or it's gone.
+func (remote *S3Remote) resumeMulti(ctx context.Context, key, uploadID string) (*s3.Multi, map[int]s3.Part, error) {
+	bucket := remote.getBucket()
+	existing := make(map[int]s3.Part)
+
+	if uploadID != "" {
+		multi := &s3.Multi{Bucket: bucket, Key: key, UploadId: uploadID}
+
+		var parts []s3.Part
+		err := remote.retry.Do(ctx, "list parts of "+key, func() (err error) {
+			parts, err = multi.ListParts()
+			return err
+		})
+
+		if err == nil {
+			log.Printf("Resuming upload of %s, %d parts already uploaded", key, len(parts))
+			for _, part := range parts {
+				existing[part.N] = part
+			}
+			return multi, existing, nil
+		}
+
+		if s3err, ok := err.(*s3.Error); !ok || s3err.Code != "NoSuchUpload" {
+			return nil, nil, err
+		}
+
+		log.Printf("Upload of %s expired, starting over", key)
+	}
+
+	var multi *s3.Multi
+	err := remote.retry.Do(ctx, "start upload of "+key, func() (err error) {
+		multi, err = bucket.InitMulti(key, "application/octet-stream", remote.objects.ACL(), remote.objects.options)
+		return err
+	})
+
+	return multi, existing, err
+}
+
+// putParts uploads the parts of f missing from existing, each with its own
+// retries, and returns the full list of parts.
+func (remote *S3Remote) putParts(ctx context.Context, multi *s3.Multi, f *os.File, size int64, existing map[int]s3.Part) ([]s3.Part, error) {
+	conf := remote.uploadDownloadConfig()
+	partSize := conf.PartSize
+
+	numParts := int((size + partSize - 1) / partSize)
+	if numParts == 0 {
+		// empty files still need a part
+		numParts = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parts := make([]s3.Part, numParts)
+	partc := make(chan int, numParts)
+	errc := make(chan error, numParts)
+
+	for n := 1; n <= numParts; n++ {
+		partc <- n
+	}
+	close(partc)
+
+	var uploaded int64
+
+	for i := 0; i < conf.Concurrency; i++ {
+		go func() {
+			for n := range partc {
+				if err := ctx.Err(); err != nil {
+					errc <- err
+					continue
+				}
+
+				offset := int64(n-1) * partSize
+				length := partSize
+				if offset+length > size {
+					length = size - offset
+				}
+
+				part, err := remote.putPart(ctx, multi, io.NewSectionReader(f, offset, length), n, existing[n])
+				parts[n-1] = part
+
+				if err == nil {
+					utils.ReportProgress(multi.Key, atomic.AddInt64(&uploaded, length), size)
+				}
+				errc <- err
+			}
+		}()
+	}
+
+	for i := 0; i < numParts; i++ {
+		if err := <-errc; err != nil {
+			return nil, err
+		}
+	}
+
+	return parts, nil
+}
+
+// putPart uploads part n from section, unless existing already holds the
+// same content.
+func (remote *S3Remote) putPart(ctx context.Context, multi *s3.Multi, section *io.SectionReader, n int, existing s3.Part) (s3.Part, error) {
+	partMd5, err := md5Section(section)
+	if err != nil {
+		return s3.Part{}, err
+	}
+
+	if existing.N == n && existing.Size == section.Size() && existing.ETag == `"`+partMd5+`"` {
+		return existing, nil
+	}
+
+	var part s3.Part
+	err = remote.retry.Do(ctx, fmt.Sprintf("upload part %d of %s", n, multi.Key), func() (err error) {
+		part, err = multi.PutPart(n, &contextReadSeeker{ctx, section})
+		return err
+	})
+
+	return part, err
+}
+
+// getFileResumable downloads key to dst, continuing a partial download from
+// an earlier run with a range request. The result is checked against the
+// md5 recorded when the object was pushed.
+func (remote *S3Remote) getFileResumable(ctx context.Context, dst string, key *keyDef) error {
+	srcKey := remote.remoteKey(key.key)
+
+	log.Printf("Pulling key %s (%s)\n", key.key, utils.HumanSize(key.s3Key.Size))
+
+	// the md5 is checked below, whether or not the download was resumed
+	conf := remote.uploadDownloadConfig()
+	conf.Md5Check = false
+
+	open := func(offset int64) (io.ReadCloser, error) {
+		if offset == 0 {
+			from, _, err := remote.getUploadDownloadBucket().GetReader(srcKey, conf)
+			return from, err
+		}
+
+		headers := map[string][]string{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+		resp, err := remote.getBucket().GetResponseWithHeaders(srcKey, headers)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return nil, fmt.Errorf("range request for %s returned %s", srcKey, resp.Status)
+		}
+
+		return resp.Body, nil
+	}
+
+	err := resumeDownload(ctx, remote.journal, dst, srcKey, key.s3Key.ETag, key.s3Key.Size, open)
+	if err != nil {
+		return err
+	}
+
+	return remote.verifyMd5(ctx, dst, srcKey)
+}
+
+// verifyMd5 checks dst against the md5 stored for key. Objects pushed without
+// one are accepted as is.
+func (remote *S3Remote) verifyMd5(ctx context.Context, dst, key string) error {
+	var want []byte
+	err := remote.retry.Do(ctx, "get md5 of "+key, func() (err error) {
+		want, err = remote.getBucket().Get(remote.md5Key(key))
+		return err
+	})
+	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 404 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	got, err := md5Section(f)
+	if err != nil {
+		return err
+	}
+
+	if got != string(want) {
+		// don't resume from a corrupt file next time
+		remote.journal.SetDownload(key, DownloadState{})
+		return fmt.Errorf("md5 mismatch for %s: expected %s, got %s", key, want, got)
+	}
+
+	return nil
+}
+
+func hexMd5(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func md5Section(r io.Reader) (string, error) {
+	digest := md5.New()
+	if _, err := io.Copy(digest, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// contextReadSeeker is a utils.NewLimitedReader for part uploads, which need
+// to seek back to the start on every attempt.
+type contextReadSeeker struct {
+	ctx context.Context
+	io.ReadSeeker
+}
+
+func (c *contextReadSeeker) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := c.ReadSeeker.Read(p)
+	if throttleErr := utils.Throttle(c.ctx, n); throttleErr != nil {
+		return n, throttleErr
+	}
+	return n, err
+}
@@ -0,0 +1,938 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dogestry/config"
+	"dogestry/utils"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// the keys ssh tries when none is given, in its order
+var sshDefaultKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// Files are written under a temporary name and renamed into place, so
+// that nobody reads half a file. Conditional writes hold a lock file.
+// Listings skip both.
+const (
+	sftpTempMarker = ".dogestry-tmp-"
+	sftpLockSuffix = ".dogestry-lock"
+)
+
+// how long a lock is honoured, after which it's taken to be left over by a
+// push that died. Its age is measured by the server's clock, which needn't
+// agree with ours.
+const sftpLockTimeout = time.Minute
+
+const sshDialTimeout = 30 * time.Second
+
+// NewSFTPRemote returns a remote in a directory of an SSH server, reached
+// over SFTP. Paths are absolute, or relative to the user's home with /~/.
+func NewSFTPRemote(config config.Config) (*SFTPRemote, error) {
+	u := config.SSH.URL
+	if u == nil || u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, errors.New("invalid SSH remote, expected eg. ssh://user@host/path/")
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	if user == "" {
+		return nil, fmt.Errorf("no user in the SSH remote '%s', expected eg. ssh://user@host/path/", u.Redacted())
+	}
+
+	root := path.Clean("/" + u.Path)
+	if root == "/~" {
+		root = "."
+	} else if strings.HasPrefix(root, "/~/") {
+		root = strings.TrimPrefix(root, "/~/")
+	}
+
+	envelope, err := newEnvelope(config.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SFTPRemote{config: config, addr: addr, user: user, root: root, now: time.Now, retry: newRetryPolicy(config), envelope: envelope}, nil
+}
+
+type SFTPRemote struct {
+	config config.Config
+	// host:port
+	addr string
+	user string
+	// directory of the remote on the server, "." for the home
+	root string
+
+	// connected on first use, and again once the connection is lost
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+
+	// the local clock, lock ages are told by the server's
+	now func() time.Time
+
+	retry             RetryPolicy
+	journal           *Journal
+	expectedID        ID
+	overrideImmutable bool
+	// nil unless objects are encrypted
+	envelope *envelope
+}
+
+func (remote *SFTPRemote) Push(ctx context.Context, image, imageRoot string) error {
+	// the upload workers share the one connection
+	u := objectUploader{
+		store:             remote,
+		put:               remote.putFile,
+		config:            remote.config,
+		name:              "SFTP",
+		expectedID:        remote.expectedID,
+		overrideImmutable: remote.overrideImmutable,
+		envelope:          remote.envelope,
+	}
+	return u.pushImage(ctx, imageRoot)
+}
+
+// putFile uploads a file under a temporary name and renames it into place.
+func (remote *SFTPRemote) putFile(ctx context.Context, keyDef *uploadKeyDef) error {
+	name := remote.path(keyDef.key)
+
+	state := remote.journal.Upload(name, keyDef.sum)
+	if state.Done {
+		log.Printf("Key %s already uploaded", name)
+		return nil
+	}
+
+	f, err := os.Open(keyDef.fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = remote.withClient(ctx, "upload "+name, func(client *sftp.Client) error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return writeRemoteFile(client, name, utils.NewLimitedReader(ctx, utils.NewProgressReader(f, info.Size(), keyDef.fullPath)))
+	})
+	if err != nil {
+		return err
+	}
+
+	return remote.journal.SetUpload(name, UploadState{Sum: keyDef.sum, Done: true})
+}
+
+// pull a single image from the remote
+func (remote *SFTPRemote) PullImageId(ctx context.Context, id ID, dst string) error {
+	prefix := "images/" + string(id) + "/"
+	objects, err := listObjects(ctx, remote, prefix)
+	if err != nil {
+		return err
+	}
+
+	d := objectDownloader{store: remote, fetch: remote.fetch, retry: remote.retry, journal: remote.journal, envelope: remote.envelope}
+	return d.pullImage(ctx, prefix, objects, dst)
+}
+
+// map repo:tag to id (like git rev-parse)
+func (remote *SFTPRemote) ParseTag(ctx context.Context, repo, tag string) (ID, error) {
+	id, _, err := readTag(ctx, remote, repo, tag)
+	return id, err
+}
+
+// map a ref-like to id. "ref-like" could be a ref or an id.
+func (remote *SFTPRemote) ResolveImageNameToId(ctx context.Context, image string) (ID, error) {
+	return ResolveImageNameToId(ctx, remote, image)
+}
+
+func (remote *SFTPRemote) ImageFullId(ctx context.Context, id ID) (ID, error) {
+	if fullID, ok := catalogFullID(ctx, remote, id); ok {
+		return fullID, nil
+	}
+
+	objects, err := listObjects(ctx, remote, "images/")
+	if err != nil {
+		return "", err
+	}
+
+	for _, object := range objects {
+		imageID := strings.SplitN(strings.TrimPrefix(object.Key, "images/"), "/", 2)[0]
+		if strings.HasPrefix(imageID, string(id)) {
+			return ID(imageID), nil
+		}
+	}
+
+	return "", ErrNoSuchImage
+}
+
+// Download the json file at images/{id}/json
+func (remote *SFTPRemote) ImageMetadata(ctx context.Context, id ID) (docker.Image, error) {
+	image := docker.Image{}
+
+	data, _, err := remote.getObject(ctx, "images/"+string(id)+"/json")
+	if err == errObjectNotFound {
+		return image, ErrNoSuchImage
+	} else if err != nil {
+		return image, err
+	}
+
+	err = json.Unmarshal(data, &image)
+	return image, err
+}
+
+// return repo, tag from a file path
+func (remote *SFTPRemote) ParseImagePath(path string, prefix string) (repo, tag string) {
+	return ParseImagePath(path, prefix)
+}
+
+// walk the image history on the remote, starting at id
+func (remote *SFTPRemote) WalkImages(ctx context.Context, id ID, walker ImageWalkFn) error {
+	return WalkImages(ctx, remote, id, walker)
+}
+
+// checks the config and connectivity of the remote
+func (remote *SFTPRemote) Validate(ctx context.Context) error {
+	err := remote.withClient(ctx, "check "+remote.root, func(client *sftp.Client) error {
+		info, err := client.Stat(remote.root)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s isn't a directory", remote.root)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s unable to reach the remote: %s", remote.Desc(), err)
+	}
+
+	if err := checkLayout(ctx, remote); err != nil {
+		return err
+	}
+
+	return checkEncryption(ctx, remote, remote.envelope)
+}
+
+// record transfer progress in journal
+func (remote *SFTPRemote) SetJournal(journal *Journal) {
+	remote.journal = journal
+}
+
+func (remote *SFTPRemote) SetExpectedID(id ID) {
+	remote.expectedID = id
+}
+
+func (remote *SFTPRemote) SetOverrideImmutable(override bool) {
+	remote.overrideImmutable = override
+}
+
+func (remote *SFTPRemote) Policy(ctx context.Context) (Policy, error) {
+	return readPolicy(ctx, remote)
+}
+
+func (remote *SFTPRemote) SetTag(ctx context.Context, repo, tag string, id ID) error {
+	return setTag(ctx, remote, repo, tag, id, remote.expectedID, remote.overrideImmutable)
+}
+
+func (remote *SFTPRemote) TagHistory(ctx context.Context, repo, tag string) ([]TagHistoryEntry, error) {
+	history, _, err := readTagHistory(ctx, remote, repo, tag)
+	return history, err
+}
+
+func (remote *SFTPRemote) PutTagMetadata(ctx context.Context, meta TagMetadata) error {
+	return putTagMetadata(ctx, remote, meta)
+}
+
+func (remote *SFTPRemote) TagMetadata(ctx context.Context, repo, tag string) (TagMetadata, error) {
+	return readTagMetadata(ctx, remote, repo, tag)
+}
+
+func (remote *SFTPRemote) Reindex(ctx context.Context) (*Catalog, error) {
+	return reindex(ctx, remote)
+}
+
+func (remote *SFTPRemote) Layout(ctx context.Context) (Layout, error) {
+	layout, _, err := readLayout(ctx, remote)
+	return layout, err
+}
+
+func (remote *SFTPRemote) Migrate(ctx context.Context, to int) error {
+	return migrate(ctx, remote, to)
+}
+
+// describe the remote
+func (remote *SFTPRemote) Desc() string {
+	return fmt.Sprintf("sftp(host=%s, user=%s, path=%s)", remote.addr, remote.user, remote.root)
+}
+
+// List images on the remote
+func (remote *SFTPRemote) List(ctx context.Context) ([]Image, error) {
+	if images, ok := listCatalog(ctx, remote); ok {
+		return images, nil
+	}
+
+	objects, err := listObjects(ctx, remote, "repositories/")
+	if err != nil {
+		return nil, err
+	}
+
+	var images []Image
+	for _, object := range objects {
+		repo, tag := ParseImagePath(object.Key, "repositories/")
+		images = append(images, Image{repo, tag})
+	}
+
+	return images, nil
+}
+
+// path is where key is on the server.
+func (remote *SFTPRemote) path(key string) string {
+	return path.Join(remote.root, key)
+}
+
+// key is the key of the file at p on the server.
+func (remote *SFTPRemote) key(p string) string {
+	switch {
+	case remote.root == ".":
+		return strings.TrimPrefix(p, "./")
+	case strings.HasSuffix(remote.root, "/"):
+		return strings.TrimPrefix(p, remote.root)
+	}
+	return strings.TrimPrefix(p, remote.root+"/")
+}
+
+// sftpClient returns the SFTP client of the connection to the server,
+// connecting if there's none.
+func (remote *SFTPRemote) sftpClient(ctx context.Context) (*sftp.Client, error) {
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+
+	if remote.client != nil {
+		return remote.client, nil
+	}
+
+	conn, err := dialSSH(ctx, remote.config, remote.addr, remote.user)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("starting SFTP on %s: %v", remote.addr, err)
+	}
+
+	remote.conn, remote.client = conn, client
+	return client, nil
+}
+
+// disconnect closes client if it's still the current one, so that the next
+// call connects again.
+func (remote *SFTPRemote) disconnect(client *sftp.Client) {
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+
+	if remote.client != client {
+		return
+	}
+
+	client.Close()
+	remote.conn.Close()
+	remote.conn, remote.client = nil, nil
+}
+
+// withClient calls fn with the SFTP client, retrying transient errors. A
+// lost connection is replaced before the next attempt.
+func (remote *SFTPRemote) withClient(ctx context.Context, desc string, fn func(client *sftp.Client) error) error {
+	return remote.retry.Do(ctx, desc, func() error {
+		client, err := remote.sftpClient(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = fn(client)
+		if err == sftp.ErrSSHFxConnectionLost || err == io.EOF {
+			remote.disconnect(client)
+		}
+		return err
+	})
+}
+
+// dialSSH connects to addr as user, checking the host's key against
+// known_hosts.
+func dialSSH(ctx context.Context, cfg config.Config, addr, user string) (*ssh.Client, error) {
+	hostKeyCallback, algorithms, err := sshHostKeyCallback(cfg, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	signers, agentConn, err := sshSigners(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if agentConn != nil {
+		// the agent signs during the handshake only
+		defer agentConn.Close()
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:              user,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: algorithms,
+		Timeout:           sshDialTimeout,
+	}
+
+	dialer := net.Dialer{Timeout: sshDialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(netConn, addr, clientConfig)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("connecting to %s: %v", addr, err)
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sshSigners returns the keys to log in with: the agent's, then those of
+// KeyFile or of ssh's default files. The caller closes the connection to
+// the agent, if any, once logged in.
+func sshSigners(cfg config.Config) ([]ssh.Signer, io.Closer, error) {
+	var signers []ssh.Signer
+	var agentConn net.Conn
+
+	if cfg.SSH.AgentSocket != "" {
+		conn, err := net.Dial("unix", cfg.SSH.AgentSocket)
+		if err != nil {
+			log.Printf("Warning: unable to reach the SSH agent: %v", err)
+		} else {
+			agentSigners, err := agent.NewClient(conn).Signers()
+			if err != nil {
+				conn.Close()
+				return nil, nil, fmt.Errorf("listing the keys of the SSH agent: %v", err)
+			}
+			signers, agentConn = agentSigners, conn
+		}
+	}
+
+	if cfg.SSH.KeyFile != "" {
+		signer, err := readSSHKey(cfg.SSH.KeyFile)
+		if err != nil {
+			if agentConn != nil {
+				agentConn.Close()
+			}
+			return nil, nil, err
+		}
+		signers = append(signers, signer)
+	} else if home := os.Getenv("HOME"); home != "" {
+		for _, name := range sshDefaultKeys {
+			// like ssh, keys that can't be used are skipped
+			if signer, err := readSSHKey(filepath.Join(home, ".ssh", name)); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+
+	if len(signers) == 0 {
+		return nil, nil, errors.New("no SSH keys found, add one to ssh-agent or set the key parameter of the remote's URL")
+	}
+
+	if agentConn == nil {
+		return signers, nil, nil
+	}
+	return signers, agentConn, nil
+}
+
+func readSSHKey(name string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("SSH key %s is encrypted, add it to ssh-agent instead", name)
+	} else if err != nil {
+		return nil, fmt.Errorf("SSH key %s: %v", name, err)
+	}
+
+	return signer, nil
+}
+
+// sshHostKeyCallback checks host keys against KnownHostsFile, and returns
+// the algorithms of the keys it has for addr so that the server presents
+// one of those.
+func sshHostKeyCallback(cfg config.Config, addr string) (ssh.HostKeyCallback, []string, error) {
+	file := cfg.SSH.KnownHostsFile
+	if file == "" {
+		file = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(file)
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("%s doesn't exist, add the key of %s to it, eg. with ssh-keyscan", file, addr)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	check := func(hostname string, remoteAddr net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remoteAddr, key)
+		if keyErr, ok := err.(*knownhosts.KeyError); ok {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("%s isn't in %s, add its key %s after checking it, eg. with ssh-keyscan", hostname, file, ssh.FingerprintSHA256(key))
+			}
+			return fmt.Errorf("the key of %s doesn't match the one in %s, it was changed or someone is intercepting the connection", hostname, file)
+		}
+		return err
+	}
+
+	return check, knownHostKeyAlgorithms(callback, addr), nil
+}
+
+// knownHostKeyAlgorithms asks callback about a key nobody has, for the
+// error to list the keys known for addr.
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, addr string) []string {
+	err := callback(addr, &net.TCPAddr{IP: net.IPv4zero}, unknownHostKey{})
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, known.Key.Type())
+		}
+	}
+	return algorithms
+}
+
+type unknownHostKey struct{}
+
+func (unknownHostKey) Type() string                                 { return "unknown" }
+func (unknownHostKey) Marshal() []byte                              { return []byte{} }
+func (unknownHostKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("unknown key") }
+
+// writeRemoteFile writes r to name under a temporary name, and renames it
+// into place once complete.
+func writeRemoteFile(client *sftp.Client, name string, r io.Reader) error {
+	if err := client.MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+
+	tmp, err := sftpTempName(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.ReadFrom(r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = client.PosixRename(tmp, name)
+	}
+	if err != nil {
+		client.Remove(tmp)
+	}
+	return err
+}
+
+func sftpTempName(name string) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return name + sftpTempMarker + hex.EncodeToString(suffix), nil
+}
+
+// lockRemoteFile takes the lock of name, waiting for whoever holds it, and
+// returns the function that releases it. Locks older than sftpLockTimeout
+// are broken.
+func lockRemoteFile(ctx context.Context, client *sftp.Client, name string, now func() time.Time) (func(), error) {
+	lock := name + sftpLockSuffix
+	if err := client.MkdirAll(path.Dir(name)); err != nil {
+		return nil, err
+	}
+
+	// how far the server's clock is ahead of ours, once a lock is held
+	var offset *time.Duration
+	for {
+		holder, err := createRemoteLock(client, lock)
+		if err != nil {
+			return nil, err
+		}
+		if holder == nil {
+			return func() { client.Remove(lock) }, nil
+		}
+
+		if offset == nil {
+			d, err := serverClockOffset(client, name, now)
+			if err != nil {
+				return nil, err
+			}
+			offset = &d
+		}
+
+		serverNow := now().Add(*offset)
+		if serverNow.Sub(holder.ModTime()) > sftpLockTimeout {
+			if err := breakRemoteLock(client, name, holder, serverNow); err != nil {
+				return nil, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// serverClockOffset returns how far the clock of the server is ahead of
+// now, going by the time it gives a file it writes next to name.
+func serverClockOffset(client *sftp.Client, name string, now func() time.Time) (time.Duration, error) {
+	probe, err := sftpTempName(name)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := client.Create(probe)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Remove(probe)
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	info, err := client.Stat(probe)
+	if err != nil {
+		return 0, err
+	}
+	return info.ModTime().Sub(now()), nil
+}
+
+// createRemoteLock creates the lock file lock. It returns nil once it's
+// created, or the info of the lock someone else holds.
+func createRemoteLock(client *sftp.Client, lock string) (os.FileInfo, error) {
+	// servers report an existing file as a plain failure, so a failed
+	// create is only waited on if the lock is there
+	for attempt := 0; ; attempt++ {
+		f, err := client.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err == nil {
+			return nil, f.Close()
+		}
+
+		info, statErr := client.Stat(lock)
+		if statErr == nil {
+			return info, nil
+		}
+		if !os.IsNotExist(statErr) {
+			return nil, statErr
+		}
+
+		// the lock may have been released in between, so try once more
+		// before taking the create to have failed
+		if attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// breakRemoteLock removes the lock of name, seen as stale at now on the
+// server's clock, unless it's been taken again since. Breakers hold a lock of
+// their own, so that the second of two can't remove the lock the first took
+// after breaking it.
+func breakRemoteLock(client *sftp.Client, name string, stale os.FileInfo, now time.Time) error {
+	lock := name + sftpLockSuffix
+	breaker := name + ".break" + sftpLockSuffix
+
+	holder, err := createRemoteLock(client, breaker)
+	if err != nil {
+		return err
+	}
+	if holder != nil {
+		// someone else is breaking it, or died doing so
+		if now.Sub(holder.ModTime()) > sftpLockTimeout {
+			client.Remove(breaker)
+		}
+		return nil
+	}
+	defer client.Remove(breaker)
+
+	info, err := client.Stat(lock)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().Equal(stale.ModTime()) {
+		return nil
+	}
+
+	log.Printf("Breaking the lock of %s, taken at %s", name, stale.ModTime().Format(time.RFC3339))
+	return client.Remove(lock)
+}
+
+// fetch streams the content of key from offset on, as stored.
+func (remote *SFTPRemote) fetch(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	var f *sftp.File
+	err := remote.withClient(ctx, "open "+key, func(client *sftp.Client) (err error) {
+		f, err = client.Open(remote.path(key))
+		if os.IsNotExist(err) {
+			return errObjectNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// getObject returns the content of key, and its sha1 for the ETag that
+// putObjectIf compares. The ETags of listings are the time the file was
+// written and its size, which is enough to resume downloads with.
+func (remote *SFTPRemote) getObject(ctx context.Context, key string) ([]byte, string, error) {
+	var data []byte
+	err := remote.withClient(ctx, "get "+key, func(client *sftp.Client) (err error) {
+		data, err = readRemoteFile(client, remote.path(key))
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	etag := sha1Hex(data)
+	data, err = remote.envelope.open(key, data)
+	return data, etag, err
+}
+
+func readRemoteFile(client *sftp.Client, name string) ([]byte, error) {
+	f, err := client.Open(name)
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	_, err = f.WriteTo(&buf)
+	return buf.Bytes(), err
+}
+
+func sha1Hex(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (remote *SFTPRemote) putObject(ctx context.Context, key string, data []byte) error {
+	data, err := remote.envelope.sealObject(key, data)
+	if err != nil {
+		return err
+	}
+
+	return remote.withClient(ctx, "put "+key, func(client *sftp.Client) error {
+		return writeRemoteFile(client, remote.path(key), bytes.NewReader(data))
+	})
+}
+
+// putObjectIf compares the sha1 of the file with etag and replaces it while
+// holding the file's lock. Writers that don't take the lock, like
+// putObject, aren't held back by it.
+func (remote *SFTPRemote) putObjectIf(ctx context.Context, key string, data []byte, etag string) error {
+	data, err := remote.envelope.sealObject(key, data)
+	if err != nil {
+		return err
+	}
+
+	name := remote.path(key)
+	return remote.withClient(ctx, "put "+key, func(client *sftp.Client) error {
+		unlock, err := lockRemoteFile(ctx, client, name, remote.now)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		current, err := readRemoteFile(client, name)
+		switch {
+		case err == errObjectNotFound:
+			if etag != "" {
+				return errPreconditionFailed
+			}
+		case err != nil:
+			return err
+		case etag != sha1Hex(current):
+			return errPreconditionFailed
+		}
+
+		return writeRemoteFile(client, name, bytes.NewReader(data))
+	})
+}
+
+func (remote *SFTPRemote) statObject(ctx context.Context, key string) (objectInfo, error) {
+	var object objectInfo
+	err := remote.withClient(ctx, "check "+key, func(client *sftp.Client) error {
+		info, err := client.Stat(remote.path(key))
+		if os.IsNotExist(err) {
+			return errObjectNotFound
+		} else if err != nil {
+			return err
+		}
+
+		object = sftpObjectInfo(key, info)
+		return nil
+	})
+	return object, err
+}
+
+func sftpObjectInfo(key string, info os.FileInfo) objectInfo {
+	return objectInfo{Key: key, Size: info.Size(), ETag: fmt.Sprintf("%x-%x", info.ModTime().Unix(), info.Size())}
+}
+
+func (remote *SFTPRemote) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, err := remote.fetch(ctx, key, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return remote.envelope.openReader(key, rc)
+}
+
+// copyObject hard links src to a temporary name and renames that to dst,
+// files are never written in place. Servers without hard links get a copy
+// through the client.
+func (remote *SFTPRemote) copyObject(ctx context.Context, src, dst string) error {
+	srcPath, dstPath := remote.path(src), remote.path(dst)
+
+	return remote.withClient(ctx, "copy "+src+" to "+dst, func(client *sftp.Client) error {
+		if err := client.MkdirAll(path.Dir(dstPath)); err != nil {
+			return err
+		}
+
+		tmp, err := sftpTempName(dstPath)
+		if err != nil {
+			return err
+		}
+
+		if err := client.Link(srcPath, tmp); err == nil {
+			if err := client.PosixRename(tmp, dstPath); err != nil {
+				client.Remove(tmp)
+				return err
+			}
+			return nil
+		}
+
+		f, err := client.Open(srcPath)
+		if os.IsNotExist(err) {
+			return errObjectNotFound
+		} else if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return writeRemoteFile(client, dstPath, f)
+	})
+}
+
+func (remote *SFTPRemote) deleteObject(ctx context.Context, key string) error {
+	return remote.withClient(ctx, "delete "+key, func(client *sftp.Client) error {
+		err := client.Remove(remote.path(key))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// listPage walks the directories under prefix and lists all of their
+// files at once.
+func (remote *SFTPRemote) listPage(ctx context.Context, prefix, marker string) ([]objectInfo, string, error) {
+	dir := remote.path(prefix[:strings.LastIndex(prefix, "/")+1])
+
+	var objects []objectInfo
+	err := remote.withClient(ctx, "list "+prefix, func(client *sftp.Client) error {
+		objects = nil
+
+		walker := client.Walk(dir)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				if os.IsNotExist(err) && walker.Path() == dir {
+					return nil
+				}
+				return err
+			}
+
+			info := walker.Stat()
+			if info.IsDir() || strings.Contains(info.Name(), sftpTempMarker) || strings.HasSuffix(info.Name(), sftpLockSuffix) {
+				continue
+			}
+
+			key := remote.key(walker.Path())
+			if strings.HasPrefix(key, prefix) {
+				objects = append(objects, sftpObjectInfo(key, info))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, "", nil
+}
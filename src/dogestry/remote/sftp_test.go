@@ -0,0 +1,382 @@
+package remote
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"dogestry/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	. "gopkg.in/check.v1"
+)
+
+type SFTPSuite struct {
+	fake *fakeSFTP
+	// served by the fake, its working directory
+	home      string
+	cfg       config.Config
+	imageRoot string
+}
+
+var _ = Suite(&SFTPSuite{})
+
+func (s *SFTPSuite) SetUpTest(c *C) {
+	s.home = c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(s.home, "team-a"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.home, "team-a", LayoutKey), []byte(`{"version": 3}`), 0644), IsNil)
+
+	var err error
+	s.fake, err = newFakeSFTP(s.home)
+	c.Assert(err, IsNil)
+
+	dir := c.MkDir()
+	s.cfg = config.Config{}
+	s.cfg.SSH.KnownHostsFile, err = s.fake.knownHosts(dir, nil)
+	c.Assert(err, IsNil)
+	s.cfg.SSH.KeyFile, err = s.fake.keyFile(dir)
+	c.Assert(err, IsNil)
+	s.cfg.Retry.Attempts, s.cfg.Retry.BaseDelay, s.cfg.Retry.MaxDelay = 3, time.Millisecond, 10*time.Millisecond
+	c.Assert(s.cfg.SetSSHURL("ssh://docker@"+s.fake.Addr()+"/~/team-a/"), IsNil)
+
+	s.imageRoot = filepath.Join(c.MkDir(), "image")
+	files := map[string]string{
+		"images/" + pushImageId + "/json":      `{"id":"` + pushImageId + `"}`,
+		"images/" + pushImageId + "/layer.tar": "layer contents",
+		"images/" + pushImageId + "/VERSION":   "1.0",
+		"repositories/app/latest":              pushImageId,
+	}
+	for name, content := range files {
+		path := filepath.Join(s.imageRoot, name)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+	}
+}
+
+func (s *SFTPSuite) TearDownTest(c *C) {
+	s.fake.Close()
+}
+
+func (s *SFTPSuite) remote(c *C) *SFTPRemote {
+	remote, err := NewSFTPRemote(s.cfg)
+	c.Assert(err, IsNil)
+	c.Assert(remote.Validate(context.Background()), IsNil)
+	return remote
+}
+
+// stored returns the content of a file of the remote on the server.
+func (s *SFTPSuite) stored(name string) (string, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(s.home, "team-a", name))
+	return string(data), err == nil
+}
+
+func (s *SFTPSuite) TestPushPull(c *C) {
+	ctx := context.Background()
+	remote := s.remote(c)
+	c.Assert(remote.Desc(), Equals, "sftp(host="+s.fake.Addr()+", user=docker, path=team-a)")
+
+	c.Assert(remote.Push(ctx, "app:latest", s.imageRoot), IsNil)
+
+	tag, ok := s.stored("repositories/app/latest")
+	c.Assert(ok, Equals, true)
+	c.Assert(tag, Equals, pushImageId)
+	_, ok = s.stored(blobKey(digestOf(c, "layer contents")) + ".gz")
+	c.Assert(ok, Equals, true)
+
+	// nothing left behind by the uploads
+	err := filepath.Walk(s.home, func(path string, info os.FileInfo, err error) error {
+		c.Assert(err, IsNil)
+		c.Assert(path, Not(Matches), ".*"+sftpTempMarker+".*")
+		c.Assert(path, Not(Matches), ".*"+sftpLockSuffix)
+		return nil
+	})
+	c.Assert(err, IsNil)
+
+	images, err := remote.List(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(images, DeepEquals, []Image{{"app", "latest"}})
+
+	id, err := remote.ImageFullId(ctx, ID(pushImageId[:12]))
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID(pushImageId))
+
+	// with and without a journal
+	for _, journal := range []bool{false, true} {
+		r := s.remote(c)
+		if journal {
+			j, err := OpenJournal(filepath.Join(c.MkDir(), "pull.journal"), r.Desc())
+			c.Assert(err, IsNil)
+			r.SetJournal(j)
+		}
+
+		id, err := r.ParseTag(ctx, "app", "latest")
+		c.Assert(err, IsNil)
+		c.Assert(id, Equals, ID(pushImageId))
+
+		dst := filepath.Join(c.MkDir(), pushImageId)
+		c.Assert(r.PullImageId(ctx, id, dst), IsNil)
+
+		layer, err := ioutil.ReadFile(filepath.Join(dst, "layer.tar"))
+		c.Assert(err, IsNil)
+		c.Assert(string(layer), Equals, "layer contents")
+	}
+
+	// the uploads shared the one connection
+	c.Assert(s.fake.logins, Equals, 3)
+}
+
+func (s *SFTPSuite) TestAbsolutePath(c *C) {
+	c.Assert(s.cfg.SetSSHURL("ssh://docker@"+s.fake.Addr()+filepath.Join(s.home, "team-a")), IsNil)
+	remote := s.remote(c)
+	c.Assert(remote.Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+
+	tag, _ := s.stored("repositories/app/latest")
+	c.Assert(tag, Equals, pushImageId)
+}
+
+func (s *SFTPSuite) TestTags(c *C) {
+	ctx := context.Background()
+	remote := s.remote(c)
+	c.Assert(remote.Push(ctx, "app:latest", s.imageRoot), IsNil)
+
+	c.Assert(remote.SetTag(ctx, "app", "prod", pushImageId), IsNil)
+	id, err := remote.ParseTag(ctx, "app", "prod")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ID(pushImageId))
+
+	history, err := remote.TagHistory(ctx, "app", "prod")
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 1)
+}
+
+func (s *SFTPSuite) TestConditionalWrites(c *C) {
+	ctx := context.Background()
+	remote := s.remote(c)
+
+	c.Assert(remote.putObjectIf(ctx, "docs/doc", []byte("one"), ""), IsNil)
+	c.Assert(remote.putObjectIf(ctx, "docs/doc", []byte("two"), ""), Equals, errPreconditionFailed)
+
+	data, etag, err := remote.getObject(ctx, "docs/doc")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "one")
+
+	c.Assert(remote.putObjectIf(ctx, "docs/doc", []byte("two"), etag), IsNil)
+	c.Assert(remote.putObjectIf(ctx, "docs/doc", []byte("three"), etag), Equals, errPreconditionFailed)
+
+	stored, _ := s.stored("docs/doc")
+	c.Assert(stored, Equals, "two")
+
+	// a lock left over by a push that died is broken once stale
+	lock := filepath.Join(s.home, "team-a", "docs", "doc"+sftpLockSuffix)
+	c.Assert(ioutil.WriteFile(lock, nil, 0644), IsNil)
+	stale := time.Now().Add(-2 * sftpLockTimeout)
+	c.Assert(os.Chtimes(lock, stale, stale), IsNil)
+
+	_, etag, err = remote.getObject(ctx, "docs/doc")
+	c.Assert(err, IsNil)
+	c.Assert(remote.putObjectIf(ctx, "docs/doc", []byte("three"), etag), IsNil)
+	_, err = os.Stat(lock)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// but a fresh one is waited for
+	c.Assert(ioutil.WriteFile(lock, nil, 0644), IsNil)
+	timeout, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	_, etag, err = remote.getObject(ctx, "docs/doc")
+	c.Assert(err, IsNil)
+	c.Assert(remote.putObjectIf(timeout, "docs/doc", []byte("four"), etag), Equals, context.DeadlineExceeded)
+
+	objects, err := listObjects(ctx, remote, "docs/")
+	c.Assert(err, IsNil)
+	c.Assert(objects, HasLen, 1)
+	c.Assert(objects[0].Key, Equals, "docs/doc")
+	c.Assert(objects[0].Size, Equals, int64(5))
+
+	c.Assert(remote.deleteObject(ctx, "docs/doc"), IsNil)
+	c.Assert(remote.deleteObject(ctx, "docs/doc"), IsNil)
+	_, _, err = remote.getObject(ctx, "docs/doc")
+	c.Assert(err, Equals, errObjectNotFound)
+}
+
+func (s *SFTPSuite) TestLock(c *C) {
+	ctx := context.Background()
+	remote := s.remote(c)
+	name := remote.path("docs/doc")
+	lock := filepath.Join(s.home, "team-a", "docs", "doc"+sftpLockSuffix)
+	c.Assert(os.MkdirAll(filepath.Dir(lock), 0755), IsNil)
+
+	err := remote.withClient(ctx, "lock", func(client *sftp.Client) error {
+		// a lock that was taken again isn't broken
+		c.Assert(ioutil.WriteFile(lock, nil, 0644), IsNil)
+		stale, err := client.Stat(name + sftpLockSuffix)
+		c.Assert(err, IsNil)
+		fresh := stale.ModTime().Add(2 * sftpLockTimeout)
+		c.Assert(os.Chtimes(lock, fresh, fresh), IsNil)
+
+		c.Assert(breakRemoteLock(client, name, stale, time.Now()), IsNil)
+		_, err = os.Stat(lock)
+		c.Assert(err, IsNil)
+
+		// nor is one somebody else is breaking
+		breaker := filepath.Join(s.home, "team-a", "docs", "doc.break"+sftpLockSuffix)
+		c.Assert(ioutil.WriteFile(breaker, nil, 0644), IsNil)
+		stale, err = client.Stat(name + sftpLockSuffix)
+		c.Assert(err, IsNil)
+		c.Assert(breakRemoteLock(client, name, stale, time.Now()), IsNil)
+		_, err = os.Stat(lock)
+		c.Assert(err, IsNil)
+		c.Assert(os.Remove(breaker), IsNil)
+
+		c.Assert(breakRemoteLock(client, name, stale, time.Now()), IsNil)
+		_, err = os.Stat(lock)
+		c.Assert(os.IsNotExist(err), Equals, true)
+		_, err = os.Stat(breaker)
+		c.Assert(os.IsNotExist(err), Equals, true)
+
+		// a lock that can't be created isn't waited for
+		c.Assert(os.Symlink(filepath.Join(s.home, "missing"), lock), IsNil)
+		timeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		_, err = lockRemoteFile(timeout, client, name, time.Now)
+		c.Assert(err, NotNil)
+		c.Assert(err, Not(Equals), context.DeadlineExceeded)
+		return nil
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *SFTPSuite) TestLockClockSkew(c *C) {
+	ctx := context.Background()
+	remote := s.remote(c)
+	c.Assert(remote.putObject(ctx, "docs/doc", []byte("one")), IsNil)
+	lock := filepath.Join(s.home, "team-a", "docs", "doc"+sftpLockSuffix)
+
+	// the server's clock is behind ours, so a lock just taken looks old
+	remote.now = func() time.Time { return time.Now().Add(2 * sftpLockTimeout) }
+	c.Assert(ioutil.WriteFile(lock, nil, 0644), IsNil)
+	_, etag, err := remote.getObject(ctx, "docs/doc")
+	c.Assert(err, IsNil)
+	timeout, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	c.Assert(remote.putObjectIf(timeout, "docs/doc", []byte("two"), etag), Equals, context.DeadlineExceeded)
+	_, err = os.Stat(lock)
+	c.Assert(err, IsNil)
+
+	// it's ahead, so a lock left over a while ago looks new
+	remote.now = func() time.Time { return time.Now().Add(-2 * sftpLockTimeout) }
+	stale := time.Now().Add(-2 * sftpLockTimeout)
+	c.Assert(os.Chtimes(lock, stale, stale), IsNil)
+	c.Assert(remote.putObjectIf(ctx, "docs/doc", []byte("two"), etag), IsNil)
+	_, err = os.Stat(lock)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *SFTPSuite) TestList(c *C) {
+	ctx := context.Background()
+	remote := s.remote(c)
+
+	for _, name := range []string{"images/aaaa/json", "images/bbbb/json", "images/bbbb/layer.tar"} {
+		c.Assert(remote.putObject(ctx, name, []byte("{}")), IsNil)
+	}
+	// outside of the remote's directory
+	c.Assert(ioutil.WriteFile(filepath.Join(s.home, "json"), nil, 0644), IsNil)
+
+	objects, err := listObjects(ctx, remote, "images/b")
+	c.Assert(err, IsNil)
+	c.Assert(objects, HasLen, 2)
+	c.Assert(objects[0].Key, Equals, "images/bbbb/json")
+	c.Assert(objects[1].Key, Equals, "images/bbbb/layer.tar")
+
+	objects, err = listObjects(ctx, remote, "repositories/")
+	c.Assert(err, IsNil)
+	c.Assert(objects, HasLen, 0)
+}
+
+func (s *SFTPSuite) TestMigrate(c *C) {
+	ctx := context.Background()
+	remote := s.remote(c)
+	c.Assert(remote.putObject(ctx, LayoutKey, []byte(`{"version": 1}`)), IsNil)
+	c.Assert(remote.putObject(ctx, "images/aaaa/json", []byte(`{"id":"aaaa"}`)), IsNil)
+	c.Assert(remote.putObject(ctx, "images/aaaa/layer.tar", []byte("same layer")), IsNil)
+
+	c.Assert(remote.Migrate(ctx, 2), IsNil)
+
+	// the layer was moved to its blob
+	digest := digestOf(c, "same layer")
+	blob, ok := s.stored(blobKey(digest))
+	c.Assert(ok, Equals, true)
+	c.Assert(blob, Equals, "same layer")
+	_, ok = s.stored("images/aaaa/layer.tar")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *SFTPSuite) TestReconnect(c *C) {
+	ctx := context.Background()
+	remote := s.remote(c)
+
+	s.fake.drop()
+	c.Assert(remote.Push(ctx, "app:latest", s.imageRoot), IsNil)
+	c.Assert(s.fake.logins, Equals, 2)
+}
+
+func (s *SFTPSuite) TestAgent(c *C) {
+	var err error
+	s.cfg.SSH.KeyFile = ""
+	s.cfg.SSH.AgentSocket, err = s.fake.agent(c.MkDir())
+	c.Assert(err, IsNil)
+
+	c.Assert(s.remote(c).Push(context.Background(), "app:latest", s.imageRoot), IsNil)
+	c.Assert(s.fake.users, DeepEquals, []string{"docker"})
+}
+
+func (s *SFTPSuite) TestKeyFile(c *C) {
+	ctx := context.Background()
+
+	// keys the server doesn't know are refused
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	der, err := x509.MarshalPKCS8PrivateKey(other)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(s.cfg.SSH.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600), IsNil)
+
+	remote, err := NewSFTPRemote(s.cfg)
+	c.Assert(err, IsNil)
+	c.Assert(remote.Validate(ctx), ErrorMatches, ".*unable to authenticate.*")
+
+	// and files that aren't keys are errors
+	c.Assert(ioutil.WriteFile(s.cfg.SSH.KeyFile, []byte("not a key"), 0600), IsNil)
+	c.Assert(remote.Validate(ctx), ErrorMatches, ".*SSH key .*id_ed25519: .*")
+}
+
+func (s *SFTPSuite) TestHostKeys(c *C) {
+	ctx := context.Background()
+
+	// unknown hosts are refused
+	c.Assert(ioutil.WriteFile(s.cfg.SSH.KnownHostsFile, nil, 0600), IsNil)
+	remote, err := NewSFTPRemote(s.cfg)
+	c.Assert(err, IsNil)
+	c.Assert(remote.Validate(ctx), ErrorMatches, ".* isn't in .*known_hosts, add its key SHA256:.*")
+
+	// as are keys that changed
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	otherPub, err := ssh.NewPublicKey(other.Public())
+	c.Assert(err, IsNil)
+	_, err = s.fake.knownHosts(filepath.Dir(s.cfg.SSH.KnownHostsFile), otherPub)
+	c.Assert(err, IsNil)
+	c.Assert(remote.Validate(ctx), ErrorMatches, ".*the key of .* doesn't match the one in .*known_hosts.*")
+
+	// and there's no connecting without known_hosts
+	s.cfg.SSH.KnownHostsFile = filepath.Join(c.MkDir(), "known_hosts")
+	remote, err = NewSFTPRemote(s.cfg)
+	c.Assert(err, IsNil)
+	c.Assert(remote.Validate(ctx), ErrorMatches, ".*known_hosts doesn't exist, .*ssh-keyscan")
+	c.Assert(s.fake.logins, Equals, 0)
+}
@@ -0,0 +1,121 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// errObjectNotFound is returned by objectStore for missing keys.
+var errObjectNotFound = errors.New("object not found")
+
+// objectInfo describes an object found by listing a remote.
+type objectInfo struct {
+	// relative to the root of the remote
+	Key  string
+	Size int64
+	ETag string
+}
+
+// objectStore is the access to small documents, like tags, the policy and
+// tag history, and to listings that code shared by the remotes needs. Keys
+// are relative to the root of the remote.
+type objectStore interface {
+	// getObject returns the content of key and its ETag.
+	getObject(ctx context.Context, key string) ([]byte, string, error)
+
+	// putObject writes key unconditionally.
+	putObject(ctx context.Context, key string, data []byte) error
+
+	// putObjectIf writes key only if it still has etag, or doesn't exist
+	// for an empty etag. Otherwise it fails with errPreconditionFailed.
+	putObjectIf(ctx context.Context, key string, data []byte, etag string) error
+
+	// statObject describes key.
+	statObject(ctx context.Context, key string) (objectInfo, error)
+
+	// openObject streams the content of key, for objects too large to
+	// read with getObject.
+	openObject(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// copyObject copies src to dst on the backend.
+	copyObject(ctx context.Context, src, dst string) error
+
+	// deleteObject removes key. Removing a missing key isn't an error.
+	deleteObject(ctx context.Context, key string) error
+
+	// listPage returns a page of the objects whose key starts with prefix,
+	// starting after marker, and the marker of the next page. The next
+	// marker is empty after the last page.
+	listPage(ctx context.Context, prefix, marker string) ([]objectInfo, string, error)
+}
+
+// objectIterator goes through the objects under a prefix page by page, so
+// that listing a large remote doesn't stop at the backend's page size.
+//
+//	it := newObjectIterator(ctx, store, "images/")
+//	for it.Next() {
+//		object := it.Object()
+//	}
+//	if err := it.Err(); err != nil {
+type objectIterator struct {
+	ctx    context.Context
+	store  objectStore
+	prefix string
+
+	page   []objectInfo
+	marker string
+	last   bool
+
+	object objectInfo
+	err    error
+}
+
+func newObjectIterator(ctx context.Context, store objectStore, prefix string) *objectIterator {
+	return &objectIterator{ctx: ctx, store: store, prefix: prefix}
+}
+
+// Next moves to the next object, fetching the next page when needed. It
+// returns false at the end of the listing or on an error.
+func (it *objectIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.last || it.err != nil {
+			return false
+		}
+
+		if it.err = it.ctx.Err(); it.err != nil {
+			return false
+		}
+
+		it.page, it.marker, it.err = it.store.listPage(it.ctx, it.prefix, it.marker)
+		if it.err != nil {
+			return false
+		}
+		it.last = it.marker == ""
+	}
+
+	it.object, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Object is the current object.
+func (it *objectIterator) Object() objectInfo {
+	return it.object
+}
+
+// Err is the error that ended the listing, if any.
+func (it *objectIterator) Err() error {
+	return it.err
+}
+
+// listObjects returns every object whose key starts with prefix.
+func listObjects(ctx context.Context, store objectStore, prefix string) ([]objectInfo, error) {
+	var objects []objectInfo
+
+	it := newObjectIterator(ctx, store, prefix)
+	for it.Next() {
+		objects = append(objects, it.Object())
+	}
+
+	return objects, it.Err()
+}
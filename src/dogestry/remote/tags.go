@@ -0,0 +1,255 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+)
+
+// storeRemote is a Remote whose documents can be read and written through
+// objectStore, which goes for all of them.
+type storeRemote interface {
+	Remote
+	objectStore
+}
+
+// tagRef is a tag being pointed at ID.
+type tagRef struct {
+	Repo string
+	Tag  string
+	ID   ID
+
+	// set by checkImmutableTags when the tag is immutable: the pattern
+	// making it so, and what the tag pointed at when checked, with its ETag.
+	// The tag is then only written while it's still unchanged.
+	immutable string
+	checked   ID
+	etag      string
+}
+
+// TagHistoryEntry records one move of a tag.
+type TagHistoryEntry struct {
+	Time time.Time `json:"time"`
+	// empty when the tag was created
+	Old ID `json:"old,omitempty"`
+	New ID `json:"new"`
+	// user and machine dogestry ran as
+	User string `json:"user,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
+// how often appending to a tag's history is retried when a concurrent
+// update got there first
+const historyAttempts = 5
+
+func tagKey(repo, tag string) string {
+	return path.Join("repositories", repo, tag)
+}
+
+// every tag has its history in a JSON array, oldest entry first
+func historyKey(repo, tag string) string {
+	return path.Join("history", repo, tag+".json")
+}
+
+// readTagFiles reads the tags being pushed from tagFiles, local tag files
+// by key.
+func readTagFiles(tagFiles map[string]string) ([]tagRef, error) {
+	var tags []tagRef
+	for key, file := range tagFiles {
+		id, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		repo, tag := ParseImagePath(key, "repositories/")
+		tags = append(tags, tagRef{Repo: repo, Tag: tag, ID: ID(id)})
+	}
+
+	return tags, nil
+}
+
+// readTag returns what repo:tag points at and the ETag of the tag object,
+// both empty if the tag doesn't exist.
+func readTag(ctx context.Context, store objectStore, repo, tag string) (ID, string, error) {
+	data, etag, err := store.getObject(ctx, tagKey(repo, tag))
+	if err == errObjectNotFound {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	// Azure tags used to be written with a null terminator
+	return ID(strings.TrimRight(string(data), "\x00")), etag, nil
+}
+
+// setTag points a single tag at id, with the same checks as Push.
+func setTag(ctx context.Context, r storeRemote, repo, tag string, id ID, expected ID, overrideImmutable bool) error {
+	tags := []tagRef{{Repo: repo, Tag: tag, ID: id}}
+
+	if !overrideImmutable {
+		if err := checkImmutableTags(ctx, r, tags); err != nil {
+			return err
+		}
+	}
+
+	return writeTags(ctx, r, tags, expected)
+}
+
+// writeTags points every tag at its ID and records the move in the tag's
+// history, the catalog and the index. With expected set the tags are
+// compared and swapped, see Remote.SetExpectedID.
+func writeTags(ctx context.Context, store objectStore, tags []tagRef, expected ID) (err error) {
+	var written []tagRef
+	defer func() {
+		if err := catalogTags(ctx, store, written); err != nil {
+			log.Printf("Warning: unable to update %s: %v", CatalogKey, err)
+		}
+		if err := indexTags(ctx, store, written); err != nil {
+			log.Printf("Warning: unable to update %s: %v", IndexKey, err)
+		}
+	}()
+
+	for _, t := range tags {
+		old, err := writeTag(ctx, store, t, expected)
+		if err != nil {
+			return err
+		}
+		written = append(written, t)
+
+		if old == t.ID {
+			continue
+		}
+
+		// the tag has moved already, failing the command now would only
+		// make it look like it hadn't
+		if err := appendTagHistory(ctx, store, t.Repo, t.Tag, newHistoryEntry(old, t.ID)); err != nil {
+			log.Printf("Warning: unable to record history of %s:%s: %v", t.Repo, t.Tag, err)
+		}
+	}
+
+	return nil
+}
+
+// writeTag writes a single tag and returns what it pointed at before.
+func writeTag(ctx context.Context, store objectStore, t tagRef, expected ID) (ID, error) {
+	key := tagKey(t.Repo, t.Tag)
+
+	if t.immutable != "" {
+		return writeImmutableTag(ctx, store, t, expected)
+	}
+
+	if expected == "" {
+		old, _, err := readTag(ctx, store, t.Repo, t.Tag)
+		if err != nil {
+			return "", err
+		}
+
+		return old, store.putObject(ctx, key, []byte(t.ID))
+	}
+
+	if expected == ExpectNoTag {
+		log.Printf("Creating tag %s:%s if it doesn't exist", t.Repo, t.Tag)
+	} else {
+		log.Printf("Updating tag %s:%s if it points at %s", t.Repo, t.Tag, expected.Short())
+	}
+
+	var old ID
+	read := func() (id ID, etag string, err error) {
+		id, etag, err = readTag(ctx, store, t.Repo, t.Tag)
+		old = id
+		return id, etag, err
+	}
+
+	write := func(etag string) error {
+		return store.putObjectIf(ctx, key, []byte(t.ID), etag)
+	}
+
+	err := casTag(t.Repo, t.Tag, t.ID, expected, read, write)
+	return old, err
+}
+
+// writeImmutableTag writes a tag checked by checkImmutableTags over the
+// version it checked, so that a tag created or moved by a concurrent push in
+// between isn't overwritten.
+func writeImmutableTag(ctx context.Context, store objectStore, t tagRef, expected ID) (ID, error) {
+	if expected != "" && !tagMatches(t.checked, expected) {
+		return "", &TagConflictError{Repo: t.Repo, Tag: t.Tag, Expected: expected, Actual: t.checked}
+	}
+
+	err := store.putObjectIf(ctx, tagKey(t.Repo, t.Tag), []byte(t.ID), t.etag)
+	if err != errPreconditionFailed {
+		return t.checked, err
+	}
+
+	current, _, err := readTag(ctx, store, t.Repo, t.Tag)
+	if err != nil {
+		return "", err
+	}
+	// pushed concurrently with the same ID
+	if current == t.ID {
+		return t.ID, nil
+	}
+	return "", &ImmutableTagError{Repo: t.Repo, Tag: t.Tag, Pattern: t.immutable, Current: current}
+}
+
+func newHistoryEntry(old, new ID) TagHistoryEntry {
+	entry := TagHistoryEntry{Time: time.Now().UTC(), Old: old, New: new, User: currentUser()}
+	entry.Host, _ = os.Hostname()
+
+	return entry
+}
+
+// currentUser is the name of the user dogestry runs as, for the records it
+// keeps on the remote.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// readTagHistory returns the history of repo:tag, oldest first, and the
+// ETag of the history object.
+func readTagHistory(ctx context.Context, store objectStore, repo, tag string) ([]TagHistoryEntry, string, error) {
+	data, etag, err := store.getObject(ctx, historyKey(repo, tag))
+	if err == errObjectNotFound {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	var history []TagHistoryEntry
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, "", fmt.Errorf("invalid history for %s:%s: %v", repo, tag, err)
+	}
+
+	return history, etag, nil
+}
+
+// appendTagHistory adds entry to the history of repo:tag. Concurrent
+// appends are serialised with conditional writes.
+func appendTagHistory(ctx context.Context, store objectStore, repo, tag string, entry TagHistoryEntry) error {
+	for attempt := 1; ; attempt++ {
+		history, etag, err := readTagHistory(ctx, store, repo, tag)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(append(history, entry), "", "  ")
+		if err != nil {
+			return err
+		}
+
+		err = store.putObjectIf(ctx, historyKey(repo, tag), data, etag)
+		if err != errPreconditionFailed || attempt == historyAttempts {
+			return err
+		}
+	}
+}
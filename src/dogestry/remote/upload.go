@@ -0,0 +1,233 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"dogestry/config"
+	"dogestry/utils"
+)
+
+// objectUploader pushes images to a store whose files are uploaded one at a
+// time, each by put.
+type objectUploader struct {
+	store objectStore
+	// uploads the local file of keyDef as keyDef.key
+	put    func(ctx context.Context, keyDef *uploadKeyDef) error
+	config config.Config
+	// the kind of remote, for messages
+	name              string
+	expectedID        ID
+	overrideImmutable bool
+	// nil unless objects are encrypted
+	envelope *envelope
+}
+
+// uploadKeyDef is a local file to push.
+type uploadKeyDef struct {
+	// relative to the root of the remote
+	key      string
+	sum      string
+	fullPath string
+}
+
+type uploadKeys map[string]*uploadKeyDef
+
+// pushImage pushes the work dir at imageRoot: layers to their blobs, then
+// the image files, then tags.
+func (u objectUploader) pushImage(ctx context.Context, imageRoot string) error {
+	if u.envelope != nil {
+		if err := markEncrypted(ctx, u.store); err != nil {
+			return err
+		}
+	}
+
+	// before listing the files to push, as it adds layer.digest files
+	blobKeys, err := layerBlobKeys(ctx, u.store, imageRoot, u.config.Transfer.Compression)
+	if err != nil {
+		return err
+	}
+
+	keysToPush, err := localUploadKeys(imageRoot)
+	if err != nil {
+		return fmt.Errorf("error calculating keys to push: %v", err)
+	}
+
+	// layers go to their blob, or nowhere if it's there already
+	for key, dstKey := range blobKeys {
+		keyDef, ok := keysToPush[key]
+		if !ok {
+			continue
+		}
+
+		delete(keysToPush, key)
+		if dstKey != "" {
+			keyDef.key = dstKey
+			keysToPush[dstKey] = keyDef
+		}
+	}
+
+	if len(keysToPush) == 0 {
+		log.Println("There are no files to push")
+		return nil
+	}
+
+	tagFiles := make(map[string]string)
+	for key, keyDef := range keysToPush {
+		if publishPhase(key) == publishTags {
+			tagFiles[key] = keyDef.fullPath
+		}
+	}
+
+	tags, err := readTagFiles(tagFiles)
+	if err != nil {
+		return err
+	}
+
+	if !u.overrideImmutable {
+		if err := checkImmutableTags(ctx, u.store, tags); err != nil {
+			return err
+		}
+	}
+
+	if u.envelope != nil {
+		for _, keyDef := range keysToPush {
+			keyDef.fullPath, keyDef.sum, err = u.envelope.sealFile(keyDef.key, keyDef.fullPath, keyDef.sum)
+			if err != nil {
+				return fmt.Errorf("encrypting %s: %v", keyDef.key, err)
+			}
+		}
+	}
+
+	// Publish in phases so that nobody sees a tag before its layers: layer
+	// contents, then layer json, then tags. A failed phase stops the push and
+	// leaves the previous tag in place.
+	println("Pushing files to " + u.name + " remote:")
+	for phase := publishLayerData; phase < publishTags; phase++ {
+		phaseKeys := make(uploadKeys)
+		for key, keyDef := range keysToPush {
+			if publishPhase(key) == phase {
+				phaseKeys[key] = keyDef
+			}
+		}
+
+		if err := u.putFiles(ctx, phaseKeys); err != nil {
+			return err
+		}
+
+		if err := u.verifyUploaded(ctx, phaseKeys); err != nil {
+			return err
+		}
+	}
+
+	if err := catalogImages(ctx, u.store, imageRoot); err != nil {
+		log.Printf("Warning: unable to update %s: %v", CatalogKey, err)
+	}
+	if err := indexImages(ctx, u.store, imageRoot); err != nil {
+		log.Printf("Warning: unable to update %s: %v", IndexKey, err)
+	}
+
+	return writeTags(ctx, u.store, tags, u.expectedID)
+}
+
+// localUploadKeys lists the files of the work dir at root, with their sha1.
+func localUploadKeys(root string) (uploadKeys, error) {
+	localKeys := make(uploadKeys)
+
+	if !strings.HasSuffix(root, "/") {
+		root = root + "/"
+	}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// encrypted copies are pushed in place of the files they're made of
+		if info.IsDir() || strings.HasSuffix(path, sealedExt) {
+			return nil
+		}
+
+		sum, err := utils.Sha1File(path)
+		if err != nil {
+			return err
+		}
+
+		key := strings.TrimPrefix(path, root)
+		localKeys[key] = &uploadKeyDef{key: key, sum: sum, fullPath: path}
+		return nil
+	})
+
+	return localKeys, err
+}
+
+// putFiles uploads keysToPush with Transfer.UploadWorkers workers. The first
+// failure cancels the other uploads.
+func (u objectUploader) putFiles(ctx context.Context, keysToPush uploadKeys) error {
+	if len(keysToPush) == 0 {
+		return nil
+	}
+
+	// Cancelled on the first failure, so the other uploads are aborted too.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	keyDefs := make(chan *uploadKeyDef, len(keysToPush))
+	for _, keyDef := range keysToPush {
+		keyDefs <- keyDef
+	}
+	close(keyDefs)
+
+	// Buffered so workers never block once we've stopped reading results.
+	errs := make(chan error, len(keysToPush))
+
+	for i := 0; i < uploadWorkers(u.config); i++ {
+		go func() {
+			for keyDef := range keyDefs {
+				if err := ctx.Err(); err != nil {
+					errs <- err
+					continue
+				}
+
+				errs <- u.put(ctx, keyDef)
+			}
+		}()
+	}
+
+	for i := 0; i < len(keysToPush); i++ {
+		if err := <-errs; err != nil {
+			// Abort all running uploads
+			cancel()
+
+			log.Printf("error when uploading to %s: %v", u.name, err)
+			return fmt.Errorf("Error when uploading to %s: %v", u.name, err)
+		}
+	}
+
+	return nil
+}
+
+// verifyUploaded checks that every key made it to the remote with the size
+// of the local file.
+func (u objectUploader) verifyUploaded(ctx context.Context, uploaded uploadKeys) error {
+	for key, keyDef := range uploaded {
+		info, err := os.Stat(keyDef.fullPath)
+		if err != nil {
+			return err
+		}
+
+		object, err := u.store.statObject(ctx, key)
+		if err != nil {
+			return fmt.Errorf("verifying upload of %s: %v", key, err)
+		}
+
+		if object.Size != info.Size() {
+			return fmt.Errorf("verifying upload of %s: size on %s is %d, expected %d", key, u.name, object.Size, info.Size())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,5 @@
+// Package s3 is github.com/AdRoll/goamz/s3 at revision 0c4b4ec49d2d, forked
+// to add S3.Client: goamz dials every request with a transport of its own,
+// which can't be told to trust the CA bundle of an S3-compatible endpoint.
+// Keep it otherwise as upstream, so it can be updated from there.
+package s3
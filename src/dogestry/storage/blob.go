@@ -818,10 +818,20 @@ func (b BlobStorageClient) GetBlobSASURI(container, name string, expiry time.Tim
 		signedPermissions = permissions
 		blobURL           = b.GetBlobURL(container, name)
 	)
+	if b.client.sasToken != nil {
+		// its URLs carry its own token, whatever permissions and expiry
+		// were asked for
+		return "", errors.New("storage: a client authorized by a SAS token can't create others")
+	}
+
 	canonicalizedResource, err := b.client.buildCanonicalizedResource(blobURL)
 	if err != nil {
 		return "", err
 	}
+	if b.client.blobEndpoint != "" {
+		// the endpoint's path, eg. an emulator's account, isn't signed
+		canonicalizedResource = "/" + b.client.accountName + pathForBlob(container, name)
+	}
 	signedExpiry := expiry.Format(time.RFC3339)
 	signedResource := "b"
 
@@ -1,4 +1,10 @@
 // Package storage provides clients for Microsoft Azure Storage Services.
+//
+// It's github.com/MSOpenTech/azure-sdk-for-go/storage at revision
+// 99b5c364c7be, forked to authorize requests with a shared access signature
+// (NewSASClient) and to talk to a blob endpoint other than Azure's
+// (WithBlobEndpoint). Keep it otherwise as upstream, so it can be updated
+// from there.
 package storage
 
 import (
@@ -39,6 +45,10 @@ type Client struct {
 	useHTTPS    bool
 	baseURL     string
 	apiVersion  string
+	// blob service URL replacing <account>.blob.<baseURL>, eg. an emulator's
+	blobEndpoint string
+	// shared access signature authorizing requests instead of the key
+	sasToken url.Values
 }
 
 type storageResponse struct {
@@ -112,7 +122,47 @@ func NewClient(accountName, accountKey, blobServiceBaseURL, apiVersion string, u
 	}, nil
 }
 
+// NewSASClient constructs a Client authorizing its requests with a shared
+// access signature, eg. "sv=...&sig=...", rather than the account key.
+func NewSASClient(accountName, sasToken, blobServiceBaseURL, apiVersion string, useHTTPS bool) (Client, error) {
+	var c Client
+	if blobServiceBaseURL == "" {
+		return c, fmt.Errorf("azure: base storage service url required")
+	}
+
+	token, err := url.ParseQuery(strings.TrimPrefix(sasToken, "?"))
+	if err != nil {
+		return c, fmt.Errorf("azure: invalid SAS token: %v", err)
+	} else if token.Get("sig") == "" {
+		return c, fmt.Errorf("azure: SAS token has no signature")
+	}
+
+	return Client{
+		accountName: accountName,
+		useHTTPS:    useHTTPS,
+		baseURL:     blobServiceBaseURL,
+		apiVersion:  apiVersion,
+		sasToken:    token,
+	}, nil
+}
+
+// WithBlobEndpoint returns a copy of the client talking to the blob service
+// at endpoint, eg. http://127.0.0.1:10000/devstoreaccount1 for an emulator.
+func (c Client) WithBlobEndpoint(endpoint string) (Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c, fmt.Errorf("azure: invalid blob endpoint %s", endpoint)
+	}
+
+	c.blobEndpoint = strings.TrimSuffix(u.Scheme+"://"+u.Host+u.Path, "/")
+	return c, nil
+}
+
 func (c Client) getBaseURL(service string) string {
+	if service == blobServiceName && c.blobEndpoint != "" {
+		return c.blobEndpoint
+	}
+
 	scheme := "http"
 	if c.useHTTPS {
 		scheme = "https"
@@ -137,7 +187,10 @@ func (c Client) getEndpoint(service, path string, params url.Values) string {
 		path = "/" // API doesn't accept path segments not starting with '/'
 	}
 
-	u.Path = path
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	if c.sasToken != nil {
+		params = mergeParams(params, c.sasToken)
+	}
 	u.RawQuery = params.Encode()
 	return u.String()
 }
@@ -272,14 +325,13 @@ func (c Client) buildCanonicalizedString(verb string, headers map[string]string,
 }
 
 func (c Client) exec(verb, url string, headers map[string]string, body io.Reader) (*storageResponse, error) {
-	authHeader, err := c.getAuthorizationHeader(verb, url, headers)
-	if err != nil {
-		return nil, err
-	}
-	headers["Authorization"] = authHeader
-
-	if err != nil {
-		return nil, err
+	// the SAS token is in the URL already, see getEndpoint
+	if c.sasToken == nil {
+		authHeader, err := c.getAuthorizationHeader(verb, url, headers)
+		if err != nil {
+			return nil, err
+		}
+		headers["Authorization"] = authHeader
 	}
 
 	req, err := http.NewRequest(verb, url, body)
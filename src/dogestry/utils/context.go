@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ExitCancelled is the exit code used when a command was aborted by SIGINT or
+// SIGTERM, so callers can tell an interrupted run from a failed one.
+const ExitCancelled = 130
+
+// ExitConflict is the exit code used when push -expect-id found the tag
+// pointing somewhere else, so pipelines can decide to retry or give up.
+const ExitConflict = 3
+
+// SignalContext returns a context that is cancelled on the first SIGINT or
+// SIGTERM. A second signal exits immediately with ExitCancelled.
+// Call stop to release the signal handler.
+func SignalContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signalc := make(chan os.Signal, 2)
+	signal.Notify(signalc, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-signalc:
+			log.Println("Got signal, cancelling pending actions (send again to exit immediately)")
+			cancel()
+		case <-done:
+			return
+		}
+
+		select {
+		case <-signalc:
+			log.Println("Got second signal, exiting")
+			os.Exit(ExitCancelled)
+		case <-done:
+		}
+	}()
+
+	stop = func() {
+		signal.Stop(signalc)
+		close(done)
+		cancel()
+	}
+
+	return ctx, stop
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// NewContextReader wraps r so that reads fail with the context's error once
+// ctx is done. Used to abort streaming copies.
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx, r}
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
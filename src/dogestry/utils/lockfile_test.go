@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeCli struct {
+	ran     bool
+	cleaned bool
+}
+
+func (f *fakeCli) RunCmd(ctx context.Context, args ...string) error {
+	f.ran = true
+	return ctx.Err()
+}
+
+func (f *fakeCli) Cleanup() {
+	f.cleaned = true
+}
+
+func TestLockByFileReleasesLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dogestry-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lockfile := filepath.Join(dir, "lock")
+	cli := &fakeCli{}
+
+	if err := LockByFile(context.Background(), cli, nil, lockfile); err != nil {
+		t.Fatalf("LockByFile should work. Error: %v", err)
+	}
+
+	if !cli.ran || !cli.cleaned {
+		t.Error("LockByFile should run the command and clean up.")
+	}
+
+	if _, err := os.Stat(lockfile); !os.IsNotExist(err) {
+		t.Error("LockByFile should remove the lock file.")
+	}
+}
+
+func TestLockByFileCancelledWhileWaiting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dogestry-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// somebody else holds the lock
+	lockfile := filepath.Join(dir, "lock")
+	if err := ioutil.WriteFile(lockfile, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	cli := &fakeCli{}
+	if err := LockByFile(ctx, cli, nil, lockfile); err != context.DeadlineExceeded {
+		t.Errorf("LockByFile should return the context error. Error: %v", err)
+	}
+
+	if cli.ran {
+		t.Error("The command should not run without the lock.")
+	}
+
+	if _, err := os.Stat(lockfile); err != nil {
+		t.Error("A lock held by someone else must not be removed.")
+	}
+}
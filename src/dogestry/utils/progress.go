@@ -11,6 +11,20 @@ var progressLogger = log.New(os.Stdout, "", 0)
 
 var defaultInterval int64 = 1024 * 1024 * 10 // 10 MB
 
+// progressFunc, if set, is called alongside every progress line.
+var progressFunc func(fileName string, current, total int64)
+
+// SetProgressOutput sets where progress lines are written.
+func SetProgressOutput(w io.Writer) {
+	progressLogger.SetOutput(w)
+}
+
+// SetProgressFunc registers fn to be called with every progress update,
+// eg. to report progress in a machine-readable form.
+func SetProgressFunc(fn func(fileName string, current, total int64)) {
+	progressFunc = fn
+}
+
 type ProgressReader struct {
 	r              io.Reader
 	TotalSize      int64
@@ -27,6 +41,16 @@ func NewProgressReader(r io.Reader, size int64, fileName string) io.Reader {
 func printProgress(progress, total int64, fileName string) {
 	calc := fmt.Sprintf("%s/%s", HumanSize(progress), HumanSize(total))
 	progressLogger.Printf("  %-17s : %s\n", calc, fileName)
+
+	if progressFunc != nil {
+		progressFunc(fileName, progress, total)
+	}
+}
+
+// ReportProgress prints a progress line for transfers that don't go through
+// a single ProgressReader, eg. multipart uploads.
+func ReportProgress(fileName string, current, total int64) {
+	printProgress(current, total, fileName)
 }
 
 func (p *ProgressReader) Read(in []byte) (n int, err error) {
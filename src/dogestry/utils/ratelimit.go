@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how far ahead of the average rate transfers may run after being idle
+const rateBurst = time.Second
+
+// rateLimiter spaces out transfers so that together they don't exceed rate
+// bytes per second. Every transfer in the process shares the same limiter.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	// time at which all the bytes handed out so far are paid for
+	next time.Time
+}
+
+var limiter *rateLimiter
+
+// SetRateLimit limits all remote transfers and docker loads in the process
+// to bytesPerSecond in total. Zero removes the limit.
+func SetRateLimit(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		limiter = nil
+		return
+	}
+	limiter = &rateLimiter{rate: float64(bytesPerSecond)}
+}
+
+// Throttle blocks until n more bytes may be transferred under the rate limit,
+// or ctx is done.
+func Throttle(ctx context.Context, n int) error {
+	l := limiter
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now.Add(-rateBurst)) {
+		l.next = now.Add(-rateBurst)
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// NewLimitedReader wraps r so that reads are held to the rate limit set with
+// SetRateLimit. Reads also fail with the context's error once ctx is done.
+func NewLimitedReader(ctx context.Context, r io.Reader) io.Reader {
+	return &limitedReader{ctx, r}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if err := l.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := l.r.Read(p)
+	if throttleErr := Throttle(l.ctx, n); throttleErr != nil {
+		return n, throttleErr
+	}
+	return n, err
+}
+
+// ParseSize parses a size like "512", "10kB", "2.5M" or "1GB". Units are
+// powers of 1000, like HumanSize.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	units := []string{"K", "M", "G", "T"}
+
+	multiplier := 1.0
+	upper := strings.TrimSuffix(strings.ToUpper(s), "B")
+	for i, unit := range units {
+		if strings.HasSuffix(upper, unit) {
+			upper = strings.TrimSuffix(upper, unit)
+			for j := 0; j <= i; j++ {
+				multiplier *= 1000
+			}
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(upper), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+
+	return int64(value * multiplier), nil
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]int64{
+		"512":   512,
+		"10kB":  10000,
+		"10K":   10000,
+		"2.5M":  2500000,
+		"1GB":   1000000000,
+		" 3mb ": 3000000,
+	}
+
+	for s, expected := range sizes {
+		size, err := ParseSize(s)
+		if err != nil {
+			t.Errorf("ParseSize(%q) should work. Error: %v", s, err)
+		} else if size != expected {
+			t.Errorf("ParseSize(%q) = %d, expected %d", s, size, expected)
+		}
+	}
+
+	for _, s := range []string{"", "fast", "-1M", "10X"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) should fail.", s)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	SetRateLimit(1000000)
+	defer SetRateLimit(0)
+
+	// a second's worth is allowed as a burst, the rest is spread out
+	start := time.Now()
+	if err := Throttle(context.Background(), 1200000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Throttle should wait for the bytes over the burst. Waited: %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Throttle(ctx, 1000000); err != context.Canceled {
+		t.Errorf("Throttle should return the context error. Error: %v", err)
+	}
+}
+
+func TestLimitedReaderWithoutLimit(t *testing.T) {
+	SetRateLimit(0)
+
+	content := bytes.Repeat([]byte("x"), 1<<20)
+	start := time.Now()
+
+	got, err := ioutil.ReadAll(NewLimitedReader(context.Background(), bytes.NewReader(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("NewLimitedReader should pass data through unchanged.")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Reads shouldn't be throttled without a limit. Took: %v", elapsed)
+	}
+}